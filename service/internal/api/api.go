@@ -0,0 +1,109 @@
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Where the versioned API is mounted
+const V2_PREFIX = "/api/v2"
+
+// Error codes, clients should branch on these rather than the message
+const (
+	CODE_BAD_REQUEST            = "bad_request"
+	CODE_INVALID_PARAMETER      = "invalid_parameter"
+	CODE_UNSUPPORTED_MEDIA_TYPE = "unsupported_media_type"
+	CODE_UNAUTHORIZED           = "unauthorized"
+	CODE_FORBIDDEN              = "forbidden"
+	CODE_NOT_FOUND              = "not_found"
+	CODE_METHOD_NOT_ALLOWED     = "method_not_allowed"
+	CODE_SENSOR_NOT_CONNECTED   = "sensor_not_connected"
+	CODE_ALREADY_RECORDING      = "already_recording"
+	CODE_NOT_RECORDING          = "not_recording"
+	CODE_NO_READINGS            = "no_readings"
+	CODE_NOT_IMPLEMENTED        = "not_implemented"
+	CODE_INTERNAL               = "internal_error"
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// The body of every /api/v2 error
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// More about the error, like the parameter that was invalid
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Whether the request is for /api/v2, so shared middleware can answer with the error envelope
+func IsV2(r *http.Request) bool {
+	return r.URL.Path == V2_PREFIX || strings.HasPrefix(r.URL.Path, V2_PREFIX+"/")
+}
+
+func ServeJSON(w http.ResponseWriter, body interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// Serve the error envelope, details may be nil
+func ServeError(w http.ResponseWriter, status int, code string, message string, details map[string]interface{}) {
+	ServeJSON(w, ErrorResponse{Error: Error{Code: code, Message: message, Details: details}}, status)
+}
+
+// A query parameter or body field that isn't valid
+func ServeInvalidParameter(w http.ResponseWriter, parameter string, message string) {
+	ServeError(w, http.StatusBadRequest, CODE_INVALID_PARAMETER, message, map[string]interface{}{"parameter": parameter})
+}
+
+// The error code for a status, when there isn't a more specific one
+func CodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CODE_BAD_REQUEST
+	case http.StatusUnsupportedMediaType:
+		return CODE_UNSUPPORTED_MEDIA_TYPE
+	case http.StatusUnauthorized:
+		return CODE_UNAUTHORIZED
+	case http.StatusForbidden:
+		return CODE_FORBIDDEN
+	case http.StatusNotFound:
+		return CODE_NOT_FOUND
+	case http.StatusMethodNotAllowed:
+		return CODE_METHOD_NOT_ALLOWED
+	case http.StatusNotImplemented:
+		return CODE_NOT_IMPLEMENTED
+	}
+	return CODE_INTERNAL
+}
+
+// For /api/v2 routes that don't exist, or don't take the method
+func NotFound() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ServeError(w, http.StatusNotFound, CODE_NOT_FOUND, "No such endpoint", map[string]interface{}{"path": r.URL.Path})
+	}
+}
+
+func MethodNotAllowed() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ServeError(w, http.StatusMethodNotAllowed, CODE_METHOD_NOT_ALLOWED, r.Method+" isn't supported here", nil)
+	}
+}
+
+// Serve the OpenAPI 3 document for /api/v2, clients are generated from it
+func ServeOpenAPI() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPIDocument)
+	}
+}
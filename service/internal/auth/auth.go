@@ -0,0 +1,313 @@
+package auth
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Role string
+
+const (
+	// Viewers can read data and the dashboard
+	RoleViewer Role = "viewer"
+	// Operators can also start and stop jobs, and manage credentials
+	RoleOperator Role = "operator"
+)
+
+const (
+	TOKEN_PREFIX      = "gn_"
+	PBKDF2_ITERATIONS = 100000
+
+	// Password checks are slow by design, so successful logins are cached for a while
+	CREDENTIAL_CACHE_TTL = 5 * time.Minute
+)
+
+var ErrInvalidRole = errors.New("role must be viewer or operator")
+
+func ParseRole(value string) (Role, error) {
+	switch Role(value) {
+	case RoleViewer, RoleOperator:
+		return Role(value), nil
+	default:
+		return "", ErrInvalidRole
+	}
+}
+
+// Allows reports whether this role can act as the required role
+func (r Role) Allows(required Role) bool {
+	return r == RoleOperator || r == required
+}
+
+// Identity is who made a request, it's stored in the request context
+type Identity struct {
+	Name   string `json:"name"`
+	Role   Role   `json:"role"`
+	Method string `json:"method"`
+}
+
+type contextKey struct{}
+
+func FromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(contextKey{}).(Identity)
+	return identity, ok
+}
+
+// Authenticator checks API tokens and passwords, which are stored hashed in sqlite
+type Authenticator struct {
+	db       *sql.DB
+	enabled  bool
+	envToken string
+	// Signs CSRF tokens, tokens from before a restart are only accepted with their cookie
+	csrfSecret []byte
+
+	mu    sync.Mutex
+	cache map[string]cachedIdentity
+}
+
+type cachedIdentity struct {
+	identity Identity
+	expires  time.Time
+}
+
+// Create an Authenticator. If auth is enabled and there's no way to log in as an operator,
+// a token is generated and logged, so the device can't lock its owner out.
+func NewAuthenticator(db *sql.DB, enabled bool, envToken string) (*Authenticator, error) {
+	a := &Authenticator{
+		db:         db,
+		enabled:    enabled,
+		envToken:   envToken,
+		csrfSecret: make([]byte, 32),
+		cache:      make(map[string]cachedIdentity),
+	}
+	if _, err := rand.Read(a.csrfSecret); err != nil {
+		return nil, err
+	}
+	if !enabled || envToken != "" {
+		return a, nil
+	}
+
+	var operators int
+	err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM api_tokens WHERE role = ?) + (SELECT COUNT(*) FROM users WHERE role = ?)`, RoleOperator, RoleOperator).Scan(&operators)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for operators: %w", err)
+	}
+	if operators == 0 {
+		token, _, err := a.CreateToken("bootstrap", RoleOperator)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Auth is enabled with no operators, created a bootstrap operator token: %s", token)
+	}
+	return a, nil
+}
+
+func (a *Authenticator) Enabled() bool {
+	return a.enabled
+}
+
+// Require a role for the wrapped handler. Passes everything through when auth is disabled.
+func (a *Authenticator) Require(role Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !a.enabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			r, identity, err := a.resolve(r)
+			if err != nil {
+				// Let browsers prompt for a username and password
+				w.Header().Set("WWW-Authenticate", `Basic realm="Gnome", charset="UTF-8"`)
+				serveDenied(w, r, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if !identity.Role.Allows(role) {
+				serveDenied(w, r, fmt.Sprintf("%s role is required", role), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, identity)))
+		})
+	}
+}
+
+// The outcome of checking a request's credentials, kept in its context
+type resolved struct {
+	identity Identity
+	err      error
+}
+
+type resolvedKey struct{}
+
+// Check the request's credentials once, the CSRF check and Require share the outcome.
+// A token's last use is only written once per request.
+func (a *Authenticator) resolve(r *http.Request) (*http.Request, Identity, error) {
+	if outcome, ok := r.Context().Value(resolvedKey{}).(resolved); ok {
+		return r, outcome.identity, outcome.err
+	}
+	identity, err := a.authenticate(r)
+	return r.WithContext(context.WithValue(r.Context(), resolvedKey{}, resolved{identity: identity, err: err})), identity, err
+}
+
+// Check the request's credentials, a bearer token, X-API-Token header, or basic auth
+func (a *Authenticator) authenticate(r *http.Request) (Identity, error) {
+	if token := apiToken(r); token != "" {
+		return a.checkToken(token)
+	} else if username, password, ok := r.BasicAuth(); ok {
+		return a.checkPassword(username, password)
+	}
+	return Identity{}, errors.New("credentials are required")
+}
+
+// The API token sent as a bearer token or in the X-API-Token header, if there is one
+func apiToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return r.Header.Get("X-API-Token")
+}
+
+func (a *Authenticator) checkToken(token string) (Identity, error) {
+	if a.envToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.envToken)) == 1 {
+		return Identity{Name: "GNOME_API_TOKEN", Role: RoleOperator, Method: "token"}, nil
+	}
+
+	var id int64
+	var name, role string
+	err := a.db.QueryRow(`SELECT id, name, role FROM api_tokens WHERE token_hash = ?`, hashToken(token)).Scan(&id, &name, &role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Identity{}, errors.New("invalid token")
+	} else if err != nil {
+		return Identity{}, err
+	}
+	if _, err := a.db.Exec(`UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?`, id); err != nil {
+		log.Printf("Failed to update token last used: %v", err)
+	}
+	return Identity{Name: name, Role: Role(role), Method: "token"}, nil
+}
+
+func (a *Authenticator) checkPassword(username string, password string) (Identity, error) {
+	cacheKey := hashToken(username + "\x00" + password)
+	a.mu.Lock()
+	cached, ok := a.cache[cacheKey]
+	a.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.identity, nil
+	}
+
+	var passwordHash, role string
+	err := a.db.QueryRow(`SELECT password_hash, role FROM users WHERE username = ?`, username).Scan(&passwordHash, &role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Identity{}, errors.New("invalid username or password")
+	} else if err != nil {
+		return Identity{}, err
+	}
+	if !verifyPassword(password, passwordHash) {
+		return Identity{}, errors.New("invalid username or password")
+	}
+
+	identity := Identity{Name: username, Role: Role(role), Method: "password"}
+	a.mu.Lock()
+	a.cache[cacheKey] = cachedIdentity{identity: identity, expires: time.Now().Add(CREDENTIAL_CACHE_TTL)}
+	a.mu.Unlock()
+	return identity, nil
+}
+
+// Forget cached logins, so a removed or changed user can't keep using old credentials
+func (a *Authenticator) clearCache() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cache = make(map[string]cachedIdentity)
+}
+
+// CreateToken stores a new API token, the plain token is only available from the return value
+func (a *Authenticator) CreateToken(name string, role Role) (string, int64, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", 0, err
+	}
+	token := TOKEN_PREFIX + base64.RawURLEncoding.EncodeToString(secret)
+
+	result, err := a.db.Exec(`INSERT INTO api_tokens (name, token_hash, role) VALUES (?, ?, ?)`, name, hashToken(token), role)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to store token: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return "", 0, err
+	}
+	return token, id, nil
+}
+
+// SetUser creates a user, or replaces the password and role of an existing one
+func (a *Authenticator) SetUser(username string, password string, role Role) error {
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = a.db.Exec(`INSERT INTO users (username, password_hash, role) VALUES (?, ?, ?)
+		ON CONFLICT(username) DO UPDATE SET password_hash = excluded.password_hash, role = excluded.role`,
+		username, passwordHash, role)
+	if err != nil {
+		return fmt.Errorf("failed to store user: %w", err)
+	}
+	a.clearCache()
+	return nil
+}
+
+// Tokens are random and long, so a fast hash is enough to keep them out of the database
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Passwords are hashed as pbkdf2-sha256$<iterations>$<salt>$<key>
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, PBKDF2_ITERATIONS, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", PBKDF2_ITERATIONS,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func verifyPassword(password string, encoded string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
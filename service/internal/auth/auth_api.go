@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ztkent/gnome/internal/api"
+)
+
+type Token struct {
+	ID         int64   `json:"id"`
+	Name       string  `json:"name"`
+	Role       Role    `json:"role"`
+	CreatedAt  string  `json:"created_at"`
+	LastUsedAt *string `json:"last_used_at"`
+}
+
+type User struct {
+	Username  string `json:"username"`
+	Role      Role   `json:"role"`
+	CreatedAt string `json:"created_at"`
+}
+
+// Report who the request was authenticated as
+func (a *Authenticator) WhoAmI() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := FromContext(r.Context())
+		if !ok {
+			identity = Identity{Name: "anonymous", Role: RoleOperator, Method: "none"}
+		}
+		serveJSON(w, identity, http.StatusOK)
+	}
+}
+
+func (a *Authenticator) ListTokens() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := a.db.Query(`SELECT id, name, role, created_at, last_used_at FROM api_tokens ORDER BY id`)
+		if err != nil {
+			log.Println(err)
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		tokens := []Token{}
+		for rows.Next() {
+			var token Token
+			if err := rows.Scan(&token.ID, &token.Name, &token.Role, &token.CreatedAt, &token.LastUsedAt); err != nil {
+				serveMessage(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			tokens = append(tokens, token)
+		}
+		serveJSON(w, tokens, http.StatusOK)
+	}
+}
+
+// Create a token from a JSON body of {"name": ..., "role": ...}. The token is only shown in this response.
+func (a *Authenticator) CreateTokenHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Name string `json:"name"`
+			Role string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			serveMessage(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		request.Name = strings.TrimSpace(request.Name)
+		if request.Name == "" {
+			serveMessage(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		role, err := ParseRole(request.Role)
+		if err != nil {
+			serveMessage(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		token, id, err := a.CreateToken(request.Name, role)
+		if err != nil {
+			log.Println(err)
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveJSON(w, map[string]interface{}{
+			"id":    id,
+			"name":  request.Name,
+			"role":  role,
+			"token": token,
+		}, http.StatusCreated)
+	}
+}
+
+func (a *Authenticator) DeleteToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			serveMessage(w, "Invalid token id", http.StatusBadRequest)
+			return
+		}
+		result, err := a.db.Exec(`DELETE FROM api_tokens WHERE id = ?`, id)
+		if err != nil {
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if deleted, _ := result.RowsAffected(); deleted == 0 {
+			serveMessage(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		serveMessage(w, "Token deleted", http.StatusOK)
+	}
+}
+
+func (a *Authenticator) ListUsers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := a.db.Query(`SELECT username, role, created_at FROM users ORDER BY username`)
+		if err != nil {
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		users := []User{}
+		for rows.Next() {
+			var user User
+			if err := rows.Scan(&user.Username, &user.Role, &user.CreatedAt); err != nil {
+				serveMessage(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			users = append(users, user)
+		}
+		serveJSON(w, users, http.StatusOK)
+	}
+}
+
+// Create or update a user from a JSON body of {"username": ..., "password": ..., "role": ...}
+func (a *Authenticator) SetUserHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Role     string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			serveMessage(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		request.Username = strings.TrimSpace(request.Username)
+		if request.Username == "" || len(request.Password) < 8 {
+			serveMessage(w, "username and a password of at least 8 characters are required", http.StatusBadRequest)
+			return
+		}
+		role, err := ParseRole(request.Role)
+		if err != nil {
+			serveMessage(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := a.SetUser(request.Username, request.Password, role); err != nil {
+			log.Println(err)
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveMessage(w, "User saved", http.StatusOK)
+	}
+}
+
+func (a *Authenticator) DeleteUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := a.db.Exec(`DELETE FROM users WHERE username = ?`, chi.URLParam(r, "username"))
+		if err != nil {
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if deleted, _ := result.RowsAffected(); deleted == 0 {
+			serveMessage(w, "User not found", http.StatusNotFound)
+			return
+		}
+		a.clearCache()
+		serveMessage(w, "User deleted", http.StatusOK)
+	}
+}
+
+func serveJSON(w http.ResponseWriter, body interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+func serveMessage(w http.ResponseWriter, message string, status int) {
+	serveJSON(w, map[string]string{"message": message}, status)
+}
+
+// Middleware answers /api/v2 requests with its error envelope
+func serveDenied(w http.ResponseWriter, r *http.Request, message string, status int) {
+	if api.IsV2(r) {
+		api.ServeError(w, status, api.CodeForStatus(status), message, nil)
+		return
+	}
+	serveMessage(w, message, status)
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CSRF_COOKIE = "gnome_csrf"
+	CSRF_HEADER = "X-CSRF-Token"
+
+	// How long a token is accepted without the cookie
+	CSRF_TOKEN_TTL = 24 * time.Hour
+)
+
+type csrfKey struct{}
+
+// CSRF protects state-changing requests with a token in the X-CSRF-Token header.
+// Every response carries the token in a cookie, and a header matching the cookie is accepted.
+// Tokens are signed too, so clients without a cookie jar can send one from /api/v1/csrf on its own until it expires.
+// A page on another origin can't read the token or set the header, so it can't forge the request.
+// Requests with a valid API token are exempt, browsers never send those on their own.
+func (a *Authenticator) CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if cookie, err := r.Cookie(CSRF_COOKIE); err == nil && cookie.Value != "" {
+			token = cookie.Value
+		} else {
+			token = a.newCSRFToken(time.Now())
+			http.SetCookie(w, &http.Cookie{
+				Name:     CSRF_COOKIE,
+				Value:    token,
+				Path:     "/",
+				SameSite: http.SameSiteStrictMode,
+				Secure:   r.TLS != nil,
+			})
+		}
+
+		if !isSafeMethod(r.Method) {
+			var exempt bool
+			r, exempt = a.hasValidAPIToken(r)
+			header := r.Header.Get(CSRF_HEADER)
+			matchesCookie := header != "" && subtle.ConstantTimeCompare([]byte(header), []byte(token)) == 1
+			if !exempt && !matchesCookie && !a.validCSRFToken(header, time.Now()) {
+				serveDenied(w, r, "missing or invalid CSRF token", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfKey{}, token)))
+	})
+}
+
+// The CSRF token for this request, for templates and clients that don't use API tokens
+func CSRFToken(ctx context.Context) string {
+	token, _ := ctx.Value(csrfKey{}).(string)
+	return token
+}
+
+// Serve a CSRF token, to send in the header with the cookie, or on its own until it expires
+func (a *Authenticator) ServeCSRFToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		token := CSRFToken(r.Context())
+		if !a.validCSRFToken(token, now) {
+			// The cookie is from before a restart, or close to expiring
+			token = a.newCSRFToken(now)
+		}
+		serveJSON(w, map[string]string{"token": token, "header": CSRF_HEADER}, http.StatusOK)
+	}
+}
+
+// A token is <expiry>.<nonce>.<signature>, signed with a key that's made when Gnome starts
+func (a *Authenticator) newCSRFToken(now time.Time) string {
+	payload := strconv.FormatInt(now.Add(CSRF_TOKEN_TTL).Unix(), 10) + "." + rand.Text()
+	return payload + "." + a.signCSRF(payload)
+}
+
+func (a *Authenticator) validCSRFToken(token string, now time.Time) bool {
+	payload, signature, ok := cutLast(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(a.signCSRF(payload))) {
+		return false
+	}
+	expiry, _, _ := strings.Cut(payload, ".")
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	return err == nil && now.Unix() < expires
+}
+
+func (a *Authenticator) signCSRF(payload string) string {
+	mac := hmac.New(sha256.New, a.csrfSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func cutLast(s string, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// Only a token that's accepted skips the CSRF check, any Authorization header isn't enough.
+// The request is returned with the token's identity, so Require doesn't check it again.
+func (a *Authenticator) hasValidAPIToken(r *http.Request) (*http.Request, bool) {
+	if apiToken(r) == "" {
+		return r, false
+	}
+	r, _, err := a.resolve(r)
+	return r, err == nil
+}
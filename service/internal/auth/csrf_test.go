@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	t.Helper()
+	db, err := tools.ConnectSqlite(filepath.Join(t.TempDir(), "gnome.db"))
+	if err != nil {
+		t.Fatalf("ConnectSqlite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// Auth is off, like the default, CSRF still applies
+	a, err := NewAuthenticator(db, false, "env-token")
+	if err != nil {
+		t.Fatalf("NewAuthenticator: %v", err)
+	}
+	return a
+}
+
+func post(a *Authenticator, header http.Header, cookie *http.Cookie) int {
+	handler := a.CSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/start", nil)
+	for name, values := range header {
+		for _, value := range values {
+			r.Header.Add(name, value)
+		}
+	}
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+func fetchToken(t *testing.T, a *Authenticator) string {
+	t.Helper()
+	var token string
+	handler := a.CSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = CSRFToken(r.Context())
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/csrf", nil))
+	return token
+}
+
+func TestCSRFWithoutCookie(t *testing.T) {
+	a := newTestAuthenticator(t)
+	token := fetchToken(t, a)
+
+	if code := post(a, http.Header{CSRF_HEADER: {token}}, nil); code != http.StatusNoContent {
+		t.Errorf("a signed token without the cookie got %d", code)
+	}
+	if code := post(a, http.Header{}, nil); code != http.StatusForbidden {
+		t.Errorf("no token got %d", code)
+	}
+	if code := post(a, http.Header{CSRF_HEADER: {token + "x"}}, nil); code != http.StatusForbidden {
+		t.Errorf("a tampered token got %d", code)
+	}
+	other := newTestAuthenticator(t)
+	if code := post(other, http.Header{CSRF_HEADER: {token}}, nil); code != http.StatusForbidden {
+		t.Errorf("a token from before a restart got %d without its cookie", code)
+	}
+}
+
+func TestCSRFTokenExpires(t *testing.T) {
+	a := newTestAuthenticator(t)
+	expired := a.newCSRFToken(time.Now().Add(-CSRF_TOKEN_TTL - time.Minute))
+	if code := post(a, http.Header{CSRF_HEADER: {expired}}, nil); code != http.StatusForbidden {
+		t.Errorf("an expired token got %d", code)
+	}
+	// With its cookie, the double submit still matches
+	cookie := &http.Cookie{Name: CSRF_COOKIE, Value: expired}
+	if code := post(a, http.Header{CSRF_HEADER: {expired}}, cookie); code != http.StatusNoContent {
+		t.Errorf("an expired token matching its cookie got %d", code)
+	}
+}
+
+func TestCSRFWithCookie(t *testing.T) {
+	a := newTestAuthenticator(t)
+	cookie := &http.Cookie{Name: CSRF_COOKIE, Value: "from-an-earlier-run"}
+	if code := post(a, http.Header{CSRF_HEADER: {"from-an-earlier-run"}}, cookie); code != http.StatusNoContent {
+		t.Errorf("a header matching the cookie got %d", code)
+	}
+	if code := post(a, http.Header{CSRF_HEADER: {"something-else"}}, cookie); code != http.StatusForbidden {
+		t.Errorf("a header not matching the cookie got %d", code)
+	}
+}
+
+func TestCSRFNeedsValidAPIToken(t *testing.T) {
+	a := newTestAuthenticator(t)
+	if code := post(a, http.Header{"Authorization": {"Bearer made-up"}}, nil); code != http.StatusForbidden {
+		t.Errorf("an unknown bearer token skipped the CSRF check, got %d", code)
+	}
+	if code := post(a, http.Header{"X-Api-Token": {"made-up"}}, nil); code != http.StatusForbidden {
+		t.Errorf("an unknown X-API-Token skipped the CSRF check, got %d", code)
+	}
+	if code := post(a, http.Header{"Authorization": {"Bearer env-token"}}, nil); code != http.StatusNoContent {
+		t.Errorf("GNOME_API_TOKEN got %d", code)
+	}
+
+	token, _, err := a.CreateToken("phone", RoleViewer)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	if code := post(a, http.Header{"X-Api-Token": {token}}, nil); code != http.StatusNoContent {
+		t.Errorf("a stored token got %d", code)
+	}
+}
+
+func TestTokenCheckedOncePerRequest(t *testing.T) {
+	a := newTestAuthenticator(t)
+	a.enabled = true
+	token, id, err := a.CreateToken("phone", RoleOperator)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+
+	// Revoke the token between the CSRF check and Require, so checking it again would be refused
+	revoke := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := a.db.Exec(`DELETE FROM api_tokens WHERE id = ?`, id); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	var identity Identity
+	handler := a.CSRF(revoke(a.Require(RoleOperator)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = FromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}))))
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/start", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent || identity.Name != "phone" {
+		t.Errorf("expected Require to use the identity from the CSRF check, got %d and %+v", w.Code, identity)
+	}
+}
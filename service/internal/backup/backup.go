@@ -0,0 +1,550 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/ztkent/gnome/internal/device"
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+const (
+	KIND_DAILY  = "daily"
+	KIND_WEEKLY = "weekly"
+	// Taken through the API, or before a restore. They're kept until they're deleted.
+	KIND_MANUAL = "manual"
+	// How often to check whether today's backup has been taken
+	CHECK_INTERVAL = time.Hour
+	// Pages copied per step, the database is unlocked between steps so recording isn't held up
+	STEP_PAGES = 256
+	STEP_PAUSE = 10 * time.Millisecond
+	// Backup times in file names, in UTC
+	NAME_TIME_FORMAT = "20060102T150405Z"
+	// Backups are written here first, and renamed once they're verified
+	PARTIAL_SUFFIX = ".partial"
+	// A backup is upgraded here before it's restored, with the device's credentials and ids
+	RESTORE_SUFFIX = ".restoring"
+	// A restore copies every page in one step, so nothing is written to a half-restored database
+	ALL_PAGES = -1
+)
+
+var (
+	ErrNotFound      = errors.New("backup not found")
+	ErrBackupRunning = errors.New("a backup or restore is already running")
+	ErrDamaged       = errors.New("the backup failed its integrity check")
+	ErrNewerSchema   = errors.New("the backup is from a newer version of Gnome, update this device first")
+	ErrOtherDevice   = errors.New("the backup is from another device, import it with /api/v1/import instead")
+)
+
+// Like gnome-daily-20261019T070000Z.db
+var namePattern = regexp.MustCompile(`^gnome-(daily|weekly|manual)-(\d{8}T\d{6}Z)\.db$`)
+
+type Backup struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Size      int64  `json:"size"`
+	CreatedAt string `json:"created_at"`
+
+	created time.Time
+}
+
+type Status struct {
+	Dir    string `json:"dir"`
+	Daily  int    `json:"daily"`
+	Weekly int    `json:"weekly"`
+	// The last scheduled or manual backup's outcome
+	LastBackupAt *string `json:"last_backup_at"`
+	LastError    string  `json:"last_error,omitempty"`
+	// Newest first
+	Backups []Backup `json:"backups"`
+}
+
+// Manager snapshots the database to a directory once a day with SQLite's online backup API,
+// so the copy is consistent while readings are being written. The first backup of each week is also kept as a weekly one.
+type Manager struct {
+	db   *sql.DB
+	self *device.Registry
+	dir  string
+	// Generations of each kind to keep
+	daily  int
+	weekly int
+	// Days and weeks start in this timezone
+	timezone *time.Location
+	// Holds the readings' writer while a restore replaces the database, set when there's a meter recording into it
+	PauseWrites func() (resume func())
+
+	// Only one backup or restore runs at a time
+	running sync.Mutex
+
+	mu           sync.Mutex
+	lastBackupAt time.Time
+	lastError    error
+}
+
+// The directory has to exist already, so an unmounted drive isn't mistaken for an empty folder on the SD card
+func New(db *sql.DB, self *device.Registry, dir string, daily int, weekly int, timezone *time.Location) (*Manager, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("backup directory %s isn't available, is the drive mounted? %w", dir, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("backup directory %s isn't a directory", dir)
+	}
+	if daily < 1 || weekly < 0 {
+		return nil, errors.New("keep at least one daily backup, and zero or more weekly ones")
+	}
+	return &Manager{
+		db:       db,
+		self:     self,
+		dir:      dir,
+		daily:    daily,
+		weekly:   weekly,
+		timezone: timezone,
+	}, nil
+}
+
+// Take the day's backup when it's due, until the context is cancelled
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		if err := m.scheduled(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to back up the database: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Back up once a day, keeping the first of each week as a weekly backup too
+func (m *Manager) scheduled(ctx context.Context) error {
+	backups, err := m.List()
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(m.timezone)
+	if hasBackup(backups, KIND_DAILY, func(created time.Time) bool { return sameDay(created.In(m.timezone), now) }) {
+		return nil
+	}
+
+	daily, err := m.Create(ctx, KIND_DAILY)
+	if err != nil {
+		return err
+	}
+	if m.weekly > 0 && !hasBackup(backups, KIND_WEEKLY, func(created time.Time) bool { return sameWeek(created.In(m.timezone), now) }) {
+		if err := m.copyAs(daily, KIND_WEEKLY); err != nil {
+			return err
+		}
+	}
+	return m.rotate()
+}
+
+// Snapshot the database now, verifying the copy before it's kept
+func (m *Manager) Create(ctx context.Context, kind string) (Backup, error) {
+	if !m.running.TryLock() {
+		return Backup{}, ErrBackupRunning
+	}
+	defer m.running.Unlock()
+	return m.create(ctx, kind)
+}
+
+func (m *Manager) create(ctx context.Context, kind string) (Backup, error) {
+	backup, err := m.snapshot(ctx, kind)
+	m.mu.Lock()
+	m.lastError = err
+	if err == nil {
+		m.lastBackupAt = backup.created
+	}
+	m.mu.Unlock()
+	if err == nil {
+		log.Printf("Backed up the database to %s", filepath.Join(m.dir, backup.Name))
+	}
+	return backup, err
+}
+
+func (m *Manager) snapshot(ctx context.Context, kind string) (Backup, error) {
+	// Names only have seconds, a backup in the same second as another takes the next second rather than replacing it
+	created := time.Now().UTC().Truncate(time.Second)
+	name := fmt.Sprintf("gnome-%s-%s.db", kind, created.Format(NAME_TIME_FORMAT))
+	for _, err := m.backup(name); err == nil; _, err = m.backup(name) {
+		created = created.Add(time.Second)
+		name = fmt.Sprintf("gnome-%s-%s.db", kind, created.Format(NAME_TIME_FORMAT))
+	}
+	path := filepath.Join(m.dir, name)
+	partial := path + PARTIAL_SUFFIX
+	os.Remove(partial)
+	defer os.Remove(partial)
+
+	dest, err := sql.Open("sqlite3", partial)
+	if err != nil {
+		return Backup{}, err
+	}
+	if err := copyDatabase(ctx, dest, m.db, STEP_PAGES); err != nil {
+		dest.Close()
+		return Backup{}, err
+	}
+	if err := tools.ClearCredentials(ctx, dest); err != nil {
+		dest.Close()
+		return Backup{}, err
+	}
+	// The copy takes the database's WAL mode, a backup should be a single file
+	_, err = dest.ExecContext(ctx, `PRAGMA journal_mode = DELETE`)
+	if err == nil {
+		err = verify(ctx, dest)
+	}
+	dest.Close()
+	if err != nil {
+		return Backup{}, err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return Backup{}, err
+	}
+	return m.backup(name)
+}
+
+// Copy a verified backup under another kind, files on a USB drive can't be hard linked
+func (m *Manager) copyAs(backup Backup, kind string) error {
+	name := strings.Replace(backup.Name, backup.Kind, kind, 1)
+	source, err := os.Open(filepath.Join(m.dir, backup.Name))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	partial := filepath.Join(m.dir, name+PARTIAL_SUFFIX)
+	dest, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partial)
+	if _, err := io.Copy(dest, source); err != nil {
+		dest.Close()
+		return err
+	}
+	if err := dest.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partial, filepath.Join(m.dir, name))
+}
+
+// Delete the oldest daily and weekly backups beyond the number to keep
+func (m *Manager) rotate() error {
+	backups, err := m.List()
+	if err != nil {
+		return err
+	}
+	kept := map[string]int{}
+	for _, backup := range backups {
+		kept[backup.Kind]++
+		if (backup.Kind == KIND_DAILY && kept[backup.Kind] > m.daily) || (backup.Kind == KIND_WEEKLY && kept[backup.Kind] > m.weekly) {
+			if err := os.Remove(filepath.Join(m.dir, backup.Name)); err != nil {
+				return err
+			}
+			log.Printf("Removed old backup %s", backup.Name)
+		}
+	}
+	return nil
+}
+
+// Every backup in the directory, newest first
+func (m *Manager) List() ([]Backup, error) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, err
+	}
+	backups := []Backup{}
+	for _, entry := range entries {
+		if entry.IsDir() || !namePattern.MatchString(entry.Name()) {
+			continue
+		}
+		backup, err := m.backup(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, backup)
+	}
+	slices.SortFunc(backups, func(a, b Backup) int {
+		return b.created.Compare(a.created)
+	})
+	return backups, nil
+}
+
+func (m *Manager) backup(name string) (Backup, error) {
+	match := namePattern.FindStringSubmatch(name)
+	if match == nil {
+		return Backup{}, ErrNotFound
+	}
+	created, err := time.Parse(NAME_TIME_FORMAT, match[2])
+	if err != nil {
+		return Backup{}, ErrNotFound
+	}
+	info, err := os.Stat(filepath.Join(m.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return Backup{}, ErrNotFound
+	} else if err != nil {
+		return Backup{}, err
+	}
+	return Backup{
+		Name:      name,
+		Kind:      match[1],
+		Size:      info.Size(),
+		CreatedAt: tools.FormatTime(created.UnixMilli(), m.timezone),
+		created:   created,
+	}, nil
+}
+
+func (m *Manager) Status() (Status, error) {
+	backups, err := m.List()
+	if err != nil {
+		return Status{}, err
+	}
+	status := Status{Dir: m.dir, Daily: m.daily, Weekly: m.weekly, Backups: backups}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.lastBackupAt.IsZero() {
+		lastBackupAt := tools.FormatTime(m.lastBackupAt.UnixMilli(), m.timezone)
+		status.LastBackupAt = &lastBackupAt
+	}
+	if m.lastError != nil {
+		status.LastError = m.lastError.Error()
+	}
+	return status, nil
+}
+
+// Remove a backup, daily and weekly ones are rotated away on their own
+func (m *Manager) Delete(name string) error {
+	backup, err := m.backup(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(m.dir, backup.Name))
+}
+
+// Replace the database with a backup, taking a manual backup of it first.
+// The backup must be this device's, and is upgraded to the current schema before it's put in place, in one step.
+// Users and API tokens aren't restored, they stay as they are, and ids carry on from the ones already handed out.
+func (m *Manager) Restore(ctx context.Context, name string) (Backup, error) {
+	if !m.running.TryLock() {
+		return Backup{}, ErrBackupRunning
+	}
+	defer m.running.Unlock()
+
+	backup, err := m.backup(name)
+	if err != nil {
+		return Backup{}, err
+	}
+	source, err := sql.Open("sqlite3", "file:"+filepath.Join(m.dir, backup.Name)+"?mode=ro")
+	if err != nil {
+		return Backup{}, err
+	}
+	defer source.Close()
+	if err := verify(ctx, source); err != nil {
+		return Backup{}, err
+	}
+	if unknown, err := tools.UnknownMigrations(ctx, source); err != nil {
+		return Backup{}, err
+	} else if len(unknown) > 0 {
+		return Backup{}, fmt.Errorf("%w: unknown migration %s", ErrNewerSchema, unknown[0])
+	}
+	var deviceID string
+	err = source.QueryRowContext(ctx, `SELECT uuid FROM device WHERE id = 1`).Scan(&deviceID)
+	if err == nil && deviceID != m.self.Info().ID {
+		return Backup{}, ErrOtherDevice
+	}
+
+	// Recording carries on into the results queue, and is written once the restored database is in place
+	if m.PauseWrites != nil {
+		resume := m.PauseWrites()
+		defer resume()
+	}
+	// Backups don't have the credentials, the device keeps the ones it has now
+	credentials, err := tools.SaveCredentials(ctx, m.db)
+	if err != nil {
+		return Backup{}, err
+	}
+	previous, err := m.create(ctx, KIND_MANUAL)
+	if err != nil {
+		return Backup{}, fmt.Errorf("failed to back up the database before restoring: %w", err)
+	}
+
+	staged := filepath.Join(m.dir, backup.Name+RESTORE_SUFFIX)
+	os.Remove(staged)
+	defer os.Remove(staged)
+	dest, err := sql.Open("sqlite3", staged)
+	if err != nil {
+		return previous, err
+	}
+	defer dest.Close()
+	if err := m.stage(ctx, dest, source, credentials); err != nil {
+		return previous, fmt.Errorf("failed to prepare %s: %w", backup.Name, err)
+	}
+	if err := copyDatabase(ctx, m.db, dest, ALL_PAGES); err != nil {
+		return previous, err
+	}
+	log.Printf("Restored the database from %s, the previous one is in %s", backup.Name, previous.Name)
+	return previous, m.self.Reload()
+}
+
+// Copy a backup to dest and upgrade it to the current schema, with the device's credentials.
+// Its sequences are raised past the ids the device has handed out, so readings restored over aren't given their ids again.
+// Hubs, collectors and clients syncing by id would skip the new readings otherwise.
+func (m *Manager) stage(ctx context.Context, dest *sql.DB, source *sql.DB, credentials tools.Credentials) error {
+	if err := copyDatabase(ctx, dest, source, STEP_PAGES); err != nil {
+		return err
+	}
+	if err := tools.RunMigrations(dest); err != nil {
+		return err
+	}
+	if err := credentials.Restore(ctx, dest); err != nil {
+		return err
+	}
+	sequences, err := saveSequences(ctx, m.db)
+	if err != nil {
+		return err
+	}
+	if err := raiseSequences(ctx, dest, sequences); err != nil {
+		return err
+	}
+	return verify(ctx, dest)
+}
+
+// The last id each AUTOINCREMENT table has handed out
+func saveSequences(ctx context.Context, db *sql.DB) (map[string]int64, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name, seq FROM sqlite_sequence`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the sequences: %w", err)
+	}
+	defer rows.Close()
+	sequences := map[string]int64{}
+	for rows.Next() {
+		var name string
+		var seq int64
+		if err := rows.Scan(&name, &seq); err != nil {
+			return nil, err
+		}
+		sequences[name] = seq
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// Readings are the cursor everything syncs by, they're never behind the newest one
+	var latest sql.NullInt64
+	if err := db.QueryRowContext(ctx, `SELECT MAX(id) FROM sunlight`).Scan(&latest); err != nil {
+		return nil, err
+	}
+	sequences["sunlight"] = max(sequences["sunlight"], latest.Int64)
+	return sequences, nil
+}
+
+// Raise the sequences to at least the saved ones, in one transaction
+func raiseSequences(ctx context.Context, db *sql.DB, sequences map[string]int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for name, seq := range sequences {
+		result, err := tx.ExecContext(ctx, `UPDATE sqlite_sequence SET seq = MAX(seq, ?) WHERE name = ?`, seq, name)
+		if err != nil {
+			return fmt.Errorf("failed to raise the %s sequence: %w", name, err)
+		}
+		// A table that was empty in the backup has no sequence yet
+		if updated, err := result.RowsAffected(); err != nil {
+			return err
+		} else if updated == 0 {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO sqlite_sequence (name, seq) VALUES (?, ?)`, name, seq); err != nil {
+				return fmt.Errorf("failed to raise the %s sequence: %w", name, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Copy every page of source into dest, pages at a time
+func copyDatabase(ctx context.Context, dest *sql.DB, source *sql.DB, pages int) error {
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	sourceConn, err := source.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer sourceConn.Close()
+
+	return destConn.Raw(func(destDriver any) error {
+		return sourceConn.Raw(func(sourceDriver any) error {
+			destSQLite, ok := destDriver.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("backups need a sqlite3 connection")
+			}
+			sourceSQLite, ok := sourceDriver.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("backups need a sqlite3 connection")
+			}
+			backup, err := destSQLite.Backup("main", sourceSQLite, "main")
+			if err != nil {
+				return err
+			}
+			for {
+				done, err := backup.Step(pages)
+				if err != nil {
+					backup.Finish()
+					return err
+				}
+				if done {
+					return backup.Finish()
+				}
+				// Busy and locked steps are retried
+				select {
+				case <-ctx.Done():
+					backup.Finish()
+					return ctx.Err()
+				case <-time.After(STEP_PAUSE):
+				}
+			}
+		})
+	})
+}
+
+func verify(ctx context.Context, db *sql.DB) error {
+	var result string
+	if err := db.QueryRowContext(ctx, `PRAGMA integrity_check`).Scan(&result); err != nil {
+		return fmt.Errorf("%w: %w", ErrDamaged, err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("%w: %s", ErrDamaged, result)
+	}
+	return nil
+}
+
+func hasBackup(backups []Backup, kind string, matches func(time.Time) bool) bool {
+	return slices.ContainsFunc(backups, func(backup Backup) bool {
+		return backup.Kind == kind && matches(backup.created)
+	})
+}
+
+func sameDay(a time.Time, b time.Time) bool {
+	return a.YearDay() == b.YearDay() && a.Year() == b.Year()
+}
+
+func sameWeek(a time.Time, b time.Time) bool {
+	aYear, aWeek := a.ISOWeek()
+	bYear, bWeek := b.ISOWeek()
+	return aYear == bYear && aWeek == bWeek
+}
@@ -0,0 +1,82 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (m *Manager) StatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := m.Status()
+		if err != nil {
+			log.Println(err)
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveJSON(w, status, http.StatusOK)
+	}
+}
+
+// Take a manual backup now
+func (m *Manager) CreateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		backup, err := m.Create(r.Context(), KIND_MANUAL)
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+		serveJSON(w, backup, http.StatusCreated)
+	}
+}
+
+func (m *Manager) DeleteHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := m.Delete(chi.URLParam(r, "name")); err != nil {
+			serveError(w, err)
+			return
+		}
+		serveMessage(w, "Backup deleted", http.StatusOK)
+	}
+}
+
+// Replace the database with a backup, responding with the backup taken of it first
+func (m *Manager) RestoreHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		previous, err := m.Restore(r.Context(), chi.URLParam(r, "name"))
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+		serveJSON(w, map[string]interface{}{"message": "Database restored", "previous": previous}, http.StatusOK)
+	}
+}
+
+func serveError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		serveMessage(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrBackupRunning):
+		serveMessage(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrDamaged), errors.Is(err, ErrNewerSchema), errors.Is(err, ErrOtherDevice):
+		serveMessage(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		log.Println(err)
+		serveMessage(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func serveJSON(w http.ResponseWriter, body interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+func serveMessage(w http.ResponseWriter, message string, status int) {
+	serveJSON(w, map[string]string{"message": message}, status)
+}
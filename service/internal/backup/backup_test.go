@@ -0,0 +1,267 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ztkent/gnome/internal/device"
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+// A manager for a new database, backing up to dir
+func newTestManager(t *testing.T, dir string, daily int, weekly int) (*Manager, *sql.DB) {
+	t.Helper()
+	db, err := tools.ConnectSqlite(filepath.Join(t.TempDir(), "gnome.db"))
+	if err != nil {
+		t.Fatalf("ConnectSqlite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	self, err := device.Load(db)
+	if err != nil {
+		t.Fatalf("device.Load: %v", err)
+	}
+	m, err := New(db, self, dir, daily, weekly, time.UTC)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return m, db
+}
+
+func insertReadings(t *testing.T, db *sql.DB, count int) {
+	t.Helper()
+	var latest int64
+	db.QueryRow(`SELECT COALESCE(MAX(created_at), 0) FROM sunlight`).Scan(&latest)
+	for i := 1; i <= count; i++ {
+		_, err := db.Exec(`INSERT INTO sunlight (job_id, lux, full_spectrum, visible, infrared, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			"job-1", 1000, 2000, 1500, 500, latest+int64(i)*1000)
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+}
+
+func maxID(t *testing.T, db *sql.DB) int64 {
+	t.Helper()
+	var id int64
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM sunlight`).Scan(&id); err != nil {
+		t.Fatalf("max id: %v", err)
+	}
+	return id
+}
+
+func names(backups []Backup, kind string) []string {
+	found := []string{}
+	for _, backup := range backups {
+		if backup.Kind == kind {
+			found = append(found, backup.Name)
+		}
+	}
+	return found
+}
+
+func TestCreateListRotate(t *testing.T) {
+	ctx := context.Background()
+	m, db := newTestManager(t, t.TempDir(), 2, 1)
+	insertReadings(t, db, 3)
+
+	daily := []Backup{}
+	for i := 0; i < 3; i++ {
+		backup, err := m.Create(ctx, KIND_DAILY)
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		daily = append(daily, backup)
+	}
+	for _, backup := range daily[:2] {
+		if err := m.copyAs(backup, KIND_WEEKLY); err != nil {
+			t.Fatalf("copyAs: %v", err)
+		}
+	}
+	if _, err := m.Create(ctx, KIND_MANUAL); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	backups, err := m.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(backups) != 6 {
+		t.Fatalf("expected 6 backups, got %+v", backups)
+	}
+	for i := 1; i < len(backups); i++ {
+		if backups[i].created.After(backups[i-1].created) {
+			t.Fatalf("backups aren't newest first: %s after %s", backups[i].Name, backups[i-1].Name)
+		}
+	}
+
+	if err := m.rotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	backups, _ = m.List()
+	if kept := names(backups, KIND_DAILY); len(kept) != 2 || kept[0] != daily[2].Name || kept[1] != daily[1].Name {
+		t.Errorf("expected the 2 newest daily backups, got %v", kept)
+	}
+	if kept := names(backups, KIND_WEEKLY); len(kept) != 1 || kept[0] != "gnome-weekly-"+daily[1].Name[len("gnome-daily-"):] {
+		t.Errorf("expected the newest weekly backup, got %v", kept)
+	}
+	if kept := names(backups, KIND_MANUAL); len(kept) != 1 {
+		t.Errorf("expected the manual backup to be kept, got %v", kept)
+	}
+	if entries, _ := os.ReadDir(m.dir); len(entries) != len(backups) {
+		t.Errorf("expected no partial files left, got %d entries", len(entries))
+	}
+}
+
+func TestScheduledOncePerDay(t *testing.T) {
+	ctx := context.Background()
+	m, _ := newTestManager(t, t.TempDir(), 2, 1)
+	for i := 0; i < 2; i++ {
+		if err := m.scheduled(ctx); err != nil {
+			t.Fatalf("scheduled: %v", err)
+		}
+	}
+	backups, _ := m.List()
+	if len(names(backups, KIND_DAILY)) != 1 || len(names(backups, KIND_WEEKLY)) != 1 {
+		t.Errorf("expected one daily backup promoted to the week's, got %+v", backups)
+	}
+	if status, _ := m.Status(); status.LastBackupAt == nil || status.LastError != "" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestSameWeek(t *testing.T) {
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 12, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		a, b time.Time
+		same bool
+	}{
+		{"monday and sunday", date(2026, 10, 19), date(2026, 10, 25), true},
+		{"sunday and the next monday", date(2026, 10, 18), date(2026, 10, 19), false},
+		{"across new year", date(2026, 12, 31), date(2027, 1, 1), true},
+		{"a year apart", date(2025, 10, 20), date(2026, 10, 19), false},
+	}
+	for _, test := range tests {
+		if same := sameWeek(test.a, test.b); same != test.same {
+			t.Errorf("%s: expected %t, got %t", test.name, test.same, same)
+		}
+	}
+}
+
+func TestRestoreRejectsOtherDevices(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	m, _ := newTestManager(t, dir, 2, 1)
+	other, _ := newTestManager(t, dir, 2, 1)
+	foreign, err := other.Create(ctx, KIND_MANUAL)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := m.Restore(ctx, foreign.Name); !errors.Is(err, ErrOtherDevice) {
+		t.Errorf("expected another device's backup to be refused, got %v", err)
+	}
+}
+
+func TestRestoreRejectsNewerSchemas(t *testing.T) {
+	ctx := context.Background()
+	m, _ := newTestManager(t, t.TempDir(), 2, 1)
+	backup, err := m.Create(ctx, KIND_MANUAL)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	file, err := sql.Open("sqlite3", filepath.Join(m.dir, backup.Name))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	_, err = file.Exec(`INSERT INTO schema_migrations (name) VALUES ('master_up_20991231_01_future.sql')`)
+	file.Close()
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if _, err := m.Restore(ctx, backup.Name); !errors.Is(err, ErrNewerSchema) {
+		t.Errorf("expected a newer schema to be refused, got %v", err)
+	}
+}
+
+func TestRestoreKeepsCredentials(t *testing.T) {
+	ctx := context.Background()
+	m, db := newTestManager(t, t.TempDir(), 2, 1)
+	if _, err := db.Exec(`INSERT INTO users (username, password_hash, role) VALUES ('before', 'hash-1', 'operator')`); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	backup, err := m.Create(ctx, KIND_MANUAL)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	file, err := sql.Open("sqlite3", filepath.Join(m.dir, backup.Name))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	var users int
+	file.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&users)
+	file.Close()
+	if users != 0 {
+		t.Fatalf("the backup has %d users", users)
+	}
+
+	// Credentials changed since the backup was taken
+	if _, err := db.Exec(`DELETE FROM users`); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (username, password_hash, role) VALUES ('after', 'hash-2', 'operator')`); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO api_tokens (name, token_hash, role) VALUES ('phone', 'token-hash', 'viewer')`); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	if _, err := m.Restore(ctx, backup.Name); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	var username, tokenName string
+	if err := db.QueryRow(`SELECT username FROM users`).Scan(&username); err != nil || username != "after" {
+		t.Errorf("expected the current user to be kept, got %q, %v", username, err)
+	}
+	if err := db.QueryRow(`SELECT name FROM api_tokens`).Scan(&tokenName); err != nil || tokenName != "phone" {
+		t.Errorf("expected the current token to be kept, got %q, %v", tokenName, err)
+	}
+}
+
+func TestRestoredIDsCarryOn(t *testing.T) {
+	ctx := context.Background()
+	m, db := newTestManager(t, t.TempDir(), 2, 1)
+	paused, resumed := 0, 0
+	m.PauseWrites = func() func() {
+		paused++
+		return func() { resumed++ }
+	}
+	insertReadings(t, db, 3)
+	older, err := m.Create(ctx, KIND_MANUAL)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	insertReadings(t, db, 3)
+	issued := maxID(t, db)
+
+	if _, err := m.Restore(ctx, older.Name); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if paused != 1 || resumed != 1 {
+		t.Errorf("expected writes paused for the restore and resumed, got %d and %d", paused, resumed)
+	}
+	if restored := maxID(t, db); restored != 3 {
+		t.Fatalf("expected the backup's 3 readings, the newest has id %d", restored)
+	}
+
+	insertReadings(t, db, 1)
+	if id := maxID(t, db); id <= issued {
+		t.Errorf("a reading after the restore got id %d, ids up to %d were issued before it", id, issued)
+	}
+}
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is read from GNOME_* environment variables, so it can be set in the systemd unit
+type Config struct {
+	// Require an API token or username/password for the API and dashboard
+	AuthEnabled bool
+	// An operator token to accept, in addition to the tokens stored in sqlite
+	APIToken string
+	// Only accept requests from private networks
+	LocalOnly bool
+	// An IANA timezone like America/Denver for serving times and starting days, the system's when empty
+	Timezone string
+	// Where the device is, in decimal degrees, for sunrise, sunset and clear-sky light. NaN when unset.
+	Latitude  float64
+	Longitude float64
+	// Only record between civil dawn and dusk, it needs the latitude and longitude
+	DaylightOnly bool
+	// Keep serving start and stop over GET, for clients that haven't moved to POST
+	LegacyGetRoutes bool
+
+	// Serve HTTPS, with a self-signed certificate unless one is supplied
+	TLSEnabled bool
+	HTTPPort   string
+	HTTPSPort  string
+	// A user supplied certificate and key, in PEM format
+	TLSCertPath string
+	TLSKeyPath  string
+	// Redirect plain HTTP requests to HTTPS
+	HTTPRedirect bool
+
+	// Manage Wi-Fi through NetworkManager, so the app can provision it
+	WifiEnabled   bool
+	WifiInterface string
+	// Start a setup access point when no known network can be joined
+	WifiFallbackAP bool
+	APSSID         string
+	APPassword     string
+
+	// Advertise _gnome._tcp over mDNS
+	MDNSEnabled bool
+	// Answer discovery broadcasts on this UDP port, 0 to turn it off
+	DiscoveryPort int
+
+	// Run as a hub, pulling readings from other devices
+	HubEnabled bool
+	// Base URLs of peers to sync, in addition to the ones found by discovery
+	HubPeers []string
+	// An API token the peers accept
+	HubToken string
+
+	// Push readings to this collector URL, empty to turn it off
+	UploadURL string
+	// Sent to the collector as a bearer token
+	UploadToken string
+	// json or ndjson, both gzipped
+	UploadFormat string
+
+	// Back up the database to this directory, like a mounted USB drive, empty to turn it off
+	BackupDir string
+	// Generations of each kind to keep
+	BackupDaily  int
+	BackupWeekly int
+
+	// Where readings are kept: sqlite, memory or postgres
+	Storage string
+	// The connection string for postgres, e.g. postgres://gnome:secret@db:5432/gnome
+	PostgresURL string
+}
+
+// Where the self-signed certificate is kept, when one isn't supplied
+const (
+	SELF_SIGNED_CERT_PATH = "gnome.crt"
+	SELF_SIGNED_KEY_PATH  = "gnome.key"
+)
+
+// Whether the certificate was supplied, rather than generated by us
+func (c Config) UserCertificate() bool {
+	return c.TLSCertPath != "" && c.TLSKeyPath != ""
+}
+
+// The device's timezone, falling back to the system's when it's unset or unknown
+func (c Config) Location() *time.Location {
+	if c.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		log.Printf("Invalid value for GNOME_TIMEZONE: %q, using the system timezone", c.Timezone)
+		return time.Local
+	}
+	return loc
+}
+
+func Load() Config {
+	return Config{
+		AuthEnabled: getBool("GNOME_AUTH", false),
+		APIToken:    getString("GNOME_API_TOKEN", ""),
+		LocalOnly:   getBool("GNOME_LOCAL_ONLY", true),
+		Timezone:    getString("GNOME_TIMEZONE", ""),
+
+		Latitude:     getFloat("GNOME_LATITUDE", math.NaN()),
+		Longitude:    getFloat("GNOME_LONGITUDE", math.NaN()),
+		DaylightOnly: getBool("GNOME_DAYLIGHT_ONLY", false),
+
+		LegacyGetRoutes: getBool("GNOME_LEGACY_GET", true),
+
+		TLSEnabled:   getBool("GNOME_TLS", true),
+		HTTPPort:     getString("GNOME_HTTP_PORT", "8080"),
+		HTTPSPort:    getString("GNOME_HTTPS_PORT", "8443"),
+		TLSCertPath:  getString("GNOME_TLS_CERT", ""),
+		TLSKeyPath:   getString("GNOME_TLS_KEY", ""),
+		HTTPRedirect: getBool("GNOME_HTTP_REDIRECT", false),
+
+		WifiEnabled:    getBool("GNOME_WIFI", true),
+		WifiInterface:  getString("GNOME_WIFI_INTERFACE", "wlan0"),
+		WifiFallbackAP: getBool("GNOME_WIFI_FALLBACK_AP", false),
+		APSSID:         getString("GNOME_AP_SSID", "Gnome-Setup"),
+		APPassword:     getString("GNOME_AP_PASSWORD", ""),
+
+		MDNSEnabled:   getBool("GNOME_MDNS", true),
+		DiscoveryPort: getInt("GNOME_DISCOVERY_PORT", 35353),
+
+		HubEnabled: getBool("GNOME_HUB", false),
+		HubPeers:   getList("GNOME_HUB_PEERS"),
+		HubToken:   getString("GNOME_HUB_TOKEN", ""),
+
+		UploadURL:    getString("GNOME_UPLOAD_URL", ""),
+		UploadToken:  getString("GNOME_UPLOAD_TOKEN", ""),
+		UploadFormat: getString("GNOME_UPLOAD_FORMAT", "json"),
+
+		BackupDir:    getString("GNOME_BACKUP_DIR", ""),
+		BackupDaily:  getInt("GNOME_BACKUP_DAILY", 7),
+		BackupWeekly: getInt("GNOME_BACKUP_WEEKLY", 4),
+
+		Storage:     getString("GNOME_STORAGE", "sqlite"),
+		PostgresURL: getString("GNOME_POSTGRES_URL", ""),
+	}
+}
+
+func getString(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return strings.TrimSpace(value)
+	}
+	return fallback
+}
+
+func getBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using %v", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func getInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using %v", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func getFloat(key string, fallback float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using %v", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// A comma separated list, without empty items
+func getList(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
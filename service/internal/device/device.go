@@ -0,0 +1,150 @@
+package device
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+const (
+	MAX_NAME_LENGTH  = 64
+	MAX_NOTES_LENGTH = 4096
+)
+
+// Info identifies this device. The UUID is generated on first boot and never changes,
+// the rest is set by the user to tell devices apart.
+type Info struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Location  string `json:"location"`
+	Notes     string `json:"notes"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// Patch changes the fields that are set, leaving the others as they are
+type Patch struct {
+	Name     *string `json:"name"`
+	Location *string `json:"location"`
+	Notes    *string `json:"notes"`
+}
+
+// Registry keeps the device info in sqlite, and tells subscribers when it changes
+type Registry struct {
+	db *sql.DB
+
+	mu       sync.RWMutex
+	info     Info
+	onChange []func(Info)
+}
+
+// Load the device info, creating it with a new UUID on first boot
+func Load(db *sql.DB) (*Registry, error) {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		name = "Gnome"
+	}
+	_, err = db.Exec(`INSERT OR IGNORE INTO device (id, uuid, name) VALUES (1, ?, ?)`, uuid.New().String(), name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create device identity: %w", err)
+	}
+
+	r := &Registry{db: db}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Registry) load() error {
+	var info Info
+	err := r.db.QueryRow(`SELECT uuid, name, location, notes, created_at, updated_at FROM device WHERE id = 1`).
+		Scan(&info.ID, &info.Name, &info.Location, &info.Notes, &info.CreatedAt, &info.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to load device identity: %w", err)
+	}
+	r.mu.Lock()
+	r.info = info
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Registry) Info() Info {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.info
+}
+
+// Call fn with the new info whenever it changes
+func (r *Registry) OnChange(fn func(Info)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onChange = append(r.onChange, fn)
+}
+
+func (r *Registry) Update(patch Patch) (Info, error) {
+	if err := patch.Validate(); err != nil {
+		return Info{}, err
+	}
+
+	info := r.Info()
+	if patch.Name != nil {
+		info.Name = strings.TrimSpace(*patch.Name)
+	}
+	if patch.Location != nil {
+		info.Location = strings.TrimSpace(*patch.Location)
+	}
+	if patch.Notes != nil {
+		info.Notes = *patch.Notes
+	}
+	_, err := r.db.Exec(`UPDATE device SET name = ?, location = ?, notes = ?, updated_at = CURRENT_TIMESTAMP WHERE id = 1`,
+		info.Name, info.Location, info.Notes)
+	if err != nil {
+		return Info{}, fmt.Errorf("failed to update device: %w", err)
+	}
+	return r.reload()
+}
+
+// Load the info again after the database was replaced, like by a restore
+func (r *Registry) Reload() error {
+	_, err := r.reload()
+	return err
+}
+
+// Load the info, and tell the subscribers
+func (r *Registry) reload() (Info, error) {
+	if err := r.load(); err != nil {
+		return Info{}, err
+	}
+
+	r.mu.RLock()
+	info, subscribers := r.info, r.onChange
+	r.mu.RUnlock()
+	for _, fn := range subscribers {
+		fn(info)
+	}
+	return info, nil
+}
+
+func (p Patch) Validate() error {
+	if p.Name != nil {
+		name := strings.TrimSpace(*p.Name)
+		if name == "" {
+			return errors.New("name can't be empty")
+		} else if len(name) > MAX_NAME_LENGTH {
+			return fmt.Errorf("name must be at most %d characters", MAX_NAME_LENGTH)
+		}
+	}
+	if p.Location != nil && len(*p.Location) > MAX_NAME_LENGTH {
+		return fmt.Errorf("location must be at most %d characters", MAX_NAME_LENGTH)
+	}
+	if p.Notes != nil && len(*p.Notes) > MAX_NOTES_LENGTH {
+		return fmt.Errorf("notes must be at most %d characters", MAX_NOTES_LENGTH)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package device
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+func (r *Registry) GetHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		serveJSON(w, r.Info(), http.StatusOK)
+	}
+}
+
+// Update the name, location or notes from a JSON body, e.g. {"name": "Tomato Bed"}
+func (r *Registry) PatchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var patch Patch
+		if status, err := tools.DecodeJSONBody(w, req, &patch); err != nil {
+			serveMessage(w, err.Error(), status)
+			return
+		}
+		if err := patch.Validate(); err != nil {
+			serveMessage(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		info, err := r.Update(patch)
+		if err != nil {
+			log.Println(err)
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveJSON(w, info, http.StatusOK)
+	}
+}
+
+func serveJSON(w http.ResponseWriter, body interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+func serveMessage(w http.ResponseWriter, message string, status int) {
+	serveJSON(w, map[string]string{"message": message}, status)
+}
@@ -0,0 +1,131 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ztkent/gnome/internal/network"
+)
+
+// Clients broadcast this to the discovery port, every device replies to the sender with a Reply
+const DISCOVERY_REQUEST = "GNOME_DISCOVER"
+
+type Reply struct {
+	Name      string   `json:"name"`
+	ID        string   `json:"id"`
+	API       string   `json:"api"`
+	IP        string   `json:"ip"`
+	Port      int      `json:"port"`
+	TLSPort   int      `json:"tls_port,omitempty"`
+	Sensors   []string `json:"sensors"`
+	TLSSHA256 string   `json:"tls_sha256,omitempty"`
+}
+
+func (a *Advertiser) runBroadcast(ctx context.Context) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: a.port})
+	if err != nil {
+		log.Printf("Failed to listen for discovery broadcasts: %v", err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	log.Printf("Answering discovery broadcasts on port %d", a.port)
+
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Failed to read discovery request: %v", err)
+			continue
+		}
+		if strings.TrimSpace(string(buf[:n])) != DISCOVERY_REQUEST {
+			continue
+		}
+
+		service := a.Service()
+		reply, err := json.Marshal(Reply{
+			Name:      service.Name,
+			ID:        service.ID,
+			API:       API_VERSION,
+			IP:        replyIP(addr.IP).String(),
+			Port:      service.Port,
+			TLSPort:   service.TLSPort,
+			Sensors:   service.Sensors,
+			TLSSHA256: service.TLSSHA256,
+		})
+		if err != nil {
+			log.Printf("Failed to encode discovery reply: %v", err)
+			continue
+		}
+		if _, err := conn.WriteToUDP(reply, addr); err != nil {
+			log.Printf("Failed to send discovery reply: %v", err)
+		}
+	}
+}
+
+// The address the client can reach us on, the one on the same subnet if we have several
+func replyIP(client net.IP) net.IP {
+	ifaces, err := net.Interfaces()
+	if err == nil {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp == 0 {
+				continue
+			}
+			addrs, err := iface.Addrs()
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && ipNet.Contains(client) {
+					return ipNet.IP
+				}
+			}
+		}
+	}
+	return network.PrimaryIP()
+}
+
+// Broadcast a discovery request, and collect replies until the context is done
+func Discover(ctx context.Context, port int) ([]Reply, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	if _, err := conn.WriteToUDP([]byte(DISCOVERY_REQUEST), &net.UDPAddr{IP: net.IPv4bcast, Port: port}); err != nil {
+		return nil, fmt.Errorf("failed to send discovery request: %w", err)
+	}
+
+	var replies []Reply
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// The deadline ends the search
+			return replies, nil
+		}
+		var reply Reply
+		if err := json.Unmarshal(buf[:n], &reply); err != nil || reply.ID == "" {
+			continue
+		}
+		replies = append(replies, reply)
+	}
+}
@@ -0,0 +1,113 @@
+package discovery
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	SERVICE_TYPE = "_gnome._tcp"
+	DOMAIN       = "local"
+	API_VERSION  = "v1"
+)
+
+// Service describes this device to clients looking for it
+type Service struct {
+	// Instance name shown to users, e.g. "Tomato Bed"
+	Name      string
+	ID        string
+	Port      int
+	TLSPort   int
+	Sensors   []string
+	TLSSHA256 string
+}
+
+func (s Service) hostname() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "gnome"
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+	return hostname
+}
+
+// TXT records for DNS-SD, key=value pairs that each fit in 255 bytes
+func (s Service) txt() []string {
+	txt := []string{
+		"name=" + s.Name,
+		"id=" + s.ID,
+		"api=" + API_VERSION,
+		"sensors=" + strings.Join(s.Sensors, ","),
+	}
+	if s.TLSPort != 0 {
+		txt = append(txt, "https="+strconv.Itoa(s.TLSPort))
+	}
+	if s.TLSSHA256 != "" {
+		txt = append(txt, "tls_sha256="+strings.ReplaceAll(s.TLSSHA256, ":", ""))
+	}
+	for i, record := range txt {
+		if len(record) > 255 {
+			txt[i] = record[:255]
+		}
+	}
+	return txt
+}
+
+// Advertiser publishes the service over mDNS and answers discovery broadcasts
+type Advertiser struct {
+	mu      sync.RWMutex
+	service Service
+	updated chan struct{}
+	mdns    bool
+	port    int
+}
+
+// Advertise over mDNS if mdns is set, and answer broadcasts on port if it isn't zero
+func NewAdvertiser(service Service, mdns bool, port int) *Advertiser {
+	return &Advertiser{
+		service: service,
+		updated: make(chan struct{}, 1),
+		mdns:    mdns,
+		port:    port,
+	}
+}
+
+func (a *Advertiser) Service() Service {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.service
+}
+
+// Change what we advertise, e.g. after a rename or a certificate renewal
+func (a *Advertiser) Update(update func(*Service)) {
+	a.mu.Lock()
+	update(&a.service)
+	a.mu.Unlock()
+	select {
+	case a.updated <- struct{}{}:
+	default:
+	}
+}
+
+// Advertise until the context is cancelled
+func (a *Advertiser) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	if a.mdns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.runMDNS(ctx)
+		}()
+	}
+	if a.port != 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.runBroadcast(ctx)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,311 @@
+package discovery
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	MDNS_PORT = 5353
+	// TTLs recommended by RFC 6762, host records change more often than the service
+	HOST_TTL    = 120
+	SERVICE_TTL = 4500
+	// Set on records only we answer for, so caches replace rather than add to them
+	CACHE_FLUSH = 0x8000
+	// Set on questions that want a unicast response
+	UNICAST_RESPONSE = 0x8000
+	ANNOUNCE_COUNT   = 2
+)
+
+var (
+	mdnsGroupIPv4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: MDNS_PORT}
+	mdnsGroupIPv6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: MDNS_PORT}
+)
+
+// The names we answer for
+type names struct {
+	serviceType dnsmessage.Name
+	instance    dnsmessage.Name
+	host        dnsmessage.Name
+	enumeration dnsmessage.Name
+}
+
+func newNames(service Service) (names, error) {
+	// Dots would split the instance label
+	instance := strings.ReplaceAll(service.Name, ".", "-")
+	if instance == "" {
+		instance = service.hostname()
+	}
+	var n names
+	var err error
+	if n.serviceType, err = dnsmessage.NewName(SERVICE_TYPE + "." + DOMAIN + "."); err != nil {
+		return n, err
+	}
+	if n.instance, err = dnsmessage.NewName(instance + "." + SERVICE_TYPE + "." + DOMAIN + "."); err != nil {
+		return n, err
+	}
+	if n.host, err = dnsmessage.NewName(service.hostname() + "." + DOMAIN + "."); err != nil {
+		return n, err
+	}
+	n.enumeration, err = dnsmessage.NewName("_services._dns-sd._udp." + DOMAIN + ".")
+	return n, err
+}
+
+func (a *Advertiser) runMDNS(ctx context.Context) {
+	conn4, err := net.ListenMulticastUDP("udp4", nil, mdnsGroupIPv4)
+	if err != nil {
+		log.Printf("Failed to listen for mDNS queries: %v", err)
+		return
+	}
+	conns := []*net.UDPConn{conn4}
+	// IPv6 is best effort, it isn't available everywhere
+	if conn6, err := net.ListenMulticastUDP("udp6", nil, mdnsGroupIPv6); err == nil {
+		conns = append(conns, conn6)
+	}
+	log.Printf("Advertising %s over mDNS as %q", SERVICE_TYPE, a.Service().Name)
+
+	for _, conn := range conns {
+		go a.answerQueries(ctx, conn)
+	}
+
+	// Announce, and again whenever the service changes, then say goodbye when we stop
+	a.announce(conns, a.Service(), false)
+	for {
+		select {
+		case <-ctx.Done():
+			a.announce(conns, a.Service(), true)
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return
+		case <-a.updated:
+			a.announce(conns, a.Service(), false)
+		}
+	}
+}
+
+func (a *Advertiser) announce(conns []*net.UDPConn, service Service, goodbye bool) {
+	names, err := newNames(service)
+	if err != nil {
+		log.Printf("Invalid mDNS name: %v", err)
+		return
+	}
+	msg, err := buildResponse(0, nil, names, service, allRecords, goodbye)
+	if err != nil {
+		log.Printf("Failed to build mDNS announcement: %v", err)
+		return
+	}
+	count := ANNOUNCE_COUNT
+	if goodbye {
+		count = 1
+	}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+		for _, conn := range conns {
+			group := mdnsGroupIPv4
+			if conn.LocalAddr().(*net.UDPAddr).IP.To4() == nil {
+				group = mdnsGroupIPv6
+			}
+			conn.WriteToUDP(msg, group)
+		}
+	}
+}
+
+func (a *Advertiser) answerQueries(ctx context.Context, conn *net.UDPConn) {
+	buf := make([]byte, 9000)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+
+		var parser dnsmessage.Parser
+		header, err := parser.Start(buf[:n])
+		if err != nil || header.Response {
+			continue
+		}
+		questions, err := parser.AllQuestions()
+		if err != nil {
+			continue
+		}
+
+		service := a.Service()
+		names, err := newNames(service)
+		if err != nil {
+			continue
+		}
+		wanted := recordSet(0)
+		unicast := false
+		for _, q := range questions {
+			wanted |= answersFor(q, names)
+			unicast = unicast || uint16(q.Class)&UNICAST_RESPONSE != 0
+		}
+		if wanted == 0 {
+			continue
+		}
+
+		// Legacy resolvers query from an ephemeral port, and expect a plain unicast DNS answer
+		legacy := addr.Port != MDNS_PORT
+		var id uint16
+		var echo []dnsmessage.Question
+		if legacy {
+			id, echo = header.ID, questions
+		}
+		msg, err := buildResponse(id, echo, names, service, wanted, false)
+		if err != nil {
+			log.Printf("Failed to build mDNS response: %v", err)
+			continue
+		}
+
+		target := addr
+		if !legacy && !unicast {
+			target = mdnsGroupIPv4
+			if addr.IP.To4() == nil {
+				target = mdnsGroupIPv6
+			}
+		}
+		conn.WriteToUDP(msg, target)
+	}
+}
+
+type recordSet uint8
+
+const (
+	recordPTR recordSet = 1 << iota
+	recordSRV
+	recordTXT
+	recordHost
+	recordEnumeration
+
+	allRecords = recordPTR | recordSRV | recordTXT | recordHost
+)
+
+func answersFor(q dnsmessage.Question, n names) recordSet {
+	name := strings.ToLower(q.Name.String())
+	matches := func(candidate dnsmessage.Name, t dnsmessage.Type) bool {
+		return name == strings.ToLower(candidate.String()) && (q.Type == t || q.Type == dnsmessage.TypeALL)
+	}
+	switch {
+	case matches(n.enumeration, dnsmessage.TypePTR):
+		return recordEnumeration
+	case matches(n.serviceType, dnsmessage.TypePTR):
+		// Include everything needed to connect, to save the client a round trip
+		return allRecords
+	case matches(n.instance, dnsmessage.TypeSRV):
+		return recordSRV | recordHost
+	case matches(n.instance, dnsmessage.TypeTXT):
+		return recordTXT
+	case matches(n.instance, dnsmessage.TypeALL):
+		return recordSRV | recordTXT | recordHost
+	case name == strings.ToLower(n.host.String()) && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA || q.Type == dnsmessage.TypeALL):
+		return recordHost
+	}
+	return 0
+}
+
+func buildResponse(id uint16, questions []dnsmessage.Question, n names, service Service, records recordSet, goodbye bool) ([]byte, error) {
+	ttl := func(seconds uint32) uint32 {
+		if goodbye {
+			return 0
+		}
+		return seconds
+	}
+	unique := dnsmessage.ClassINET | CACHE_FLUSH
+	if id != 0 || len(questions) > 0 {
+		// Legacy unicast responses don't use the cache flush bit
+		unique = dnsmessage.ClassINET
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	builder.EnableCompression()
+	if len(questions) > 0 {
+		if err := builder.StartQuestions(); err != nil {
+			return nil, err
+		}
+		for _, q := range questions {
+			q.Class &^= UNICAST_RESPONSE
+			if err := builder.Question(q); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	if records&recordEnumeration != 0 {
+		header := dnsmessage.ResourceHeader{Name: n.enumeration, Class: dnsmessage.ClassINET, TTL: ttl(SERVICE_TTL)}
+		if err := builder.PTRResource(header, dnsmessage.PTRResource{PTR: n.serviceType}); err != nil {
+			return nil, err
+		}
+	}
+	if records&recordPTR != 0 {
+		header := dnsmessage.ResourceHeader{Name: n.serviceType, Class: dnsmessage.ClassINET, TTL: ttl(SERVICE_TTL)}
+		if err := builder.PTRResource(header, dnsmessage.PTRResource{PTR: n.instance}); err != nil {
+			return nil, err
+		}
+	}
+	if records&recordSRV != 0 {
+		header := dnsmessage.ResourceHeader{Name: n.instance, Class: unique, TTL: ttl(HOST_TTL)}
+		if err := builder.SRVResource(header, dnsmessage.SRVResource{Port: uint16(service.Port), Target: n.host}); err != nil {
+			return nil, err
+		}
+	}
+	if records&recordTXT != 0 {
+		header := dnsmessage.ResourceHeader{Name: n.instance, Class: unique, TTL: ttl(SERVICE_TTL)}
+		if err := builder.TXTResource(header, dnsmessage.TXTResource{TXT: service.txt()}); err != nil {
+			return nil, err
+		}
+	}
+	if records&recordHost != 0 {
+		for _, ip := range hostAddresses() {
+			header := dnsmessage.ResourceHeader{Name: n.host, Class: unique, TTL: ttl(HOST_TTL)}
+			var err error
+			if ip4 := ip.To4(); ip4 != nil {
+				err = builder.AResource(header, dnsmessage.AResource{A: [4]byte(ip4)})
+			} else {
+				err = builder.AAAAResource(header, dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())})
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return builder.Finish()
+}
+
+// Addresses of the interfaces that are up, leaving out loopback and IPv6 link-local
+func hostAddresses() []net.IP {
+	var ips []net.IP
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || (ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast()) {
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
@@ -2,32 +2,105 @@ package gnome
 
 import (
 	"context"
-	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"math"
-	"os/exec"
-	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/ztkent/gnome/internal/device"
 	"github.com/ztkent/gnome/internal/gnome/tsl2591"
+	"github.com/ztkent/gnome/internal/network"
+	"github.com/ztkent/gnome/internal/quality"
+	"github.com/ztkent/gnome/internal/queue"
+	"github.com/ztkent/gnome/internal/solar"
+	"github.com/ztkent/gnome/internal/storage"
+	"github.com/ztkent/gnome/internal/tools"
+	"github.com/ztkent/gnome/internal/upload"
 )
 
 const (
 	MAX_JOB_DURATION = 168 * time.Hour
 	RECORD_INTERVAL  = 15 * time.Second
 	GNOME_DB_PATH    = "gnome.db"
-	GNOME_CSV_PATH   = "gnome.csv"
+	RESULTS_BUFFER   = 16
+	SHUTDOWN_TIMEOUT = 10 * time.Second
+
+	// Results are queued on disk until they're written, a week of samples at the record interval
+	GNOME_QUEUE_PATH  = "gnome.queue"
+	QUEUE_CAPACITY    = 40320
+	WRITE_BATCH_SIZE  = 100
+	MAX_WRITE_BACKOFF = 5 * time.Minute
+
+	SENSOR_PROBE_INTERVAL = 10 * time.Second
+	MAX_READ_FAILURES     = 3
+
+	// The current conditions summarize the job's last week, at most once a minute
+	CONDITIONS_WINDOW_DAYS = 7
+	CONDITIONS_CACHE_TTL   = time.Minute
+
+	// Readings are paged by id, for clients and hubs that sync incrementally
+	READINGS_PAGE_SIZE     = 500
+	MAX_READINGS_PAGE_SIZE = 5000
+)
+
+var (
+	ErrSensorNotConnected = errors.New("sensor is not connected")
+	ErrAlreadyRecording   = errors.New("sensor is already started")
+	ErrNotRecording       = errors.New("sensor is already stopped")
 )
 
 type SLMeter struct {
-	*tsl2591.TSL2591
 	LuxResultsChan chan LuxResults
-	ResultsDB      *sql.DB
-	cancel         context.CancelFunc
-	Pid            int
+	// Every query on the readings goes through the store
+	Store storage.ReadingStore
+	Pid   int
+	// Network keeps the signal history for the dashboard, run it alongside the meter
+	Network *network.Monitor
+	Device  *device.Registry
+	// Set in hub mode, to show the device comparison on the dashboard
+	HubDashboard bool
+	// Set when requests need credentials, so the open /id leaves out the readings
+	AuthEnabled bool
+	// Set when readings are pushed to a collector, to show the upload lag
+	Uploads *upload.Uploader
+	// Times are served in this timezone unless a request asks for another, and days start at its midnight
+	Timezone *time.Location
+	// Where the device is, to follow the sun. Nil when it isn't configured.
+	Site *solar.Site
+	// Pause recording between civil dusk and dawn, it needs the Site
+	DaylightOnly bool
+	recorded     chan struct{}
+
+	// results holds samples between acquisition and sqlite
+	results *queue.Queue[LuxResults]
+	// Held while a batch is written, and while a restore replaces the database
+	writes          sync.Mutex
+	recordedResults atomic.Uint64
+	writeErrors     atomic.Uint64
+	lastWrite       atomic.Int64
+	// When a daylight only job starts recording again in epoch milliseconds, 0 when it isn't waiting for dawn.
+	// The waiting job sets it without mu, which StopSensor holds while it waits for the job to finish.
+	pausedUntil atomic.Int64
+
+	// The current job's summary for the conditions, so each request doesn't summarize it again
+	conditionsMu     sync.Mutex
+	conditionsReport cachedReport
+
+	// mu guards the sensor and the running job, which are shared between
+	// the acquisition goroutine, the supervisor and the HTTP handlers.
+	// jobID outlives the acquisition goroutine, so a job can resume after the sensor reconnects.
+	mu     sync.Mutex
+	sensor *tsl2591.TSL2591
+	jobID  string
+	// How the running job takes its readings
+	options JobOptions
+	cancel  context.CancelFunc
+	done    chan struct{}
+	events  []ConnectionEvent
 }
 
 type LuxResults struct {
@@ -36,219 +109,661 @@ type LuxResults struct {
 	Visible      float64
 	FullSpectrum float64
 	JobID        string
+	Time         time.Time
+	// What the quality checks found, 0 for a good reading
+	Quality quality.Flags
+	// Sub-samples in the point, and their spread when there was more than one
+	Samples int
+	Stats   *PointStats
+	// The live lux after the job's filter, when it has one
+	Filtered *float64
 }
 
 type Conditions struct {
-	JobID                 string  `json:"jobID"`
-	Lux                   float64 `json:"lux"`
-	FullSpectrum          float64 `json:"fullSpectrum"`
-	Visible               float64 `json:"visible"`
-	Infrared              float64 `json:"infrared"`
+	JobID        string  `json:"jobID"`
+	Lux          float64 `json:"lux"`
+	FullSpectrum float64 `json:"fullSpectrum"`
+	Visible      float64 `json:"visible"`
+	Infrared     float64 `json:"infrared"`
+	// The current job's sun-exposure report over its last week, with full sunlight in hours of direct sun a day
 	DateRange             string  `json:"dateRange"`
 	RecordedHoursInRange  float64 `json:"recordedHoursInRange"`
 	FullSunlightInRange   float64 `json:"fullSunlightInRange"`
 	LightConditionInRange string  `json:"lightConditionInRange"`
 	AverageLuxInRange     float64 `json:"averageLuxInRange"`
+	// The latest point's spread and smoothed lux, when the job takes several samples or filters them
+	LuxStdDev   *float64 `json:"luxStdDev,omitempty"`
+	LuxFiltered *float64 `json:"luxFiltered,omitempty"`
+	// Set when the device knows where it is
+	SolarElevation    *float64 `json:"solarElevation,omitempty"`
+	ClearSkyLux       float64  `json:"clearSkyLux,omitempty"`
+	PercentOfPossible float64  `json:"percentOfPossible,omitempty"`
 }
 
 type Status struct {
-	Connected bool `json:"connected"`
-	Enabled   bool `json:"enabled"`
+	Connected bool              `json:"connected"`
+	Enabled   bool              `json:"enabled"`
+	JobID     string            `json:"jobID,omitempty"`
+	Events    []ConnectionEvent `json:"events,omitempty"`
+	// When a daylight only job will start recording again
+	PausedUntil *time.Time `json:"pausedUntil,omitempty"`
+	// How the running job takes its readings
+	Options *JobOptions `json:"options,omitempty"`
 }
 
 type SignalStrength struct {
-	SignalInt int `json:"signalInt"`
-	Strength  int `json:"strength"`
+	SignalInt    int     `json:"signalInt"`
+	Strength     int     `json:"strength"`
+	Interface    string  `json:"interface,omitempty"`
+	SSID         string  `json:"ssid,omitempty"`
+	LinkQuality  int     `json:"linkQuality,omitempty"`
+	BitrateMbps  float64 `json:"bitrateMbps,omitempty"`
+	FrequencyMHz int     `json:"frequencyMhz,omitempty"`
+}
+
+func NewSLMeter(sensor *tsl2591.TSL2591, store storage.ReadingStore, results *queue.Queue[LuxResults], identity *device.Registry, pid int) *SLMeter {
+	return &SLMeter{
+		LuxResultsChan: make(chan LuxResults, RESULTS_BUFFER),
+		Store:          store,
+		Pid:            pid,
+		Network:        network.NewMonitor(network.SIGNAL_HISTORY),
+		Device:         identity,
+		Timezone:       time.Local,
+		recorded:       make(chan struct{}),
+		results:        results,
+		sensor:         sensor,
+	}
+}
+
+// Sensor returns the connected TSL2591, or nil if there isn't one
+func (m *SLMeter) Sensor() *tsl2591.TSL2591 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sensor
+}
+
+// IsRecording reports whether a job is running, including one waiting on the sensor to reconnect
+func (m *SLMeter) IsRecording() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.jobID != ""
 }
 
 // Start the sensor, and collect data in a loop
-func (m *SLMeter) StartSensor() error {
-	if m.TSL2591 == nil {
-		return fmt.Errorf("sensor is not connected")
+func (m *SLMeter) StartSensor(options JobOptions) error {
+	options, err := options.normalize()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sensor == nil {
+		return ErrSensorNotConnected
 	}
-	if m.Enabled {
-		return fmt.Errorf("sensor is already started")
+	if m.jobID != "" {
+		return ErrAlreadyRecording
 	}
 
+	m.jobID = uuid.New().String()
+	m.options = options
+	m.startJob()
+	return nil
+}
+
+// Start collecting data for the current job. The caller must hold mu.
+func (m *SLMeter) startJob() {
 	// Create context with timeout
 	ctx, cancel := context.WithCancel(context.Background()) // Lets let it run forever
 	m.cancel = cancel
 
 	// Enable sensor
-	m.Enable()
+	sensor := m.sensor
+	if err := sensor.Enable(); err != nil {
+		log.Printf("Failed to enable sensor: %s", err)
+	}
 
-	// Initializing Sensor Optimal Gain
+	done := make(chan struct{})
+	m.done = done
+	jobID, options := m.jobID, m.options
+	go func() {
+		err := m.runJob(ctx, sensor, jobID, options)
+		close(done)
+		if err != nil {
+			m.detachSensor(sensor, err)
+		}
+	}()
+}
+
+// Collect data from the sensor until the context is cancelled, a point every RECORD_INTERVAL
+// from options.Samples sub-samples. Returns an error if the sensor stops responding.
+func (m *SLMeter) runJob(ctx context.Context, sensor *tsl2591.TSL2591, jobID string, options JobOptions) error {
+	// Initializing Sensor Optimal Gain, off the caller's goroutine so we don't hold up the request
 	log.Printf("Setting sensor initial gain & integration time")
-	if err := m.SetOptimalGain(); err != nil {
+	if err := sensor.SetOptimalGainContext(ctx); err != nil && ctx.Err() == nil {
 		log.Printf("Failed to set initial optimal gain: %s, using default settings", err)
 	}
-	log.Printf("Current Sensor Settings: Gain: %s, Timing: %s", m.GetGain(), m.GetTiming())
-
-	go func() {
-		defer m.Disable()
-		jobID := uuid.New().String()
-		ticker := time.NewTicker(RECORD_INTERVAL)
-		isLowLight := true
-
-		for {
-			select {
-			case <-ctx.Done():
+	log.Printf("Current Sensor Settings: Gain: %s, Timing: %s, Sampling: %s", sensor.GetGain(), sensor.GetTiming(), options)
+
+	ticker := time.NewTicker(options.sampleInterval())
+	defer ticker.Stop()
+	isLowLight := true
+	failures := 0
+	checker := quality.NewChecker()
+	filter := newLiveFilter(options)
+	// Sub-samples attempted for the current point, and the ones that were read
+	attempts := 0
+	current := point{}
+
+	for {
+		// A daylight only job sleeps through the night with the sensor powered down
+		if dawn, dark := m.untilDawn(time.Now()); dark {
+			if !m.waitForDawn(ctx, sensor, dawn) {
 				log.Println("Job Cancelled, stopping sensor")
-				return
-			default:
+				return nil
 			}
+			// The gain was set for the twilight at dawn
+			isLowLight = true
+			attempts, current = 0, point{}
+			ticker.Reset(options.sampleInterval())
+			continue
+		}
 
-			ch0, ch1, err := m.GetFullLuminosity()
-			if err != nil {
-				log.Printf("Failed to get luminosity: %s", err)
-				m.LuxResultsChan <- LuxResults{JobID: jobID}
-				<-ticker.C
-				continue
+		ch0, ch1, err := sensor.GetFullLuminosityContext(ctx)
+		if ctx.Err() != nil {
+			log.Println("Job Cancelled, stopping sensor")
+			return nil
+		} else if err != nil {
+			log.Printf("Failed to get luminosity: %s", err)
+			// Counted in points, so sampling faster doesn't give up on the sensor sooner
+			if failures++; failures >= MAX_READ_FAILURES*options.Samples {
+				return fmt.Errorf("%d consecutive failed reads: %w", failures, err)
 			}
-
-			lux, err := m.CalculateLux(ch0, ch1)
-			if err != nil {
-				log.Printf("Failed to calculate lux: %s", err)
-				if err := m.SetOptimalGain(); err != nil {
-					log.Printf("Failed to set optimal gain: %s", err)
+			// A point without any sub-samples is stored as a failed read
+			if attempts++; attempts >= options.Samples {
+				result := LuxResults{JobID: jobID, Time: time.Now(), Quality: checker.Failed()}
+				if current.samples > 0 {
+					result = finishPoint(sensor, current, jobID, checker, filter)
 				}
-				log.Printf("Updated Sensor Settings: Gain: %s, Timing: %s", m.GetGain(), m.GetTiming())
-				time.Sleep(5 * time.Second)
-				continue
-			} else if math.IsInf(lux, 0) {
-				log.Printf("Lux is +inf, the sensor is over/under saturated, rechecking optimal gain")
-				if err := m.SetOptimalGain(); err != nil {
-					log.Printf("Failed to set optimal gain: %s", err)
+				attempts, current = 0, point{}
+				if !m.sendResult(ctx, result) {
+					log.Println("Job Cancelled, stopping sensor")
+					return nil
 				}
-				log.Printf("Updated Sensor Settings: Gain: %s, Timing: %s", m.GetGain(), m.GetTiming())
-				time.Sleep(5 * time.Second)
-				continue
 			}
+			if !waitForTick(ctx, ticker) {
+				log.Println("Job Cancelled, stopping sensor")
+				return nil
+			}
+			continue
+		}
+		failures = 0
 
-			if lux < 25 && !isLowLight {
-				log.Printf("Rechecking optimal gain in low-light")
-				if err := m.SetOptimalGain(); err != nil {
-					log.Printf("Failed to set optimal gain: %s", err)
-				}
-				isLowLight = true
-				log.Printf("Updated Sensor Settings: Gain: %s, Timing: %s", m.GetGain(), m.GetTiming())
-			} else if lux > 25 && isLowLight {
-				log.Printf("Rechecking optimal gain in high-light")
-				if err := m.SetOptimalGain(); err != nil {
-					log.Printf("Failed to set optimal gain: %s", err)
-				}
-				isLowLight = false
-				log.Printf("Updated Sensor Settings: Gain: %s, Timing: %s", m.GetGain(), m.GetTiming())
+		lux, err := sensor.CalculateLux(ch0, ch1)
+		if err != nil {
+			log.Printf("Failed to calculate lux: %s", err)
+			checker.Saturated()
+			recheckGain(ctx, sensor)
+			if !sleepContext(ctx, 5*time.Second) {
+				log.Println("Job Cancelled, stopping sensor")
+				return nil
 			}
+			continue
+		} else if math.IsInf(lux, 0) {
+			log.Printf("Lux is +inf, the sensor is over/under saturated, rechecking optimal gain")
+			recheckGain(ctx, sensor)
+			if !sleepContext(ctx, 5*time.Second) {
+				log.Println("Job Cancelled, stopping sensor")
+				return nil
+			}
+			continue
+		} else if ch0 == 0 && ch1 == 0 {
+			// Darkness, 0/0 in the lux formula
+			lux = 0
+		}
+
+		// After dusk the light only changes when a lamp does, so the gain found at dusk is kept
+		if m.sunIsDown(time.Now()) {
+			isLowLight = true
+		} else if lux < 25 && !isLowLight {
+			log.Printf("Rechecking optimal gain in low-light")
+			recheckGain(ctx, sensor)
+			isLowLight = true
+		} else if lux > 25 && isLowLight {
+			log.Printf("Rechecking optimal gain in high-light")
+			recheckGain(ctx, sensor)
+			isLowLight = false
+		}
 
-			m.LuxResultsChan <- LuxResults{
-				Lux:          lux,
-				Visible:      tsl2591.GetNormalizedOutput(tsl2591.TSL2591_VISIBLE, ch0, ch1),
-				Infrared:     tsl2591.GetNormalizedOutput(tsl2591.TSL2591_INFRARED, ch0, ch1),
-				FullSpectrum: tsl2591.GetNormalizedOutput(tsl2591.TSL2591_FULLSPECTRUM, ch0, ch1),
-				JobID:        jobID,
+		current.add(lux, ch0, ch1,
+			tsl2591.GetNormalizedOutput(tsl2591.TSL2591_VISIBLE, ch0, ch1),
+			tsl2591.GetNormalizedOutput(tsl2591.TSL2591_INFRARED, ch0, ch1),
+			tsl2591.GetNormalizedOutput(tsl2591.TSL2591_FULLSPECTRUM, ch0, ch1))
+		if attempts++; attempts >= options.Samples {
+			result := finishPoint(sensor, current, jobID, checker, filter)
+			attempts, current = 0, point{}
+			if !m.sendResult(ctx, result) {
+				log.Println("Job Cancelled, stopping sensor")
+				return nil
 			}
-			<-ticker.C
 		}
-	}()
+		if !waitForTick(ctx, ticker) {
+			log.Println("Job Cancelled, stopping sensor")
+			return nil
+		}
+	}
+}
 
-	return nil
+// Check a finished point, and smooth it for the live lux. Faults are flagged rather than dropped.
+func finishPoint(sensor *tsl2591.TSL2591, current point, jobID string, checker *quality.Checker, filter liveFilter) LuxResults {
+	result := current.result(jobID)
+	sample := quality.Sample{Lux: result.Lux, Ch0: current.ch0, Ch1: current.ch1, MaxCount: sensor.FullScale(), Time: result.Time}
+	result.Lux, result.Quality = checker.Check(sample)
+	if result.Quality != 0 {
+		log.Printf("Reading flagged: %s", result.Quality)
+	}
+	if filter != nil && result.Quality&quality.INVALID == 0 {
+		filtered := filter.apply(result.Lux)
+		result.Filtered = &filtered
+	}
+	return result
+}
+
+// Re-run the gain search, and log the settings we end up with
+func recheckGain(ctx context.Context, sensor *tsl2591.TSL2591) {
+	if err := sensor.SetOptimalGainContext(ctx); err != nil && ctx.Err() == nil {
+		log.Printf("Failed to set optimal gain: %s", err)
+	}
+	log.Printf("Updated Sensor Settings: Gain: %s, Timing: %s", sensor.GetGain(), sensor.GetTiming())
+}
+
+// Pass a result to the recorder, returns false if the job is cancelled.
+// A result taken before the cancel is still handed over if the buffer has room,
+// so stopping or shutting down doesn't lose the last sample.
+func (m *SLMeter) sendResult(ctx context.Context, result LuxResults) bool {
+	select {
+	case m.LuxResultsChan <- result:
+		return ctx.Err() == nil
+	case <-ctx.Done():
+		select {
+		case m.LuxResultsChan <- result:
+		default:
+			log.Printf("Results buffer is full, dropping result for JobID: %s", result.JobID)
+		}
+		return false
+	}
+}
+
+// Wait for the next tick, returns false if the context is cancelled first
+func waitForTick(ctx context.Context, ticker *time.Ticker) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-ticker.C:
+		return true
+	}
+}
+
+// Sleep for the duration, returns false if the context is cancelled first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
 }
 
 // Stop the sensor
 func (m *SLMeter) StopSensor() error {
-	if m.TSL2591 == nil {
-		return fmt.Errorf("sensor is not connected")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.jobID == "" {
+		if m.sensor == nil {
+			return ErrSensorNotConnected
+		}
+		return ErrNotRecording
 	}
-	if !m.Enabled {
-		return fmt.Errorf("sensor is already stopped")
+
+	// A job waiting on the sensor to reconnect has nothing running
+	m.jobID = ""
+	if m.cancel == nil {
+		return nil
 	}
 
+	// Wait for the job to finish with the sensor before we power it down
 	m.cancel()
-	m.Disable()
-	return nil
+	<-m.done
+	m.cancel = nil
+	m.done = nil
+	return m.sensor.Disable()
 }
 
-// GetSignalStrength returns the signal strength of the wifi connection
-func (m *SLMeter) GetSignalStrength() (SignalStrength, error) {
-	cmd := exec.Command("sh", "-c", "iw dev wlan0 link | grep 'signal:' | awk '{print $2}'")
-	output, err := cmd.Output()
-	if err != nil {
-		return SignalStrength{}, err
+// Shutdown stops any running job, powers down the sensor, and waits for the
+// buffered results to be recorded. LuxResultsChan is closed, so call it once.
+func (m *SLMeter) Shutdown(ctx context.Context) error {
+	if m.IsRecording() {
+		if err := m.StopSensor(); err != nil {
+			log.Printf("Failed to stop sensor: %s", err)
+		}
 	}
-
-	signalInt, err := strconv.Atoi(strings.TrimSpace(string(output)))
-	if err != nil {
-		return SignalStrength{}, fmt.Errorf("device is not connected to a network")
+	if sensor := m.Sensor(); sensor != nil {
+		if err := sensor.Disable(); err != nil {
+			log.Printf("Failed to power down sensor: %s", err)
+		}
+		sensor.Close()
 	}
 
-	if signalInt < -110 {
-		signalInt = -110
-	} else if signalInt > -40 {
-		signalInt = -40
+	close(m.LuxResultsChan)
+	select {
+	case <-m.recorded:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out recording buffered results: %w", ctx.Err())
 	}
+}
 
-	strength := (signalInt + 110) * 100 / 70
-	if strength < 0 {
-		strength = 0
-	} else if strength > 100 {
-		strength = 100
+// GetSignalStrength returns the signal strength of the wifi connection
+func (m *SLMeter) GetSignalStrength() (SignalStrength, error) {
+	iface, err := network.PrimaryWireless()
+	if err != nil {
+		return SignalStrength{}, err
 	}
-
 	return SignalStrength{
-		SignalInt: signalInt,
-		Strength:  strength,
+		SignalInt:    iface.Wireless.SignalDBM,
+		Strength:     network.SignalPercent(iface.Wireless.SignalDBM),
+		Interface:    iface.Name,
+		SSID:         iface.Wireless.SSID,
+		LinkQuality:  iface.Wireless.LinkQuality,
+		BitrateMbps:  iface.Wireless.BitrateMbps,
+		FrequencyMHz: iface.Wireless.FrequencyMHz,
 	}, nil
 }
 
 // GetCurrentConditions returns the most recent sensor readings
 func (m *SLMeter) GetCurrentConditions() (Conditions, error) {
-	if m.TSL2591 == nil || !m.Enabled {
+	if m.Sensor() == nil || !m.IsRecording() {
 		return Conditions{}, nil
 	}
 
-	conditions := Conditions{}
-	row := m.ResultsDB.QueryRow("SELECT job_id, lux, full_spectrum, visible, infrared FROM sunlight ORDER BY id DESC LIMIT 1")
-	err := row.Scan(&conditions.JobID, &conditions.Lux, &conditions.FullSpectrum, &conditions.Visible, &conditions.Infrared)
+	latest, err := m.Store.LatestReading()
 	if err != nil {
 		return Conditions{}, err
 	}
+	conditions := Conditions{
+		JobID:        latest.JobID,
+		Lux:          latest.Lux,
+		FullSpectrum: latest.FullSpectrum,
+		Visible:      latest.Visible,
+		Infrared:     latest.Infrared,
+		LuxStdDev:    latest.LuxStdDev,
+		LuxFiltered:  latest.LuxFiltered,
+	}
 
+	if m.Site != nil {
+		at := time.UnixMilli(latest.CreatedAt)
+		elevation := m.Site.Position(at).Elevation
+		conditions.SolarElevation = &elevation
+		conditions.ClearSkyLux = m.Site.ClearSkyLux(at)
+		conditions.PercentOfPossible = percentOf(conditions.Lux, conditions.ClearSkyLux)
+	}
+
+	// How the current job's spot classifies lately
+	report, err := m.recentJobReport(conditions.JobID)
+	if err != nil {
+		return Conditions{}, err
+	}
+	conditions.DateRange = fmt.Sprintf("%s to %s", report.Days[0].Date, report.Days[len(report.Days)-1].Date)
+	conditions.RecordedHoursInRange = report.RecordedHours
+	conditions.FullSunlightInRange = report.AverageSunHours
+	conditions.LightConditionInRange = report.Classification
+	conditions.AverageLuxInRange = report.AverageLux
 	return conditions, nil
 }
 
+// A stored reading. IDs only increase, so they're a cursor for syncing.
+type Reading struct {
+	ID           int64   `json:"id"`
+	JobID        string  `json:"job_id"`
+	Lux          float64 `json:"lux"`
+	FullSpectrum float64 `json:"full_spectrum"`
+	Visible      float64 `json:"visible"`
+	Infrared     float64 `json:"infrared"`
+	CreatedAt    string  `json:"created_at"`
+	// Degrees above the horizon, when the device knew where it was
+	SolarElevation *float64 `json:"solar_elevation,omitempty"`
+	// What looked wrong with the reading, omitted when nothing did
+	QualityFlags []string `json:"quality_flags,omitempty"`
+	// Sub-samples averaged into lux, and their spread when there was more than one
+	Samples   int      `json:"samples"`
+	LuxMin    *float64 `json:"lux_min,omitempty"`
+	LuxMax    *float64 `json:"lux_max,omitempty"`
+	LuxStdDev *float64 `json:"lux_stddev,omitempty"`
+	// The live lux after the job's filter, when it had one
+	LuxFiltered *float64 `json:"lux_filtered,omitempty"`
+}
+
+type ReadingsPage struct {
+	DeviceID string    `json:"device_id"`
+	Readings []Reading `json:"readings"`
+	// Pass as after_id to get the next page, it's after_id again when there's nothing new
+	NextAfterID int64 `json:"next_after_id"`
+	// Whether there are more readings after this page
+	HasMore bool `json:"has_more"`
+	// The newest reading's id, to show sync progress
+	LatestID int64 `json:"latest_id"`
+}
+
+// GetReadingsPage returns up to limit readings with an id after afterID, oldest first, with times in loc
+func (m *SLMeter) GetReadingsPage(afterID int64, limit int, loc *time.Location) (ReadingsPage, error) {
+	page := ReadingsPage{
+		DeviceID:    m.Device.Info().ID,
+		NextAfterID: afterID,
+	}
+	// Ask for one more than the limit, to know if there's another page
+	readings, err := m.GetReadings(afterID, limit+1, loc)
+	if err != nil {
+		return page, err
+	}
+	if len(readings) > limit {
+		readings = readings[:limit]
+		page.HasMore = true
+	}
+	page.Readings = readings
+	if len(readings) > 0 {
+		page.NextAfterID = readings[len(readings)-1].ID
+	}
+
+	page.LatestID, err = m.Store.LatestID()
+	return page, err
+}
+
+// GetReadings returns up to limit readings with an id after afterID, oldest first, with times in loc
+func (m *SLMeter) GetReadings(afterID int64, limit int, loc *time.Location) ([]Reading, error) {
+	records, err := m.Store.ReadingsAfter(afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return newReadings(records, loc), nil
+}
+
+// GetReadingsBetween returns the readings from start to end, oldest first, with times in loc
+func (m *SLMeter) GetReadingsBetween(start time.Time, end time.Time, loc *time.Location) ([]Reading, error) {
+	records, err := m.Store.ReadingsBetween(start, end)
+	if err != nil {
+		return nil, err
+	}
+	return newReadings(records, loc), nil
+}
+
+func newReadings(records []storage.Record, loc *time.Location) []Reading {
+	readings := make([]Reading, 0, len(records))
+	for _, record := range records {
+		reading := Reading{
+			ID:             record.ID,
+			JobID:          record.JobID,
+			Lux:            record.Lux,
+			FullSpectrum:   record.FullSpectrum,
+			Visible:        record.Visible,
+			Infrared:       record.Infrared,
+			CreatedAt:      tools.FormatTime(record.CreatedAt, loc),
+			SolarElevation: record.SolarElevation,
+			Samples:        record.Samples,
+			LuxMin:         record.LuxMin,
+			LuxMax:         record.LuxMax,
+			LuxStdDev:      record.LuxStdDev,
+			LuxFiltered:    record.LuxFiltered,
+		}
+		if record.Quality != 0 {
+			reading.QualityFlags = record.Quality.Names()
+		}
+		readings = append(readings, reading)
+	}
+	return readings
+}
+
 // GetSensorStatus returns the connection and enabled status of the sensor
 func (m *SLMeter) GetSensorStatus() (Status, error) {
-	status := Status{}
-	if m.TSL2591 == nil {
-		status.Connected = false
-		return status, nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := Status{
+		Connected: m.sensor != nil,
+		Enabled:   m.jobID != "",
+		JobID:     m.jobID,
+		Events:    append([]ConnectionEvent(nil), m.events...),
+	}
+	if until := m.pausedUntil.Load(); until != 0 {
+		pausedUntil := time.UnixMilli(until).In(m.Timezone)
+		status.PausedUntil = &pausedUntil
+	}
+	if m.jobID != "" {
+		options := m.options
+		status.Options = &options
 	}
-
-	status.Connected = true
-	status.Enabled = m.Enabled
 	return status, nil
 }
 
-// Read from LuxResultsChan, write the results to sqlite
+// Read from LuxResultsChan, and queue the results to be written to sqlite.
+// The queue is on disk, so results survive the database being unavailable, or a restart.
 func (m *SLMeter) MonitorAndRecordResults() {
+	defer close(m.recorded)
 	log.Println("Monitoring for new messages...")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		m.writeQueuedResults(ctx)
+	}()
+
 	for result := range m.LuxResultsChan {
 		log.Printf("- JobID: %s, Lux: %.5f", result.JobID, result.Lux)
-		if math.IsInf(result.Lux, 1) {
+		if math.IsInf(result.Lux, 0) || math.IsNaN(result.Lux) {
 			log.Println("Lux is invalid, skipping record")
 			continue
 		}
-		_, err := m.ResultsDB.Exec(
-			"INSERT INTO sunlight (job_id, lux, full_spectrum, visible, infrared) VALUES (?, ?, ?, ?, ?)",
-			result.JobID,
-			fmt.Sprintf("%.5f", result.Lux),
-			fmt.Sprintf("%.5e", result.FullSpectrum),
-			fmt.Sprintf("%.5e", result.Visible),
-			fmt.Sprintf("%.5e", result.Infrared),
-		)
-		if err != nil {
-			log.Println(err)
+		if err := m.results.Push(result); err != nil {
+			log.Printf("Failed to queue result: %s", err)
+		}
+	}
+
+	// Stop the writer, and make one last attempt at storing what's queued
+	cancel()
+	<-written
+	if err := m.flushQueuedResults(); err != nil {
+		log.Printf("Failed to write queued results, they will be replayed on restart: %s", err)
+	}
+	m.results.Close()
+}
+
+// Write queued results to sqlite, backing off while the database is failing
+func (m *SLMeter) writeQueuedResults(ctx context.Context) {
+	backoff := time.Second
+	for {
+		if err := m.flushQueuedResults(); err != nil {
+			log.Printf("Failed to write results, retrying in %s: %s", backoff, err)
+			if !sleepContext(ctx, backoff) {
+				return
+			}
+			backoff = min(backoff*2, MAX_WRITE_BACKOFF)
+			continue
+		}
+		backoff = time.Second
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.results.Ready():
+		}
+	}
+}
+
+// Write everything in the queue, with a transaction per batch.
+// A batch stored before a crash but not committed is written again on restart, the store skips the readings it already has.
+func (m *SLMeter) flushQueuedResults() error {
+	for {
+		written, err := m.flushBatch()
+		if err != nil || written == 0 {
+			return err
+		}
+	}
+}
+
+// Write the next batch in the queue, returning how many results it had
+func (m *SLMeter) flushBatch() (int, error) {
+	m.writes.Lock()
+	defer m.writes.Unlock()
+	batch := m.results.Peek(WRITE_BATCH_SIZE)
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	if err := m.insertResults(batch); err != nil {
+		m.writeErrors.Add(1)
+		return 0, err
+	}
+	if err := m.results.Commit(len(batch)); err != nil {
+		return 0, err
+	}
+	m.recordedResults.Add(uint64(len(batch)))
+	m.lastWrite.Store(time.Now().Unix())
+	return len(batch), nil
+}
+
+// PauseWrites keeps results in the queue until resume is called, so a restore can replace the database.
+// Recording carries on, and what was queued is written once it resumes.
+func (m *SLMeter) PauseWrites() (resume func()) {
+	m.writes.Lock()
+	return m.writes.Unlock
+}
+
+func (m *SLMeter) insertResults(results []LuxResults) error {
+	records := make([]storage.Record, 0, len(results))
+	for _, result := range results {
+		record := storage.Record{
+			JobID:        result.JobID,
+			Lux:          result.Lux,
+			FullSpectrum: result.FullSpectrum,
+			Visible:      result.Visible,
+			Infrared:     result.Infrared,
+			CreatedAt:    result.Time.UnixMilli(),
+			Quality:      result.Quality,
+			Samples:      result.Samples,
+			LuxFiltered:  result.Filtered,
+		}
+		if m.Site != nil {
+			elevation := m.Site.Position(result.Time).Elevation
+			record.SolarElevation = &elevation
+		}
+		// A failed read has no samples, results queued before sampling was added had one
+		if record.Samples == 0 && result.Quality&quality.FLAG_READ_FAILED == 0 {
+			record.Samples = 1
+		}
+		if result.Stats != nil {
+			record.LuxMin, record.LuxMax, record.LuxStdDev = &result.Stats.Min, &result.Stats.Max, &result.Stats.StdDev
 		}
+		records = append(records, record)
 	}
+	return m.Store.InsertReadings(records)
 }
@@ -3,13 +3,22 @@ package gnome
 import (
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/ztkent/gnome/internal/device"
+	"github.com/ztkent/gnome/internal/network"
+	"github.com/ztkent/gnome/internal/storage"
 	"github.com/ztkent/gnome/internal/tools"
+	"github.com/ztkent/gnome/internal/upload"
 )
 
 //go:embed html/*
@@ -20,9 +29,19 @@ func (m *SLMeter) GetTemplateFiles() embed.FS {
 	return templateFiles
 }
 
+// Options for a new job, the request body may be empty
+type StartRequest struct {
+	JobOptions
+}
+
 func (m *SLMeter) Start() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if err := m.StartSensor(); err != nil {
+		var request StartRequest
+		if status, err := tools.DecodeJSONBody(w, r, &request); err != nil {
+			ServeResponse(w, r, err.Error(), status)
+			return
+		}
+		if err := m.StartSensor(request.JobOptions); err != nil {
 			ServeResponse(w, r, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -32,6 +51,11 @@ func (m *SLMeter) Start() http.HandlerFunc {
 
 func (m *SLMeter) Stop() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		var request struct{}
+		if status, err := tools.DecodeJSONBody(w, r, &request); err != nil {
+			ServeResponse(w, r, err.Error(), status)
+			return
+		}
 		if err := m.StopSensor(); err != nil {
 			ServeResponse(w, r, err.Error(), http.StatusBadRequest)
 			return
@@ -43,10 +67,10 @@ func (m *SLMeter) Stop() http.HandlerFunc {
 // Serve data about the most recent entry saved to the db
 func (m *SLMeter) CurrentConditions() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if m.TSL2591 == nil {
+		if m.Sensor() == nil {
 			ServeResponse(w, r, "The sensor is not connected", http.StatusBadRequest)
 			return
-		} else if !m.Enabled {
+		} else if !m.IsRecording() {
 			ServeResponse(w, r, "The sensor is not enabled", http.StatusBadRequest)
 			return
 		}
@@ -65,7 +89,7 @@ func (m *SLMeter) CurrentConditions() http.HandlerFunc {
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		// v1 clients parse the conditions out of the message, /api/v2/current-conditions serves them as JSON
 		ServeResponse(w, r, string(conditionsData), http.StatusOK)
 	}
 }
@@ -84,21 +108,48 @@ func (m *SLMeter) SignalStrength() http.HandlerFunc {
 	}
 }
 
+// Serve the network interfaces, and the recent signal history
+func (m *SLMeter) NetworkInfo() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		interfaces, err := network.Interfaces()
+		if err != nil {
+			log.Println(err)
+			ServeResponse(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(map[string]interface{}{
+			"interfaces":     interfaces,
+			"signal_history": m.Network.History(),
+		})
+		if err != nil {
+			log.Printf("Error encoding response: %v", err)
+		}
+	}
+}
+
 type ServiceResponse struct {
-	ServiceName    string            `json:"service_name"`
-	OutboundIP     string            `json:"outbound_ip"`
-	MACAddresses   []string          `json:"mac_addresses"`
-	SignalStrength SignalStrength    `json:"signal_strength"`
-	Conditions     Conditions        `json:"conditions"`
-	Status         Status            `json:"status"`
-	Errors         map[string]string `json:"errors,omitempty"`
+	ServiceName    string         `json:"service_name"`
+	Device         device.Info    `json:"device"`
+	OutboundIP     string         `json:"outbound_ip"`
+	MACAddresses   []string       `json:"mac_addresses"`
+	SignalStrength SignalStrength `json:"signal_strength"`
+	// Left out of /id when requests need credentials, it stays open for discovery
+	Conditions *Conditions       `json:"conditions,omitempty"`
+	Status     Status            `json:"status"`
+	Upload     *upload.Status    `json:"upload,omitempty"`
+	Quality    *DataQuality      `json:"quality,omitempty"`
+	Errors     map[string]string `json:"errors,omitempty"`
 }
 
 func (m *SLMeter) ID() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		response := ServiceResponse{
 			ServiceName: "Gnome",
-			OutboundIP:  tools.GetOutboundIP().String(),
+			Device:      m.Device.Info(),
+			OutboundIP:  network.PrimaryIP().String(),
 			Errors:      make(map[string]string),
 		}
 
@@ -118,22 +169,29 @@ func (m *SLMeter) ID() http.HandlerFunc {
 			response.SignalStrength = signalStrength
 		}
 
-		conditions, err := m.GetCurrentConditions()
-		if err != nil {
-			response.Errors["conditions"] = err.Error()
-			response.Conditions = Conditions{}
-		} else {
-			response.Conditions = Conditions{
-				JobID:                 conditions.JobID,
-				Lux:                   sanitizeFloat64(conditions.Lux),
-				FullSpectrum:          sanitizeFloat64(conditions.FullSpectrum),
-				Visible:               sanitizeFloat64(conditions.Visible),
-				Infrared:              sanitizeFloat64(conditions.Infrared),
-				DateRange:             conditions.DateRange,
-				RecordedHoursInRange:  sanitizeFloat64(conditions.RecordedHoursInRange),
-				FullSunlightInRange:   sanitizeFloat64(conditions.FullSunlightInRange),
-				LightConditionInRange: conditions.LightConditionInRange,
-				AverageLuxInRange:     sanitizeFloat64(conditions.AverageLuxInRange),
+		if !m.AuthEnabled {
+			conditions, err := m.GetCurrentConditions()
+			if err != nil {
+				response.Errors["conditions"] = err.Error()
+				response.Conditions = &Conditions{}
+			} else {
+				response.Conditions = &Conditions{
+					JobID:                 conditions.JobID,
+					Lux:                   sanitizeFloat64(conditions.Lux),
+					FullSpectrum:          sanitizeFloat64(conditions.FullSpectrum),
+					Visible:               sanitizeFloat64(conditions.Visible),
+					Infrared:              sanitizeFloat64(conditions.Infrared),
+					DateRange:             conditions.DateRange,
+					RecordedHoursInRange:  sanitizeFloat64(conditions.RecordedHoursInRange),
+					FullSunlightInRange:   sanitizeFloat64(conditions.FullSunlightInRange),
+					LightConditionInRange: conditions.LightConditionInRange,
+					AverageLuxInRange:     sanitizeFloat64(conditions.AverageLuxInRange),
+					LuxStdDev:             conditions.LuxStdDev,
+					LuxFiltered:           conditions.LuxFiltered,
+					SolarElevation:        conditions.SolarElevation,
+					ClearSkyLux:           sanitizeFloat64(conditions.ClearSkyLux),
+					PercentOfPossible:     sanitizeFloat64(conditions.PercentOfPossible),
+				}
 			}
 		}
 
@@ -160,53 +218,143 @@ func sanitizeFloat64(value float64) float64 {
 	return value
 }
 
-// Serve the sqlite db for download
+// Serve readings after an id, e.g. /api/v1/readings?after_id=1200&limit=500&tz=America/Denver.
+// Ids only increase, so a client can resume from the last id it stored.
+// A page's ETag changes when new readings would be added to it, so polling with If-None-Match is cheap.
+func (m *SLMeter) Readings() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		afterID, limit, _, err := parsePageRequest(r)
+		if err != nil {
+			ServeResponse(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		loc, err := tools.RequestLocation(r, m.Timezone)
+		if err != nil {
+			ServeResponse(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		page, err := m.GetReadingsPage(afterID, limit, loc)
+		if err != nil {
+			log.Println(err)
+			ServeResponse(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if notModified := setPageHeaders(w, r, "/api/v1/readings", page, afterID, limit, loc); notModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(page); err != nil {
+			log.Printf("Error encoding response: %v", err)
+		}
+	}
+}
+
+// Get ?after_id=&limit= from the request, with the name of the parameter that's invalid
+func parsePageRequest(r *http.Request) (int64, int, string, error) {
+	afterID, limit := int64(0), READINGS_PAGE_SIZE
+	var err error
+	if value := r.URL.Query().Get("after_id"); value != "" {
+		afterID, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || afterID < 0 {
+			return 0, 0, "after_id", errors.New("after_id must be a non-negative integer")
+		}
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > MAX_READINGS_PAGE_SIZE {
+			return 0, 0, "limit", fmt.Errorf("limit must be between 1 and %d", MAX_READINGS_PAGE_SIZE)
+		}
+	}
+	return afterID, limit, "", nil
+}
+
+// Set the page's ETag, and a Link to the next page on path. Returns whether the client already has the page.
+func setPageHeaders(w http.ResponseWriter, r *http.Request, path string, page ReadingsPage, afterID int64, limit int, loc *time.Location) bool {
+	// Stored readings don't change, so the page is identified by where it starts and ends
+	etag := fmt.Sprintf(`"%s-%d-%d-%d-%t-%s"`, page.DeviceID, afterID, limit, page.NextAfterID, page.HasMore, loc)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if page.HasMore {
+		next := url.Values{"after_id": {strconv.FormatInt(page.NextAfterID, 10)}, "limit": {strconv.Itoa(limit)}}
+		if tz := r.URL.Query().Get("tz"); tz != "" {
+			next.Set("tz", tz)
+		}
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, path, next.Encode()))
+	}
+	return etagMatches(r.Header.Get("If-None-Match"), etag)
+}
+
+// Check an If-None-Match header, which can list several tags, or be *
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve the sqlite db for download, without the users and API tokens
 func (m *SLMeter) ServeResultsDB() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		snapshotter, ok := m.Store.(storage.Snapshotter)
+		if !ok {
+			http.Error(w, "The database export needs GNOME_STORAGE=sqlite, use /api/v1/csv instead", http.StatusNotImplemented)
+			return
+		}
+		snapshot, err := snapshotter.Snapshot()
+		if err != nil {
+			log.Printf("Failed to snapshot the database: %v", err)
+			http.Error(w, "Failed to export the database", http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(snapshot)
 		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", "gnome.db"))
 		w.Header().Set("Content-Type", "application/octet-stream")
-		http.ServeFile(w, r, GNOME_DB_PATH)
+		http.ServeFile(w, r, snapshot)
 	}
 }
 
 func (m *SLMeter) ServeResultsCSV() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := tools.ExportToCSV(GNOME_DB_PATH, GNOME_CSV_PATH)
+		info := m.Device.Info()
+		loc, err := tools.RequestLocation(r, m.Timezone)
 		if err != nil {
-			http.Error(w, "Failed to export CSV", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		// Streamed, so a failure part way can only be logged
 		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", "gnome.csv"))
 		w.Header().Set("Content-Type", "text/csv")
-		http.ServeFile(w, r, GNOME_CSV_PATH)
+		if err := storage.ExportCSV(m.Store, w, info.ID, info.Name, loc); err != nil {
+			log.Printf("Failed to export CSV: %v", err)
+		}
 	}
 }
 
+// Serve readings over ?start=&end=, the last 8 hours by default, with times in the device's timezone or ?tz=
 func (m *SLMeter) ServeResultsJSON() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		r.ParseForm()
-		startDate := time.Now().UTC().Add(-8 * time.Hour)
-		endDate := time.Now().UTC()
-
-		startDateStr := r.FormValue("start")
-		endDateStr := r.FormValue("end")
-		if startDateStr != "" && endDateStr != "" {
-			var err error
-			startDate, err = time.Parse(time.RFC3339, startDateStr)
-			if err != nil {
-				http.Error(w, "Invalid start date", http.StatusBadRequest)
-				return
-			}
-			endDate, err = time.Parse(time.RFC3339, endDateStr)
-			if err != nil {
-				http.Error(w, "Invalid end date", http.StatusBadRequest)
-				return
-			}
+		loc, err := tools.RequestLocation(r, m.Timezone)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		startDate, endDate, err := tools.ParseStartAndEndDate(r, loc, 8*time.Hour)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		data, err := tools.ExportToJSON(GNOME_DB_PATH, startDate, endDate)
+		data, err := storage.ExportJSON(m.Store, startDate, endDate, m.Device.Info().ID, loc)
 		if err != nil {
-			http.Error(w, "Failed to export CSV", http.StatusInternalServerError)
+			http.Error(w, "Failed to export JSON", http.StatusInternalServerError)
 			return
 		}
 
@@ -216,6 +364,54 @@ func (m *SLMeter) ServeResultsJSON() http.HandlerFunc {
 	}
 }
 
+// Serve metrics in the Prometheus text format
+func (m *SLMeter) Metrics() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := m.results.Stats()
+		status, _ := m.GetSensorStatus()
+		labels := metricLabels(m.Device.Info())
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetric(w, labels, "gnome_sensor_connected", "gauge", "Whether the TSL2591 is attached.", boolToFloat(status.Connected))
+		writeMetric(w, labels, "gnome_sensor_recording", "gauge", "Whether a job is running.", boolToFloat(status.Enabled))
+		writeMetric(w, labels, "gnome_queue_depth", "gauge", "Results waiting to be written to the database.", float64(stats.Depth))
+		writeMetric(w, labels, "gnome_queue_capacity", "gauge", "Results the queue can hold before dropping the oldest.", float64(stats.Capacity))
+		writeMetric(w, labels, "gnome_queue_pushed_total", "counter", "Results added to the queue.", float64(stats.Pushed))
+		writeMetric(w, labels, "gnome_queue_dropped_total", "counter", "Results dropped because the queue was full.", float64(stats.Dropped))
+		writeMetric(w, labels, "gnome_results_recorded_total", "counter", "Results written to the database.", float64(m.recordedResults.Load()))
+		writeMetric(w, labels, "gnome_results_write_errors_total", "counter", "Failed attempts to write results to the database.", float64(m.writeErrors.Load()))
+		writeMetric(w, labels, "gnome_results_last_write_timestamp_seconds", "gauge", "When results were last written to the database.", float64(m.lastWrite.Load()))
+		if dataQuality, err := m.GetDataQuality(); err == nil && dataQuality != nil {
+			writeMetric(w, labels, "gnome_quality_score", "gauge", "Percent of the last hour's readings without quality flags.", dataQuality.Score)
+		}
+		if m.Uploads != nil {
+			if uploads, err := m.Uploads.Status(r.Context()); err == nil {
+				writeMetric(w, labels, "gnome_upload_pending", "gauge", "Readings the collector hasn't accepted yet.", float64(uploads.Pending))
+				writeMetric(w, labels, "gnome_upload_lag_seconds", "gauge", "How long the oldest pending reading has waited.", uploads.LagSeconds)
+				writeMetric(w, labels, "gnome_upload_failures", "gauge", "Failed uploads in a row.", float64(uploads.Failures))
+			}
+		}
+	}
+}
+
+func writeMetric(w http.ResponseWriter, labels string, name string, kind string, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s{%s} %g\n", name, help, name, kind, name, labels, value)
+}
+
+// Label every metric with the device, so a shared Prometheus can tell them apart
+func metricLabels(info device.Info) string {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return fmt.Sprintf(`device_id="%s",device_name="%s",location="%s"`,
+		escape.Replace(info.ID), escape.Replace(info.Name), escape.Replace(info.Location))
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
 // Populate the response div with a message, or reply with a JSON message
 func ServeResponse(w http.ResponseWriter, r *http.Request, message string, status int) {
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,427 @@
+package gnome
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ztkent/gnome/internal/api"
+	"github.com/ztkent/gnome/internal/device"
+	"github.com/ztkent/gnome/internal/network"
+	"github.com/ztkent/gnome/internal/storage"
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+// The /api/v2 bodies. Fields are snake_case, and errors are an api.ErrorResponse.
+// internal/api/openapi.json describes them, keep it in step. The router tests in main_test.go check its paths.
+
+type StatusV2 struct {
+	Connected bool        `json:"connected"`
+	Recording bool        `json:"recording"`
+	JobID     string      `json:"job_id,omitempty"`
+	Options   *JobOptions `json:"options,omitempty"`
+	// When a daylight only job will start recording again
+	PausedUntil *time.Time        `json:"paused_until,omitempty"`
+	Events      []ConnectionEvent `json:"events"`
+}
+
+type ConditionsV2 struct {
+	JobID        string   `json:"job_id"`
+	Lux          float64  `json:"lux"`
+	FullSpectrum float64  `json:"full_spectrum"`
+	Visible      float64  `json:"visible"`
+	Infrared     float64  `json:"infrared"`
+	LuxStdDev    *float64 `json:"lux_stddev,omitempty"`
+	LuxFiltered  *float64 `json:"lux_filtered,omitempty"`
+	// When the device knows where it is
+	SolarElevation    *float64 `json:"solar_elevation,omitempty"`
+	ClearSkyLux       *float64 `json:"clear_sky_lux,omitempty"`
+	PercentOfPossible *float64 `json:"percent_of_possible,omitempty"`
+	// The job so far
+	Job JobSummaryV2 `json:"job"`
+}
+
+type JobSummaryV2 struct {
+	DateRange       string  `json:"date_range"`
+	RecordedHours   float64 `json:"recorded_hours"`
+	AverageSunHours float64 `json:"average_sun_hours"`
+	AverageLux      float64 `json:"average_lux"`
+	Classification  string  `json:"classification,omitempty"`
+}
+
+type SignalStrengthV2 struct {
+	Interface    string  `json:"interface"`
+	SSID         string  `json:"ssid,omitempty"`
+	SignalDBM    int     `json:"signal_dbm"`
+	Percent      int     `json:"percent"`
+	LinkQuality  int     `json:"link_quality"`
+	BitrateMbps  float64 `json:"bitrate_mbps,omitempty"`
+	FrequencyMHz int     `json:"frequency_mhz,omitempty"`
+}
+
+type NetworkV2 struct {
+	Interfaces    []network.Interface    `json:"interfaces"`
+	SignalHistory []network.SignalSample `json:"signal_history"`
+}
+
+type ReadingsRangeV2 struct {
+	DeviceID string    `json:"device_id"`
+	Start    string    `json:"start"`
+	End      string    `json:"end"`
+	Readings []Reading `json:"readings"`
+}
+
+type DailySummariesV2 struct {
+	// Empty when it's the system's timezone, and it has no name
+	Timezone string         `json:"timezone"`
+	Days     []DailySummary `json:"days"`
+}
+
+// V2 serves the meter's /api/v2 routes
+type V2 struct {
+	m *SLMeter
+}
+
+func (m *SLMeter) V2() V2 {
+	return V2{m: m}
+}
+
+func (v V2) status() StatusV2 {
+	status, _ := v.m.GetSensorStatus()
+	events := status.Events
+	if events == nil {
+		events = []ConnectionEvent{}
+	}
+	return StatusV2{
+		Connected:   status.Connected,
+		Recording:   status.Enabled,
+		JobID:       status.JobID,
+		Options:     status.Options,
+		PausedUntil: status.PausedUntil,
+		Events:      events,
+	}
+}
+
+func (v V2) Status() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		api.ServeJSON(w, v.status(), http.StatusOK)
+	}
+}
+
+// Start a job with the options in the body, which may be empty
+func (v V2) Start() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var options JobOptions
+		if status, err := tools.DecodeJSONBody(w, r, &options); err != nil {
+			api.ServeError(w, status, api.CodeForStatus(status), err.Error(), nil)
+			return
+		}
+		if err := v.m.StartSensor(options); err != nil {
+			serveSensorError(w, err)
+			return
+		}
+		api.ServeJSON(w, v.status(), http.StatusOK)
+	}
+}
+
+func (v V2) Stop() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request struct{}
+		if status, err := tools.DecodeJSONBody(w, r, &request); err != nil {
+			api.ServeError(w, status, api.CodeForStatus(status), err.Error(), nil)
+			return
+		}
+		if err := v.m.StopSensor(); err != nil {
+			serveSensorError(w, err)
+			return
+		}
+		api.ServeJSON(w, v.status(), http.StatusOK)
+	}
+}
+
+// The sensor's state errors are conflicts, anything else from starting a job is a bad option
+func serveSensorError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrSensorNotConnected):
+		api.ServeError(w, http.StatusConflict, api.CODE_SENSOR_NOT_CONNECTED, err.Error(), nil)
+	case errors.Is(err, ErrAlreadyRecording):
+		api.ServeError(w, http.StatusConflict, api.CODE_ALREADY_RECORDING, err.Error(), nil)
+	case errors.Is(err, ErrNotRecording):
+		api.ServeError(w, http.StatusConflict, api.CODE_NOT_RECORDING, err.Error(), nil)
+	default:
+		api.ServeError(w, http.StatusBadRequest, api.CODE_INVALID_PARAMETER, err.Error(), nil)
+	}
+}
+
+// The latest reading of the job that's recording
+func (v V2) CurrentConditions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if v.m.Sensor() == nil {
+			serveSensorError(w, ErrSensorNotConnected)
+			return
+		} else if !v.m.IsRecording() {
+			api.ServeError(w, http.StatusConflict, api.CODE_NOT_RECORDING, "the sensor is not recording", nil)
+			return
+		}
+
+		conditions, err := v.m.GetCurrentConditions()
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, ErrNoReadings) {
+			api.ServeError(w, http.StatusNotFound, api.CODE_NO_READINGS, "the job hasn't recorded a reading yet", nil)
+			return
+		} else if err != nil {
+			log.Println(err)
+			api.ServeError(w, http.StatusInternalServerError, api.CODE_INTERNAL, err.Error(), nil)
+			return
+		}
+
+		response := ConditionsV2{
+			JobID:          conditions.JobID,
+			Lux:            conditions.Lux,
+			FullSpectrum:   conditions.FullSpectrum,
+			Visible:        conditions.Visible,
+			Infrared:       conditions.Infrared,
+			LuxStdDev:      conditions.LuxStdDev,
+			LuxFiltered:    conditions.LuxFiltered,
+			SolarElevation: conditions.SolarElevation,
+			Job: JobSummaryV2{
+				DateRange:       conditions.DateRange,
+				RecordedHours:   sanitizeFloat64(conditions.RecordedHoursInRange),
+				AverageSunHours: sanitizeFloat64(conditions.FullSunlightInRange),
+				AverageLux:      sanitizeFloat64(conditions.AverageLuxInRange),
+				Classification:  conditions.LightConditionInRange,
+			},
+		}
+		if v.m.Site != nil {
+			clearSkyLux, percent := sanitizeFloat64(conditions.ClearSkyLux), sanitizeFloat64(conditions.PercentOfPossible)
+			response.ClearSkyLux, response.PercentOfPossible = &clearSkyLux, &percent
+		}
+		api.ServeJSON(w, response, http.StatusOK)
+	}
+}
+
+func (v V2) SignalStrength() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		signal, err := v.m.GetSignalStrength()
+		if err != nil {
+			api.ServeError(w, http.StatusNotFound, api.CODE_NOT_FOUND, err.Error(), nil)
+			return
+		}
+		api.ServeJSON(w, SignalStrengthV2{
+			Interface:    signal.Interface,
+			SSID:         signal.SSID,
+			SignalDBM:    signal.SignalInt,
+			Percent:      signal.Strength,
+			LinkQuality:  signal.LinkQuality,
+			BitrateMbps:  signal.BitrateMbps,
+			FrequencyMHz: signal.FrequencyMHz,
+		}, http.StatusOK)
+	}
+}
+
+func (v V2) Network() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		interfaces, err := network.Interfaces()
+		if err != nil {
+			log.Println(err)
+			api.ServeError(w, http.StatusInternalServerError, api.CODE_INTERNAL, err.Error(), nil)
+			return
+		}
+		history := v.m.Network.History()
+		if history == nil {
+			history = []network.SignalSample{}
+		}
+		api.ServeJSON(w, NetworkV2{Interfaces: interfaces, SignalHistory: history}, http.StatusOK)
+	}
+}
+
+// Page through readings by id, like /api/v1/readings
+func (v V2) Readings() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		afterID, limit, parameter, err := parsePageRequest(r)
+		if err != nil {
+			api.ServeInvalidParameter(w, parameter, err.Error())
+			return
+		}
+		loc, err := tools.RequestLocation(r, v.m.Timezone)
+		if err != nil {
+			api.ServeInvalidParameter(w, "tz", err.Error())
+			return
+		}
+
+		page, err := v.m.GetReadingsPage(afterID, limit, loc)
+		if err != nil {
+			log.Println(err)
+			api.ServeError(w, http.StatusInternalServerError, api.CODE_INTERNAL, err.Error(), nil)
+			return
+		}
+		if notModified := setPageHeaders(w, r, api.V2_PREFIX+"/readings", page, afterID, limit, loc); notModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		api.ServeJSON(w, page, http.StatusOK)
+	}
+}
+
+// Readings over ?start=&end=, the last 8 hours by default
+func (v V2) ReadingsRange() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		loc, err := tools.RequestLocation(r, v.m.Timezone)
+		if err != nil {
+			api.ServeInvalidParameter(w, "tz", err.Error())
+			return
+		}
+		start, end, err := tools.ParseStartAndEndDate(r, loc, 8*time.Hour)
+		if err != nil {
+			serveRangeError(w, err)
+			return
+		}
+
+		readings, err := v.m.GetReadingsBetween(start, end, loc)
+		if err != nil {
+			log.Println(err)
+			api.ServeError(w, http.StatusInternalServerError, api.CODE_INTERNAL, err.Error(), nil)
+			return
+		}
+		api.ServeJSON(w, ReadingsRangeV2{
+			DeviceID: v.m.Device.Info().ID,
+			Start:    tools.FormatTime(start.UnixMilli(), loc),
+			End:      tools.FormatTime(end.UnixMilli(), loc),
+			Readings: readings,
+		}, http.StatusOK)
+	}
+}
+
+// ?start= and ?end= are checked together, so either can be the one that's wrong
+func serveRangeError(w http.ResponseWriter, err error) {
+	api.ServeError(w, http.StatusBadRequest, api.CODE_INVALID_PARAMETER, err.Error(), map[string]interface{}{"parameters": []string{"start", "end"}})
+}
+
+func (v V2) DailySummaries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := tools.RequestLocation(r, v.m.Timezone); err != nil {
+			api.ServeInvalidParameter(w, "tz", err.Error())
+			return
+		}
+		start, end, loc, err := v.m.parseDailyRequest(r)
+		if err != nil {
+			serveRangeError(w, err)
+			return
+		}
+		summaries, err := v.m.GetDailySummaries(start, end, loc)
+		if err != nil {
+			log.Println(err)
+			api.ServeError(w, http.StatusInternalServerError, api.CODE_INTERNAL, err.Error(), nil)
+			return
+		}
+		api.ServeJSON(w, DailySummariesV2{Timezone: timezoneName(loc), Days: summaries}, http.StatusOK)
+	}
+}
+
+func (v V2) SunReport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, status, err := v.m.parseReportRequest(r)
+		switch status {
+		case http.StatusOK:
+			api.ServeJSON(w, report, http.StatusOK)
+		case http.StatusBadRequest:
+			api.ServeError(w, status, api.CODE_INVALID_PARAMETER, err.Error(), nil)
+		case http.StatusNotFound:
+			api.ServeError(w, status, api.CODE_NO_READINGS, err.Error(), map[string]interface{}{"job_id": r.URL.Query().Get("job_id")})
+		default:
+			api.ServeError(w, status, api.CODE_INTERNAL, err.Error(), nil)
+		}
+	}
+}
+
+// The sun for ?date=, 404 when the device doesn't know where it is
+func (v V2) Solar() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if v.m.Site == nil {
+			api.ServeError(w, http.StatusNotFound, api.CODE_NOT_FOUND, "GNOME_LATITUDE and GNOME_LONGITUDE aren't set", nil)
+			return
+		}
+		loc, err := tools.RequestLocation(r, v.m.Timezone)
+		if err != nil {
+			api.ServeInvalidParameter(w, "tz", err.Error())
+			return
+		}
+		date := time.Now()
+		if value := r.URL.Query().Get("date"); value != "" {
+			if date, err = time.ParseInLocation(time.DateOnly, value, loc); err != nil {
+				api.ServeInvalidParameter(w, "date", "date must be formatted like 2006-01-02")
+				return
+			}
+		}
+		api.ServeJSON(w, v.m.GetSolar(date, loc), http.StatusOK)
+	}
+}
+
+func (v V2) Device() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		api.ServeJSON(w, v.m.Device.Info(), http.StatusOK)
+	}
+}
+
+// Update the name, location or notes, e.g. {"name": "Tomato Bed"}
+func (v V2) PatchDevice() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var patch device.Patch
+		if status, err := tools.DecodeJSONBody(w, r, &patch); err != nil {
+			api.ServeError(w, status, api.CodeForStatus(status), err.Error(), nil)
+			return
+		}
+		if err := patch.Validate(); err != nil {
+			api.ServeError(w, http.StatusBadRequest, api.CODE_INVALID_PARAMETER, err.Error(), nil)
+			return
+		}
+		info, err := v.m.Device.Update(patch)
+		if err != nil {
+			log.Println(err)
+			api.ServeError(w, http.StatusInternalServerError, api.CODE_INTERNAL, err.Error(), nil)
+			return
+		}
+		api.ServeJSON(w, info, http.StatusOK)
+	}
+}
+
+// Every reading as CSV. Errors after the download has started can only be logged.
+func (v V2) ExportCSV() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		loc, err := tools.RequestLocation(r, v.m.Timezone)
+		if err != nil {
+			api.ServeInvalidParameter(w, "tz", err.Error())
+			return
+		}
+		info := v.m.Device.Info()
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", "gnome.csv"))
+		w.Header().Set("Content-Type", "text/csv")
+		if err := storage.ExportCSV(v.m.Store, w, info.ID, info.Name, loc); err != nil {
+			log.Printf("Failed to export CSV: %v", err)
+		}
+	}
+}
+
+// A copy of the SQLite database
+func (v V2) ExportDB() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snapshotter, ok := v.m.Store.(storage.Snapshotter)
+		if !ok {
+			api.ServeError(w, http.StatusNotImplemented, api.CODE_NOT_IMPLEMENTED, "the database export needs GNOME_STORAGE=sqlite", nil)
+			return
+		}
+		snapshot, err := snapshotter.Snapshot()
+		if err != nil {
+			log.Printf("Failed to snapshot the database: %v", err)
+			api.ServeError(w, http.StatusInternalServerError, api.CODE_INTERNAL, "failed to export the database", nil)
+			return
+		}
+		defer os.Remove(snapshot)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", "gnome.db"))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeFile(w, r, snapshot)
+	}
+}
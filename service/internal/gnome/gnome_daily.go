@@ -0,0 +1,139 @@
+package gnome
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+const (
+	// Sunlight's photosynthetic photon flux density per lux, in µmol/m²/s
+	SUNLIGHT_PPFD_PER_LUX = 0.0185
+	// Days summarized when the request doesn't give a range
+	DAILY_SUMMARY_DAYS     = 7
+	MAX_DAILY_SUMMARY_DAYS = 366
+)
+
+// Totals for one local day, from midnight to midnight in the requested timezone
+type DailySummary struct {
+	Date          string  `json:"date"`
+	Start         string  `json:"start"`
+	End           string  `json:"end"`
+	Readings      int     `json:"readings"`
+	RecordedHours float64 `json:"recorded_hours"`
+	AverageLux    float64 `json:"average_lux"`
+	MaxLux        float64 `json:"max_lux"`
+	// Daily light integral in mol/m²/day, treating each reading as a RECORD_INTERVAL of sunlight
+	DLI float64 `json:"dli"`
+	// What a clear sky would have given over the same readings, when the device knows where it is
+	ClearSkyDLI       float64 `json:"clear_sky_dli,omitempty"`
+	PercentOfPossible float64 `json:"percent_of_possible,omitempty"`
+}
+
+// GetDailySummaries returns a summary for every day in loc from start's day to end's, including days without readings
+func (m *SLMeter) GetDailySummaries(start time.Time, end time.Time, loc *time.Location) ([]DailySummary, error) {
+	var summaries []DailySummary
+	for day := tools.StartOfDay(start, loc); day.Before(end); day = day.AddDate(0, 0, 1) {
+		next := day.AddDate(0, 0, 1)
+		summaries = append(summaries, DailySummary{
+			Date:  day.Format(time.DateOnly),
+			Start: day.Format(tools.TIME_FORMAT),
+			End:   next.Format(tools.TIME_FORMAT),
+		})
+	}
+	if len(summaries) == 0 {
+		return []DailySummary{}, nil
+	}
+	// Days are bucketed here rather than in sqlite, which doesn't know the timezone's DST rules
+	first, err := time.ParseInLocation(time.DateOnly, summaries[0].Date, loc)
+	if err != nil {
+		return nil, err
+	}
+	last := first.AddDate(0, 0, len(summaries))
+	// Readings with a wrong value, like a failed read, would drag the totals down
+	points, err := m.Store.ValidLux(first, last, "")
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]int, len(summaries))
+	for i, summary := range summaries {
+		index[summary.Date] = i
+	}
+	for _, point := range points {
+		at := time.UnixMilli(point.CreatedAt)
+		i, ok := index[at.In(loc).Format(time.DateOnly)]
+		if !ok {
+			continue
+		}
+		summary := &summaries[i]
+		summary.Readings++
+		summary.AverageLux += point.Lux
+		summary.MaxLux = max(summary.MaxLux, point.Lux)
+		summary.DLI += luxToDLI(point.Lux)
+		if m.Site != nil {
+			summary.ClearSkyDLI += luxToDLI(m.Site.ClearSkyLux(at))
+		}
+	}
+
+	for i := range summaries {
+		summary := &summaries[i]
+		if summary.Readings > 0 {
+			summary.AverageLux /= float64(summary.Readings)
+		}
+		summary.RecordedHours = float64(summary.Readings) * RECORD_INTERVAL.Hours()
+		summary.PercentOfPossible = percentOf(summary.DLI, summary.ClearSkyDLI)
+	}
+	return summaries, nil
+}
+
+// The mol/m² of sunlight a reading adds to the day
+func luxToDLI(lux float64) float64 {
+	return lux * SUNLIGHT_PPFD_PER_LUX * RECORD_INTERVAL.Seconds() / 1e6
+}
+
+// Serve daily totals and DLI over ?start=&end=, the last week by default, with days in the device's timezone or ?tz=
+func (m *SLMeter) DailySummaries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start, end, loc, err := m.parseDailyRequest(r)
+		if err != nil {
+			ServeResponse(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		summaries, err := m.GetDailySummaries(start, end, loc)
+		if err != nil {
+			log.Println(err)
+			ServeResponse(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(summaries); err != nil {
+			log.Printf("Error encoding response: %v", err)
+		}
+	}
+}
+
+// The days from ?start=&end= and ?tz=, whole days ending today by default
+func (m *SLMeter) parseDailyRequest(r *http.Request) (time.Time, time.Time, *time.Location, error) {
+	loc, err := tools.RequestLocation(r, m.Timezone)
+	if err != nil {
+		return time.Time{}, time.Time{}, nil, err
+	}
+	start, end, err := tools.ParseStartAndEndDate(r, loc, DAILY_SUMMARY_DAYS*24*time.Hour)
+	if err != nil {
+		return start, end, loc, err
+	} else if end.Sub(start) > MAX_DAILY_SUMMARY_DAYS*24*time.Hour {
+		return start, end, loc, fmt.Errorf("the range can't be longer than %d days", MAX_DAILY_SUMMARY_DAYS)
+	}
+	if r.URL.Query().Get("start") == "" {
+		start = tools.StartOfDay(end, loc).AddDate(0, 0, 1-DAILY_SUMMARY_DAYS)
+	}
+	return start, end, loc, nil
+}
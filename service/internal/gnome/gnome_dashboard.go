@@ -1,10 +1,19 @@
 package gnome
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"os"
+	"strings"
 	"text/template"
+	"time"
 
+	"github.com/ztkent/gnome/internal/auth"
+	"github.com/ztkent/gnome/internal/network"
+	"github.com/ztkent/gnome/internal/solar"
 	"github.com/ztkent/gnome/internal/tools"
 )
 
@@ -18,7 +27,7 @@ func (m *SLMeter) Dashboard() http.HandlerFunc {
 		}
 
 		w.Header().Set("Content-Type", "text/html")
-		err = tmpl.Execute(w, nil)
+		err = tmpl.Execute(w, DashboardData{CSRFToken: auth.CSRFToken(r.Context()), Hub: m.HubDashboard, Timezone: timezoneName(m.Timezone)})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -26,6 +35,26 @@ func (m *SLMeter) Dashboard() http.HandlerFunc {
 	}
 }
 
+type DashboardData struct {
+	// Echoed by dashboard.js on requests that change state
+	CSRFToken string
+	// Show the card comparing the hub's devices
+	Hub bool
+	// The IANA name the dashboard labels times in, empty to use the browser's
+	Timezone string
+}
+
+// time.Local is named Local, which browsers don't know, unless TZ names it
+func timezoneName(loc *time.Location) string {
+	if loc != time.Local {
+		return loc.String()
+	}
+	if name := os.Getenv("TZ"); name != "" {
+		return strings.TrimPrefix(name, ":")
+	}
+	return ""
+}
+
 func (m *SLMeter) DashboardDeviceStatus() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		response := m.getServiceResponse()
@@ -55,7 +84,8 @@ func (m *SLMeter) DashboardCurrentConditions() http.HandlerFunc {
 		}
 
 		// Sanitize values for display
-		sanitizedConditions := Conditions{
+		data := CurrentConditionsData{}
+		data.Conditions = Conditions{
 			JobID:                 conditions.JobID,
 			Lux:                   sanitizeFloat64(conditions.Lux),
 			FullSpectrum:          sanitizeFloat64(conditions.FullSpectrum),
@@ -66,6 +96,26 @@ func (m *SLMeter) DashboardCurrentConditions() http.HandlerFunc {
 			FullSunlightInRange:   sanitizeFloat64(conditions.FullSunlightInRange),
 			LightConditionInRange: conditions.LightConditionInRange,
 			AverageLuxInRange:     sanitizeFloat64(conditions.AverageLuxInRange),
+			LuxStdDev:             conditions.LuxStdDev,
+			LuxFiltered:           conditions.LuxFiltered,
+			SolarElevation:        conditions.SolarElevation,
+			ClearSkyLux:           sanitizeFloat64(conditions.ClearSkyLux),
+			PercentOfPossible:     sanitizeFloat64(conditions.PercentOfPossible),
+		}
+
+		if data.LuxStdDev != nil {
+			data.StdDev = sanitizeFloat64(*data.LuxStdDev)
+		}
+		if data.LuxFiltered != nil {
+			data.Smoothed = sanitizeFloat64(*data.LuxFiltered)
+		}
+		now := time.Now()
+		if today, err := m.GetDailySummaries(now, now, m.Timezone); err == nil && len(today) == 1 {
+			data.Today = &today[0]
+		}
+		if m.Site != nil {
+			sun := m.Site.Day(now, m.Timezone)
+			data.Sun = &sun
 		}
 
 		tmpl, err := parseTemplateFile("html/templates/current-conditions.gohtml")
@@ -75,7 +125,7 @@ func (m *SLMeter) DashboardCurrentConditions() http.HandlerFunc {
 		}
 
 		w.Header().Set("Content-Type", "text/html")
-		err = tmpl.Execute(w, sanitizedConditions)
+		err = tmpl.Execute(w, data)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -83,14 +133,43 @@ func (m *SLMeter) DashboardCurrentConditions() http.HandlerFunc {
 	}
 }
 
+type CurrentConditionsData struct {
+	Conditions
+	// Totals since midnight in the device's timezone
+	Today *DailySummary
+	// Today's sunrise and sunset, when the device knows where it is
+	Sun *solar.Day
+	// LuxStdDev and LuxFiltered's values, templates can't dereference them
+	StdDev   float64
+	Smoothed float64
+}
+
+type SignalStrengthData struct {
+	SignalStrength
+	// Set when there's no wireless link, but a wired one is up
+	Wired *network.Interface
+	// SVG polyline points for the history sparkline, and its range
+	HistoryPoints string
+	HistoryMin    int
+	HistoryMax    int
+	HistoryHours  float64
+}
+
 func (m *SLMeter) DashboardSignalStrength() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		data := SignalStrengthData{}
 		signal, err := m.GetSignalStrength()
 		if err != nil {
-			w.Header().Set("Content-Type", "text/html")
-			w.Write([]byte(`<div class="error">Failed to load signal strength</div>`))
-			return
+			wired, wiredErr := wiredInterface()
+			if wiredErr != nil {
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte(`<div class="error">Failed to load signal strength</div>`))
+				return
+			}
+			data.Wired = &wired
 		}
+		data.SignalStrength = signal
+		setSignalHistory(&data, m.Network.History())
 
 		tmpl, err := parseTemplateFile("html/templates/signal-strength.gohtml")
 		if err != nil {
@@ -99,7 +178,7 @@ func (m *SLMeter) DashboardSignalStrength() http.HandlerFunc {
 		}
 
 		w.Header().Set("Content-Type", "text/html")
-		err = tmpl.Execute(w, signal)
+		err = tmpl.Execute(w, data)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -107,9 +186,46 @@ func (m *SLMeter) DashboardSignalStrength() http.HandlerFunc {
 	}
 }
 
+// The first wired interface that's up
+func wiredInterface() (network.Interface, error) {
+	interfaces, err := network.Interfaces()
+	if err != nil {
+		return network.Interface{}, err
+	}
+	for _, iface := range interfaces {
+		if iface.Type == "ethernet" && iface.Up {
+			return iface, nil
+		}
+	}
+	return network.Interface{}, network.ErrNotConnected
+}
+
+// Scale the history into a 100x30 sparkline
+func setSignalHistory(data *SignalStrengthData, history []network.SignalSample) {
+	if len(history) < 2 {
+		return
+	}
+	data.HistoryMin, data.HistoryMax = history[0].SignalDBM, history[0].SignalDBM
+	for _, sample := range history {
+		data.HistoryMin = min(data.HistoryMin, sample.SignalDBM)
+		data.HistoryMax = max(data.HistoryMax, sample.SignalDBM)
+	}
+	data.HistoryHours = math.Round(history[len(history)-1].Time.Sub(history[0].Time).Hours()*10) / 10
+
+	points := make([]string, len(history))
+	for i, sample := range history {
+		x := float64(i) * 100 / float64(len(history)-1)
+		y := 30 - float64(sample.Percent)*30/100
+		points[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+	}
+	data.HistoryPoints = strings.Join(points, " ")
+}
+
 type ControlsData struct {
 	Enabled     bool
 	LastMessage string
+	// How the running job takes its readings
+	Options *JobOptions
 }
 
 func (m *SLMeter) DashboardControls() http.HandlerFunc {
@@ -123,6 +239,7 @@ func (m *SLMeter) DashboardControls() http.HandlerFunc {
 
 		controlsData := ControlsData{
 			Enabled: status.Enabled,
+			Options: status.Options,
 		}
 
 		tmpl, err := parseTemplateFile("html/templates/controls.gohtml")
@@ -180,7 +297,8 @@ func (m *SLMeter) DashboardHistoricalGraph() http.HandlerFunc {
 func (m *SLMeter) getServiceResponse() ServiceResponse {
 	response := ServiceResponse{
 		ServiceName: "Gnome",
-		OutboundIP:  tools.GetOutboundIP().String(),
+		Device:      m.Device.Info(),
+		OutboundIP:  network.PrimaryIP().String(),
 		Errors:      make(map[string]string),
 	}
 
@@ -203,9 +321,9 @@ func (m *SLMeter) getServiceResponse() ServiceResponse {
 	conditions, err := m.GetCurrentConditions()
 	if err != nil {
 		response.Errors["conditions"] = err.Error()
-		response.Conditions = Conditions{}
+		response.Conditions = &Conditions{}
 	} else {
-		response.Conditions = Conditions{
+		response.Conditions = &Conditions{
 			JobID:                 conditions.JobID,
 			Lux:                   sanitizeFloat64(conditions.Lux),
 			FullSpectrum:          sanitizeFloat64(conditions.FullSpectrum),
@@ -216,6 +334,11 @@ func (m *SLMeter) getServiceResponse() ServiceResponse {
 			FullSunlightInRange:   sanitizeFloat64(conditions.FullSunlightInRange),
 			LightConditionInRange: conditions.LightConditionInRange,
 			AverageLuxInRange:     sanitizeFloat64(conditions.AverageLuxInRange),
+			LuxStdDev:             conditions.LuxStdDev,
+			LuxFiltered:           conditions.LuxFiltered,
+			SolarElevation:        conditions.SolarElevation,
+			ClearSkyLux:           sanitizeFloat64(conditions.ClearSkyLux),
+			PercentOfPossible:     sanitizeFloat64(conditions.PercentOfPossible),
 		}
 	}
 
@@ -227,6 +350,22 @@ func (m *SLMeter) getServiceResponse() ServiceResponse {
 		response.Status = status
 	}
 
+	dataQuality, err := m.GetDataQuality()
+	if err != nil {
+		response.Errors["quality"] = err.Error()
+	} else {
+		response.Quality = dataQuality
+	}
+
+	if m.Uploads != nil {
+		uploads, err := m.Uploads.Status(context.Background())
+		if err != nil {
+			response.Errors["upload"] = err.Error()
+		} else {
+			response.Upload = &uploads
+		}
+	}
+
 	return response
 }
 
@@ -0,0 +1,57 @@
+package gnome
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ztkent/gnome/internal/quality"
+)
+
+// How far back the health score looks
+const QUALITY_WINDOW = time.Hour
+
+// How the recent readings look, for the device status card
+type DataQuality struct {
+	Readings int `json:"readings"`
+	Flagged  int `json:"flagged"`
+	// The percent of readings without flags
+	Score float64 `json:"score"`
+	// How many readings had each flag
+	Flags map[string]int `json:"flags,omitempty"`
+}
+
+// The flags seen, like "jump 2, flatline 20"
+func (q DataQuality) Summary() string {
+	parts := []string{}
+	for _, name := range quality.Names() {
+		if count, ok := q.Flags[name]; ok {
+			parts = append(parts, fmt.Sprintf("%s %d", name, count))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// GetDataQuality scores the readings recorded in the last QUALITY_WINDOW, nil when there weren't any
+func (m *SLMeter) GetDataQuality() (*DataQuality, error) {
+	flags, err := m.Store.QualityFlagsSince(time.Now().Add(-QUALITY_WINDOW))
+	if err != nil {
+		return nil, err
+	}
+
+	report := DataQuality{Readings: len(flags), Flags: map[string]int{}}
+	for _, flag := range flags {
+		if flag == 0 {
+			continue
+		}
+		report.Flagged++
+		for _, name := range flag.Names() {
+			report.Flags[name]++
+		}
+	}
+	if report.Readings == 0 {
+		return nil, nil
+	}
+	report.Score = float64(report.Readings-report.Flagged) * 100 / float64(report.Readings)
+	return &report, nil
+}
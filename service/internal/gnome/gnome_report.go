@@ -0,0 +1,381 @@
+package gnome
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ztkent/gnome/internal/solar"
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+const (
+	// Readings at or above this count as direct sun, open shade on a bright day stays well under it
+	DIRECT_SUN_LUX = 20000.0
+	// A day needs this share of its expected hours recorded to count toward the classification
+	MIN_REPORT_COVERAGE = 0.5
+)
+
+var ErrNoReadings = errors.New("no readings found")
+
+// A horticultural light category, by hours of direct sun a day
+type SunCategory struct {
+	Name        string
+	MinHours    float64
+	Description string
+}
+
+// From the most sun to the least, a location is the first category its average reaches
+var SunCategories = []SunCategory{
+	{Name: "Full sun", MinHours: 6, Description: "6 or more hours of direct sun a day"},
+	{Name: "Part sun", MinHours: 4, Description: "4 to 6 hours of direct sun a day"},
+	{Name: "Part shade", MinHours: 2, Description: "2 to 4 hours of direct sun a day"},
+	{Name: "Shade", MinHours: 0, Description: "Less than 2 hours of direct sun a day"},
+}
+
+// One local day of a sun-exposure report
+type SunReportDay struct {
+	Date          string  `json:"date"`
+	Readings      int     `json:"readings"`
+	RecordedHours float64 `json:"recorded_hours"`
+	// Recorded hours over the hours the day should have, daylight when the device knows where it is, from 0 to 1
+	Coverage   float64 `json:"coverage"`
+	SunHours   float64 `json:"sun_hours"`
+	AverageLux float64 `json:"average_lux"`
+	MaxLux     float64 `json:"max_lux"`
+	DLI        float64 `json:"dli"`
+	// Whether the day had enough coverage to be classified
+	Analyzed bool `json:"analyzed"`
+
+	expectedHours float64
+	// Counted as readings, so six hours of them make exactly six hours
+	daylightReadings int
+	sunReadings      int
+}
+
+// How much direct sun a spot gets, for a job or a date range
+type SunReport struct {
+	JobID        string  `json:"job_id,omitempty"`
+	DeviceName   string  `json:"device_name"`
+	Location     string  `json:"location,omitempty"`
+	Start        string  `json:"start"`
+	End          string  `json:"end"`
+	Timezone     string  `json:"timezone"`
+	GeneratedAt  string  `json:"generated_at"`
+	DirectSunLux float64 `json:"direct_sun_lux"`
+	// Whether coverage is measured against daylight or the whole day
+	DaylightCoverage bool           `json:"daylight_coverage"`
+	Days             []SunReportDay `json:"days"`
+	DaysAnalyzed     int            `json:"days_analyzed"`
+	Coverage         float64        `json:"coverage"`
+	RecordedHours    float64        `json:"recorded_hours"`
+	// Averages over the analyzed days
+	AverageSunHours float64 `json:"average_sun_hours"`
+	AverageLux      float64 `json:"average_lux"`
+	AverageDLI      float64 `json:"average_dli"`
+	// Empty when no day had enough coverage
+	Classification string `json:"classification,omitempty"`
+	Description    string `json:"description,omitempty"`
+}
+
+// GetSunReport returns the hours of direct sun for each day of the range in loc, and classifies the spot.
+// A job's range is from its first reading to its last.
+func (m *SLMeter) GetSunReport(jobID string, start time.Time, end time.Time, loc *time.Location) (SunReport, error) {
+	if jobID != "" {
+		first, last, found, err := m.Store.JobSpan(jobID)
+		if err != nil {
+			return SunReport{}, err
+		} else if !found {
+			return SunReport{}, ErrNoReadings
+		}
+		start, end = first, last
+	}
+	return m.sunReport(jobID, start, end, loc)
+}
+
+type cachedReport struct {
+	jobID   string
+	expires time.Time
+	report  SunReport
+}
+
+// The job's report over its last CONDITIONS_WINDOW_DAYS local days, summarized at most once every CONDITIONS_CACHE_TTL.
+// A long job doesn't load every reading it has on each request for the conditions.
+func (m *SLMeter) recentJobReport(jobID string) (SunReport, error) {
+	m.conditionsMu.Lock()
+	defer m.conditionsMu.Unlock()
+	if cached := m.conditionsReport; cached.jobID == jobID && time.Now().Before(cached.expires) {
+		return cached.report, nil
+	}
+
+	first, last, found, err := m.Store.JobSpan(jobID)
+	if err != nil {
+		return SunReport{}, err
+	} else if !found {
+		return SunReport{}, ErrNoReadings
+	}
+	start := tools.StartOfDay(last, m.Timezone).AddDate(0, 0, 1-CONDITIONS_WINDOW_DAYS)
+	if first.After(start) {
+		start = first
+	}
+	report, err := m.sunReport(jobID, start, last, m.Timezone)
+	if err != nil {
+		return SunReport{}, err
+	}
+	m.conditionsReport = cachedReport{jobID: jobID, expires: time.Now().Add(CONDITIONS_CACHE_TTL), report: report}
+	return report, nil
+}
+
+// The report on the job's readings from start to end, both included, or every reading's when jobID is empty
+func (m *SLMeter) sunReport(jobID string, start time.Time, end time.Time, loc *time.Location) (SunReport, error) {
+	info := m.Device.Info()
+	timezone := timezoneName(loc)
+	if timezone == "" {
+		timezone = "local time"
+	}
+	report := SunReport{
+		JobID:            jobID,
+		DeviceName:       info.Name,
+		Location:         info.Location,
+		Start:            start.In(loc).Format(tools.TIME_FORMAT),
+		End:              end.In(loc).Format(tools.TIME_FORMAT),
+		Timezone:         timezone,
+		GeneratedAt:      time.Now().In(loc).Format(tools.TIME_FORMAT),
+		DirectSunLux:     DIRECT_SUN_LUX,
+		DaylightCoverage: m.Site != nil,
+		Days:             []SunReportDay{},
+	}
+	index := map[string]int{}
+	// A job's last reading can be at its first's moment, it still has a day
+	for day := tools.StartOfDay(start, loc); day.Before(end) || len(report.Days) == 0; day = day.AddDate(0, 0, 1) {
+		summary := SunReportDay{Date: day.Format(time.DateOnly), expectedHours: day.AddDate(0, 0, 1).Sub(day).Hours()}
+		if m.Site != nil {
+			summary.expectedHours = m.Site.Day(day, loc).DayLengthHours
+		}
+		index[summary.Date] = len(report.Days)
+		report.Days = append(report.Days, summary)
+	}
+
+	// The range includes its end, it's a job's last reading
+	points, err := m.Store.ValidLux(start, end.Add(time.Millisecond), jobID)
+	if err != nil {
+		return SunReport{}, err
+	}
+	for _, point := range points {
+		at := time.UnixMilli(point.CreatedAt)
+		i, ok := index[at.In(loc).Format(time.DateOnly)]
+		if !ok {
+			continue
+		}
+		day := &report.Days[i]
+		day.Readings++
+		day.AverageLux += point.Lux
+		day.MaxLux = max(day.MaxLux, point.Lux)
+		day.DLI += luxToDLI(point.Lux)
+		// Readings in the dark don't cover any of the daylight
+		if m.Site == nil || m.Site.Position(at).Elevation > solar.SUNRISE_ELEVATION {
+			day.daylightReadings++
+		}
+		if point.Lux >= DIRECT_SUN_LUX {
+			day.sunReadings++
+		}
+	}
+
+	var expectedHours float64
+	for i := range report.Days {
+		day := &report.Days[i]
+		if day.Readings > 0 {
+			day.AverageLux /= float64(day.Readings)
+		}
+		day.RecordedHours = (time.Duration(day.daylightReadings) * RECORD_INTERVAL).Hours()
+		day.SunHours = (time.Duration(day.sunReadings) * RECORD_INTERVAL).Hours()
+		if day.expectedHours > 0 {
+			day.Coverage = min(day.RecordedHours/day.expectedHours, 1)
+		}
+		day.Analyzed = day.Readings > 0 && day.Coverage >= MIN_REPORT_COVERAGE
+		expectedHours += day.expectedHours
+		report.RecordedHours += day.RecordedHours
+		if day.Analyzed {
+			report.DaysAnalyzed++
+			report.AverageSunHours += day.SunHours
+			report.AverageLux += day.AverageLux
+			report.AverageDLI += day.DLI
+		}
+	}
+	if expectedHours > 0 {
+		report.Coverage = min(report.RecordedHours/expectedHours, 1)
+	}
+	if report.DaysAnalyzed > 0 {
+		days := float64(report.DaysAnalyzed)
+		report.AverageSunHours /= days
+		report.AverageLux /= days
+		report.AverageDLI /= days
+		category := classifySun(report.AverageSunHours)
+		report.Classification, report.Description = category.Name, category.Description
+	}
+	return report, nil
+}
+
+func (d SunReportDay) CoveragePercent() float64 {
+	return d.Coverage * 100
+}
+
+func (r SunReport) CoveragePercent() float64 {
+	return r.Coverage * 100
+}
+
+func classifySun(hours float64) SunCategory {
+	for _, category := range SunCategories {
+		if hours >= category.MinHours {
+			return category
+		}
+	}
+	return SunCategories[len(SunCategories)-1]
+}
+
+// The report as Markdown, to keep with garden notes
+func (r SunReport) Markdown() string {
+	var b strings.Builder
+	title := "Sun Exposure Report"
+	if r.DeviceName != "" {
+		title += ": " + r.DeviceName
+	}
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	if r.Location != "" {
+		fmt.Fprintf(&b, "- **Location:** %s\n", r.Location)
+	}
+	if r.JobID != "" {
+		fmt.Fprintf(&b, "- **Job:** %s\n", r.JobID)
+	}
+	fmt.Fprintf(&b, "- **Period:** %s to %s (%s)\n", r.Start, r.End, r.Timezone)
+	if r.Classification != "" {
+		fmt.Fprintf(&b, "- **Classification:** %s, %s\n", r.Classification, strings.ToLower(r.Description[:1])+r.Description[1:])
+		fmt.Fprintf(&b, "- **Direct sun:** %.1f hours a day on average\n", r.AverageSunHours)
+		fmt.Fprintf(&b, "- **Average light:** %.0f lux, %.2f mol/m²/day\n", r.AverageLux, r.AverageDLI)
+	} else {
+		fmt.Fprintf(&b, "- **Classification:** not enough data, no day had %.0f%% coverage\n", MIN_REPORT_COVERAGE*100)
+	}
+	fmt.Fprintf(&b, "- **Days analyzed:** %d of %d\n", r.DaysAnalyzed, len(r.Days))
+	fmt.Fprintf(&b, "- **Coverage:** %.0f%% of %s, %.1f hours recorded\n\n", r.Coverage*100, r.coverageOf(), r.RecordedHours)
+
+	b.WriteString("| Date | Direct sun (h) | Average lux | Max lux | DLI | Coverage | Analyzed |\n")
+	b.WriteString("|---|---:|---:|---:|---:|---:|:---:|\n")
+	for _, day := range r.Days {
+		analyzed := ""
+		if day.Analyzed {
+			analyzed = "✓"
+		}
+		fmt.Fprintf(&b, "| %s | %.1f | %.0f | %.0f | %.2f | %.0f%% | %s |\n",
+			day.Date, day.SunHours, day.AverageLux, day.MaxLux, day.DLI, day.Coverage*100, analyzed)
+	}
+
+	b.WriteString("\nDirect sun is time with at least ")
+	fmt.Fprintf(&b, "%.0f lux. Days need %.0f%% coverage to be analyzed.\n\n", r.DirectSunLux, MIN_REPORT_COVERAGE*100)
+	for _, category := range SunCategories {
+		fmt.Fprintf(&b, "- **%s:** %s\n", category.Name, category.Description)
+	}
+	fmt.Fprintf(&b, "\nGenerated %s\n", r.GeneratedAt)
+	return b.String()
+}
+
+// What the coverage is measured against
+func (r SunReport) coverageOf() string {
+	if r.DaylightCoverage {
+		return "daylight"
+	}
+	return "the day"
+}
+
+// The report's range from ?job_id=, or ?start=&end= with whole days ending today by default
+func (m *SLMeter) parseReportRequest(r *http.Request) (SunReport, int, error) {
+	loc, err := tools.RequestLocation(r, m.Timezone)
+	if err != nil {
+		return SunReport{}, http.StatusBadRequest, err
+	}
+	jobID := r.URL.Query().Get("job_id")
+	start, end, err := tools.ParseStartAndEndDate(r, loc, DAILY_SUMMARY_DAYS*24*time.Hour)
+	if err != nil {
+		return SunReport{}, http.StatusBadRequest, err
+	}
+	if jobID == "" {
+		if r.URL.Query().Get("start") == "" {
+			start = tools.StartOfDay(end, loc).AddDate(0, 0, 1-DAILY_SUMMARY_DAYS)
+		}
+		if end.Sub(start) > MAX_DAILY_SUMMARY_DAYS*24*time.Hour {
+			return SunReport{}, http.StatusBadRequest, fmt.Errorf("the range can't be longer than %d days", MAX_DAILY_SUMMARY_DAYS)
+		}
+	}
+
+	report, err := m.GetSunReport(jobID, start, end, loc)
+	if errors.Is(err, ErrNoReadings) {
+		return SunReport{}, http.StatusNotFound, fmt.Errorf("no readings found for job %s", jobID)
+	} else if err != nil {
+		log.Println(err)
+		return SunReport{}, http.StatusInternalServerError, err
+	}
+	return report, http.StatusOK, nil
+}
+
+// Serve the sun-exposure report for ?job_id= or ?start=&end=, the last week by default
+func (m *SLMeter) SunReport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, status, err := m.parseReportRequest(r)
+		if err != nil {
+			ServeResponse(w, r, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Printf("Error encoding response: %v", err)
+		}
+	}
+}
+
+// Serve the report as a Markdown download
+func (m *SLMeter) SunReportMarkdown() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, status, err := m.parseReportRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", "gnome-sun-report.md"))
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Write([]byte(report.Markdown()))
+	}
+}
+
+type SunReportData struct {
+	SunReport
+	Categories []SunCategory
+	// The query to download the same report as Markdown
+	Query string
+}
+
+// Serve the report as a printable page
+func (m *SLMeter) DashboardSunReport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, status, err := m.parseReportRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		tmpl, err := parseTemplateFile("html/report.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		err = tmpl.Execute(w, SunReportData{SunReport: report, Categories: SunCategories, Query: r.URL.RawQuery})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
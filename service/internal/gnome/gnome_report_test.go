@@ -0,0 +1,99 @@
+package gnome
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ztkent/gnome/internal/device"
+	"github.com/ztkent/gnome/internal/storage"
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+func newTestMeter(t *testing.T, store storage.ReadingStore) *SLMeter {
+	t.Helper()
+	db, err := tools.ConnectSqlite(filepath.Join(t.TempDir(), "gnome.db"))
+	if err != nil {
+		t.Fatalf("ConnectSqlite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	identity, err := device.Load(db)
+	if err != nil {
+		t.Fatalf("device.Load: %v", err)
+	}
+	m := NewSLMeter(nil, store, nil, identity, 0)
+	m.Timezone = time.UTC
+	return m
+}
+
+// A reading every hour from start, for days
+func hourlyReadings(jobID string, start time.Time, days int) []storage.Record {
+	records := []storage.Record{}
+	for at := start; at.Before(start.AddDate(0, 0, days)); at = at.Add(time.Hour) {
+		records = append(records, storage.Record{JobID: jobID, Lux: 30000, CreatedAt: at.UnixMilli(), Samples: 1})
+	}
+	return records
+}
+
+func TestRecentJobReportCoversTheLastWeek(t *testing.T) {
+	store := storage.NewMemory()
+	m := newTestMeter(t, store)
+	start := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	if err := store.InsertReadings(hourlyReadings("job-1", start, 30)); err != nil {
+		t.Fatalf("InsertReadings: %v", err)
+	}
+
+	report, err := m.recentJobReport("job-1")
+	if err != nil {
+		t.Fatalf("recentJobReport: %v", err)
+	}
+	if len(report.Days) != CONDITIONS_WINDOW_DAYS || report.Days[0].Date != "2026-09-24" || report.Days[6].Date != "2026-09-30" {
+		t.Fatalf("expected the job's last %d days, got %+v", CONDITIONS_WINDOW_DAYS, report.Days)
+	}
+
+	// The summary is reused until it expires
+	if err := store.InsertReadings(hourlyReadings("job-1", start.AddDate(0, 0, 30), 1)); err != nil {
+		t.Fatalf("InsertReadings: %v", err)
+	}
+	if cached, _ := m.recentJobReport("job-1"); len(cached.Days) != len(report.Days) {
+		t.Errorf("expected the cached report, got %d days", len(cached.Days))
+	}
+	m.conditionsReport.expires = time.Now()
+	if refreshed, _ := m.recentJobReport("job-1"); refreshed.Days[6].Date != "2026-10-01" {
+		t.Errorf("expected the report to move on once it expired, got %+v", refreshed.Days)
+	}
+}
+
+func TestRecentJobReportOfAShortJob(t *testing.T) {
+	store := storage.NewMemory()
+	m := newTestMeter(t, store)
+	if err := store.InsertReadings(hourlyReadings("job-1", time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC), 2)); err != nil {
+		t.Fatalf("InsertReadings: %v", err)
+	}
+	report, err := m.recentJobReport("job-1")
+	if err != nil {
+		t.Fatalf("recentJobReport: %v", err)
+	}
+	if len(report.Days) != 2 || report.Days[0].Date != "2026-09-01" {
+		t.Errorf("expected the whole job, got %+v", report.Days)
+	}
+}
+
+func TestIDLeavesOutConditionsWithAuth(t *testing.T) {
+	m := newTestMeter(t, storage.NewMemory())
+	for _, authEnabled := range []bool{false, true} {
+		m.AuthEnabled = authEnabled
+		w := httptest.NewRecorder()
+		m.ID().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/id", nil))
+		var response map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("the response isn't JSON: %v", err)
+		}
+		if _, ok := response["conditions"]; ok == authEnabled {
+			t.Errorf("with auth %t, conditions were in /id: %t", authEnabled, ok)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package gnome
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+const (
+	// Sub-samples in one recorded point, each read takes up to 600ms at the longest integration time
+	MAX_SAMPLES = 15
+	// Filters for the live lux
+	FILTER_NONE   = ""
+	FILTER_EMA    = "ema"
+	FILTER_MEDIAN = "median"
+	// Defaults when a filter is asked for without its setting
+	DEFAULT_EMA_ALPHA     = 0.3
+	DEFAULT_MEDIAN_WINDOW = 5
+	MAX_MEDIAN_WINDOW     = 60
+)
+
+// How a job takes its readings, set when it starts
+type JobOptions struct {
+	// Sub-samples taken across each RECORD_INTERVAL, and stored as their mean, min, max and standard deviation. 1 by default.
+	Samples int `json:"samples,omitempty"`
+	// Smooth the live lux with "ema" or "median", the raw mean is still stored
+	Filter string `json:"filter,omitempty"`
+	// The EMA's weight for the newest point, from 0 to 1
+	Alpha float64 `json:"alpha,omitempty"`
+	// Points the median is taken over
+	Window int `json:"window,omitempty"`
+}
+
+// Fill in the defaults, and check the rest
+func (o JobOptions) normalize() (JobOptions, error) {
+	if o.Samples == 0 {
+		o.Samples = 1
+	} else if o.Samples < 1 || o.Samples > MAX_SAMPLES {
+		return o, fmt.Errorf("samples must be between 1 and %d", MAX_SAMPLES)
+	}
+	switch o.Filter {
+	case FILTER_NONE:
+		if o.Alpha != 0 || o.Window != 0 {
+			return o, fmt.Errorf("alpha and window need a filter")
+		}
+	case FILTER_EMA:
+		if o.Alpha == 0 {
+			o.Alpha = DEFAULT_EMA_ALPHA
+		} else if o.Alpha < 0 || o.Alpha > 1 {
+			return o, fmt.Errorf("alpha must be between 0 and 1")
+		}
+		if o.Window != 0 {
+			return o, fmt.Errorf("window is only used by the median filter")
+		}
+	case FILTER_MEDIAN:
+		if o.Window == 0 {
+			o.Window = DEFAULT_MEDIAN_WINDOW
+		} else if o.Window < 2 || o.Window > MAX_MEDIAN_WINDOW {
+			return o, fmt.Errorf("window must be between 2 and %d", MAX_MEDIAN_WINDOW)
+		}
+		if o.Alpha != 0 {
+			return o, fmt.Errorf("alpha is only used by the ema filter")
+		}
+	default:
+		return o, fmt.Errorf("unknown filter %q, expected %s or %s", o.Filter, FILTER_EMA, FILTER_MEDIAN)
+	}
+	return o, nil
+}
+
+// The interval between sub-samples
+func (o JobOptions) sampleInterval() time.Duration {
+	return RECORD_INTERVAL / time.Duration(max(o.Samples, 1))
+}
+
+// A description for the dashboard, like "5 samples per point, median of 5"
+func (o JobOptions) String() string {
+	description := "1 sample per point"
+	if o.Samples > 1 {
+		description = fmt.Sprintf("%d samples per point", o.Samples)
+	}
+	switch o.Filter {
+	case FILTER_EMA:
+		description += fmt.Sprintf(", EMA α=%.2g", o.Alpha)
+	case FILTER_MEDIAN:
+		description += fmt.Sprintf(", median of %d", o.Window)
+	}
+	return description
+}
+
+// Sub-samples for one point, summed as they're taken
+type point struct {
+	samples                         int
+	sum, squares, min, max          float64
+	visible, infrared, fullSpectrum float64
+	// The last counts, for the quality checks
+	ch0, ch1 uint16
+}
+
+func (p *point) add(lux float64, ch0 uint16, ch1 uint16, visible float64, infrared float64, fullSpectrum float64) {
+	if p.samples == 0 || lux < p.min {
+		p.min = lux
+	}
+	if p.samples == 0 || lux > p.max {
+		p.max = lux
+	}
+	p.samples++
+	p.sum += lux
+	p.squares += lux * lux
+	p.visible += visible
+	p.infrared += infrared
+	p.fullSpectrum += fullSpectrum
+	p.ch0, p.ch1 = ch0, ch1
+}
+
+// The point's mean, with its spread when there's more than one sample
+func (p *point) result(jobID string) LuxResults {
+	n := float64(p.samples)
+	result := LuxResults{
+		Lux:          p.sum / n,
+		Visible:      p.visible / n,
+		Infrared:     p.infrared / n,
+		FullSpectrum: p.fullSpectrum / n,
+		JobID:        jobID,
+		Time:         time.Now(),
+		Samples:      p.samples,
+	}
+	if p.samples > 1 {
+		variance := max(p.squares/n-result.Lux*result.Lux, 0)
+		result.Stats = &PointStats{Min: p.min, Max: p.max, StdDev: math.Sqrt(variance)}
+	}
+	return result
+}
+
+// The spread of a point's sub-samples
+type PointStats struct {
+	Min    float64
+	Max    float64
+	StdDev float64
+}
+
+// Smooths the live lux, point by point
+type liveFilter interface {
+	apply(lux float64) float64
+}
+
+func newLiveFilter(options JobOptions) liveFilter {
+	switch options.Filter {
+	case FILTER_EMA:
+		return &emaFilter{alpha: options.Alpha}
+	case FILTER_MEDIAN:
+		return &medianFilter{window: options.Window}
+	}
+	return nil
+}
+
+type emaFilter struct {
+	alpha  float64
+	value  float64
+	primed bool
+}
+
+func (f *emaFilter) apply(lux float64) float64 {
+	if !f.primed {
+		f.value, f.primed = lux, true
+	} else {
+		f.value = f.alpha*lux + (1-f.alpha)*f.value
+	}
+	return f.value
+}
+
+type medianFilter struct {
+	window int
+	recent []float64
+}
+
+func (f *medianFilter) apply(lux float64) float64 {
+	f.recent = append(f.recent, lux)
+	if len(f.recent) > f.window {
+		f.recent = f.recent[1:]
+	}
+	sorted := slices.Clone(f.recent)
+	slices.Sort(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
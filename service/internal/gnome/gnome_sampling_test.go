@@ -0,0 +1,121 @@
+package gnome
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ztkent/gnome/internal/gnome/tsl2591"
+	"github.com/ztkent/gnome/internal/quality"
+)
+
+func closeTo(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestPointAggregatesSubSamples(t *testing.T) {
+	p := point{}
+	for _, lux := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		p.add(lux, uint16(lux*10), uint16(lux), lux*2, lux/2, lux*3)
+	}
+	result := p.result("job-1")
+	if result.Samples != 8 || !closeTo(result.Lux, 5) || result.JobID != "job-1" {
+		t.Fatalf("unexpected point %+v", result)
+	}
+	if !closeTo(result.Visible, 10) || !closeTo(result.Infrared, 2.5) || !closeTo(result.FullSpectrum, 15) {
+		t.Errorf("expected the channels averaged too, got %+v", result)
+	}
+	if result.Stats == nil || result.Stats.Min != 2 || result.Stats.Max != 9 || !closeTo(result.Stats.StdDev, 2) {
+		t.Errorf("expected min 2, max 9 and a standard deviation of 2, got %+v", result.Stats)
+	}
+	if p.ch0 != 90 || p.ch1 != 9 {
+		t.Errorf("expected the last counts for the quality checks, got %d and %d", p.ch0, p.ch1)
+	}
+}
+
+func TestPointOfOneSample(t *testing.T) {
+	p := point{}
+	p.add(-3, 0, 10, 0, 0, 0)
+	result := p.result("job-1")
+	if result.Samples != 1 || result.Lux != -3 || result.Stats != nil {
+		t.Errorf("expected a single sample without stats, got %+v", result)
+	}
+}
+
+func TestPointStdDevOfIdenticalSamples(t *testing.T) {
+	// The variance is from running sums, so rounding leaves a little, or takes it below zero
+	for _, lux := range []float64{0.1, 1234.5, 88000.3} {
+		p := point{}
+		for i := 0; i < MAX_SAMPLES; i++ {
+			p.add(lux, 1, 1, 0, 0, 0)
+		}
+		result := p.result("job-1")
+		if result.Stats == nil || math.IsNaN(result.Stats.StdDev) || result.Stats.StdDev > lux*1e-6 {
+			t.Errorf("expected no spread at %g lux, got %+v", lux, result.Stats)
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  JobOptions
+		lux      []float64
+		expected []float64
+	}{
+		{"ema starts at the first point", JobOptions{Filter: FILTER_EMA, Alpha: 0.5}, []float64{100, 200, 200, 0}, []float64{100, 150, 175, 87.5}},
+		{"ema of 1 follows the lux", JobOptions{Filter: FILTER_EMA, Alpha: 1}, []float64{100, 300, 50}, []float64{100, 300, 50}},
+		{"median warms up with the points it has", JobOptions{Filter: FILTER_MEDIAN, Window: 3}, []float64{100, 300, 200}, []float64{100, 200, 200}},
+		{"median drops the oldest point", JobOptions{Filter: FILTER_MEDIAN, Window: 3}, []float64{100, 300, 200, 5000, 6000}, []float64{100, 200, 200, 300, 5000}},
+		{"median of an even window", JobOptions{Filter: FILTER_MEDIAN, Window: 4}, []float64{10, 20, 30, 40, 1000}, []float64{10, 15, 20, 25, 35}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := newLiveFilter(test.options)
+			for i, lux := range test.lux {
+				if filtered := filter.apply(lux); !closeTo(filtered, test.expected[i]) {
+					t.Errorf("point %d: expected %g, got %g", i, test.expected[i], filtered)
+				}
+			}
+		})
+	}
+	if newLiveFilter(JobOptions{}) != nil {
+		t.Error("expected no filter without one in the options")
+	}
+}
+
+func TestEachJobStartsItsOwnFilter(t *testing.T) {
+	for _, options := range []JobOptions{{Filter: FILTER_EMA, Alpha: 0.2}, {Filter: FILTER_MEDIAN, Window: 5}} {
+		first := newLiveFilter(options)
+		for _, lux := range []float64{50000, 60000, 70000} {
+			first.apply(lux)
+		}
+		// The next job's first point isn't pulled toward the last job's light
+		if filtered := newLiveFilter(options).apply(100); filtered != 100 {
+			t.Errorf("%s: expected the new job's filter to start at its first point, got %g", options.Filter, filtered)
+		}
+	}
+}
+
+func TestInvalidReadingsSkipTheFilter(t *testing.T) {
+	sensor, err := tsl2591.NewTSL2591WithBus(tsl2591.NewSimulatedBus(0), tsl2591.TSL2591_GAIN_MED, tsl2591.TSL2591_INTEGRATIONTIME_100MS)
+	if err != nil {
+		t.Fatalf("NewTSL2591WithBus: %v", err)
+	}
+	defer sensor.Close()
+	checker := quality.NewChecker()
+	filter := newLiveFilter(JobOptions{Filter: FILTER_EMA, Alpha: 0.5})
+
+	good := point{}
+	good.add(1000, 500, 100, 0, 0, 0)
+	if result := finishPoint(sensor, good, "job-1", checker, filter); result.Filtered == nil || *result.Filtered != 1000 {
+		t.Fatalf("expected the first point to prime the filter, got %+v", result)
+	}
+	negative := point{}
+	negative.add(-50, 100, 200, 0, 0, 0)
+	if result := finishPoint(sensor, negative, "job-1", checker, filter); result.Filtered != nil || result.Quality&quality.FLAG_NEGATIVE == 0 {
+		t.Fatalf("expected a negative point to be flagged and left out of the filter, got %+v", result)
+	}
+	if result := finishPoint(sensor, good, "job-1", checker, filter); result.Filtered == nil || *result.Filtered != 1000 {
+		t.Errorf("the negative point moved the filter, got %v", result.Filtered)
+	}
+}
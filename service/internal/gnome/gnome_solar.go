@@ -0,0 +1,144 @@
+package gnome
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ztkent/gnome/internal/gnome/tsl2591"
+	"github.com/ztkent/gnome/internal/solar"
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+// How often a paused job checks the sun again, in case the clock jumps once NTP syncs
+const DAYLIGHT_RECHECK_INTERVAL = 10 * time.Minute
+
+type SolarResponse struct {
+	Site solar.Site `json:"site"`
+	// The sun's times for ?date=, today by default
+	Day solar.Day `json:"day"`
+	// Where the sun is now, and how much light a clear sky would give
+	Position           solar.Position `json:"position"`
+	ClearSkyIrradiance float64        `json:"clear_sky_irradiance"`
+	ClearSkyLux        float64        `json:"clear_sky_lux"`
+	// The latest reading as a percent of the clear-sky lux, when recording
+	Lux               *float64   `json:"lux,omitempty"`
+	PercentOfPossible *float64   `json:"percent_of_possible,omitempty"`
+	DaylightOnly      bool       `json:"daylight_only"`
+	PausedUntil       *time.Time `json:"paused_until,omitempty"`
+}
+
+// Serve sunrise, sunset, civil twilight and the sun's position, for ?date= in the device's timezone or ?tz=
+func (m *SLMeter) Solar() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		loc, err := tools.RequestLocation(r, m.Timezone)
+		if err != nil {
+			ServeResponse(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		date := time.Now()
+		if value := r.URL.Query().Get("date"); value != "" {
+			if date, err = time.ParseInLocation(time.DateOnly, value, loc); err != nil {
+				ServeResponse(w, r, "date must be formatted like 2006-01-02", http.StatusBadRequest)
+				return
+			}
+		}
+
+		response := m.GetSolar(date, loc)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Error encoding response: %v", err)
+		}
+	}
+}
+
+// GetSolar returns the sun's times for date in loc, and where it is now. The device's site must be set.
+func (m *SLMeter) GetSolar(date time.Time, loc *time.Location) SolarResponse {
+	now := time.Now()
+	response := SolarResponse{
+		Site:               *m.Site,
+		Day:                m.Site.Day(date, loc),
+		Position:           m.Site.Position(now),
+		ClearSkyIrradiance: m.Site.ClearSkyIrradiance(now),
+		ClearSkyLux:        m.Site.ClearSkyLux(now),
+		DaylightOnly:       m.DaylightOnly,
+	}
+	if status, err := m.GetSensorStatus(); err == nil {
+		response.PausedUntil = status.PausedUntil
+	}
+	if conditions, err := m.GetCurrentConditions(); err == nil && conditions.JobID != "" {
+		response.Lux = &conditions.Lux
+		response.PercentOfPossible = &conditions.PercentOfPossible
+	}
+	return response
+}
+
+// Whether the sun is below civil twilight, false when the device doesn't know where it is
+func (m *SLMeter) sunIsDown(t time.Time) bool {
+	return m.Site != nil && m.Site.Position(t).Elevation < solar.CIVIL_TWILIGHT_ELEVATION
+}
+
+// When a daylight only job should start recording again, and whether it should wait
+func (m *SLMeter) untilDawn(t time.Time) (time.Time, bool) {
+	if !m.DaylightOnly || !m.sunIsDown(t) {
+		return time.Time{}, false
+	}
+	dawn, ok := m.Site.NextCivilDawn(t)
+	if !ok {
+		// A polar night, check again later
+		dawn = t.Add(DAYLIGHT_RECHECK_INTERVAL)
+	}
+	return dawn.In(m.Timezone), true
+}
+
+// Power the sensor down until civil dawn, then find the gain for the twilight.
+// Returns false if the job is cancelled first.
+func (m *SLMeter) waitForDawn(ctx context.Context, sensor *tsl2591.TSL2591, dawn time.Time) bool {
+	log.Printf("Recording daylight only, pausing until civil dawn at %s", dawn.In(m.Timezone).Format(time.RFC3339))
+	if err := sensor.Disable(); err != nil {
+		log.Printf("Failed to disable sensor: %s", err)
+	}
+	m.setPausedUntil(dawn)
+	defer m.setPausedUntil(time.Time{})
+
+	for {
+		wait := max(min(time.Until(dawn), DAYLIGHT_RECHECK_INTERVAL), time.Second)
+		if !sleepContext(ctx, wait) {
+			return false
+		}
+		next, dark := m.untilDawn(time.Now())
+		if !dark {
+			break
+		} else if !next.Equal(dawn) {
+			dawn = next
+			m.setPausedUntil(dawn)
+		}
+	}
+
+	log.Printf("Civil dawn, resuming recording")
+	if err := sensor.Enable(); err != nil {
+		log.Printf("Failed to enable sensor: %s", err)
+	}
+	recheckGain(ctx, sensor)
+	return ctx.Err() == nil
+}
+
+// Clear it with the zero time
+func (m *SLMeter) setPausedUntil(t time.Time) {
+	if t.IsZero() {
+		m.pausedUntil.Store(0)
+		return
+	}
+	m.pausedUntil.Store(t.UnixMilli())
+}
+
+// value as a percent of possible, 0 when nothing was possible
+func percentOf(value float64, possible float64) float64 {
+	if possible <= 0 {
+		return 0
+	}
+	return value * 100 / possible
+}
@@ -0,0 +1,63 @@
+package gnome
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ztkent/gnome/internal/gnome/tsl2591"
+	"github.com/ztkent/gnome/internal/solar"
+	"github.com/ztkent/gnome/internal/storage"
+)
+
+// A site on the equator where the sun is well below the horizon at t, so dawn is hours away
+func nightSite(t *testing.T, at time.Time) *solar.Site {
+	t.Helper()
+	for longitude := -180.0; longitude < 180; longitude += 15 {
+		site := &solar.Site{Latitude: 0, Longitude: longitude}
+		if site.Position(at).Elevation < -30 {
+			return site
+		}
+	}
+	t.Fatal("no site where it's night")
+	return nil
+}
+
+func TestStopWhilePausedUntilDawn(t *testing.T) {
+	sensor, err := tsl2591.NewTSL2591WithBus(tsl2591.NewSimulatedBus(0), tsl2591.TSL2591_GAIN_MED, tsl2591.TSL2591_INTEGRATIONTIME_100MS)
+	if err != nil {
+		t.Fatalf("NewTSL2591WithBus: %v", err)
+	}
+	defer sensor.Close()
+	m := NewSLMeter(sensor, storage.NewMemory(), nil, nil, 0)
+	m.Timezone = time.UTC
+	m.Site = nightSite(t, time.Now())
+	m.DaylightOnly = true
+
+	if err := m.StartSensor(JobOptions{}); err != nil {
+		t.Fatalf("StartSensor: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status, _ := m.GetSensorStatus()
+		if status.PausedUntil != nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("the job didn't pause until dawn")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- m.StopSensor() }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("StopSensor: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StopSensor deadlocked with the job paused until dawn")
+	}
+	if status, _ := m.GetSensorStatus(); status.PausedUntil != nil || status.Enabled {
+		t.Errorf("expected the job to be stopped and unpaused, got %+v", status)
+	}
+}
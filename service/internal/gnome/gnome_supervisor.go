@@ -0,0 +1,107 @@
+package gnome
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ztkent/gnome/internal/gnome/tsl2591"
+)
+
+const MAX_CONNECTION_EVENTS = 10
+
+type ConnectionEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// LastEvent returns the most recent connection event, or nil if there hasn't been one
+func (s Status) LastEvent() *ConnectionEvent {
+	if len(s.Events) == 0 {
+		return nil
+	}
+	return &s.Events[len(s.Events)-1]
+}
+
+// Supervise keeps the sensor attached. When there's no sensor, the bus is re-probed with connect,
+// and a job that was running when the sensor dropped out is resumed with the same JobID.
+// An idle sensor is pinged, so a loose wire is noticed before the next job starts.
+// If startOnConnect is set, a job is started the first time a sensor is available.
+func (m *SLMeter) Supervise(ctx context.Context, connect func() (*tsl2591.TSL2591, error), startOnConnect bool) {
+	ticker := time.NewTicker(SENSOR_PROBE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if sensor := m.Sensor(); sensor == nil {
+			if newSensor, err := connect(); err == nil {
+				m.attachSensor(ctx, newSensor)
+			}
+		} else if !m.IsRecording() {
+			if err := sensor.Ping(); err != nil {
+				m.detachSensor(sensor, err)
+			}
+		}
+
+		if startOnConnect && m.Sensor() != nil {
+			startOnConnect = false
+			if err := m.StartSensor(JobOptions{}); err != nil {
+				log.Printf("Failed to start sensor: %s", err)
+			}
+		}
+
+		if !waitForTick(ctx, ticker) {
+			return
+		}
+	}
+}
+
+// Attach a newly connected sensor, and resume the job if one was interrupted
+func (m *SLMeter) attachSensor(ctx context.Context, sensor *tsl2591.TSL2591) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ctx.Err() != nil || m.sensor != nil {
+		sensor.Close()
+		return
+	}
+
+	m.sensor = sensor
+	m.recordEvent("connected", "")
+	if m.jobID != "" {
+		log.Printf("Resuming JobID: %s", m.jobID)
+		m.startJob()
+	}
+}
+
+// Drop a sensor that stopped responding. The job is kept, so it can resume when the sensor is back.
+func (m *SLMeter) detachSensor(sensor *tsl2591.TSL2591, cause error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sensor != sensor {
+		return
+	}
+
+	if m.cancel != nil {
+		m.cancel()
+		<-m.done
+		m.cancel = nil
+		m.done = nil
+	}
+	sensor.Disable()
+	sensor.Close()
+	m.sensor = nil
+	m.recordEvent("disconnected", cause.Error())
+}
+
+// Log a connection event, and keep it for the status endpoints. The caller must hold mu.
+func (m *SLMeter) recordEvent(event string, detail string) {
+	if detail != "" {
+		log.Printf("Sensor %s: %s", event, detail)
+	} else {
+		log.Printf("Sensor %s", event)
+	}
+	m.events = append(m.events, ConnectionEvent{Time: time.Now().UTC(), Event: event, Detail: detail})
+	if len(m.events) > MAX_CONNECTION_EVENTS {
+		m.events = m.events[len(m.events)-MAX_CONNECTION_EVENTS:]
+	}
+}
@@ -34,6 +34,11 @@ class Dashboard {
         this.loadContent('/dashboard/controls', 'controls');
         this.loadContent('/dashboard/system-info', 'system-info');
         this.loadContent('/dashboard/historical-graph', 'historical-graph');
+        
+        // Only hubs have the device comparison card
+        if (document.getElementById('hub')) {
+            this.loadContent('/dashboard/hub', 'hub');
+        }
     }
     
     setupAutoRefresh() {
@@ -48,6 +53,11 @@ class Dashboard {
         
         // System info - every 120s
         setInterval(() => this.loadContent('/dashboard/system-info', 'system-info'), 120000);
+        
+        // Hub devices - every 60s
+        if (document.getElementById('hub')) {
+            setInterval(() => this.loadContent('/dashboard/hub', 'hub'), 60000);
+        }
     }
     
     setupEventDelegation() {
@@ -56,10 +66,19 @@ class Dashboard {
                 e.preventDefault();
                 const action = e.target.getAttribute('data-action');
                 const target = e.target.getAttribute('data-target') || 'controls';
+                // The request body can come from a select, like the job's sampling options
+                const bodyFrom = document.getElementById(e.target.getAttribute('data-body-from'));
                 
                 try {
                     e.target.textContent = 'Loading...';
-                    const response = await fetch(action);
+                    const response = await fetch(action, {
+                        method: e.target.getAttribute('data-method') || 'POST',
+                        headers: {
+                            'Content-Type': 'application/json',
+                            'X-CSRF-Token': this.csrfToken()
+                        },
+                        body: bodyFrom ? bodyFrom.value : '{}'
+                    });
                     if (!response.ok) throw new Error(`HTTP ${response.status}`);
                     
                     // Reload the controls section
@@ -73,6 +92,12 @@ class Dashboard {
         });
     }
     
+    // Token for requests that change state, rendered into the page
+    csrfToken() {
+        const meta = document.querySelector('meta[name="csrf-token"]');
+        return meta ? meta.getAttribute('content') : '';
+    }
+    
     // Function to refresh all dashboard data including historical graph
     refreshAll() {
         this.loadAll();
@@ -178,13 +203,16 @@ window.initHistoricalChart = function() {
         });
     }
 
+    // Label times in the device's timezone, so they line up with its days
     function formatTimeLabel(dateString) {
         const date = new Date(dateString);
+        const timeZone = document.querySelector('meta[name="timezone"]')?.content || undefined;
         return date.toLocaleTimeString('en-US', { 
             hour: '2-digit', 
             minute: '2-digit',
             month: 'short',
-            day: 'numeric'
+            day: 'numeric',
+            timeZone
         });
     }
 
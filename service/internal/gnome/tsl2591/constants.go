@@ -1,11 +1,14 @@
 package tsl2591
 
+import "time"
+
 const (
 	TSL2591_VISIBLE      byte = 2 ///< channel 0 - channel 1
 	TSL2591_INFRARED     byte = 1 ///< channel 1
 	TSL2591_FULLSPECTRUM byte = 0 ///< channel 0
 
 	TSL2591_ADDR        uint16 = 0x29 ///< Default I2C address
+	TSL2591_DEVICE_ID   byte   = 0x50 ///< Value of the DEVICE_ID register
 	TSL2591_COMMAND_BIT byte   = 0xA0 ///< 1010 0000: bits 7 and 5 for 'command normal'
 
 	TSL2591_WORD_BIT  byte = 0x20 ///< 1 = read/write word rather than byte
@@ -45,6 +48,13 @@ const (
 	TSL2591_REGISTER_CHAN1_HIGH        byte = 0x17 // Channel 1 data, high byte
 )
 
+// TSL2591 Status register bits
+const (
+	TSL2591_STATUS_AVALID byte = 0x01 // ALS valid, an integration cycle has completed since AEN was asserted
+	TSL2591_STATUS_AINT   byte = 0x10 // ALS interrupt
+	TSL2591_STATUS_NPINTR byte = 0x20 // No-persist interrupt
+)
+
 // Constants for adjusting the sensor integration timing
 const (
 	TSL2591_INTEGRATIONTIME_100MS byte = 0x00 // 100 millis
@@ -82,6 +92,51 @@ func IntegrationTimeToString(value byte) string {
 	}
 }
 
+// IntegrationTimeToDuration returns the nominal length of an integration cycle
+func IntegrationTimeToDuration(value byte) time.Duration {
+	switch value {
+	case TSL2591_INTEGRATIONTIME_100MS:
+		return 100 * time.Millisecond
+	case TSL2591_INTEGRATIONTIME_200MS:
+		return 200 * time.Millisecond
+	case TSL2591_INTEGRATIONTIME_300MS:
+		return 300 * time.Millisecond
+	case TSL2591_INTEGRATIONTIME_400MS:
+		return 400 * time.Millisecond
+	case TSL2591_INTEGRATIONTIME_500MS:
+		return 500 * time.Millisecond
+	case TSL2591_INTEGRATIONTIME_600MS:
+		return 600 * time.Millisecond
+	default:
+		return 100 * time.Millisecond
+	}
+}
+
+// MaxCount returns the full scale ADC count for an integration time.
+// The 100ms integration saturates early, per the datasheet.
+func MaxCount(value byte) uint16 {
+	if value == TSL2591_INTEGRATIONTIME_100MS {
+		return 0x8FFF
+	}
+	return 0xFFFF
+}
+
+// GainToMultiplier returns the typical amplification for a gain setting
+func GainToMultiplier(value byte) float64 {
+	switch value {
+	case TSL2591_GAIN_LOW:
+		return 1.0
+	case TSL2591_GAIN_MED:
+		return 25.0
+	case TSL2591_GAIN_HIGH:
+		return 428.0
+	case TSL2591_GAIN_MAX:
+		return 9876.0
+	default:
+		return 1.0
+	}
+}
+
 func GainToString(value byte) string {
 	switch value {
 	case TSL2591_GAIN_LOW:
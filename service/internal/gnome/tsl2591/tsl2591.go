@@ -10,12 +10,16 @@ package tsl2591
  */
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -24,6 +28,17 @@ import (
 
 var l *logrus.Logger
 
+const (
+	enableFlags = TSL2591_ENABLE_POWERON | TSL2591_ENABLE_AEN | TSL2591_ENABLE_AIEN | TSL2591_ENABLE_NPIEN
+
+	statusPollInterval = 10 * time.Millisecond
+
+	// Gain search aims channel 0 at a quarter of full scale, leaving headroom for the sun coming out
+	gainSearchTarget   = 0x4000
+	gainSearchMinCount = 0x0200
+	maxGainSearchSteps = 6
+)
+
 func init() {
 	l = logrus.New()
 	// Setup the logger, so it can be parsed by datadog
@@ -43,12 +58,22 @@ func init() {
 	}
 }
 
+// Bus is the register access the driver needs from the I2C device.
+// It's satisfied by *i2c.Device, and by SimulatedBus for running without hardware.
+type Bus interface {
+	ReadReg(reg byte, buf []byte) error
+	WriteReg(reg byte, buf []byte) error
+	Close() error
+}
+
+// TSL2591 is safe for concurrent use. Register access is serialized by mu,
+// and enabled can be checked without waiting on an in-progress read.
 type TSL2591 struct {
-	Enabled bool
-	Timing  byte
-	Gain    byte
-	Device  *i2c.Device
-	*sync.Mutex
+	mu      sync.Mutex
+	enabled atomic.Bool
+	timing  byte
+	gain    byte
+	bus     Bus
 }
 
 // Connect to a TSL2591 via I2C protocol & set gain/timing
@@ -61,94 +86,132 @@ func NewTSL2591(gain byte, timing byte, path string) (*TSL2591, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to open: %w", err)
 	}
+	tsl, err := NewTSL2591WithBus(device, gain, timing)
+	if err != nil {
+		return nil, fmt.Errorf("%w on I2C bus %s", err, path)
+	}
+	return tsl, nil
+}
+
+// Connect to a TSL2591 over an already open bus & set gain/timing.
+// The bus is closed if the sensor can't be set up.
+func NewTSL2591WithBus(bus Bus, gain byte, timing byte) (*TSL2591, error) {
+	tsl, err := setup(bus, gain, timing)
+	if err != nil {
+		bus.Close()
+		return nil, err
+	}
+	return tsl, nil
+}
+
+func setup(bus Bus, gain byte, timing byte) (*TSL2591, error) {
 	tsl := &TSL2591{
-		Device:  device,
-		Mutex:   &sync.Mutex{},
-		Enabled: true,
+		bus: bus,
 	}
+	tsl.enabled.Store(true)
 
 	// Read the device ID from the TSL2591
 	buf := make([]byte, 1)
-	err = tsl.Device.ReadReg(TSL2591_COMMAND_BIT|TSL2591_REGISTER_DEVICE_ID, buf)
+	err := tsl.bus.ReadReg(TSL2591_COMMAND_BIT|TSL2591_REGISTER_DEVICE_ID, buf)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to read ref: %w", err)
 	}
-	if buf[0] != 0x50 {
-		return nil, errors.New("Can't find a TSL2591 on I2C bus /dev/i2c-1")
+	if buf[0] != TSL2591_DEVICE_ID {
+		return nil, errors.New("Can't find a TSL2591")
 	}
 
-	tsl.SetTiming(timing)
-	tsl.SetGain(gain)
+	tsl.mu.Lock()
+	err = tsl.setGainAndTiming(gain, timing)
+	tsl.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to set gain and timing: %w", err)
+	}
 
-	tsl.Disable()
+	if err := tsl.Disable(); err != nil {
+		return nil, fmt.Errorf("Failed to disable: %w", err)
+	}
 	return tsl, nil
 }
 
+// Close the underlying bus
+func (tsl *TSL2591) Close() error {
+	tsl.mu.Lock()
+	defer tsl.mu.Unlock()
+	return tsl.bus.Close()
+}
+
 // Read from the light sensor's channels
 func (tsl *TSL2591) GetFullLuminosity() (uint16, uint16, error) {
-	if !tsl.Enabled {
+	return tsl.GetFullLuminosityContext(context.Background())
+}
+
+// Read from the light sensor's channels, once the current integration cycle has completed.
+// Returns early if the context is cancelled while waiting on the sensor.
+func (tsl *TSL2591) GetFullLuminosityContext(ctx context.Context) (uint16, uint16, error) {
+	tsl.mu.Lock()
+	defer tsl.mu.Unlock()
+	return tsl.readChannels(ctx)
+}
+
+func (tsl *TSL2591) readChannels(ctx context.Context) (uint16, uint16, error) {
+	if !tsl.enabled.Load() {
 		return 0, 0, errors.New("sensor must be enabled")
 	}
 
-	for d := byte(0); d < tsl.Timing; d++ {
-		time.Sleep(200 * time.Millisecond)
+	if err := tsl.waitForValid(ctx); err != nil {
+		return 0, 0, err
 	}
 
 	// Reading from TSL2591_REGISTER_CHAN0_LOW, and TSL2591_REGISTER_CHAN1_LOW
 	// They are 2 bytes each, so we read 4 bytes in total
 	bytes := make([]byte, 4)
-	err := tsl.Device.ReadReg(TSL2591_COMMAND_BIT|TSL2591_REGISTER_CHAN0_LOW, bytes)
+	err := tsl.bus.ReadReg(TSL2591_COMMAND_BIT|TSL2591_REGISTER_CHAN0_LOW, bytes)
 	if err != nil {
-
-		fmt.Printf("Error reading from register: %v\n", err)
-		return 0, 0, err
+		return 0, 0, fmt.Errorf("Failed to read channels: %w", err)
 	}
-	// l.Debugf("Bytes read: %v\n", bytes)
 
 	channel0 := binary.LittleEndian.Uint16(bytes[0:])
 	channel1 := binary.LittleEndian.Uint16(bytes[2:])
-
-	// l.Debugf("Channel 0: %v, Channel 1: %v\n", channel0, channel1)
 	return channel0, channel1, nil
 }
 
+// Poll the STATUS register until the AVALID bit is set.
+// The integration time is nominal, so we allow the oscillator some slack before giving up.
+func (tsl *TSL2591) waitForValid(ctx context.Context) error {
+	timeout := time.NewTimer(2*IntegrationTimeToDuration(tsl.timing) + 100*time.Millisecond)
+	defer timeout.Stop()
+	poll := time.NewTicker(statusPollInterval)
+	defer poll.Stop()
+
+	status := make([]byte, 1)
+	for {
+		if err := tsl.bus.ReadReg(TSL2591_COMMAND_BIT|TSL2591_REGISTER_DEVICE_STATUS, status); err != nil {
+			return fmt.Errorf("Failed to read status: %w", err)
+		}
+		if status[0]&TSL2591_STATUS_AVALID != 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			return errors.New("timed out waiting for a valid reading")
+		case <-poll.C:
+		}
+	}
+}
+
 func (tsl *TSL2591) CalculateLux(ch0, ch1 uint16) (float64, error) {
 	// Check for channel overflow
 	if ch0 == 0xFFFF || ch1 == 0xFFFF {
 		return 0, fmt.Errorf("Overflow: Channel 0: %v, Channel 1: %v\n", ch0, ch1)
 	}
 
-	var int_time float64
-	switch tsl.Timing {
-	case TSL2591_INTEGRATIONTIME_100MS:
-		int_time = 100.0
-	case TSL2591_INTEGRATIONTIME_200MS:
-		int_time = 200.0
-	case TSL2591_INTEGRATIONTIME_300MS:
-		int_time = 300.0
-	case TSL2591_INTEGRATIONTIME_400MS:
-		int_time = 400.0
-	case TSL2591_INTEGRATIONTIME_500MS:
-		int_time = 500.0
-	case TSL2591_INTEGRATIONTIME_600MS:
-		int_time = 600.0
-	default:
-		int_time = 100.0
-	}
-
-	var adj_gain float64
-	switch tsl.Gain {
-	case TSL2591_GAIN_LOW:
-		adj_gain = 1.0
-	case TSL2591_GAIN_MED:
-		adj_gain = 25.0
-	case TSL2591_GAIN_HIGH:
-		adj_gain = 428.0
-	case TSL2591_GAIN_MAX:
-		adj_gain = 9876.0
-	default:
-		adj_gain = 1.0
-	}
+	tsl.mu.Lock()
+	int_time := float64(IntegrationTimeToDuration(tsl.timing).Milliseconds())
+	adj_gain := GainToMultiplier(tsl.gain)
+	tsl.mu.Unlock()
 
 	// Based on the formula provided in the datasheet of the TSL2591 sensor
 	cpl := (int_time * adj_gain) / TSL2591_LUX_DF
@@ -156,38 +219,119 @@ func (tsl *TSL2591) CalculateLux(ch0, ch1 uint16) (float64, error) {
 	return lux, nil
 }
 
+// A gain & integration time pair, ordered by how sensitive the sensor is with it applied
+type setting struct {
+	gain   byte
+	timing byte
+}
+
+func (s setting) sensitivity() float64 {
+	return GainToMultiplier(s.gain) * float64(IntegrationTimeToDuration(s.timing).Milliseconds())
+}
+
+var settings = func() []setting {
+	gains := []byte{TSL2591_GAIN_LOW, TSL2591_GAIN_MED, TSL2591_GAIN_HIGH, TSL2591_GAIN_MAX}
+	timings := []byte{TSL2591_INTEGRATIONTIME_100MS, TSL2591_INTEGRATIONTIME_200MS, TSL2591_INTEGRATIONTIME_300MS, TSL2591_INTEGRATIONTIME_400MS, TSL2591_INTEGRATIONTIME_500MS, TSL2591_INTEGRATIONTIME_600MS}
+	all := make([]setting, 0, len(gains)*len(timings))
+	for _, gain := range gains {
+		for _, timing := range timings {
+			all = append(all, setting{gain: gain, timing: timing})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].sensitivity() < all[j].sensitivity() })
+	return all
+}()
+
+// Index of the most sensitive setting that doesn't exceed the wanted sensitivity, within [lo, hi]
+func settingFor(want float64, lo, hi int) int {
+	idx := lo
+	for i := lo; i <= hi; i++ {
+		if settings[i].sensitivity() <= want {
+			idx = i
+		}
+	}
+	return idx
+}
+
 func (tsl *TSL2591) SetOptimalGain() error {
-	// Try each gain option and see if the sensor is saturated
-	gainOptions := []byte{TSL2591_GAIN_MAX, TSL2591_GAIN_HIGH, TSL2591_GAIN_MED, TSL2591_GAIN_LOW}
-	integrationOptions := []byte{TSL2591_INTEGRATIONTIME_600MS, TSL2591_INTEGRATIONTIME_500MS, TSL2591_INTEGRATIONTIME_400MS, TSL2591_INTEGRATIONTIME_300MS, TSL2591_INTEGRATIONTIME_200MS, TSL2591_INTEGRATIONTIME_100MS}
-	for _, time := range integrationOptions {
-		tsl.SetTiming(time)
-		for _, gain := range gainOptions {
-			tsl.SetGain(gain)
-			l.Debugf("Attempting - Gain: %v, Integration Time: %v", GainToString(gain), IntegrationTimeToString(time))
-			ch0, ch1, err := tsl.GetFullLuminosity()
-			if err != nil {
-				continue
-			}
-			if ch0 == 0xFFFF || ch1 == 0xFFFF {
-				continue
-			}
-			lux, err := tsl.CalculateLux(ch0, ch1)
-			if err != nil {
-				continue
-			} else if lux == 0 {
-				continue
+	return tsl.SetOptimalGainContext(context.Background())
+}
+
+// Search for a gain & integration time that puts channel 0 near the target count.
+// Starts from the current setting, scaling by the measured counts when we can,
+// and bisecting towards lower sensitivity when the sensor is saturated.
+// The lock is only held for each probe, so the sensor can be disabled mid-search.
+func (tsl *TSL2591) SetOptimalGainContext(ctx context.Context) error {
+	lo, hi := 0, len(settings)-1
+	idx := 0
+	tsl.mu.Lock()
+	for i, s := range settings {
+		if s.gain == tsl.gain && s.timing == tsl.timing {
+			idx = i
+		}
+	}
+	tsl.mu.Unlock()
+
+	best := -1
+	for step := 0; step < maxGainSearchSteps; step++ {
+		s := settings[idx]
+		l.Debugf("Attempting - Gain: %v, Integration Time: %v", GainToString(s.gain), IntegrationTimeToString(s.timing))
+		ch0, ch1, err := tsl.probe(ctx, s)
+		if err != nil {
+			return err
+		}
+
+		maxCount := MaxCount(s.timing)
+		if ch0 >= maxCount || ch1 >= maxCount {
+			hi = idx - 1
+			if hi < lo {
+				break
 			}
-			l.Debugf("Set - Gain: %v, Integration Time: %v", GainToString(gain), IntegrationTimeToString(time))
-			return nil
+			idx = (lo + hi) / 2
+			continue
 		}
+		best = idx
+
+		want := s.sensitivity() * gainSearchTarget / math.Max(float64(ch0), 1)
+		if ch0 < gainSearchMinCount && idx < hi {
+			lo = idx + 1
+			idx = settingFor(want, lo, hi)
+			continue
+		} else if ch0 > maxCount/4*3 && idx > lo {
+			hi = idx - 1
+			idx = settingFor(want, lo, hi)
+			continue
+		}
+
+		l.Debugf("Set - Gain: %v, Integration Time: %v", GainToString(s.gain), IntegrationTimeToString(s.timing))
+		return nil
+	}
+
+	tsl.mu.Lock()
+	defer tsl.mu.Unlock()
+	if best >= 0 {
+		s := settings[best]
+		l.Debugf("Set - Gain: %v, Integration Time: %v", GainToString(s.gain), IntegrationTimeToString(s.timing))
+		return tsl.setGainAndTiming(s.gain, s.timing)
+	}
+
+	// Use the least sensitive options
+	if err := tsl.setGainAndTiming(settings[0].gain, settings[0].timing); err != nil {
+		return err
 	}
-	// Use default options
-	tsl.SetGain(TSL2591_GAIN_LOW)
-	tsl.SetTiming(TSL2591_INTEGRATIONTIME_600MS)
 	return errors.New("All gain options are saturated")
 }
 
+// Apply a setting and take a reading with it
+func (tsl *TSL2591) probe(ctx context.Context, s setting) (uint16, uint16, error) {
+	tsl.mu.Lock()
+	defer tsl.mu.Unlock()
+	if err := tsl.setGainAndTiming(s.gain, s.timing); err != nil {
+		return 0, 0, err
+	}
+	return tsl.readChannels(ctx)
+}
+
 // Returns the normalized output for a given spectrum type
 func GetNormalizedOutput(spectrumType byte, ch0, ch1 uint16) float64 {
 	switch spectrumType {
@@ -208,77 +352,111 @@ func GetNormalizedOutput(spectrumType byte, ch0, ch1 uint16) float64 {
 
 // Enable the sensor
 func (tsl *TSL2591) Enable() error {
-	tsl.Lock()
-	defer tsl.Unlock()
+	tsl.mu.Lock()
+	defer tsl.mu.Unlock()
 
-	if tsl.Enabled {
+	if tsl.enabled.Load() {
 		return nil
 	}
 	var write []byte = []byte{
-		TSL2591_ENABLE_POWERON | TSL2591_ENABLE_AEN | TSL2591_ENABLE_AIEN | TSL2591_ENABLE_NPIEN,
+		enableFlags,
 	}
-	if err := tsl.Device.WriteReg(TSL2591_COMMAND_BIT|TSL2591_REGISTER_ENABLE, write); err != nil {
+	if err := tsl.bus.WriteReg(TSL2591_COMMAND_BIT|TSL2591_REGISTER_ENABLE, write); err != nil {
 		return err
 	}
-	tsl.Enabled = true
+	tsl.enabled.Store(true)
 	return nil
 }
 
 // Disable the sensor
 func (tsl *TSL2591) Disable() error {
-	tsl.Lock()
-	defer tsl.Unlock()
+	tsl.mu.Lock()
+	defer tsl.mu.Unlock()
 
-	if !tsl.Enabled {
+	if !tsl.enabled.Load() {
 		return nil
 	}
 	var write []byte = []byte{
 		TSL2591_ENABLE_POWEROFF,
 	}
-	if err := tsl.Device.WriteReg(TSL2591_COMMAND_BIT|TSL2591_REGISTER_ENABLE, write); err != nil {
+	if err := tsl.bus.WriteReg(TSL2591_COMMAND_BIT|TSL2591_REGISTER_ENABLE, write); err != nil {
 		return err
 	}
-	tsl.Enabled = false
+	tsl.enabled.Store(false)
 	return nil
 }
 
+// Check if the sensor is powered on
+func (tsl *TSL2591) IsEnabled() bool {
+	return tsl.enabled.Load()
+}
+
 // Set the gain for the sensor
 func (tsl *TSL2591) SetGain(gain byte) error {
-	if !tsl.Enabled {
-		return errors.New("sensor must be enabled")
-	}
-
-	write := []byte{
-		tsl.Timing | gain,
-	}
-	if err := tsl.Device.WriteReg(TSL2591_COMMAND_BIT|TSL2591_REGISTER_CONTROL, write); err != nil {
-		return err
-	}
-	tsl.Gain = gain
-	return nil
+	tsl.mu.Lock()
+	defer tsl.mu.Unlock()
+	return tsl.setGainAndTiming(gain, tsl.timing)
 }
 
 // Set the integration timing for the sensor
 func (tsl *TSL2591) SetTiming(timing byte) error {
-	if !tsl.Enabled {
+	tsl.mu.Lock()
+	defer tsl.mu.Unlock()
+	return tsl.setGainAndTiming(tsl.gain, timing)
+}
+
+// Write the CONTROL register, then restart the ALS so the next valid reading uses the new settings.
+// The caller must hold mu.
+func (tsl *TSL2591) setGainAndTiming(gain byte, timing byte) error {
+	if !tsl.enabled.Load() {
 		return errors.New("sensor must be enabled")
 	}
-
 	write := []byte{
-		timing | tsl.Gain,
+		timing | gain,
 	}
-	err := tsl.Device.WriteReg(TSL2591_COMMAND_BIT|TSL2591_REGISTER_CONTROL, write)
-	if err != nil {
+	if err := tsl.bus.WriteReg(TSL2591_COMMAND_BIT|TSL2591_REGISTER_CONTROL, write); err != nil {
 		return err
 	}
-	tsl.Timing = timing
-	return nil
+	tsl.gain = gain
+	tsl.timing = timing
+
+	// Clearing AEN resets AVALID, the next integration cycle starts when it's set again
+	if err := tsl.bus.WriteReg(TSL2591_COMMAND_BIT|TSL2591_REGISTER_ENABLE, []byte{TSL2591_ENABLE_POWERON}); err != nil {
+		return err
+	}
+	return tsl.bus.WriteReg(TSL2591_COMMAND_BIT|TSL2591_REGISTER_ENABLE, []byte{enableFlags})
 }
 
 func (tsl *TSL2591) GetGain() string {
-	return GainToString(tsl.Gain)
+	tsl.mu.Lock()
+	defer tsl.mu.Unlock()
+	return GainToString(tsl.gain)
 }
 
 func (tsl *TSL2591) GetTiming() string {
-	return IntegrationTimeToString(tsl.Timing)
+	tsl.mu.Lock()
+	defer tsl.mu.Unlock()
+	return IntegrationTimeToString(tsl.timing)
+}
+
+// FullScale returns the count the channels saturate at, with the current integration time
+func (tsl *TSL2591) FullScale() uint16 {
+	tsl.mu.Lock()
+	defer tsl.mu.Unlock()
+	return MaxCount(tsl.timing)
+}
+
+// Check the sensor is still on the bus, by reading the device ID
+func (tsl *TSL2591) Ping() error {
+	tsl.mu.Lock()
+	defer tsl.mu.Unlock()
+
+	buf := make([]byte, 1)
+	if err := tsl.bus.ReadReg(TSL2591_COMMAND_BIT|TSL2591_REGISTER_DEVICE_ID, buf); err != nil {
+		return fmt.Errorf("Failed to read ref: %w", err)
+	}
+	if buf[0] != TSL2591_DEVICE_ID {
+		return errors.New("Can't find a TSL2591")
+	}
+	return nil
 }
@@ -0,0 +1,302 @@
+package tsl2591
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A bus whose integration cycle never completes, and that counts the status polls
+type stuckBus struct {
+	*SimulatedBus
+	stuck       atomic.Bool
+	statusReads atomic.Int32
+	deviceID    byte
+}
+
+func (b *stuckBus) ReadReg(reg byte, buf []byte) error {
+	switch reg &^ TSL2591_COMMAND_BIT {
+	case TSL2591_REGISTER_DEVICE_STATUS:
+		b.statusReads.Add(1)
+		if b.stuck.Load() {
+			buf[0] = 0
+			return nil
+		}
+	case TSL2591_REGISTER_DEVICE_ID:
+		if b.deviceID != 0 {
+			buf[0] = b.deviceID
+			return nil
+		}
+	}
+	return b.SimulatedBus.ReadReg(reg, buf)
+}
+
+func newTestSensor(t *testing.T, bus Bus, gain byte, timing byte) *TSL2591 {
+	t.Helper()
+	tsl, err := NewTSL2591WithBus(bus, gain, timing)
+	if err != nil {
+		t.Fatalf("NewTSL2591WithBus: %v", err)
+	}
+	if err := tsl.Enable(); err != nil {
+		t.Fatalf("Enable: %v", err)
+	}
+	t.Cleanup(func() { tsl.Close() })
+	return tsl
+}
+
+func TestWaitForValidPollsUntilAVALID(t *testing.T) {
+	bus := &stuckBus{SimulatedBus: NewSimulatedBus(100)}
+	tsl := newTestSensor(t, bus, TSL2591_GAIN_MED, TSL2591_INTEGRATIONTIME_200MS)
+
+	started := time.Now()
+	ch0, ch1, err := tsl.GetFullLuminosity()
+	if err != nil {
+		t.Fatalf("GetFullLuminosity: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed < 150*time.Millisecond {
+		t.Errorf("read returned after %v, before the integration cycle completed", elapsed)
+	}
+	if bus.statusReads.Load() < 2 {
+		t.Errorf("status was read %d times, expected it to be polled", bus.statusReads.Load())
+	}
+	if ch0 == 0 || ch1 == 0 {
+		t.Errorf("expected counts once AVALID is set, got %d, %d", ch0, ch1)
+	}
+}
+
+func TestWaitForValidTimesOut(t *testing.T) {
+	bus := &stuckBus{SimulatedBus: NewSimulatedBus(100)}
+	tsl := newTestSensor(t, bus, TSL2591_GAIN_MED, TSL2591_INTEGRATIONTIME_100MS)
+	bus.stuck.Store(true)
+
+	started := time.Now()
+	_, _, err := tsl.GetFullLuminosity()
+	if err == nil || err.Error() != "timed out waiting for a valid reading" {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	// Twice the integration time, plus slack
+	if elapsed := time.Since(started); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("timed out after %v", elapsed)
+	}
+}
+
+func TestWaitForValidContextCancelled(t *testing.T) {
+	bus := &stuckBus{SimulatedBus: NewSimulatedBus(100)}
+	tsl := newTestSensor(t, bus, TSL2591_GAIN_MED, TSL2591_INTEGRATIONTIME_600MS)
+	bus.stuck.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, _, err := tsl.GetFullLuminosityContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context's error, got %v", err)
+	}
+}
+
+func TestWaitForValidBusError(t *testing.T) {
+	bus := NewSimulatedBus(100)
+	tsl := newTestSensor(t, bus, TSL2591_GAIN_MED, TSL2591_INTEGRATIONTIME_100MS)
+	bus.SetError(errors.New("remote I/O error"))
+
+	if _, _, err := tsl.GetFullLuminosity(); err == nil {
+		t.Fatal("expected the bus error")
+	}
+}
+
+func TestSetOptimalGainSaturated(t *testing.T) {
+	// Bright sun saturates the most sensitive settings
+	bus := NewSimulatedBus(30000)
+	tsl := newTestSensor(t, bus, TSL2591_GAIN_MAX, TSL2591_INTEGRATIONTIME_600MS)
+
+	if err := tsl.SetOptimalGain(); err != nil {
+		t.Fatalf("SetOptimalGain: %v", err)
+	}
+	ch0, ch1, err := tsl.GetFullLuminosity()
+	if err != nil {
+		t.Fatalf("GetFullLuminosity: %v", err)
+	}
+	if full := tsl.FullScale(); ch0 >= full || ch1 >= full {
+		t.Fatalf("still saturated with %s, %s: %d, %d", tsl.GetGain(), tsl.GetTiming(), ch0, ch1)
+	}
+	lux, err := tsl.CalculateLux(ch0, ch1)
+	if err != nil {
+		t.Fatalf("CalculateLux: %v", err)
+	}
+	if math.Abs(lux-30000)/30000 > 0.01 {
+		t.Errorf("expected about 30000 lux, got %v", lux)
+	}
+}
+
+func TestSetOptimalGainAllSaturated(t *testing.T) {
+	bus := NewSimulatedBus(1e6)
+	tsl := newTestSensor(t, bus, TSL2591_GAIN_MED, TSL2591_INTEGRATIONTIME_300MS)
+
+	if err := tsl.SetOptimalGain(); err == nil {
+		t.Fatal("expected every setting to be saturated")
+	}
+	if tsl.GetGain() != GainToString(TSL2591_GAIN_LOW) || tsl.GetTiming() != IntegrationTimeToString(TSL2591_INTEGRATIONTIME_100MS) {
+		t.Errorf("expected the least sensitive setting, got %s, %s", tsl.GetGain(), tsl.GetTiming())
+	}
+}
+
+func TestSetOptimalGainLowLight(t *testing.T) {
+	// Dusk barely registers at low gain
+	bus := NewSimulatedBus(2)
+	tsl := newTestSensor(t, bus, TSL2591_GAIN_LOW, TSL2591_INTEGRATIONTIME_100MS)
+
+	if err := tsl.SetOptimalGain(); err != nil {
+		t.Fatalf("SetOptimalGain: %v", err)
+	}
+	ch0, _, err := tsl.GetFullLuminosity()
+	if err != nil {
+		t.Fatalf("GetFullLuminosity: %v", err)
+	}
+	if ch0 < gainSearchMinCount || ch0 >= tsl.FullScale() {
+		t.Errorf("expected channel 0 between %d and full scale with %s, %s, got %d", gainSearchMinCount, tsl.GetGain(), tsl.GetTiming(), ch0)
+	}
+}
+
+func TestSetOptimalGainCancelled(t *testing.T) {
+	bus := NewSimulatedBus(2)
+	tsl := newTestSensor(t, bus, TSL2591_GAIN_LOW, TSL2591_INTEGRATIONTIME_600MS)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := tsl.SetOptimalGainContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the search to stop, got %v", err)
+	}
+}
+
+func TestProbeAppliesSetting(t *testing.T) {
+	bus := NewSimulatedBus(5)
+	tsl := newTestSensor(t, bus, TSL2591_GAIN_LOW, TSL2591_INTEGRATIONTIME_100MS)
+
+	s := setting{gain: TSL2591_GAIN_HIGH, timing: TSL2591_INTEGRATIONTIME_200MS}
+	ch0, ch1, err := tsl.probe(context.Background(), s)
+	if err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if tsl.GetGain() != GainToString(s.gain) || tsl.GetTiming() != IntegrationTimeToString(s.timing) {
+		t.Errorf("probe didn't keep the setting, got %s, %s", tsl.GetGain(), tsl.GetTiming())
+	}
+	lux, err := tsl.CalculateLux(ch0, ch1)
+	if err != nil {
+		t.Fatalf("CalculateLux: %v", err)
+	}
+	if math.Abs(lux-5)/5 > 0.01 {
+		t.Errorf("expected about 5 lux, got %v", lux)
+	}
+
+	tsl.Disable()
+	if _, _, err := tsl.probe(context.Background(), s); err == nil {
+		t.Error("expected probing a disabled sensor to fail")
+	}
+}
+
+func TestPing(t *testing.T) {
+	bus := NewSimulatedBus(100)
+	tsl := newTestSensor(t, bus, TSL2591_GAIN_MED, TSL2591_INTEGRATIONTIME_100MS)
+
+	if err := tsl.Ping(); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	bus.SetError(errors.New("remote I/O error"))
+	if err := tsl.Ping(); err == nil {
+		t.Fatal("expected Ping to fail while the sensor is disconnected")
+	}
+	bus.SetError(nil)
+	if err := tsl.Ping(); err != nil {
+		t.Fatalf("Ping after reconnecting: %v", err)
+	}
+}
+
+func TestWrongDeviceID(t *testing.T) {
+	bus := &stuckBus{SimulatedBus: NewSimulatedBus(100), deviceID: 0x28}
+	if _, err := NewTSL2591WithBus(bus, TSL2591_GAIN_MED, TSL2591_INTEGRATIONTIME_100MS); err == nil {
+		t.Fatal("expected a device with another ID to be rejected")
+	}
+}
+
+// A bus that fails writes to the control register, and remembers being closed
+type failingControlBus struct {
+	*SimulatedBus
+	closed atomic.Bool
+}
+
+func (b *failingControlBus) WriteReg(reg byte, buf []byte) error {
+	if reg&^TSL2591_COMMAND_BIT == TSL2591_REGISTER_CONTROL {
+		return errors.New("remote I/O error")
+	}
+	return b.SimulatedBus.WriteReg(reg, buf)
+}
+
+func (b *failingControlBus) Close() error {
+	b.closed.Store(true)
+	return b.SimulatedBus.Close()
+}
+
+func TestSetupFailureClosesBus(t *testing.T) {
+	bus := &failingControlBus{SimulatedBus: NewSimulatedBus(100)}
+	if _, err := NewTSL2591WithBus(bus, TSL2591_GAIN_MED, TSL2591_INTEGRATIONTIME_100MS); err == nil {
+		t.Fatal("expected a failed gain write to be returned")
+	}
+	if !bus.closed.Load() {
+		t.Error("the bus was left open")
+	}
+}
+
+// Readings, gain changes and power toggling from several goroutines, for go test -race
+func TestConcurrentReadsWhileToggling(t *testing.T) {
+	bus := NewSimulatedBus(1000)
+	tsl := newTestSensor(t, bus, TSL2591_GAIN_MED, TSL2591_INTEGRATIONTIME_100MS)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var reads atomic.Int32
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				readCtx, readCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+				if _, _, err := tsl.GetFullLuminosityContext(readCtx); err == nil {
+					reads.Add(1)
+				}
+				readCancel()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			tsl.Disable()
+			tsl.IsEnabled()
+			time.Sleep(5 * time.Millisecond)
+			tsl.Enable()
+			tsl.SetGain(TSL2591_GAIN_LOW)
+			tsl.GetGain()
+			time.Sleep(150 * time.Millisecond)
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("readers didn't stop, the sensor lock may be stuck")
+	}
+	if reads.Load() == 0 {
+		t.Error("expected some reads to succeed between toggles")
+	}
+}
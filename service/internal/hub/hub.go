@@ -0,0 +1,434 @@
+package hub
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ztkent/gnome/internal/device"
+	"github.com/ztkent/gnome/internal/discovery"
+	"github.com/ztkent/gnome/internal/gnome"
+	"github.com/ztkent/gnome/internal/solar"
+	"github.com/ztkent/gnome/internal/storage"
+)
+
+const (
+	SYNC_INTERVAL      = time.Minute
+	DISCOVERY_INTERVAL = 5 * time.Minute
+	DISCOVERY_WAIT     = 3 * time.Second
+	REQUEST_TIMEOUT    = 30 * time.Second
+	// Pages per peer per sync, so one device with a long backlog doesn't hold up the rest
+	MAX_PAGES_PER_SYNC = 20
+	// When each peer was last synced, in sqlite's own format
+	TIME_FORMAT = "2006-01-02 15:04:05"
+)
+
+var (
+	ErrFingerprintMismatch = errors.New("peer certificate doesn't match the pinned key, re-pin it if the key was replaced on purpose")
+	ErrPinnedOverHTTPS     = errors.New("peer was pinned over https, so it isn't trusted over http")
+)
+
+type Peer struct {
+	DeviceID string `json:"device_id"`
+	URL      string `json:"url"`
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	// The certificate the peer presented last
+	TLSSHA256 string `json:"tls_sha256,omitempty"`
+	// The peer's public key, pinned the first time the hub connects over https. It survives a certificate renewal.
+	TLSSPKISHA256 string `json:"tls_spki_sha256,omitempty"`
+	// Only approved peers are sent the hub token. Discovered peers need approving.
+	Approved   bool    `json:"approved"`
+	LastID     int64   `json:"last_id"`
+	LastSyncAt *string `json:"last_sync_at"`
+	LastError  string  `json:"last_error,omitempty"`
+	// The hub's own readings are included as a peer
+	Local bool `json:"local"`
+}
+
+// What a peer's certificate has to match. Once its public key is known only that is checked,
+// a certificate fingerprint is used before then, when an operator or discovery gave one.
+type Pin struct {
+	SPKISHA256 string
+	SHA256     string
+}
+
+func (p Pin) empty() bool {
+	return p.SPKISHA256 == "" && p.SHA256 == ""
+}
+
+// Whether the certificate a peer presented matches, an empty pin matches anything
+func (p Pin) matches(seen Pin) bool {
+	if p.SPKISHA256 != "" {
+		return p.SPKISHA256 == seen.SPKISHA256
+	}
+	return p.SHA256 == "" || normalizeFingerprint(p.SHA256) == normalizeFingerprint(seen.SHA256)
+}
+
+// Peers pinned by certificate before public keys were keep that pin until their key is known
+func (p Peer) pin() Pin {
+	if p.TLSSPKISHA256 != "" {
+		return Pin{SPKISHA256: p.TLSSPKISHA256}
+	}
+	return Pin{SHA256: p.TLSSHA256}
+}
+
+// Hub pulls readings from other Gnome devices into its own database, so beds can be compared in one place.
+// Peers come from configuration, discovery broadcasts, or the API, and are keyed by their device UUID.
+type Hub struct {
+	db            *sql.DB
+	self          *device.Registry
+	token         string
+	peerURLs      []string
+	discoveryPort int
+	// Where the peers' readings are kept, alongside the hub's own
+	readings storage.ReadingStore
+	// Times are served in this timezone unless a request asks for another
+	timezone *time.Location
+	// Where the beds are, to compare them with a clear sky. Nil when it isn't configured.
+	site *solar.Site
+
+	// Only one sync runs at a time
+	syncing sync.Mutex
+}
+
+func New(db *sql.DB, readings storage.ReadingStore, self *device.Registry, token string, peerURLs []string, discoveryPort int, timezone *time.Location, site *solar.Site) *Hub {
+	return &Hub{
+		db:            db,
+		readings:      readings,
+		self:          self,
+		token:         token,
+		peerURLs:      peerURLs,
+		discoveryPort: discoveryPort,
+		timezone:      timezone,
+		site:          site,
+	}
+}
+
+// Discover and sync peers until the context is cancelled
+func (h *Hub) Run(ctx context.Context) {
+	syncTicker := time.NewTicker(SYNC_INTERVAL)
+	defer syncTicker.Stop()
+	discoverTicker := time.NewTicker(DISCOVERY_INTERVAL)
+	defer discoverTicker.Stop()
+	h.discover(ctx)
+	h.Sync(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-discoverTicker.C:
+			h.discover(ctx)
+		case <-syncTicker.C:
+			h.Sync(ctx)
+		}
+	}
+}
+
+// Refresh the configured peers, and look for new ones. Names and addresses are updated as they change.
+func (h *Hub) discover(ctx context.Context) {
+	for _, peerURL := range h.peerURLs {
+		if _, err := h.AddPeer(ctx, peerURL, Pin{}, true); err != nil {
+			log.Printf("Failed to add hub peer %s: %v", peerURL, err)
+		}
+	}
+	if h.discoveryPort == 0 {
+		return
+	}
+	discoverCtx, cancel := context.WithTimeout(ctx, DISCOVERY_WAIT)
+	defer cancel()
+	replies, err := discovery.Discover(discoverCtx, h.discoveryPort)
+	if err != nil {
+		log.Printf("Hub discovery failed: %v", err)
+		return
+	}
+	for _, reply := range replies {
+		if reply.ID == h.self.Info().ID {
+			continue
+		}
+		peerURL := fmt.Sprintf("http://%s:%d", reply.IP, reply.Port)
+		if reply.TLSPort != 0 {
+			peerURL = fmt.Sprintf("https://%s:%d", reply.IP, reply.TLSPort)
+		}
+		// Anyone on the network can answer, so discovered peers aren't approved
+		if _, err := h.AddPeer(ctx, peerURL, Pin{SHA256: reply.TLSSHA256}, false); err != nil {
+			log.Printf("Failed to add discovered peer %s: %v", peerURL, err)
+		}
+	}
+}
+
+// Add a peer by its base URL, or update the URL and name of one we already know.
+// An https peer's public key is pinned the first time the hub connects, and only RepinPeer replaces it.
+// The expected pin is checked before that, when an operator or discovery gave one.
+// Approving a peer lets the hub send it the hub token, an approved peer stays approved.
+func (h *Hub) AddPeer(ctx context.Context, baseURL string, expected Pin, approve bool) (Peer, error) {
+	parsed, err := url.Parse(strings.TrimRight(baseURL, "/"))
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return Peer{}, fmt.Errorf("invalid peer URL %q", baseURL)
+	}
+	baseURL = parsed.String()
+
+	identity, seen, err := h.identify(ctx, baseURL, expected)
+	if err != nil {
+		return Peer{}, err
+	}
+
+	existing, err := h.peer(ctx, identity.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Peer{}, err
+	}
+	if pinned := existing.pin(); !pinned.empty() {
+		if parsed.Scheme != "https" {
+			return Peer{}, ErrPinnedOverHTTPS
+		} else if !pinned.matches(seen) {
+			return Peer{}, ErrFingerprintMismatch
+		}
+	}
+	spki := existing.TLSSPKISHA256
+	if spki == "" {
+		spki = seen.SPKISHA256
+	}
+
+	_, err = h.db.ExecContext(ctx, `INSERT INTO hub_peers (device_id, url, name, location, tls_sha256, tls_spki_sha256, approved) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (device_id) DO UPDATE SET url = excluded.url, name = excluded.name, location = excluded.location,
+			tls_sha256 = excluded.tls_sha256, tls_spki_sha256 = excluded.tls_spki_sha256, approved = MAX(approved, excluded.approved)`,
+		identity.ID, baseURL, identity.Name, identity.Location, seen.SHA256, spki, approve)
+	if err != nil {
+		return Peer{}, fmt.Errorf("failed to save peer: %w", err)
+	}
+	return h.peer(ctx, identity.ID)
+}
+
+// Pin the key a peer presents now, after it was replaced on purpose, e.g. with a new GNOME_TLS_KEY.
+// The peer has to answer as the same device, at the URL the hub already has for it.
+func (h *Hub) RepinPeer(ctx context.Context, deviceID string) (Peer, error) {
+	peer, err := h.peer(ctx, deviceID)
+	if err != nil {
+		return Peer{}, err
+	}
+	if !strings.HasPrefix(peer.URL, "https://") {
+		return Peer{}, fmt.Errorf("%s isn't https, so there's nothing to pin", peer.URL)
+	}
+	identity, seen, err := h.identify(ctx, peer.URL, Pin{})
+	if err != nil {
+		return Peer{}, err
+	}
+	if identity.ID != deviceID {
+		return Peer{}, fmt.Errorf("%s is now device %s, not %s", peer.URL, identity.ID, deviceID)
+	}
+	_, err = h.db.ExecContext(ctx, `UPDATE hub_peers SET tls_sha256 = ?, tls_spki_sha256 = ?, last_error = '' WHERE device_id = ?`,
+		seen.SHA256, seen.SPKISHA256, deviceID)
+	if err != nil {
+		return Peer{}, fmt.Errorf("failed to save peer: %w", err)
+	}
+	return h.peer(ctx, deviceID)
+}
+
+// Let the hub send a peer the hub token, after checking its tls_spki_sha256 against the peer's own
+func (h *Hub) ApprovePeer(ctx context.Context, deviceID string) (Peer, error) {
+	if _, err := h.db.ExecContext(ctx, `UPDATE hub_peers SET approved = 1 WHERE device_id = ?`, deviceID); err != nil {
+		return Peer{}, err
+	}
+	return h.peer(ctx, deviceID)
+}
+
+// Ask a peer which device it is, without the hub token
+func (h *Hub) identify(ctx context.Context, baseURL string, expected Pin) (device.Info, Pin, error) {
+	var identity struct {
+		Device device.Info `json:"device"`
+	}
+	seen, err := h.get(ctx, baseURL+"/id", expected, false, &identity)
+	if err != nil {
+		return device.Info{}, Pin{}, err
+	}
+	if identity.Device.ID == "" {
+		return device.Info{}, Pin{}, fmt.Errorf("%s didn't report a device id", baseURL)
+	} else if identity.Device.ID == h.self.Info().ID {
+		return device.Info{}, Pin{}, errors.New("a hub can't be its own peer")
+	}
+	return identity.Device, seen, nil
+}
+
+func (h *Hub) RemovePeer(ctx context.Context, deviceID string) (bool, error) {
+	result, err := h.db.ExecContext(ctx, `DELETE FROM hub_peers WHERE device_id = ?`, deviceID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// Pull new readings from every peer
+func (h *Hub) Sync(ctx context.Context) {
+	h.syncing.Lock()
+	defer h.syncing.Unlock()
+
+	peers, err := h.Peers(ctx)
+	if err != nil {
+		log.Printf("Failed to list hub peers: %v", err)
+		return
+	}
+	for _, peer := range peers {
+		if peer.Local {
+			continue
+		}
+		err := h.syncPeer(ctx, peer)
+		message := ""
+		if err != nil {
+			message = err.Error()
+			log.Printf("Failed to sync %s (%s): %v", peer.Name, peer.URL, err)
+		}
+		_, err = h.db.ExecContext(ctx, `UPDATE hub_peers SET last_sync_at = ?, last_error = ? WHERE device_id = ?`,
+			time.Now().UTC().Format(TIME_FORMAT), message, peer.DeviceID)
+		if err != nil {
+			log.Printf("Failed to record sync of %s: %v", peer.Name, err)
+		}
+	}
+}
+
+// Page through the peer's readings after our cursor, storing each page before moving the cursor
+func (h *Hub) syncPeer(ctx context.Context, peer Peer) error {
+	afterID := peer.LastID
+	for page := 0; page < MAX_PAGES_PER_SYNC; page++ {
+		var readings gnome.ReadingsPage
+		endpoint := fmt.Sprintf("%s/api/v1/readings?after_id=%d&limit=%d", peer.URL, afterID, gnome.MAX_READINGS_PAGE_SIZE)
+		if _, err := h.get(ctx, endpoint, peer.pin(), peer.Approved, &readings); err != nil {
+			return err
+		}
+		if readings.DeviceID != "" && readings.DeviceID != peer.DeviceID {
+			return fmt.Errorf("%s is now device %s, not %s", peer.URL, readings.DeviceID, peer.DeviceID)
+		}
+		if len(readings.Readings) == 0 {
+			return nil
+		}
+		if err := h.store(ctx, peer.DeviceID, readings); err != nil {
+			return err
+		}
+		afterID = readings.NextAfterID
+		if !readings.HasMore {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Store a page of readings, then move the peer's cursor past it.
+// A page stored twice after a failure is ignored, the readings are keyed by their id on the peer.
+func (h *Hub) store(ctx context.Context, deviceID string, page gnome.ReadingsPage) error {
+	readings := make([]storage.PeerReading, 0, len(page.Readings))
+	for _, reading := range page.Readings {
+		createdAt, err := parseTime(reading.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("reading %d: %w", reading.ID, err)
+		}
+		readings = append(readings, storage.PeerReading{
+			RemoteID:     reading.ID,
+			JobID:        reading.JobID,
+			Lux:          reading.Lux,
+			FullSpectrum: reading.FullSpectrum,
+			Visible:      reading.Visible,
+			Infrared:     reading.Infrared,
+			CreatedAt:    createdAt.UnixMilli(),
+		})
+	}
+	if err := h.readings.InsertPeerReadings(deviceID, readings); err != nil {
+		return err
+	}
+	_, err := h.db.ExecContext(ctx, `UPDATE hub_peers SET last_id = ? WHERE device_id = ?`, page.NextAfterID, deviceID)
+	return err
+}
+
+// GET a JSON document from a peer, returning the certificate and public key it presented over https.
+// The hub token is only sent when authorize is set, over https, to a peer whose certificate matched its pin.
+func (h *Hub) get(ctx context.Context, endpoint string, expected Pin, authorize bool, v interface{}) (Pin, error) {
+	ctx, cancel := context.WithTimeout(ctx, REQUEST_TIMEOUT)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return Pin{}, err
+	}
+	sendToken := authorize && h.token != "" && request.URL.Scheme == "https" && !expected.empty()
+	if sendToken {
+		request.Header.Set("Authorization", "Bearer "+h.token)
+	}
+
+	var seen Pin
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				// Peers use self-signed certificates, so they're pinned rather than verified against a CA
+				InsecureSkipVerify: true,
+				VerifyConnection: func(state tls.ConnectionState) error {
+					if len(state.PeerCertificates) == 0 {
+						return errors.New("peer sent no certificate")
+					}
+					leaf := state.PeerCertificates[0]
+					spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+					seen = Pin{
+						SPKISHA256: base64.StdEncoding.EncodeToString(spki[:]),
+						SHA256:     formatFingerprint(sha256.Sum256(leaf.Raw)),
+					}
+					if !expected.matches(seen) {
+						return ErrFingerprintMismatch
+					}
+					return nil
+				},
+			},
+		},
+		// Following a redirect could take the token somewhere the pin doesn't cover
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	response, err := client.Do(request)
+	if err != nil {
+		return Pin{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusUnauthorized && h.token != "" && !sendToken {
+		return Pin{}, fmt.Errorf("%s returned %s, the hub token is only sent over https to approved peers", endpoint, response.Status)
+	} else if response.StatusCode != http.StatusOK {
+		return Pin{}, fmt.Errorf("%s returned %s", endpoint, response.Status)
+	}
+	if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+		return Pin{}, fmt.Errorf("invalid response from %s: %w", endpoint, err)
+	}
+	return seen, nil
+}
+
+// Colon separated upper case hex, like the fingerprint endpoint serves
+func formatFingerprint(sum [sha256.Size]byte) string {
+	pairs := make([]string, len(sum))
+	for i, b := range sum {
+		pairs[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(pairs, ":")
+}
+
+// Discovery's TXT records leave out the colons
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToUpper(strings.ReplaceAll(fingerprint, ":", ""))
+}
+
+// Peers before epoch milliseconds sent sqlite's own format, newer ones send RFC 3339 with an offset
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, TIME_FORMAT} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
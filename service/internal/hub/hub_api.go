@@ -0,0 +1,223 @@
+package hub
+
+import (
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+//go:embed html/*
+var templateFiles embed.FS
+
+func (h *Hub) DevicesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		peers, err := h.Peers(r.Context())
+		if err != nil {
+			log.Println(err)
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveJSON(w, peers, http.StatusOK)
+	}
+}
+
+// Add and approve a peer from a JSON body of {"url": "https://10.0.0.12:8443", "tls_spki_sha256": "..."}.
+// The public key, or the certificate's tls_sha256, is optional. Without one the first key the hub sees is pinned.
+func (h *Hub) AddPeerHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			URL           string `json:"url"`
+			TLSSHA256     string `json:"tls_sha256"`
+			TLSSPKISHA256 string `json:"tls_spki_sha256"`
+		}
+		if status, err := tools.DecodeJSONBody(w, r, &request); err != nil {
+			serveMessage(w, err.Error(), status)
+			return
+		}
+		peer, err := h.AddPeer(r.Context(), request.URL, Pin{SPKISHA256: request.TLSSPKISHA256, SHA256: request.TLSSHA256}, true)
+		if err != nil {
+			serveMessage(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		serveJSON(w, peer, http.StatusCreated)
+	}
+}
+
+// Stop syncing a peer. Its readings are kept.
+func (h *Hub) RemovePeerHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		removed, err := h.RemovePeer(r.Context(), chi.URLParam(r, "deviceID"))
+		if err != nil {
+			log.Println(err)
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !removed {
+			serveMessage(w, "peer not found", http.StatusNotFound)
+			return
+		}
+		serveMessage(w, "Peer removed", http.StatusOK)
+	}
+}
+
+// Let the hub send a discovered peer the hub token
+func (h *Hub) ApprovePeerHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		peer, err := h.ApprovePeer(r.Context(), chi.URLParam(r, "deviceID"))
+		if errors.Is(err, sql.ErrNoRows) {
+			serveMessage(w, "peer not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println(err)
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveJSON(w, peer, http.StatusOK)
+	}
+}
+
+// Pin the key a peer presents now, after it was replaced on purpose
+func (h *Hub) RepinPeerHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		peer, err := h.RepinPeer(r.Context(), chi.URLParam(r, "deviceID"))
+		if errors.Is(err, sql.ErrNoRows) {
+			serveMessage(w, "peer not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			serveMessage(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		serveJSON(w, peer, http.StatusOK)
+	}
+}
+
+// Sync every peer now, rather than waiting for the next interval
+func (h *Hub) SyncHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.Sync(r.Context())
+		peers, err := h.Peers(r.Context())
+		if err != nil {
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveJSON(w, peers, http.StatusOK)
+	}
+}
+
+// Compare devices over ?start=&end=, the last day by default, with times in the hub's timezone or ?tz=
+func (h *Hub) CompareHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start, end, loc, err := h.parseRange(r)
+		if err != nil {
+			serveMessage(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		comparisons, err := h.Compare(r.Context(), start, end, loc)
+		if err != nil {
+			log.Println(err)
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveJSON(w, comparisons, http.StatusOK)
+	}
+}
+
+// Readings over ?start=&end=, for every device or ?device_id=, with times in the hub's timezone or ?tz=
+func (h *Hub) ReadingsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start, end, loc, err := h.parseRange(r)
+		if err != nil {
+			serveMessage(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		readings, err := h.Readings(r.Context(), r.URL.Query().Get("device_id"), start, end, loc)
+		if err != nil {
+			log.Println(err)
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveJSON(w, readings, http.StatusOK)
+	}
+}
+
+type dashboardData struct {
+	Comparisons []Comparison
+	Peers       map[string]Peer
+	MaxLux      float64
+}
+
+// The combined dashboard card, comparing every bed over the last day
+func (h *Hub) DashboardHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		end := time.Now()
+		comparisons, err := h.Compare(r.Context(), end.Add(-24*time.Hour), end, h.timezone)
+		if err != nil {
+			w.Write([]byte(`<div class="error">Failed to load devices</div>`))
+			return
+		}
+		peers, err := h.Peers(r.Context())
+		if err != nil {
+			w.Write([]byte(`<div class="error">Failed to load devices</div>`))
+			return
+		}
+
+		data := dashboardData{Comparisons: comparisons, Peers: map[string]Peer{}}
+		for _, peer := range peers {
+			data.Peers[peer.DeviceID] = peer
+		}
+		for _, c := range comparisons {
+			data.MaxLux = max(data.MaxLux, c.AverageLux)
+		}
+
+		content, err := templateFiles.ReadFile("html/hub.gohtml")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl, err := template.New("hub").Funcs(template.FuncMap{
+			"percent": func(value, total float64) float64 {
+				if total <= 0 {
+					return 0
+				}
+				return value * 100 / total
+			},
+		}).Parse(string(content))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tmpl.Execute(w, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// The timezone from ?tz=, and ?start=&end= in RFC 3339 or local to it, the last day by default
+func (h *Hub) parseRange(r *http.Request) (time.Time, time.Time, *time.Location, error) {
+	loc, err := tools.RequestLocation(r, h.timezone)
+	if err != nil {
+		return time.Time{}, time.Time{}, loc, err
+	}
+	start, end, err := tools.ParseStartAndEndDate(r, loc, 24*time.Hour)
+	return start, end, loc, err
+}
+
+func serveJSON(w http.ResponseWriter, body interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+func serveMessage(w http.ResponseWriter, message string, status int) {
+	serveJSON(w, map[string]string{"message": message}, status)
+}
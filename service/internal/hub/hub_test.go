@@ -0,0 +1,261 @@
+package hub
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ztkent/gnome/internal/device"
+	"github.com/ztkent/gnome/internal/gnome"
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+// A Gnome the hub can sync from, whose certificate can be swapped while it runs
+type testPeer struct {
+	id  string
+	URL string
+
+	mu             sync.Mutex
+	cert           tls.Certificate
+	authorizations []string
+}
+
+func newTestPeer(t *testing.T, id string, key *ecdsa.PrivateKey) *testPeer {
+	t.Helper()
+	p := &testPeer{id: id, cert: newCertificate(t, key)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/id", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]device.Info{"device": {ID: p.id, Name: "Tomatoes"}})
+	})
+	mux.HandleFunc("/api/v1/readings", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.authorizations = append(p.authorizations, r.Header.Get("Authorization"))
+		p.mu.Unlock()
+		json.NewEncoder(w).Encode(gnome.ReadingsPage{DeviceID: p.id, Readings: []gnome.Reading{}})
+	})
+
+	server := httptest.NewUnstartedServer(mux)
+	server.Listener = tls.NewListener(server.Listener, &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return &p.cert, nil
+		},
+	})
+	server.Start()
+	t.Cleanup(server.Close)
+	p.URL = "https://" + server.Listener.Addr().String()
+	return p
+}
+
+// A new self-signed certificate for the key, like a renewal
+func (p *testPeer) renew(t *testing.T, key *ecdsa.PrivateKey) {
+	cert := newCertificate(t, key)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cert = cert
+}
+
+// The Authorization header of the last sync
+func (p *testPeer) lastAuthorization() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.authorizations) == 0 {
+		return ""
+	}
+	return p.authorizations[len(p.authorizations)-1]
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	return key
+}
+
+func newCertificate(t *testing.T, key *ecdsa.PrivateKey) tls.Certificate {
+	t.Helper()
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newTestHub(t *testing.T) *Hub {
+	t.Helper()
+	db, err := tools.ConnectSqlite(filepath.Join(t.TempDir(), "gnome.db"))
+	if err != nil {
+		t.Fatalf("ConnectSqlite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	self, err := device.Load(db)
+	if err != nil {
+		t.Fatalf("device.Load: %v", err)
+	}
+	return New(db, nil, self, "hub-token", nil, 0, time.UTC, nil)
+}
+
+func syncedPeer(t *testing.T, h *Hub, deviceID string) Peer {
+	t.Helper()
+	h.Sync(context.Background())
+	peer, err := h.peer(context.Background(), deviceID)
+	if err != nil {
+		t.Fatalf("peer: %v", err)
+	}
+	return peer
+}
+
+func TestDiscoveryCantReplacePin(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHub(t)
+	real := newTestPeer(t, "bed-1", newKey(t))
+	peer, err := h.AddPeer(ctx, real.URL, Pin{}, false)
+	if err != nil {
+		t.Fatalf("AddPeer: %v", err)
+	}
+	if peer.TLSSPKISHA256 == "" || peer.Approved {
+		t.Fatalf("expected a pinned, unapproved peer, got %+v", peer)
+	}
+
+	// Another device answering discovery as bed-1, with the fingerprint of its own certificate
+	impostor := newTestPeer(t, "bed-1", newKey(t))
+	advertised := formatFingerprint(sha256.Sum256(impostor.cert.Certificate[0]))
+	if _, err := h.AddPeer(ctx, impostor.URL, Pin{SHA256: advertised}, false); !errors.Is(err, ErrFingerprintMismatch) {
+		t.Fatalf("expected the pin to be kept, got %v", err)
+	}
+	after, _ := h.peer(ctx, "bed-1")
+	if after.URL != real.URL || after.TLSSPKISHA256 != peer.TLSSPKISHA256 {
+		t.Errorf("the impostor replaced the peer, got %+v", after)
+	}
+}
+
+func TestTokenOnlyToApprovedPeers(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHub(t)
+	peer := newTestPeer(t, "bed-1", newKey(t))
+	if _, err := h.AddPeer(ctx, peer.URL, Pin{}, false); err != nil {
+		t.Fatalf("AddPeer: %v", err)
+	}
+
+	syncedPeer(t, h, "bed-1")
+	if authorization := peer.lastAuthorization(); authorization != "" {
+		t.Fatalf("sent %q to an unapproved peer", authorization)
+	}
+
+	if _, err := h.ApprovePeer(ctx, "bed-1"); err != nil {
+		t.Fatalf("ApprovePeer: %v", err)
+	}
+	syncedPeer(t, h, "bed-1")
+	if authorization := peer.lastAuthorization(); authorization != "Bearer hub-token" {
+		t.Fatalf("expected the hub token once approved, got %q", authorization)
+	}
+
+	// Discovery finding it again doesn't take the approval away
+	if peer, _ := h.AddPeer(ctx, peer.URL, Pin{}, false); !peer.Approved {
+		t.Error("discovery unapproved the peer")
+	}
+}
+
+func TestNoTokenOverHTTP(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		json.NewEncoder(w).Encode(map[string]string{})
+	}))
+	defer server.Close()
+
+	h := newTestHub(t)
+	var body map[string]string
+	if _, err := h.get(context.Background(), server.URL, Pin{}, true, &body); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if authorization != "" {
+		t.Errorf("sent %q over http", authorization)
+	}
+}
+
+func TestPinSurvivesRenewal(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHub(t)
+	key := newKey(t)
+	peer := newTestPeer(t, "bed-1", key)
+	added, err := h.AddPeer(ctx, peer.URL, Pin{}, true)
+	if err != nil {
+		t.Fatalf("AddPeer: %v", err)
+	}
+
+	// A renewal keeps the key
+	peer.renew(t, key)
+	if synced := syncedPeer(t, h, "bed-1"); synced.LastError != "" {
+		t.Fatalf("sync failed after a renewal: %s", synced.LastError)
+	}
+	if _, err := h.AddPeer(ctx, peer.URL, Pin{}, true); err != nil {
+		t.Fatalf("the configured peer was refused after a renewal: %v", err)
+	}
+
+	// A new key is refused until it's re-pinned
+	peer.renew(t, newKey(t))
+	if synced := syncedPeer(t, h, "bed-1"); synced.LastError == "" {
+		t.Fatal("synced with a key that isn't pinned")
+	}
+	if _, err := h.AddPeer(ctx, peer.URL, Pin{}, true); !errors.Is(err, ErrFingerprintMismatch) {
+		t.Fatalf("expected the new key to be refused, got %v", err)
+	}
+	repinned, err := h.RepinPeer(ctx, "bed-1")
+	if err != nil {
+		t.Fatalf("RepinPeer: %v", err)
+	}
+	if repinned.TLSSPKISHA256 == added.TLSSPKISHA256 {
+		t.Fatal("the pin didn't change")
+	}
+	if synced := syncedPeer(t, h, "bed-1"); synced.LastError != "" {
+		t.Fatalf("sync failed after re-pinning: %s", synced.LastError)
+	}
+	if authorization := peer.lastAuthorization(); authorization != "Bearer hub-token" {
+		t.Errorf("expected the hub token after re-pinning, got %q", authorization)
+	}
+}
+
+func TestLegacyCertificatePinMovesToKey(t *testing.T) {
+	ctx := context.Background()
+	h := newTestHub(t)
+	peer := newTestPeer(t, "bed-1", newKey(t))
+	fingerprint := formatFingerprint(sha256.Sum256(peer.cert.Certificate[0]))
+	// Pinned by certificate, before this hub pinned keys
+	_, err := h.db.Exec(`INSERT INTO hub_peers (device_id, url, tls_sha256, approved) VALUES (?, ?, ?, 1)`, "bed-1", peer.URL, fingerprint)
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	added, err := h.AddPeer(ctx, peer.URL, Pin{}, true)
+	if err != nil {
+		t.Fatalf("AddPeer: %v", err)
+	}
+	if added.TLSSPKISHA256 == "" {
+		t.Fatal("expected the public key to be pinned")
+	}
+}
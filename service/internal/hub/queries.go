@@ -0,0 +1,175 @@
+package hub
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/ztkent/gnome/internal/gnome"
+	"github.com/ztkent/gnome/internal/storage"
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+type Comparison struct {
+	DeviceID      string  `json:"device_id"`
+	Name          string  `json:"name"`
+	Location      string  `json:"location"`
+	Readings      int64   `json:"readings"`
+	AverageLux    float64 `json:"average_lux"`
+	MaxLux        float64 `json:"max_lux"`
+	RecordedHours float64 `json:"recorded_hours"`
+	First         string  `json:"first,omitempty"`
+	Last          string  `json:"last,omitempty"`
+	// The light a bed got as a percent of what a clear sky would have given, when the hub knows where it is
+	PercentOfPossible float64 `json:"percent_of_possible,omitempty"`
+}
+
+type DeviceReading struct {
+	DeviceID     string  `json:"device_id"`
+	JobID        string  `json:"job_id"`
+	Lux          float64 `json:"lux"`
+	FullSpectrum float64 `json:"full_spectrum"`
+	Visible      float64 `json:"visible"`
+	Infrared     float64 `json:"infrared"`
+	CreatedAt    string  `json:"created_at"`
+}
+
+// The hub itself, followed by its peers
+func (h *Hub) Peers(ctx context.Context) ([]Peer, error) {
+	self := h.self.Info()
+	peers := []Peer{{DeviceID: self.ID, Name: self.Name, Location: self.Location, Local: true}}
+
+	rows, err := h.db.QueryContext(ctx, `SELECT device_id, url, name, location, tls_sha256, tls_spki_sha256, approved, last_id, last_sync_at, last_error FROM hub_peers ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		peer, err := scanPeer(rows)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, peer)
+	}
+	return peers, rows.Err()
+}
+
+func (h *Hub) peer(ctx context.Context, deviceID string) (Peer, error) {
+	row := h.db.QueryRowContext(ctx, `SELECT device_id, url, name, location, tls_sha256, tls_spki_sha256, approved, last_id, last_sync_at, last_error FROM hub_peers WHERE device_id = ?`, deviceID)
+	return scanPeer(row)
+}
+
+func scanPeer(row interface{ Scan(...any) error }) (Peer, error) {
+	var peer Peer
+	err := row.Scan(&peer.DeviceID, &peer.URL, &peer.Name, &peer.Location, &peer.TLSSHA256, &peer.TLSSPKISHA256, &peer.Approved, &peer.LastID, &peer.LastSyncAt, &peer.LastError)
+	return peer, err
+}
+
+// Summarize each device's readings between start and end, with times in loc
+func (h *Hub) Compare(ctx context.Context, start time.Time, end time.Time, loc *time.Location) ([]Comparison, error) {
+	peers, err := h.Peers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	readings, err := h.allReadings("", start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sum each device's lux, and the clear-sky lux at the same moments when the hub knows where it is.
+	// The peers are assumed to be in the same garden as the hub.
+	summaries := map[string]Comparison{}
+	total, possible := map[string]float64{}, map[string]float64{}
+	first, last := map[string]int64{}, map[string]int64{}
+	for _, reading := range readings {
+		c, seen := summaries[reading.DeviceID]
+		if !seen || reading.Lux > c.MaxLux {
+			c.MaxLux = reading.Lux
+		}
+		if !seen || reading.CreatedAt < first[reading.DeviceID] {
+			first[reading.DeviceID] = reading.CreatedAt
+		}
+		if !seen || reading.CreatedAt > last[reading.DeviceID] {
+			last[reading.DeviceID] = reading.CreatedAt
+		}
+		c.Readings++
+		summaries[reading.DeviceID] = c
+		total[reading.DeviceID] += reading.Lux
+		if h.site != nil {
+			possible[reading.DeviceID] += h.site.ClearSkyLux(time.UnixMilli(reading.CreatedAt))
+		}
+	}
+	for deviceID, c := range summaries {
+		c.AverageLux = total[deviceID] / float64(c.Readings)
+		c.RecordedHours = float64(c.Readings) * gnome.RECORD_INTERVAL.Hours()
+		c.First, c.Last = tools.FormatTime(first[deviceID], loc), tools.FormatTime(last[deviceID], loc)
+		if possible[deviceID] > 0 {
+			c.PercentOfPossible = total[deviceID] * 100 / possible[deviceID]
+		}
+		summaries[deviceID] = c
+	}
+
+	// Every device is listed, even without readings in the range
+	comparisons := make([]Comparison, 0, len(peers))
+	for _, peer := range peers {
+		c := summaries[peer.DeviceID]
+		c.DeviceID, c.Name, c.Location = peer.DeviceID, peer.Name, peer.Location
+		comparisons = append(comparisons, c)
+	}
+	return comparisons, nil
+}
+
+// Readings between start and end, for one device or all of them, with times in loc
+func (h *Hub) Readings(ctx context.Context, deviceID string, start time.Time, end time.Time, loc *time.Location) ([]DeviceReading, error) {
+	readings, err := h.allReadings(deviceID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	deviceReadings := make([]DeviceReading, 0, len(readings))
+	for _, reading := range readings {
+		deviceReadings = append(deviceReadings, DeviceReading{
+			DeviceID:     reading.DeviceID,
+			JobID:        reading.JobID,
+			Lux:          reading.Lux,
+			FullSpectrum: reading.FullSpectrum,
+			Visible:      reading.Visible,
+			Infrared:     reading.Infrared,
+			CreatedAt:    tools.FormatTime(reading.CreatedAt, loc),
+		})
+	}
+	return deviceReadings, nil
+}
+
+// The hub's own readings tagged like a peer's, with the peers' readings, oldest first.
+// Only one device's when deviceID is set.
+func (h *Hub) allReadings(deviceID string, start time.Time, end time.Time) ([]storage.PeerReading, error) {
+	self := h.self.Info().ID
+	readings := []storage.PeerReading{}
+	if deviceID == "" || deviceID == self {
+		records, err := h.readings.ReadingsBetween(start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			readings = append(readings, storage.PeerReading{
+				DeviceID:     self,
+				RemoteID:     record.ID,
+				JobID:        record.JobID,
+				Lux:          record.Lux,
+				FullSpectrum: record.FullSpectrum,
+				Visible:      record.Visible,
+				Infrared:     record.Infrared,
+				CreatedAt:    record.CreatedAt,
+			})
+		}
+	}
+	if deviceID != self {
+		peerReadings, err := h.readings.PeerReadingsBetween(deviceID, start, end)
+		if err != nil {
+			return nil, err
+		}
+		readings = append(readings, peerReadings...)
+	}
+	sort.SliceStable(readings, func(i, j int) bool { return readings[i].CreatedAt < readings[j].CreatedAt })
+	return readings, nil
+}
@@ -0,0 +1,475 @@
+package importer
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ztkent/gnome/internal/device"
+	"github.com/ztkent/gnome/internal/quality"
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+const (
+	FORMAT_SQLITE = "sqlite"
+	FORMAT_CSV    = "csv"
+	// The first bytes of every SQLite database
+	SQLITE_HEADER = "SQLite format 3\x00"
+	// Readings written per transaction, so the meter isn't locked out of the database for long
+	BATCH_SIZE = 1000
+	// Readings exported before epoch milliseconds have sqlite's own UTC format
+	LEGACY_TIME_FORMAT = "2006-01-02 15:04:05"
+)
+
+var (
+	ErrUnknownFormat = errors.New("expected a Gnome SQLite database or CSV export")
+	ErrInvalidFile   = errors.New("invalid import file")
+	ErrNewerSchema   = errors.New("the file is from a newer version of Gnome, update this device first")
+	ErrImportRunning = errors.New("an import is already running")
+)
+
+// The CSV columns every export has had, the rest were added over time and are optional
+var (
+	requiredColumns = []string{"id", "job_id", "lux", "full_spectrum", "visible", "infrared", "created_at"}
+	optionalColumns = []string{"device_id", "device_name", "solar_elevation", "quality_flags", "samples", "lux_min", "lux_max", "lux_stddev", "lux_filtered"}
+)
+
+// What an import added, and what it already had
+type Result struct {
+	Format   string `json:"format"`
+	Inserted int64  `json:"inserted"`
+	Skipped  int64  `json:"skipped"`
+	// Skipped readings that weren't repeats, another device's reading has the same id but a different job or time
+	Conflicts int64 `json:"conflicts"`
+	// The same counts for each device in the file, by UUID
+	Devices map[string]*Counts `json:"devices"`
+}
+
+type Counts struct {
+	Inserted  int64 `json:"inserted"`
+	Skipped   int64 `json:"skipped"`
+	Conflicts int64 `json:"conflicts"`
+}
+
+func (r *Result) count(deviceID string, inserted bool) {
+	counts, ok := r.Devices[deviceID]
+	if !ok {
+		counts = &Counts{}
+		r.Devices[deviceID] = counts
+	}
+	if inserted {
+		r.Inserted++
+		counts.Inserted++
+	} else {
+		r.Skipped++
+		counts.Skipped++
+	}
+}
+
+// A reading skipped because its device's id for it was already taken, e.g. after the device's database was replaced
+func (r *Result) conflict(deviceID string) {
+	r.count(deviceID, false)
+	r.Conflicts++
+	r.Devices[deviceID].Conflicts++
+}
+
+// One reading from an import file
+type reading struct {
+	deviceID string
+	// The reading's id on the device that recorded it
+	remoteID     int64
+	jobID        string
+	lux          float64
+	fullSpectrum float64
+	visible      float64
+	infrared     float64
+	createdAt    int64
+	uploadedAt   sql.NullInt64
+	elevation    sql.NullFloat64
+	flags        quality.Flags
+	samples      int
+	luxMin       sql.NullFloat64
+	luxMax       sql.NullFloat64
+	luxStdDev    sql.NullFloat64
+	luxFiltered  sql.NullFloat64
+}
+
+// Importer merges readings from backups and other devices into the database.
+// This device's readings go back into sunlight, other devices' go into hub_readings like a hub sync.
+// hub_readings only keeps the channels, job and time, so other devices' quality flags, sub-sample stats and solar elevation are left out.
+// A reading is skipped when its device already has one from the same job at the same time, so an import can be repeated.
+type Importer struct {
+	db   *sql.DB
+	self *device.Registry
+	// Uploads are spooled here, SQLite needs a file to open
+	tempDir string
+
+	// Only one import runs at a time
+	importing sync.Mutex
+}
+
+func New(db *sql.DB, self *device.Registry, tempDir string) *Importer {
+	return &Importer{
+		db:      db,
+		self:    self,
+		tempDir: tempDir,
+	}
+}
+
+// Import a Gnome SQLite database or CSV export, telling them apart by the SQLite header.
+// Batches already written are kept if it fails part way, importing the file again skips them.
+func (i *Importer) Import(ctx context.Context, path string) (Result, error) {
+	if !i.importing.TryLock() {
+		return Result{}, ErrImportRunning
+	}
+	defer i.importing.Unlock()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer file.Close()
+	header := make([]byte, len(SQLITE_HEADER))
+	n, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return Result{}, err
+	}
+	if string(header[:n]) == SQLITE_HEADER {
+		file.Close()
+		return i.importSQLite(ctx, path)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return Result{}, err
+	}
+	return i.importCSV(ctx, file)
+}
+
+// Upgrade a copy of the database to our schema, then read its readings
+func (i *Importer) importSQLite(ctx context.Context, path string) (Result, error) {
+	result := Result{Format: FORMAT_SQLITE, Devices: map[string]*Counts{}}
+	source, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return result, err
+	}
+	defer source.Close()
+	if err := checkSchema(ctx, source); err != nil {
+		return result, err
+	}
+	if err := tools.RunMigrations(source); err != nil {
+		return result, fmt.Errorf("%w: %w", ErrInvalidFile, err)
+	}
+
+	// Files from before devices had an identity can only be this device's
+	deviceID := i.self.Info().ID
+	err = source.QueryRowContext(ctx, `SELECT uuid FROM device WHERE id = 1`).Scan(&deviceID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return result, err
+	}
+
+	rows, err := source.QueryContext(ctx, `SELECT id, job_id, lux, full_spectrum, visible, infrared, created_at, uploaded_at,
+		solar_elevation, quality_flags, samples, lux_min, lux_max, lux_stddev, lux_filtered FROM sunlight ORDER BY id`)
+	if err != nil {
+		return result, err
+	}
+	err = i.copyRows(ctx, rows, &result, func(rows *sql.Rows) (reading, error) {
+		r := reading{deviceID: deviceID}
+		var lux, fullSpectrum, visible, infrared string
+		err := rows.Scan(&r.remoteID, &r.jobID, &lux, &fullSpectrum, &visible, &infrared, &r.createdAt, &r.uploadedAt,
+			&r.elevation, &r.flags, &r.samples, &r.luxMin, &r.luxMax, &r.luxStdDev, &r.luxFiltered)
+		if err != nil {
+			return r, err
+		}
+		return r, parseChannels(&r, lux, fullSpectrum, visible, infrared)
+	})
+	if err != nil {
+		return result, err
+	}
+
+	// A hub's backup has the readings it synced from its peers too, with only the columns a hub keeps
+	rows, err = source.QueryContext(ctx, `SELECT device_id, remote_id, job_id, lux, full_spectrum, visible, infrared, created_at FROM hub_readings ORDER BY id`)
+	if err != nil {
+		return result, err
+	}
+	err = i.copyRows(ctx, rows, &result, func(rows *sql.Rows) (reading, error) {
+		r := reading{samples: 1}
+		err := rows.Scan(&r.deviceID, &r.remoteID, &r.jobID, &r.lux, &r.fullSpectrum, &r.visible, &r.infrared, &r.createdAt)
+		return r, err
+	})
+	return result, err
+}
+
+// A Gnome database has a sunlight table, and no migrations we don't know about
+func checkSchema(ctx context.Context, source *sql.DB) error {
+	var check string
+	if err := source.QueryRowContext(ctx, `PRAGMA quick_check`).Scan(&check); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidFile, err)
+	} else if check != "ok" {
+		return fmt.Errorf("%w: the database is damaged: %s", ErrInvalidFile, check)
+	}
+
+	var tables int
+	err := source.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'sunlight'`).Scan(&tables)
+	if err != nil {
+		return err
+	}
+	if tables == 0 {
+		return fmt.Errorf("%w: the database has no sunlight table", ErrInvalidFile)
+	}
+
+	// Databases from before schema_migrations are upgraded from the start
+	unknown, err := tools.UnknownMigrations(ctx, source)
+	if err != nil {
+		return err
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("%w: unknown migration %s", ErrNewerSchema, unknown[0])
+	}
+	return nil
+}
+
+// Read the source rows in batches, storing each batch in its own transaction
+func (i *Importer) copyRows(ctx context.Context, rows *sql.Rows, result *Result, scan func(*sql.Rows) (reading, error)) error {
+	defer rows.Close()
+	batch := make([]reading, 0, BATCH_SIZE)
+	for rows.Next() {
+		r, err := scan(rows)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidFile, err)
+		}
+		batch = append(batch, r)
+		if len(batch) == BATCH_SIZE {
+			if err := i.store(ctx, batch, result); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return i.store(ctx, batch, result)
+}
+
+// Parse a CSV export, from any version of Gnome that has written one
+func (i *Importer) importCSV(ctx context.Context, file io.Reader) (Result, error) {
+	result := Result{Format: FORMAT_CSV, Devices: map[string]*Counts{}}
+	reader := csv.NewReader(bufio.NewReader(file))
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return result, fmt.Errorf("%w: the file is empty", ErrInvalidFile)
+	} else if err != nil {
+		return result, ErrUnknownFormat
+	}
+	columns := map[string]int{}
+	for index, name := range header {
+		columns[strings.TrimSpace(name)] = index
+	}
+	for _, name := range requiredColumns {
+		if _, ok := columns[name]; !ok {
+			return result, ErrUnknownFormat
+		}
+	}
+	for name := range columns {
+		if !slices.Contains(requiredColumns, name) && !slices.Contains(optionalColumns, name) {
+			return result, fmt.Errorf("%w: unknown column %q", ErrNewerSchema, name)
+		}
+	}
+
+	self := i.self.Info().ID
+	batch := make([]reading, 0, BATCH_SIZE)
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return result, fmt.Errorf("%w: %w", ErrInvalidFile, err)
+		}
+		line, _ := reader.FieldPos(0)
+		r, err := parseRecord(record, columns)
+		if err != nil {
+			return result, fmt.Errorf("%w: line %d: %w", ErrInvalidFile, line, err)
+		}
+		// Exports from before devices had an identity can only be this device's
+		if r.deviceID == "" {
+			r.deviceID = self
+		}
+		batch = append(batch, r)
+		if len(batch) == BATCH_SIZE {
+			if err := i.store(ctx, batch, &result); err != nil {
+				return result, err
+			}
+			batch = batch[:0]
+		}
+	}
+	return result, i.store(ctx, batch, &result)
+}
+
+func parseRecord(record []string, columns map[string]int) (reading, error) {
+	field := func(name string) string {
+		if index, ok := columns[name]; ok {
+			return strings.TrimSpace(record[index])
+		}
+		return ""
+	}
+
+	r := reading{deviceID: field("device_id"), jobID: field("job_id"), samples: 1}
+	var err error
+	if r.remoteID, err = strconv.ParseInt(field("id"), 10, 64); err != nil {
+		return r, fmt.Errorf("invalid id %q", field("id"))
+	}
+	if r.jobID == "" {
+		return r, errors.New("missing job_id")
+	}
+	if err := parseChannels(&r, field("lux"), field("full_spectrum"), field("visible"), field("infrared")); err != nil {
+		return r, err
+	}
+	createdAt, err := parseTime(field("created_at"))
+	if err != nil {
+		return r, err
+	}
+	r.createdAt = createdAt.UnixMilli()
+
+	if value := field("quality_flags"); value != "" {
+		if r.flags, err = quality.FromNames(strings.Split(value, ";")); err != nil {
+			return r, err
+		}
+	}
+	if value := field("samples"); value != "" {
+		if r.samples, err = strconv.Atoi(value); err != nil || r.samples < 0 {
+			return r, fmt.Errorf("invalid samples %q", value)
+		}
+	}
+	nullable := map[string]*sql.NullFloat64{
+		"solar_elevation": &r.elevation,
+		"lux_min":         &r.luxMin,
+		"lux_max":         &r.luxMax,
+		"lux_stddev":      &r.luxStdDev,
+		"lux_filtered":    &r.luxFiltered,
+	}
+	for name, value := range nullable {
+		if field(name) == "" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(field(name), 64)
+		if err != nil {
+			return r, fmt.Errorf("invalid %s %q", name, field(name))
+		}
+		*value = sql.NullFloat64{Float64: parsed, Valid: true}
+	}
+	return r, nil
+}
+
+// The sensor values are stored as text, so they're checked wherever they come from
+func parseChannels(r *reading, lux string, fullSpectrum string, visible string, infrared string) error {
+	values := []struct {
+		name  string
+		value string
+		into  *float64
+	}{
+		{"lux", lux, &r.lux},
+		{"full_spectrum", fullSpectrum, &r.fullSpectrum},
+		{"visible", visible, &r.visible},
+		{"infrared", infrared, &r.infrared},
+	}
+	for _, v := range values {
+		parsed, err := strconv.ParseFloat(v.value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", v.name, v.value)
+		}
+		*v.into = parsed
+	}
+	return nil
+}
+
+// CSV times are RFC 3339 with an offset, or UTC in sqlite's format from before epoch milliseconds
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(LEGACY_TIME_FORMAT, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid created_at %q", value)
+}
+
+// Write a batch, skipping readings the device already has from the same job at the same time
+func (i *Importer) store(ctx context.Context, batch []reading, result *Result) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	local, err := tx.PrepareContext(ctx, `INSERT INTO sunlight (job_id, lux, full_spectrum, visible, infrared, created_at, uploaded_at,
+		solar_elevation, quality_flags, samples, lux_min, lux_max, lux_stddev, lux_filtered)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM sunlight WHERE job_id = ? AND created_at = ?)`)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+	// Hub syncs skip a peer's readings by their id, imports skip them by their time too
+	remote, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO hub_readings (device_id, remote_id, job_id, lux, full_spectrum, visible, infrared, created_at)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM hub_readings WHERE device_id = ? AND job_id = ? AND created_at = ?)`)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	// A remote reading that wasn't a repeat was skipped because its id was taken
+	repeated, err := tx.PrepareContext(ctx, `SELECT EXISTS (SELECT 1 FROM hub_readings WHERE device_id = ? AND job_id = ? AND created_at = ?)`)
+	if err != nil {
+		return err
+	}
+	defer repeated.Close()
+
+	self := i.self.Info().ID
+	for _, r := range batch {
+		var inserted sql.Result
+		if r.deviceID == self {
+			// Formatted like the meter writes them
+			inserted, err = local.ExecContext(ctx, r.jobID,
+				fmt.Sprintf("%.5f", r.lux),
+				fmt.Sprintf("%.5e", r.fullSpectrum),
+				fmt.Sprintf("%.5e", r.visible),
+				fmt.Sprintf("%.5e", r.infrared),
+				r.createdAt, r.uploadedAt, r.elevation, r.flags, r.samples, r.luxMin, r.luxMax, r.luxStdDev, r.luxFiltered,
+				r.jobID, r.createdAt)
+		} else {
+			inserted, err = remote.ExecContext(ctx, r.deviceID, r.remoteID, r.jobID, r.lux, r.fullSpectrum, r.visible, r.infrared, r.createdAt,
+				r.deviceID, r.jobID, r.createdAt)
+		}
+		if err != nil {
+			return err
+		}
+		affected, err := inserted.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 && r.deviceID != self {
+			var isRepeat bool
+			if err := repeated.QueryRowContext(ctx, r.deviceID, r.jobID, r.createdAt).Scan(&isRepeat); err != nil {
+				return err
+			}
+			if !isRepeat {
+				result.conflict(r.deviceID)
+				continue
+			}
+		}
+		result.count(r.deviceID, affected > 0)
+	}
+	return tx.Commit()
+}
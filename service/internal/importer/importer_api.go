@@ -0,0 +1,96 @@
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The largest file accepted, a year of readings every 15 seconds is well under this
+const MAX_IMPORT_SIZE = 1 << 30
+
+// Import a file sent as the request body, or as the "file" field of a multipart form
+func (i *Importer) ImportHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path, err := i.receive(w, r)
+		if path != "" {
+			defer os.Remove(path)
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			serveMessage(w, fmt.Sprintf("the file must be at most %d MB", MAX_IMPORT_SIZE>>20), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			serveMessage(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result, err := i.Import(r.Context(), path)
+		switch {
+		case errors.Is(err, ErrImportRunning):
+			serveMessage(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, ErrUnknownFormat):
+			serveMessage(w, err.Error(), http.StatusUnsupportedMediaType)
+		case errors.Is(err, ErrNewerSchema), errors.Is(err, ErrInvalidFile):
+			log.Printf("Import stopped after %d readings: %v", result.Inserted+result.Skipped, err)
+			serveMessage(w, err.Error(), http.StatusUnprocessableEntity)
+		case err != nil:
+			log.Printf("Import failed after %d readings: %v", result.Inserted+result.Skipped, err)
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+		default:
+			log.Printf("Imported %d readings from %s, skipped %d", result.Inserted, result.Format, result.Skipped)
+			serveJSON(w, result, http.StatusOK)
+		}
+	}
+}
+
+// Spool the upload to a temporary file, returning its path
+func (i *Importer) receive(w http.ResponseWriter, r *http.Request) (string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_IMPORT_SIZE)
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		form, err := r.MultipartReader()
+		if err != nil {
+			return "", err
+		}
+		for {
+			part, err := form.NextPart()
+			if errors.Is(err, io.EOF) {
+				return "", errors.New("the form has no file field")
+			} else if err != nil {
+				return "", err
+			}
+			if part.FormName() == "file" {
+				body = part
+				break
+			}
+		}
+	}
+
+	file, err := os.CreateTemp(i.tempDir, "gnome-import-*")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, body); err != nil {
+		return file.Name(), err
+	}
+	return file.Name(), file.Close()
+}
+
+func serveJSON(w http.ResponseWriter, body interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+func serveMessage(w http.ResponseWriter, message string, status int) {
+	serveJSON(w, map[string]string{"message": message}, status)
+}
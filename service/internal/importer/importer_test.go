@@ -0,0 +1,70 @@
+package importer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ztkent/gnome/internal/device"
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+const OTHER_DEVICE = "7d1c0a8e-5b3f-4c2a-9e61-2f8b4d0c9a17"
+
+func newTestImporter(t *testing.T) *Importer {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := tools.ConnectSqlite(filepath.Join(dir, "gnome.db"))
+	if err != nil {
+		t.Fatalf("ConnectSqlite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	self, err := device.Load(db)
+	if err != nil {
+		t.Fatalf("device.Load: %v", err)
+	}
+	return New(db, self, dir)
+}
+
+func importCSV(t *testing.T, i *Importer, rows string) Result {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "readings.csv")
+	content := "id,device_id,job_id,lux,full_spectrum,visible,infrared,created_at\n" + rows
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	result, err := i.Import(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	return result
+}
+
+func TestImportingTwiceSkipsRepeats(t *testing.T) {
+	i := newTestImporter(t)
+	rows := "1," + OTHER_DEVICE + ",job-1,1200,3000,2400,600,2026-10-19T12:00:00Z\n" +
+		"2," + OTHER_DEVICE + ",job-1,1300,3100,2500,600,2026-10-19T12:01:00Z\n"
+
+	if result := importCSV(t, i, rows); result.Inserted != 2 || result.Skipped != 0 {
+		t.Fatalf("unexpected first import %+v", result)
+	}
+	result := importCSV(t, i, rows)
+	if result.Inserted != 0 || result.Skipped != 2 || result.Conflicts != 0 {
+		t.Fatalf("expected the repeat to be skipped without conflicts, got %+v", result)
+	}
+}
+
+func TestImportReportsConflictingIDs(t *testing.T) {
+	i := newTestImporter(t)
+	importCSV(t, i, "1,"+OTHER_DEVICE+",job-1,1200,3000,2400,600,2026-10-19T12:00:00Z\n")
+
+	// The device's database was replaced, so its ids started again
+	result := importCSV(t, i, "1,"+OTHER_DEVICE+",job-2,800,2000,1600,400,2026-10-20T08:00:00Z\n")
+	if result.Inserted != 0 || result.Skipped != 1 || result.Conflicts != 1 {
+		t.Fatalf("expected a conflict, got %+v", result)
+	}
+	if counts := result.Devices[OTHER_DEVICE]; counts == nil || counts.Conflicts != 1 {
+		t.Errorf("expected the conflict in the device's counts, got %+v", counts)
+	}
+}
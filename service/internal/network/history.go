@@ -0,0 +1,79 @@
+package network
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	SIGNAL_SAMPLE_INTERVAL = time.Minute
+	// A day of samples
+	SIGNAL_HISTORY = 24 * 60
+)
+
+type SignalSample struct {
+	Time      time.Time `json:"time"`
+	Interface string    `json:"interface"`
+	SignalDBM int       `json:"signal_dbm"`
+	Percent   int       `json:"percent"`
+}
+
+// Monitor samples the wireless signal periodically, keeping a bounded history for the dashboard
+type Monitor struct {
+	mu       sync.Mutex
+	samples  []SignalSample
+	next     int
+	capacity int
+}
+
+func NewMonitor(capacity int) *Monitor {
+	return &Monitor{capacity: capacity}
+}
+
+// Sample the signal until the context is cancelled
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(SIGNAL_SAMPLE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		m.sample()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Monitor) sample() {
+	iface, err := PrimaryWireless()
+	if err != nil {
+		return
+	}
+	m.Record(SignalSample{
+		Time:      time.Now(),
+		Interface: iface.Name,
+		SignalDBM: iface.Wireless.SignalDBM,
+		Percent:   SignalPercent(iface.Wireless.SignalDBM),
+	})
+}
+
+func (m *Monitor) Record(sample SignalSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.samples) < m.capacity {
+		m.samples = append(m.samples, sample)
+		return
+	}
+	m.samples[m.next] = sample
+	m.next = (m.next + 1) % m.capacity
+}
+
+// The recorded samples, oldest first
+func (m *Monitor) History() []SignalSample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	history := make([]SignalSample, 0, len(m.samples))
+	history = append(history, m.samples[m.next:]...)
+	return append(history, m.samples[:m.next]...)
+}
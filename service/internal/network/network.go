@@ -0,0 +1,292 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PROC_NET_WIRELESS   = "/proc/net/wireless"
+	PROC_NET_ROUTE      = "/proc/net/route"
+	PROC_NET_IPV6_ROUTE = "/proc/net/ipv6_route"
+	SYS_CLASS_NET       = "/sys/class/net"
+
+	// Most drivers report link quality out of 70
+	MAX_LINK_QUALITY = 70
+	IW_TIMEOUT       = 5 * time.Second
+)
+
+var ErrNotConnected = errors.New("device is not connected to a wireless network")
+
+type Interface struct {
+	Name string `json:"name"`
+	// wifi, ethernet or other
+	Type string   `json:"type"`
+	Up   bool     `json:"up"`
+	MAC  string   `json:"mac,omitempty"`
+	IPv4 []string `json:"ipv4"`
+	IPv6 []string `json:"ipv6"`
+	// Whether the interface carries the default route
+	Default bool `json:"default"`
+	// Link speed of a wired interface, in Mbit/s
+	SpeedMbps int       `json:"speed_mbps,omitempty"`
+	Wireless  *Wireless `json:"wireless,omitempty"`
+}
+
+type Wireless struct {
+	SSID         string  `json:"ssid,omitempty"`
+	SignalDBM    int     `json:"signal_dbm"`
+	NoiseDBM     int     `json:"noise_dbm,omitempty"`
+	LinkQuality  int     `json:"link_quality"`
+	BitrateMbps  float64 `json:"bitrate_mbps,omitempty"`
+	FrequencyMHz int     `json:"frequency_mhz,omitempty"`
+}
+
+// List the interfaces, other than loopback, with their addresses and link details
+func Interfaces() ([]Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	wireless, err := readProcWireless()
+	if err != nil {
+		return nil, err
+	}
+	defaults := defaultRouteInterfaces()
+
+	var interfaces []Interface
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		info := Interface{
+			Name:    iface.Name,
+			Type:    interfaceType(iface.Name),
+			Up:      iface.Flags&net.FlagUp != 0 && carrier(iface.Name),
+			MAC:     iface.HardwareAddr.String(),
+			IPv4:    []string{},
+			IPv6:    []string{},
+			Default: defaults[iface.Name],
+		}
+		if addrs, err := iface.Addrs(); err == nil {
+			for _, addr := range addrs {
+				ipNet, ok := addr.(*net.IPNet)
+				if !ok {
+					continue
+				}
+				if ipNet.IP.To4() != nil {
+					info.IPv4 = append(info.IPv4, ipNet.IP.String())
+				} else {
+					info.IPv6 = append(info.IPv6, ipNet.IP.String())
+				}
+			}
+		}
+		if speed := readSysInt(iface.Name, "speed"); info.Type == "ethernet" && info.Up && speed > 0 {
+			info.SpeedMbps = speed
+		}
+		if stats, ok := wireless[iface.Name]; ok {
+			// SSID, bitrate and frequency aren't in /proc, iw has them if it's installed
+			readLink(iface.Name, &stats)
+			info.Wireless = &stats
+		}
+		interfaces = append(interfaces, info)
+	}
+	return interfaces, nil
+}
+
+// The wireless interface we're most likely using, preferring the one with the default route
+func PrimaryWireless() (Interface, error) {
+	interfaces, err := Interfaces()
+	if err != nil {
+		return Interface{}, err
+	}
+	var found *Interface
+	for i := range interfaces {
+		if interfaces[i].Wireless == nil {
+			continue
+		}
+		if found == nil || (interfaces[i].Default && !found.Default) {
+			found = &interfaces[i]
+		}
+	}
+	if found == nil {
+		return Interface{}, ErrNotConnected
+	}
+	return *found, nil
+}
+
+// The IPv4 address of the interface with the default route, without sending any traffic
+func PrimaryIP() net.IP {
+	interfaces, err := Interfaces()
+	if err != nil {
+		return net.IPv4(127, 0, 0, 1)
+	}
+	var fallback net.IP
+	for _, iface := range interfaces {
+		if !iface.Up || len(iface.IPv4) == 0 {
+			continue
+		}
+		ip := net.ParseIP(iface.IPv4[0])
+		if iface.Default {
+			return ip
+		}
+		if fallback == nil && ip.IsPrivate() {
+			fallback = ip
+		}
+	}
+	if fallback != nil {
+		return fallback
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+// Signal quality as a percentage, mapping -110 dBm to 0% and -40 dBm to 100%
+func SignalPercent(dbm int) int {
+	if dbm < -110 {
+		dbm = -110
+	} else if dbm > -40 {
+		dbm = -40
+	}
+	return (dbm + 110) * 100 / 70
+}
+
+// Parse /proc/net/wireless, which has two header lines and then a line per interface:
+// wlan0: 0000   70.  -40.  -256        0      0      0      0      0        0
+func readProcWireless() (map[string]Wireless, error) {
+	wireless := map[string]Wireless{}
+	file, err := os.Open(PROC_NET_WIRELESS)
+	if errors.Is(err, os.ErrNotExist) {
+		// No wireless extensions, so no wireless interfaces
+		return wireless, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 0; scanner.Scan(); line++ {
+		if line < 2 {
+			continue
+		}
+		name, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) < 4 {
+			continue
+		}
+		quality, _ := strconv.ParseFloat(strings.TrimSuffix(fields[1], "."), 64)
+		level, _ := strconv.ParseFloat(strings.TrimSuffix(fields[2], "."), 64)
+		noise, _ := strconv.ParseFloat(strings.TrimSuffix(fields[3], "."), 64)
+		stats := Wireless{
+			SignalDBM:   int(level),
+			LinkQuality: min(100, int(quality)*100/MAX_LINK_QUALITY),
+		}
+		// -256 means the driver doesn't report noise
+		if noise > -256 && noise < 0 {
+			stats.NoiseDBM = int(noise)
+		}
+		wireless[strings.TrimSpace(name)] = stats
+	}
+	return wireless, scanner.Err()
+}
+
+// Fill in SSID, bitrate and frequency from `iw dev <iface> link`, parsed here rather than through a shell
+func readLink(iface string, stats *Wireless) {
+	ctx, cancel := context.WithTimeout(context.Background(), IW_TIMEOUT)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "iw", "dev", iface, "link").Output()
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "SSID":
+			stats.SSID = value
+		case "freq":
+			frequency, _ := strconv.ParseFloat(value, 64)
+			stats.FrequencyMHz = int(frequency)
+		case "tx bitrate":
+			if fields := strings.Fields(value); len(fields) > 0 {
+				stats.BitrateMbps, _ = strconv.ParseFloat(fields[0], 64)
+			}
+		case "signal":
+			// More current than /proc on some drivers
+			if fields := strings.Fields(value); len(fields) > 0 {
+				if dbm, err := strconv.Atoi(fields[0]); err == nil {
+					stats.SignalDBM = dbm
+				}
+			}
+		}
+	}
+}
+
+// The interfaces that have a default route, for IPv4 or IPv6
+func defaultRouteInterfaces() map[string]bool {
+	defaults := map[string]bool{}
+	// Iface Destination Gateway ...
+	if data, err := os.ReadFile(PROC_NET_ROUTE); err == nil {
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) > 1 && fields[1] == "00000000" {
+				defaults[fields[0]] = true
+			}
+		}
+	}
+	// Destination PrefixLength Source ... Iface
+	if data, err := os.ReadFile(PROC_NET_IPV6_ROUTE); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 10 && fields[1] == "00" && strings.Trim(fields[0], "0") == "" && fields[9] != "lo" {
+				defaults[fields[9]] = true
+			}
+		}
+	}
+	return defaults
+}
+
+func interfaceType(name string) string {
+	if _, err := os.Stat(filepath.Join(SYS_CLASS_NET, name, "wireless")); err == nil {
+		return "wifi"
+	}
+	// ARPHRD_ETHER, virtual interfaces without a device are something else
+	if readSysInt(name, "type") == 1 {
+		if _, err := os.Stat(filepath.Join(SYS_CLASS_NET, name, "device")); err == nil {
+			return "ethernet"
+		}
+	}
+	return "other"
+}
+
+func carrier(name string) bool {
+	value := readSysInt(name, "carrier")
+	// Interfaces that don't report a carrier are treated as up
+	return value != 0
+}
+
+// Read an integer from /sys/class/net/<iface>/<attribute>, -1 if it can't be read
+func readSysInt(name string, attribute string) int {
+	data, err := os.ReadFile(filepath.Join(SYS_CLASS_NET, name, attribute))
+	if err != nil {
+		return -1
+	}
+	value, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1
+	}
+	return value
+}
@@ -0,0 +1,263 @@
+package quality
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Flags mark what looked wrong with a reading. Flagged readings are still stored, so nothing is lost to a bad guess.
+type Flags uint16
+
+const (
+	FLAG_READ_FAILED Flags = 1 << iota
+	// Lux below zero, when the infrared channel reads more than the full spectrum one
+	FLAG_NEGATIVE
+	// Lux that isn't a number, it's stored as 0
+	FLAG_NAN
+	// Brighter than sunlight gets
+	FLAG_OUT_OF_RANGE
+	// The channels haven't changed at all, the sensor is likely stuck
+	FLAG_FLATLINE
+	// A change too fast and too large for sunlight, like the sensor being knocked or shaded by hand
+	FLAG_JUMP
+	// The sensor saturated several times in a row, the gain can't keep up
+	FLAG_SATURATED
+	// The light settled at a very different level and stayed, like a dirty or covered dome
+	FLAG_BASELINE_SHIFT
+)
+
+// The flags that mean the value itself is wrong, rather than suspicious
+const INVALID = FLAG_READ_FAILED | FLAG_NEGATIVE | FLAG_NAN | FLAG_OUT_OF_RANGE
+
+const (
+	// Direct sun at noon is about 120k lux
+	MAX_PLAUSIBLE_LUX = 200000.0
+	// Identical counts for this many readings in a row is a flatline, unless the sensor sees next to nothing
+	FLATLINE_SAMPLES   = 20
+	FLATLINE_MIN_COUNT = 100
+	// A jump is at least this many times brighter or darker, and this many lux apart, from one reading to the next
+	JUMP_RATIO = 20.0
+	JUMP_LUX   = 20000.0
+	// Readings further apart than this aren't compared for jumps
+	JUMP_WINDOW = time.Minute
+	// Saturated reads in a row before the next reading is flagged
+	SATURATION_REPEATS = 3
+	// Readings on each side of a baseline shift, both sides steady and this many times apart
+	BASELINE_SAMPLES = 40
+	BASELINE_RATIO   = 4.0
+	// How much a side can vary, as a coefficient of variation, and still be steady
+	BASELINE_STEADY = 0.05
+	// Lux below this are too dark to compare for a shift
+	BASELINE_MIN_LUX = 10.0
+)
+
+type flagName struct {
+	flag Flags
+	name string
+}
+
+var flagNames = []flagName{
+	{FLAG_READ_FAILED, "read_failed"},
+	{FLAG_NEGATIVE, "negative"},
+	{FLAG_NAN, "nan"},
+	{FLAG_OUT_OF_RANGE, "out_of_range"},
+	{FLAG_FLATLINE, "flatline"},
+	{FLAG_JUMP, "jump"},
+	{FLAG_SATURATED, "saturated"},
+	{FLAG_BASELINE_SHIFT, "baseline_shift"},
+}
+
+// The names of the flags that are set, empty for a good reading
+func (f Flags) Names() []string {
+	names := []string{}
+	for _, flag := range flagNames {
+		if f&flag.flag != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	return names
+}
+
+// The name of every flag
+func Names() []string {
+	names := make([]string, 0, len(flagNames))
+	for _, flag := range flagNames {
+		names = append(names, flag.name)
+	}
+	return names
+}
+
+// The flags with these names, the inverse of Flags.Names
+func FromNames(names []string) (Flags, error) {
+	var flags Flags
+	for _, name := range names {
+		i := slices.IndexFunc(flagNames, func(flag flagName) bool { return flag.name == name })
+		if i < 0 {
+			return 0, fmt.Errorf("unknown quality flag %q", name)
+		}
+		flags |= flagNames[i].flag
+	}
+	return flags, nil
+}
+
+func (f Flags) String() string {
+	return strings.Join(f.Names(), ",")
+}
+
+// A reading as it comes off the sensor
+type Sample struct {
+	Lux float64
+	// Full spectrum and infrared counts
+	Ch0 uint16
+	Ch1 uint16
+	// The ADC's full scale at the current integration time
+	MaxCount uint16
+	Time     time.Time
+}
+
+// Checker looks for faults across one job's readings. It isn't safe for concurrent use.
+type Checker struct {
+	last     *Sample
+	flatline int
+	// Saturated reads in a row, and whether the last ones were skipped rather than checked
+	saturated int
+	skipped   bool
+	// The most recent lux, oldest first, up to 2*BASELINE_SAMPLES
+	recent []float64
+	// Set while a flagged shift is still in the window, so it's flagged once
+	shifted bool
+}
+
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+// Saturated records a read that overflowed, it's flagged on the next reading if it keeps happening
+func (c *Checker) Saturated() {
+	c.saturated++
+	c.skipped = true
+}
+
+// Failed records a read that failed, the reading stored in its place is flagged
+func (c *Checker) Failed() Flags {
+	c.last = nil
+	c.flatline = 0
+	return FLAG_READ_FAILED
+}
+
+// Check a reading against the ones before it. The lux it returns is the one to store.
+func (c *Checker) Check(sample Sample) (float64, Flags) {
+	var flags Flags
+	lux := sample.Lux
+	switch {
+	case sample.Ch0 == 0 && sample.Ch1 == 0:
+		// Darkness, 0/0 in the lux formula
+		lux = 0
+	case math.IsNaN(lux) || math.IsInf(lux, 0):
+		flags |= FLAG_NAN
+		lux = 0
+	case lux < 0:
+		flags |= FLAG_NEGATIVE
+	case lux > MAX_PLAUSIBLE_LUX:
+		flags |= FLAG_OUT_OF_RANGE
+	}
+
+	// Within 2% of full scale is as good as saturated
+	nearFullScale := sample.MaxCount > 0 && sample.Ch0 >= sample.MaxCount-sample.MaxCount/50
+	if nearFullScale {
+		c.saturated++
+	}
+	if c.saturated >= SATURATION_REPEATS && (nearFullScale || c.skipped) {
+		flags |= FLAG_SATURATED
+	}
+	c.skipped = false
+	if !nearFullScale {
+		c.saturated = 0
+	}
+
+	if c.last != nil && sample.Ch0 == c.last.Ch0 && sample.Ch1 == c.last.Ch1 && sample.Ch0 >= FLATLINE_MIN_COUNT {
+		c.flatline++
+	} else {
+		c.flatline = 1
+	}
+	if c.flatline >= FLATLINE_SAMPLES {
+		flags |= FLAG_FLATLINE
+	}
+
+	if c.last != nil && sample.Time.Sub(c.last.Time) <= JUMP_WINDOW && flags&INVALID == 0 {
+		if isJump(c.last.Lux, lux) {
+			flags |= FLAG_JUMP
+		}
+	}
+	last := sample
+	last.Lux = lux
+	c.last = &last
+
+	if flags&INVALID == 0 {
+		c.recent = append(c.recent, lux)
+		if len(c.recent) > 2*BASELINE_SAMPLES {
+			c.recent = c.recent[1:]
+		}
+		if c.baselineShifted() {
+			if !c.shifted {
+				flags |= FLAG_BASELINE_SHIFT
+			}
+			c.shifted = true
+		} else {
+			c.shifted = false
+		}
+	}
+	return lux, flags
+}
+
+func isJump(before float64, after float64) bool {
+	low, high := min(before, after), max(before, after)
+	if high-low < JUMP_LUX {
+		return false
+	}
+	return low <= 0 || high/low >= JUMP_RATIO
+}
+
+// Whether the older and newer halves of the window are each steady, and far apart
+func (c *Checker) baselineShifted() bool {
+	if len(c.recent) < 2*BASELINE_SAMPLES {
+		return false
+	}
+	before, after := c.recent[:BASELINE_SAMPLES], c.recent[BASELINE_SAMPLES:]
+	if !steady(before) || !steady(after) {
+		return false
+	}
+	a, b := median(before), median(after)
+	if min(a, b) < BASELINE_MIN_LUX {
+		return false
+	}
+	return max(a, b)/min(a, b) >= BASELINE_RATIO
+}
+
+func steady(values []float64) bool {
+	var sum, squares float64
+	for _, value := range values {
+		sum += value
+	}
+	mean := sum / float64(len(values))
+	if mean <= 0 {
+		return false
+	}
+	for _, value := range values {
+		squares += (value - mean) * (value - mean)
+	}
+	return math.Sqrt(squares/float64(len(values)))/mean <= BASELINE_STEADY
+}
+
+func median(values []float64) float64 {
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
@@ -0,0 +1,186 @@
+package quality
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// The full scale at a 100ms integration time
+const MAX_COUNT = 37888
+
+var start = time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)
+
+// A reading i steps of 15 seconds into the job, with the channels following the lux
+func sample(i int, lux float64) Sample {
+	return Sample{
+		Lux:      lux,
+		Ch0:      uint16(min(lux/4, MAX_COUNT)),
+		Ch1:      uint16(min(lux/16, MAX_COUNT)),
+		MaxCount: MAX_COUNT,
+		Time:     start.Add(time.Duration(i) * 15 * time.Second),
+	}
+}
+
+func saturatedSample(i int) Sample {
+	s := sample(i, 150000)
+	s.Ch0 = MAX_COUNT
+	return s
+}
+
+func TestSaturation(t *testing.T) {
+	tests := []struct {
+		name string
+		// Each step is a saturated read that was skipped, a saturated reading, or a normal one
+		steps    string
+		expected []bool
+	}{
+		{"saturated readings in a row", "SSSS", []bool{false, false, true, true}},
+		{"skipped reads flag the next reading", "xxxn", []bool{true}},
+		{"too few skipped reads", "xxn", []bool{false}},
+		{"skipped and checked reads add up", "xxS", []bool{true}},
+		{"a normal reading resets the count", "SSnSS", []bool{false, false, false, false, false}},
+		{"only the reading after the skipped reads", "xxxnn", []bool{true, false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewChecker()
+			flagged := []bool{}
+			for i, step := range test.steps {
+				var flags Flags
+				switch step {
+				case 'x':
+					c.Saturated()
+					continue
+				case 'S':
+					_, flags = c.Check(saturatedSample(i))
+				case 'n':
+					_, flags = c.Check(sample(i, 1000+float64(i)*10))
+				}
+				flagged = append(flagged, flags&FLAG_SATURATED != 0)
+			}
+			if len(flagged) != len(test.expected) {
+				t.Fatalf("expected %d readings, got %d", len(test.expected), len(flagged))
+			}
+			for i := range flagged {
+				if flagged[i] != test.expected[i] {
+					t.Errorf("reading %d: expected saturated %t, got %t", i, test.expected[i], flagged[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFlatline(t *testing.T) {
+	c := NewChecker()
+	for i := 0; i < FLATLINE_SAMPLES-1; i++ {
+		if _, flags := c.Check(sample(i, 2000)); flags&FLAG_FLATLINE != 0 {
+			t.Fatalf("reading %d was flagged before %d identical readings", i, FLATLINE_SAMPLES)
+		}
+	}
+	if _, flags := c.Check(sample(FLATLINE_SAMPLES, 2000)); flags&FLAG_FLATLINE == 0 {
+		t.Fatalf("expected a flatline after %d identical readings", FLATLINE_SAMPLES)
+	}
+
+	// A failed read starts the count again
+	if flags := c.Failed(); flags != FLAG_READ_FAILED {
+		t.Errorf("expected a failed read to be flagged, got %s", flags)
+	}
+	for i := 0; i < FLATLINE_SAMPLES-1; i++ {
+		if _, flags := c.Check(sample(i, 2000)); flags&FLAG_FLATLINE != 0 {
+			t.Fatalf("reading %d after the failure was still flagged", i)
+		}
+	}
+	if _, flags := c.Check(sample(FLATLINE_SAMPLES, 2000)); flags&FLAG_FLATLINE == 0 {
+		t.Error("expected the flatline to be flagged again")
+	}
+}
+
+func TestFlatlineInTheDark(t *testing.T) {
+	c := NewChecker()
+	for i := 0; i < 2*FLATLINE_SAMPLES; i++ {
+		if _, flags := c.Check(sample(i, 40)); flags != 0 {
+			t.Fatalf("a dark reading was flagged %s", flags)
+		}
+	}
+}
+
+func TestJump(t *testing.T) {
+	tests := []struct {
+		name    string
+		before  float64
+		after   float64
+		elapsed time.Duration
+		jump    bool
+	}{
+		{"shaded by hand", 60000, 1500, 15 * time.Second, true},
+		{"uncovered", 1000, 45000, 15 * time.Second, true},
+		{"at the end of the window", 1000, 45000, JUMP_WINDOW, true},
+		{"after a gap", 1000, 45000, JUMP_WINDOW + time.Second, false},
+		{"a cloud passing", 80000, 20000, 15 * time.Second, false},
+		{"large ratio but few lux", 50, 5000, 15 * time.Second, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewChecker()
+			before := sample(0, test.before)
+			if _, flags := c.Check(before); flags != 0 {
+				t.Fatalf("the first reading was flagged %s", flags)
+			}
+			after := sample(0, test.after)
+			after.Time = before.Time.Add(test.elapsed)
+			if _, flags := c.Check(after); (flags&FLAG_JUMP != 0) != test.jump {
+				t.Errorf("expected jump %t, got %s", test.jump, flags)
+			}
+		})
+	}
+}
+
+func TestBaselineShiftFlaggedOncePerShift(t *testing.T) {
+	c := NewChecker()
+	// Steady, with enough noise that the channels aren't a flatline
+	levels := []float64{5000, 800, 5000}
+	shifts := []int{}
+	i := 0
+	for _, level := range levels {
+		for n := 0; n < 3*BASELINE_SAMPLES; n++ {
+			lux := level * (1 + 0.01*float64(n%5-2))
+			_, flags := c.Check(sample(i, lux))
+			if flags&^FLAG_BASELINE_SHIFT != 0 {
+				t.Fatalf("reading %d was flagged %s", i, flags)
+			}
+			if flags&FLAG_BASELINE_SHIFT != 0 {
+				shifts = append(shifts, i)
+				if !c.shifted {
+					t.Fatalf("reading %d flagged a shift without remembering it", i)
+				}
+			}
+			i++
+		}
+	}
+	// Each shift is flagged when the window has the old level in one half and the new one in the other
+	expected := []int{4 * BASELINE_SAMPLES, 7 * BASELINE_SAMPLES}
+	if len(shifts) != len(expected) || shifts[0] != expected[0]-1 || shifts[1] != expected[1]-1 {
+		t.Errorf("expected shifts flagged at %v, got %v", []int{expected[0] - 1, expected[1] - 1}, shifts)
+	}
+	if c.shifted {
+		t.Error("expected the shift to be cleared once it left the window")
+	}
+}
+
+func TestCleanDaylightRampHasNoFlags(t *testing.T) {
+	c := NewChecker()
+	// A clear day from sunrise to sunset, a reading every 15 seconds
+	const readings = 12 * 60 * 4
+	for i := 0; i <= readings; i++ {
+		lux := 100000 * math.Sin(math.Pi*float64(i)/readings)
+		s := sample(i, lux)
+		// The counts jitter a little, like a real sensor's
+		if s.Ch0 >= 10 {
+			s.Ch0 += uint16(i % 3)
+		}
+		if _, flags := c.Check(s); flags != 0 {
+			t.Fatalf("reading %d at %.0f lux was flagged %s", i, lux, flags)
+		}
+	}
+}
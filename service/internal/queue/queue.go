@@ -0,0 +1,357 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Committed bytes at the front of the segment before it's compacted
+const COMPACT_THRESHOLD = 1 << 20
+
+// Queue is a bounded FIFO backed by a segment file of JSON lines, so queued items survive a restart.
+// Items are appended and synced as they're pushed. Committing only moves a cursor, kept in a file next to the segment,
+// and the committed lines are compacted away once there's enough of them.
+// When the queue is full, the oldest items are dropped to make room.
+// Items stored but not yet committed when the process stops are delivered again, so whoever stores them should skip repeats.
+type Queue[T any] struct {
+	mu         sync.Mutex
+	path       string
+	cursorPath string
+	file       *os.File
+	items      []T
+	// Where each item's line ends in the segment
+	ends []int64
+	// Where the first uncommitted line starts, and where the segment ends
+	head int64
+	size int64
+	// The segment's header number, so a cursor from before a compaction isn't applied to the compacted segment
+	generation uint64
+	capacity   int
+	pushed     uint64
+	committed  uint64
+	dropped    uint64
+	ready      chan struct{}
+}
+
+// The first line of a compacted segment
+type header struct {
+	Generation *uint64 `json:"queue_segment"`
+}
+
+type Stats struct {
+	Depth     int
+	Capacity  int
+	Pushed    uint64
+	Committed uint64
+	Dropped   uint64
+}
+
+// Open the queue at path, loading any items left from a previous run
+func Open[T any](path string, capacity int) (*Queue[T], error) {
+	q := &Queue[T]{
+		path:       path,
+		cursorPath: path + ".cursor",
+		capacity:   capacity,
+		ready:      make(chan struct{}, 1),
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open queue segment: %w", err)
+	}
+	q.file = file
+
+	if len(q.items) > 0 {
+		log.Printf("Loaded %d queued items from %s", len(q.items), path)
+		q.signal()
+	}
+	return q, nil
+}
+
+// Read the segment from the cursor. A torn write at the end of the file is truncated.
+func (q *Queue[T]) load() error {
+	data, err := os.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read queue segment: %w", err)
+	}
+
+	// Everything after the last newline is a write that didn't finish
+	complete := int64(bytes.LastIndexByte(data, '\n') + 1)
+	if complete < int64(len(data)) {
+		log.Printf("Truncating a partial entry at the end of %s", q.path)
+		if err := os.Truncate(q.path, complete); err != nil {
+			return fmt.Errorf("failed to truncate queue segment: %w", err)
+		}
+		data = data[:complete]
+	}
+	q.size = complete
+
+	start := int64(0)
+	if line, _, found := bytes.Cut(data, []byte{'\n'}); found {
+		var h header
+		if json.Unmarshal(line, &h) == nil && h.Generation != nil {
+			q.generation = *h.Generation
+			start = int64(len(line) + 1)
+		}
+	}
+	q.head = start
+	if generation, offset, ok := q.readCursor(); ok && generation == q.generation && offset >= start && offset <= q.size {
+		q.head = offset
+	}
+
+	offset := q.head
+	for offset < q.size {
+		line, _, _ := bytes.Cut(data[offset:], []byte{'\n'})
+		offset += int64(len(line) + 1)
+		var item T
+		if err := json.Unmarshal(line, &item); err != nil {
+			log.Printf("Skipping unreadable queue entry: %v", err)
+			continue
+		}
+		q.items = append(q.items, item)
+		q.ends = append(q.ends, offset)
+	}
+	if len(q.items) > q.capacity {
+		drop := len(q.items) - q.capacity
+		q.dropped += uint64(drop)
+		q.advance(drop)
+	}
+	return nil
+}
+
+// The generation and offset saved by the last commit, ok is false when there's no cursor
+func (q *Queue[T]) readCursor() (generation uint64, offset int64, ok bool) {
+	data, err := os.ReadFile(q.cursorPath)
+	if err != nil {
+		return 0, 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return 0, 0, false
+	}
+	generation, err = strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	offset, err = strconv.ParseInt(fields[1], 10, 64)
+	return generation, offset, err == nil
+}
+
+// Push an item onto the end of the queue, it's on disk when Push returns
+func (q *Queue[T]) Push(item T) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("failed to encode queue entry: %w", err)
+	}
+	data = append(data, '\n')
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) >= q.capacity {
+		// Drop a chunk of the oldest items. The cursor is saved on the next commit,
+		// until then they're dropped again when the segment is loaded.
+		drop := max(1, q.capacity/100)
+		q.dropped += uint64(drop)
+		q.advance(drop)
+		if q.head >= COMPACT_THRESHOLD {
+			if err := q.compact(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := q.file.Write(data); err != nil {
+		// Cut off whatever made it, so the next entry doesn't land on the end of a partial line
+		q.file.Truncate(q.size)
+		return fmt.Errorf("failed to write queue entry: %w", err)
+	}
+	if err := q.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync queue segment: %w", err)
+	}
+	q.size += int64(len(data))
+	q.items = append(q.items, item)
+	q.ends = append(q.ends, q.size)
+	q.pushed++
+	q.signal()
+	return nil
+}
+
+// Peek returns up to n items from the front of the queue, without removing them
+func (q *Queue[T]) Peek(n int) []T {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n = min(n, len(q.items))
+	return append([]T(nil), q.items[:n]...)
+}
+
+// Commit removes n items from the front of the queue, once they've been stored.
+// They're removed even if the cursor can't be saved, the next commit saves it again.
+func (q *Queue[T]) Commit(n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n = min(n, len(q.items))
+	q.advance(n)
+	q.committed += uint64(n)
+
+	if q.head >= COMPACT_THRESHOLD {
+		return q.compact()
+	}
+	return q.saveCursor()
+}
+
+// Ready is signalled when items are pushed
+func (q *Queue[T]) Ready() <-chan struct{} {
+	return q.ready
+}
+
+func (q *Queue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+func (q *Queue[T]) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return Stats{
+		Depth:     len(q.items),
+		Capacity:  q.capacity,
+		Pushed:    q.pushed,
+		Committed: q.committed,
+		Dropped:   q.dropped,
+	}
+}
+
+func (q *Queue[T]) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.file.Close()
+}
+
+func (q *Queue[T]) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Move the head past the first n items. The caller must hold mu.
+func (q *Queue[T]) advance(n int) {
+	if n == 0 {
+		return
+	}
+	q.head = q.ends[n-1]
+	q.items = q.items[n:]
+	q.ends = q.ends[n:]
+}
+
+// Save where the uncommitted items start. The caller must hold mu.
+func (q *Queue[T]) saveCursor() error {
+	tmpPath := q.cursorPath + ".tmp"
+	data := fmt.Sprintf("%d %d\n", q.generation, q.head)
+	if err := writeSynced(tmpPath, func(w io.Writer) error {
+		_, err := io.WriteString(w, data)
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to save queue cursor: %w", err)
+	}
+	if err := os.Rename(tmpPath, q.cursorPath); err != nil {
+		return fmt.Errorf("failed to save queue cursor: %w", err)
+	}
+	return nil
+}
+
+// Replace the segment with a new generation holding the items still queued. The caller must hold mu.
+// If we stop before the cursor is saved, its generation doesn't match and the whole segment is loaded.
+func (q *Queue[T]) compact() error {
+	generation := q.generation + 1
+	tmpPath := q.path + ".tmp"
+	var start int64
+	var ends []int64
+	err := writeSynced(tmpPath, func(w io.Writer) error {
+		counter := &countingWriter{w: w}
+		encoder := json.NewEncoder(counter)
+		if err := encoder.Encode(header{Generation: &generation}); err != nil {
+			return err
+		}
+		start = counter.n
+		for _, item := range q.items {
+			if err := encoder.Encode(item); err != nil {
+				return err
+			}
+			ends = append(ends, counter.n)
+		}
+		return nil
+	})
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to compact queue segment: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, q.path); err != nil {
+		return fmt.Errorf("failed to compact queue segment: %w", err)
+	}
+	if dir, err := os.Open(filepath.Dir(q.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	// Reopen for appends, the old handle points at the replaced file
+	file, err := os.OpenFile(q.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open queue segment: %w", err)
+	}
+	q.file.Close()
+	q.file = file
+	q.generation = generation
+	q.head = start
+	q.ends = ends
+	q.size = start
+	if len(ends) > 0 {
+		q.size = ends[len(ends)-1]
+	}
+	return q.saveCursor()
+}
+
+// Write a file with fn and sync it
+func writeSynced(path string, fn func(io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	err = fn(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	return errors.Join(err, file.Close())
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
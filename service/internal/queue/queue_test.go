@@ -0,0 +1,160 @@
+package queue
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type entry struct {
+	N    int    `json:"n"`
+	Note string `json:"note"`
+}
+
+func openTest(t *testing.T, path string, capacity int) *Queue[entry] {
+	t.Helper()
+	q, err := Open[entry](path, capacity)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+func push(t *testing.T, q *Queue[entry], from int, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := q.Push(entry{N: i}); err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+	}
+}
+
+func expectFront(t *testing.T, q *Queue[entry], first int, length int) {
+	t.Helper()
+	if q.Len() != length {
+		t.Fatalf("expected %d items, got %d", length, q.Len())
+	}
+	if length > 0 {
+		if front := q.Peek(1)[0].N; front != first {
+			t.Fatalf("expected item %d at the front, got %d", first, front)
+		}
+	}
+}
+
+func TestCommitSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gnome.queue")
+	q := openTest(t, path, 100)
+	push(t, q, 0, 10)
+	if err := q.Commit(4); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	before, _ := os.Stat(path)
+	if err := q.Commit(2); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if before.Size() != after.Size() {
+		t.Errorf("commit rewrote the segment, %d bytes became %d", before.Size(), after.Size())
+	}
+	q.Close()
+
+	q = openTest(t, path, 100)
+	expectFront(t, q, 6, 4)
+	push(t, q, 10, 12)
+	if err := q.Commit(6); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	expectFront(t, q, 0, 0)
+}
+
+func TestTruncatesPartialLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gnome.queue")
+	q := openTest(t, path, 100)
+	push(t, q, 0, 3)
+	q.Close()
+
+	// A write cut short by a power loss or a full disk
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`{"n":3,"no`)
+	file.Close()
+
+	q = openTest(t, path, 100)
+	expectFront(t, q, 0, 3)
+	push(t, q, 3, 4)
+	q.Close()
+
+	q = openTest(t, path, 100)
+	expectFront(t, q, 0, 4)
+	if last := q.Peek(4)[3].N; last != 3 {
+		t.Fatalf("expected the entry after the torn write to load, got %d", last)
+	}
+}
+
+func TestCompactsPastThreshold(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gnome.queue")
+	q := openTest(t, path, 100000)
+	note := strings.Repeat("x", 1000)
+	count := COMPACT_THRESHOLD/1000 + 100
+	for i := 0; i < count; i++ {
+		if err := q.Push(entry{N: i, Note: note}); err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+	}
+	// Commit in batches, like the writer does
+	for committed := 0; committed < count-10; committed += 50 {
+		if err := q.Commit(min(50, count-10-committed)); err != nil {
+			t.Fatalf("Commit: %v", err)
+		}
+	}
+	info, _ := os.Stat(path)
+	if info.Size() >= COMPACT_THRESHOLD {
+		t.Errorf("expected the segment to be compacted, it's %d bytes", info.Size())
+	}
+	expectFront(t, q, count-10, 10)
+	q.Close()
+
+	q = openTest(t, path, 100000)
+	expectFront(t, q, count-10, 10)
+}
+
+func TestStaleCursorAfterCompaction(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gnome.queue")
+	q := openTest(t, path, 100000)
+	note := strings.Repeat("x", 1000)
+	count := COMPACT_THRESHOLD/1000 + 10
+	for i := 0; i < count; i++ {
+		q.Push(entry{N: i, Note: note})
+	}
+	if err := q.Commit(2); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	stale, _ := os.ReadFile(path + ".cursor")
+	if err := q.Commit(count - 7); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	q.Close()
+
+	// Stopping after the compacted segment was renamed, but before its cursor was saved
+	os.WriteFile(path+".cursor", stale, 0644)
+	q = openTest(t, path, 100000)
+	expectFront(t, q, count-5, 5)
+}
+
+func TestDropsOldestWhenFull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gnome.queue")
+	q := openTest(t, path, 200)
+	push(t, q, 0, 210)
+	if stats := q.Stats(); stats.Dropped == 0 || stats.Depth > 200 {
+		t.Fatalf("expected the oldest items to be dropped, got %+v", stats)
+	}
+	first := q.Peek(1)[0].N
+	q.Close()
+
+	q = openTest(t, path, 200)
+	if q.Len() > 200 || q.Peek(1)[0].N < first {
+		t.Fatalf("dropped items came back, %d items from %d", q.Len(), q.Peek(1)[0].N)
+	}
+}
@@ -0,0 +1,219 @@
+package solar
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Elevations of the sun's center, in degrees
+const (
+	// Sunrise and sunset, when the top of the sun crosses the horizon after refraction
+	SUNRISE_ELEVATION = -0.833
+	// Civil dawn and dusk, there's enough light to work outside without lamps
+	CIVIL_TWILIGHT_ELEVATION = -6.0
+)
+
+const (
+	// The Haurwitz clear-sky model's global horizontal irradiance, in W/m², at a zenith sun
+	HAURWITZ_IRRADIANCE = 1098.0
+	// Lumens per watt of daylight, to turn irradiance into the lux the sensor measures
+	DAYLIGHT_EFFICACY = 110.0
+)
+
+var ErrInvalidSite = errors.New("latitude must be between -90 and 90, and longitude between -180 and 180")
+
+// Where the device is, in decimal degrees with north and east positive
+type Site struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+func NewSite(latitude float64, longitude float64) (*Site, error) {
+	if math.IsNaN(latitude) || math.IsNaN(longitude) || math.Abs(latitude) > 90 || math.Abs(longitude) > 180 {
+		return nil, ErrInvalidSite
+	}
+	return &Site{Latitude: latitude, Longitude: longitude}, nil
+}
+
+// Where the sun is at a moment, in degrees
+type Position struct {
+	// Above the horizon, negative when the sun is down. Refraction isn't included.
+	Elevation float64 `json:"elevation"`
+	// Clockwise from north
+	Azimuth float64 `json:"azimuth"`
+}
+
+// The sun's times for one day. A time is nil when the sun doesn't cross its elevation that day, near the poles.
+type Day struct {
+	Date      string     `json:"date"`
+	SolarNoon time.Time  `json:"solar_noon"`
+	Sunrise   *time.Time `json:"sunrise"`
+	Sunset    *time.Time `json:"sunset"`
+	CivilDawn *time.Time `json:"civil_dawn"`
+	CivilDusk *time.Time `json:"civil_dusk"`
+	// Hours from sunrise to sunset, 0 or 24 when the sun doesn't rise or set
+	DayLengthHours float64 `json:"day_length_hours"`
+}
+
+// The sun's position from the NOAA solar equations, which are accurate to about a minute of arc
+func (s Site) Position(t time.Time) Position {
+	declination, equationOfTime := sunAt(t)
+
+	// Minutes past midnight in apparent solar time, then degrees from solar noon
+	utc := t.UTC()
+	minutes := float64(utc.Hour()*60+utc.Minute()) + float64(utc.Second())/60 + float64(utc.Nanosecond())/6e10
+	trueSolarTime := math.Mod(minutes+equationOfTime+4*s.Longitude, 1440)
+	if trueSolarTime < 0 {
+		trueSolarTime += 1440
+	}
+	hourAngle := trueSolarTime/4 - 180
+
+	lat, dec, ha := radians(s.Latitude), radians(declination), radians(hourAngle)
+	cosZenith := math.Sin(lat)*math.Sin(dec) + math.Cos(lat)*math.Cos(dec)*math.Cos(ha)
+	zenith := math.Acos(clamp(cosZenith))
+
+	azimuth := 180.0
+	if denominator := math.Cos(lat) * math.Sin(zenith); math.Abs(denominator) > 1e-9 {
+		angle := degrees(math.Acos(clamp((math.Sin(lat)*math.Cos(zenith) - math.Sin(dec)) / denominator)))
+		if hourAngle > 0 {
+			azimuth = math.Mod(angle+180, 360)
+		} else {
+			azimuth = math.Mod(540-angle, 360)
+		}
+	}
+	return Position{Elevation: 90 - degrees(zenith), Azimuth: azimuth}
+}
+
+// Sunrise, sunset and civil twilight for date's day in loc
+func (s Site) Day(date time.Time, loc *time.Location) Day {
+	local := date.In(loc)
+	noon := s.solarNoon(time.Date(local.Year(), local.Month(), local.Day(), 12, 0, 0, 0, loc))
+	day := Day{
+		Date:      local.Format(time.DateOnly),
+		SolarNoon: noon.In(loc).Round(time.Second),
+	}
+	day.Sunrise, day.Sunset = s.crossings(noon, SUNRISE_ELEVATION, loc)
+	day.CivilDawn, day.CivilDusk = s.crossings(noon, CIVIL_TWILIGHT_ELEVATION, loc)
+	switch {
+	case day.Sunrise != nil && day.Sunset != nil:
+		day.DayLengthHours = day.Sunset.Sub(*day.Sunrise).Hours()
+	case s.Position(noon).Elevation > SUNRISE_ELEVATION:
+		day.DayLengthHours = 24
+	}
+	return day
+}
+
+// The next civil dawn after t, or false when the sun stays down for days, in a polar night
+func (s Site) NextCivilDawn(t time.Time) (time.Time, bool) {
+	for days := 0; days < 3; days++ {
+		day := s.Day(t.AddDate(0, 0, days), time.UTC)
+		if day.CivilDawn != nil && day.CivilDawn.After(t) {
+			return *day.CivilDawn, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Global horizontal irradiance under a clear sky, in W/m², from the Haurwitz model
+func (s Site) ClearSkyIrradiance(t time.Time) float64 {
+	elevation := s.Position(t).Elevation
+	if elevation <= 0 {
+		return 0
+	}
+	cosZenith := math.Sin(radians(elevation))
+	return HAURWITZ_IRRADIANCE * cosZenith * math.Exp(-0.057/cosZenith)
+}
+
+// The lux a clear sky would give, to compare with what the sensor measures
+func (s Site) ClearSkyLux(t time.Time) float64 {
+	return s.ClearSkyIrradiance(t) * DAYLIGHT_EFFICACY
+}
+
+// When the sun is highest on the day around t
+func (s Site) solarNoon(t time.Time) time.Time {
+	noon := t
+	// The equation of time barely changes within a day, so two passes are plenty
+	for i := 0; i < 2; i++ {
+		_, equationOfTime := sunAt(noon)
+		midnight := time.Date(noon.UTC().Year(), noon.UTC().Month(), noon.UTC().Day(), 0, 0, 0, 0, time.UTC)
+		noon = midnight.Add(time.Duration((720 - 4*s.Longitude - equationOfTime) * float64(time.Minute)))
+		// Keep the noon nearest to t, far east or west it can fall on the next or previous UTC day
+		for noon.Sub(t) > 12*time.Hour {
+			noon = noon.AddDate(0, 0, -1)
+		}
+		for t.Sub(noon) > 12*time.Hour {
+			noon = noon.AddDate(0, 0, 1)
+		}
+	}
+	return noon
+}
+
+// When the sun crosses elevation before and after noon
+func (s Site) crossings(noon time.Time, elevation float64, loc *time.Location) (*time.Time, *time.Time) {
+	rising, ok := s.crossing(noon, elevation, -1)
+	if !ok {
+		return nil, nil
+	}
+	setting, ok := s.crossing(noon, elevation, 1)
+	if !ok {
+		return nil, nil
+	}
+	rising, setting = rising.In(loc).Round(time.Second), setting.In(loc).Round(time.Second)
+	return &rising, &setting
+}
+
+// One crossing, with the sun's declination refined at the crossing itself
+func (s Site) crossing(noon time.Time, elevation float64, direction float64) (time.Time, bool) {
+	at := noon
+	for i := 0; i < 2; i++ {
+		declination, _ := sunAt(at)
+		lat, dec := radians(s.Latitude), radians(declination)
+		cosHourAngle := (math.Sin(radians(elevation)) - math.Sin(lat)*math.Sin(dec)) / (math.Cos(lat) * math.Cos(dec))
+		if cosHourAngle < -1 || cosHourAngle > 1 {
+			return time.Time{}, false
+		}
+		minutes := 4 * degrees(math.Acos(cosHourAngle))
+		at = noon.Add(time.Duration(direction * minutes * float64(time.Minute)))
+	}
+	return at, true
+}
+
+// The sun's declination in degrees, and the equation of time in minutes
+func sunAt(t time.Time) (float64, float64) {
+	julianDay := float64(t.UnixMilli())/86400000 + 2440587.5
+	century := (julianDay - 2451545) / 36525
+
+	meanLongitude := math.Mod(280.46646+century*(36000.76983+century*0.0003032), 360)
+	meanAnomaly := 357.52911 + century*(35999.05029-0.0001537*century)
+	eccentricity := 0.016708634 - century*(0.000042037+0.0000001267*century)
+	center := math.Sin(radians(meanAnomaly))*(1.914602-century*(0.004817+0.000014*century)) +
+		math.Sin(radians(2*meanAnomaly))*(0.019993-0.000101*century) +
+		math.Sin(radians(3*meanAnomaly))*0.000289
+	omega := 125.04 - 1934.136*century
+	apparentLongitude := meanLongitude + center - 0.00569 - 0.00478*math.Sin(radians(omega))
+	meanObliquity := 23 + (26+(21.448-century*(46.815+century*(0.00059-century*0.001813)))/60)/60
+	obliquity := meanObliquity + 0.00256*math.Cos(radians(omega))
+
+	declination := degrees(math.Asin(math.Sin(radians(obliquity)) * math.Sin(radians(apparentLongitude))))
+
+	y := math.Pow(math.Tan(radians(obliquity/2)), 2)
+	l, m := radians(meanLongitude), radians(meanAnomaly)
+	equationOfTime := 4 * degrees(y*math.Sin(2*l)-2*eccentricity*math.Sin(m)+
+		4*eccentricity*y*math.Sin(m)*math.Cos(2*l)-
+		0.5*y*y*math.Sin(4*l)-1.25*eccentricity*eccentricity*math.Sin(2*m))
+	return declination, equationOfTime
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func degrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
+
+// Keep rounding error from pushing an acos argument out of range
+func clamp(value float64) float64 {
+	return math.Max(-1, math.Min(1, value))
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+// Export every reading in the store as CSV, tagged with the device it came from
+func ExportCSV(store ReadingStore, w io.Writer, deviceID string, deviceName string, loc *time.Location) error {
+	writer := csv.NewWriter(w)
+	defer writer.Flush()
+
+	// Write CSV header
+	header := []string{"id", "device_id", "device_name", "job_id", "lux", "full_spectrum", "visible", "infrared", "created_at", "solar_elevation", "quality_flags",
+		"samples", "lux_min", "lux_max", "lux_stddev", "lux_filtered"}
+	if err := writer.Write(header); err != nil {
+		return fmt.Errorf("failed to write CSV header: %w", err)
+	}
+
+	// Write CSV rows
+	err := store.EachReading(func(record Record) error {
+		row := []string{
+			strconv.FormatInt(record.ID, 10),
+			deviceID,
+			deviceName,
+			record.JobID,
+			fmt.Sprintf("%.5f", record.Lux),
+			fmt.Sprintf("%.5e", record.FullSpectrum),
+			fmt.Sprintf("%.5e", record.Visible),
+			fmt.Sprintf("%.5e", record.Infrared),
+			tools.FormatTime(record.CreatedAt, loc),
+			formatNullFloat(record.SolarElevation, 2),
+			strings.Join(record.Quality.Names(), ";"),
+			strconv.Itoa(record.Samples),
+			formatNullFloat(record.LuxMin, 5),
+			formatNullFloat(record.LuxMax, 5),
+			formatNullFloat(record.LuxStdDev, 5),
+			formatNullFloat(record.LuxFiltered, 5),
+		}
+		if err := writer.Write(row); err != nil {
+			return fmt.Errorf("failed to write CSV record: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// A nullable column for CSV, empty when it's NULL
+func formatNullFloat(value *float64, precision int) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', precision, 64)
+}
+
+// Export the store's readings between start and end, with times in loc
+func ExportJSON(store ReadingStore, start time.Time, end time.Time, deviceID string, loc *time.Location) ([]map[string]interface{}, error) {
+	records, err := store.ReadingsBetween(start, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %w", err)
+	}
+
+	var results []map[string]interface{}
+	for _, record := range records {
+		result := map[string]interface{}{
+			"id":            record.ID,
+			"device_id":     deviceID,
+			"job_id":        record.JobID,
+			"lux":           fmt.Sprintf("%.5f", record.Lux),
+			"full_spectrum": fmt.Sprintf("%.5e", record.FullSpectrum),
+			"visible":       fmt.Sprintf("%.5e", record.Visible),
+			"infrared":      fmt.Sprintf("%.5e", record.Infrared),
+			"created_at":    tools.FormatTime(record.CreatedAt, loc),
+		}
+		if record.SolarElevation != nil {
+			result["solar_elevation"] = *record.SolarElevation
+		}
+		if record.Quality != 0 {
+			result["quality_flags"] = record.Quality.Names()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
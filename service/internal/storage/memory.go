@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ztkent/gnome/internal/quality"
+)
+
+// Memory keeps readings in memory, they're gone when Gnome stops.
+// It's for tests and for trying Gnome out without writing to the SD card.
+type Memory struct {
+	mu      sync.RWMutex
+	records []Record
+	nextID  int64
+	// job_id and created_at of the readings, like the unique index in SQLite
+	recordKeys map[recordKey]bool
+	peers      []PeerReading
+	// device_id and remote_id of the peer readings, like the unique index in SQLite
+	peerIDs map[peerKey]bool
+}
+
+type recordKey struct {
+	jobID     string
+	createdAt int64
+}
+
+type peerKey struct {
+	deviceID string
+	remoteID int64
+}
+
+func NewMemory() *Memory {
+	return &Memory{nextID: 1, recordKeys: map[recordKey]bool{}, peerIDs: map[peerKey]bool{}}
+}
+
+func (m *Memory) InsertReadings(records []Record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, record := range records {
+		key := recordKey{jobID: record.JobID, createdAt: record.CreatedAt}
+		if m.recordKeys[key] {
+			continue
+		}
+		m.recordKeys[key] = true
+		record = record.rounded()
+		record.ID = m.nextID
+		m.nextID++
+		m.records = append(m.records, record)
+	}
+	return nil
+}
+
+func (m *Memory) LatestReading() (Record, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.records) == 0 {
+		return Record{}, sql.ErrNoRows
+	}
+	return m.records[len(m.records)-1], nil
+}
+
+func (m *Memory) LatestID() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.records) == 0 {
+		return 0, nil
+	}
+	return m.records[len(m.records)-1].ID, nil
+}
+
+func (m *Memory) ReadingsAfter(afterID int64, limit int) ([]Record, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	// Records are kept in id order
+	first := sort.Search(len(m.records), func(i int) bool { return m.records[i].ID > afterID })
+	last := min(first+limit, len(m.records))
+	return append([]Record{}, m.records[first:last]...), nil
+}
+
+func (m *Memory) ReadingsBetween(start time.Time, end time.Time) ([]Record, error) {
+	return m.filter(func(record Record) bool {
+		return record.CreatedAt >= start.UnixMilli() && record.CreatedAt <= end.UnixMilli()
+	}), nil
+}
+
+// Readings are copied first, so fn can take its time without holding up the recording
+func (m *Memory) EachReading(fn func(Record) error) error {
+	for _, record := range m.filter(func(Record) bool { return true }) {
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) JobSpan(jobID string) (first time.Time, last time.Time, found bool, err error) {
+	var firstMs, lastMs int64
+	for _, record := range m.filter(func(record Record) bool { return record.JobID == jobID }) {
+		if !found || record.CreatedAt < firstMs {
+			firstMs = record.CreatedAt
+		}
+		if !found || record.CreatedAt > lastMs {
+			lastMs = record.CreatedAt
+		}
+		found = true
+	}
+	if !found {
+		return first, last, false, nil
+	}
+	return time.UnixMilli(firstMs), time.UnixMilli(lastMs), true, nil
+}
+
+func (m *Memory) ValidLux(start time.Time, end time.Time, jobID string) ([]LuxPoint, error) {
+	records := m.filter(func(record Record) bool {
+		return record.CreatedAt >= start.UnixMilli() && record.CreatedAt < end.UnixMilli() &&
+			record.Quality&quality.INVALID == 0 && (jobID == "" || record.JobID == jobID)
+	})
+	points := make([]LuxPoint, 0, len(records))
+	for _, record := range records {
+		points = append(points, LuxPoint{Lux: record.Lux, CreatedAt: record.CreatedAt})
+	}
+	return points, nil
+}
+
+func (m *Memory) QualityFlagsSince(since time.Time) ([]quality.Flags, error) {
+	records := m.filter(func(record Record) bool { return record.CreatedAt >= since.UnixMilli() })
+	flags := make([]quality.Flags, 0, len(records))
+	for _, record := range records {
+		flags = append(flags, record.Quality)
+	}
+	return flags, nil
+}
+
+func (m *Memory) InsertPeerReadings(deviceID string, readings []PeerReading) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, reading := range readings {
+		key := peerKey{deviceID: deviceID, remoteID: reading.RemoteID}
+		if m.peerIDs[key] {
+			continue
+		}
+		m.peerIDs[key] = true
+		reading.DeviceID = deviceID
+		m.peers = append(m.peers, reading)
+	}
+	return nil
+}
+
+func (m *Memory) PeerReadingsBetween(deviceID string, start time.Time, end time.Time) ([]PeerReading, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	readings := []PeerReading{}
+	for _, reading := range m.peers {
+		if reading.CreatedAt >= start.UnixMilli() && reading.CreatedAt <= end.UnixMilli() && (deviceID == "" || reading.DeviceID == deviceID) {
+			readings = append(readings, reading)
+		}
+	}
+	sort.SliceStable(readings, func(i, j int) bool { return readings[i].CreatedAt < readings[j].CreatedAt })
+	return readings, nil
+}
+
+// The readings that match, oldest first
+func (m *Memory) filter(match func(Record) bool) []Record {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	records := []Record{}
+	for _, record := range m.records {
+		if match(record) {
+			records = append(records, record)
+		}
+	}
+	return records
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	// Registers the postgres driver
+	_ "github.com/lib/pq"
+
+	"github.com/ztkent/gnome/internal/quality"
+)
+
+// Readings per TimescaleDB chunk, a week of epoch milliseconds
+const TIMESCALE_CHUNK_INTERVAL = int64(7 * 24 * time.Hour / time.Millisecond)
+
+var ErrNoPostgresURL = errors.New("GNOME_POSTGRES_URL isn't set")
+
+// The tables mirror SQLite's, with real numbers for the values.
+// The primary keys include created_at, so TimescaleDB can partition them by time.
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS sunlight (
+		id BIGSERIAL,
+		job_id TEXT NOT NULL,
+		lux DOUBLE PRECISION NOT NULL,
+		full_spectrum DOUBLE PRECISION NOT NULL,
+		visible DOUBLE PRECISION NOT NULL,
+		infrared DOUBLE PRECISION NOT NULL,
+		created_at BIGINT NOT NULL,
+		solar_elevation DOUBLE PRECISION,
+		quality_flags INTEGER NOT NULL DEFAULT 0,
+		samples INTEGER NOT NULL DEFAULT 1,
+		lux_min DOUBLE PRECISION,
+		lux_max DOUBLE PRECISION,
+		lux_stddev DOUBLE PRECISION,
+		lux_filtered DOUBLE PRECISION,
+		PRIMARY KEY (id, created_at)
+	)`,
+	`CREATE INDEX IF NOT EXISTS sunlight_created_at ON sunlight (created_at)`,
+	// One reading per job at a time, readings stored twice before the index keep their first copy
+	`DO $$ BEGIN
+		IF to_regclass('sunlight_job_id_created_at_unique') IS NULL THEN
+			DELETE FROM sunlight a USING sunlight b WHERE a.job_id = b.job_id AND a.created_at = b.created_at AND a.id > b.id;
+			DROP INDEX IF EXISTS sunlight_job_id_created_at;
+			CREATE UNIQUE INDEX sunlight_job_id_created_at_unique ON sunlight (job_id, created_at);
+		END IF;
+	END $$`,
+	`CREATE TABLE IF NOT EXISTS hub_readings (
+		device_id TEXT NOT NULL,
+		remote_id BIGINT NOT NULL,
+		job_id TEXT NOT NULL,
+		lux DOUBLE PRECISION NOT NULL,
+		full_spectrum DOUBLE PRECISION NOT NULL,
+		visible DOUBLE PRECISION NOT NULL,
+		infrared DOUBLE PRECISION NOT NULL,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (device_id, remote_id, created_at)
+	)`,
+	`CREATE INDEX IF NOT EXISTS hub_readings_device_created_at ON hub_readings (device_id, created_at)`,
+}
+
+// Postgres keeps readings in a PostgreSQL database, for hubs collecting from a lot of devices.
+// The tables become hypertables when the TimescaleDB extension is installed.
+// Each Gnome needs its own database, the tables aren't shared between devices.
+type Postgres struct {
+	db     *sql.DB
+	insert *sql.Stmt
+}
+
+// Connect to the database and create the tables
+func OpenPostgres(url string) (*Postgres, error) {
+	if url == "" {
+		return nil, ErrNoPostgresURL
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(MAX_OPEN_CONNS)
+	db.SetMaxIdleConns(MAX_OPEN_CONNS)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	if err := createPostgresSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	insert, err := db.Prepare(`INSERT INTO sunlight (job_id, lux, full_spectrum, visible, infrared, created_at, solar_elevation, quality_flags,
+		samples, lux_min, lux_max, lux_stddev, lux_filtered) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (job_id, created_at) DO NOTHING`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to prepare the reading insert: %w", err)
+	}
+	return &Postgres{db: db, insert: insert}, nil
+}
+
+func createPostgresSchema(db *sql.DB) error {
+	for _, statement := range postgresSchema {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("failed to create the postgres schema: %w", err)
+		}
+	}
+
+	var timescale bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')`).Scan(&timescale)
+	if err != nil || !timescale {
+		return err
+	}
+	for _, table := range []string{"sunlight", "hub_readings"} {
+		_, err := db.Exec(`SELECT create_hypertable($1::regclass, 'created_at', chunk_time_interval => $2::bigint,
+			if_not_exists => TRUE, migrate_data => TRUE)`, table, TIMESCALE_CHUNK_INTERVAL)
+		if err != nil {
+			return fmt.Errorf("failed to create the %s hypertable: %w", table, err)
+		}
+	}
+	log.Println("Storing readings in TimescaleDB hypertables")
+	return nil
+}
+
+func (p *Postgres) Close() error {
+	p.insert.Close()
+	return p.db.Close()
+}
+
+func (p *Postgres) InsertReadings(records []Record) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insert := tx.Stmt(p.insert)
+	for _, record := range records {
+		record = record.rounded()
+		_, err := insert.Exec(record.JobID, record.Lux, record.FullSpectrum, record.Visible, record.Infrared, record.CreatedAt,
+			record.SolarElevation, record.Quality, record.Samples, record.LuxMin, record.LuxMax, record.LuxStdDev, record.LuxFiltered)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *Postgres) LatestReading() (Record, error) {
+	return scanRecord(p.db.QueryRow(`SELECT ` + recordColumns + ` FROM sunlight ORDER BY id DESC LIMIT 1`))
+}
+
+func (p *Postgres) LatestID() (int64, error) {
+	var latest sql.NullInt64
+	err := p.db.QueryRow(`SELECT MAX(id) FROM sunlight`).Scan(&latest)
+	return latest.Int64, err
+}
+
+func (p *Postgres) ReadingsAfter(afterID int64, limit int) ([]Record, error) {
+	return queryRecords(p.db, `SELECT `+recordColumns+` FROM sunlight WHERE id > $1 ORDER BY id LIMIT $2`, afterID, limit)
+}
+
+func (p *Postgres) ReadingsBetween(start time.Time, end time.Time) ([]Record, error) {
+	return queryRecords(p.db, `SELECT `+recordColumns+` FROM sunlight WHERE created_at BETWEEN $1 AND $2 ORDER BY id`, start.UnixMilli(), end.UnixMilli())
+}
+
+func (p *Postgres) EachReading(fn func(Record) error) error {
+	return eachRecord(p.db, `SELECT `+recordColumns+` FROM sunlight ORDER BY id`, fn)
+}
+
+func (p *Postgres) JobSpan(jobID string) (first time.Time, last time.Time, found bool, err error) {
+	var firstMs, lastMs sql.NullInt64
+	err = p.db.QueryRow(`SELECT MIN(created_at), MAX(created_at) FROM sunlight WHERE job_id = $1`, jobID).Scan(&firstMs, &lastMs)
+	if err != nil || !firstMs.Valid {
+		return first, last, false, err
+	}
+	return time.UnixMilli(firstMs.Int64), time.UnixMilli(lastMs.Int64), true, nil
+}
+
+func (p *Postgres) ValidLux(start time.Time, end time.Time, jobID string) ([]LuxPoint, error) {
+	return queryLuxPoints(p.db, `SELECT lux, created_at FROM sunlight
+		WHERE created_at >= $1 AND created_at < $2 AND quality_flags & $3 = 0 AND ($4 = '' OR job_id = $4) ORDER BY id`,
+		start.UnixMilli(), end.UnixMilli(), quality.INVALID, jobID)
+}
+
+func (p *Postgres) QualityFlagsSince(since time.Time) ([]quality.Flags, error) {
+	return queryFlags(p.db, `SELECT quality_flags FROM sunlight WHERE created_at >= $1`, since.UnixMilli())
+}
+
+func (p *Postgres) InsertPeerReadings(deviceID string, readings []PeerReading) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO hub_readings (device_id, remote_id, job_id, lux, full_spectrum, visible, infrared, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, reading := range readings {
+		_, err := stmt.Exec(deviceID, reading.RemoteID, reading.JobID, reading.Lux, reading.FullSpectrum, reading.Visible, reading.Infrared, reading.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *Postgres) PeerReadingsBetween(deviceID string, start time.Time, end time.Time) ([]PeerReading, error) {
+	return queryPeerReadings(p.db, `SELECT device_id, remote_id, job_id, lux, full_spectrum, visible, infrared, created_at FROM hub_readings
+		WHERE created_at BETWEEN $1 AND $2 AND ($3 = '' OR device_id = $3) ORDER BY created_at`,
+		start.UnixMilli(), end.UnixMilli(), deviceID)
+}
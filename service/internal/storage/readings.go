@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/ztkent/gnome/internal/quality"
+)
+
+// A reading as it's stored
+type Record struct {
+	// Assigned when it's stored, ids only increase
+	ID           int64
+	JobID        string
+	Lux          float64
+	FullSpectrum float64
+	Visible      float64
+	Infrared     float64
+	// UTC epoch milliseconds
+	CreatedAt int64
+	// Degrees above the horizon, nil when the device didn't know where it was
+	SolarElevation *float64
+	Quality        quality.Flags
+	// Sub-samples averaged into lux, and their spread when there was more than one
+	Samples   int
+	LuxMin    *float64
+	LuxMax    *float64
+	LuxStdDev *float64
+	// The live lux after the job's filter, when it had one
+	LuxFiltered *float64
+}
+
+// A reading's lux and time, for the summaries
+type LuxPoint struct {
+	Lux       float64
+	CreatedAt int64
+}
+
+const recordColumns = `id, job_id, lux, full_spectrum, visible, infrared, created_at, solar_elevation, quality_flags,
+	samples, lux_min, lux_max, lux_stddev, lux_filtered`
+
+func scanRecord(row interface{ Scan(...any) error }) (Record, error) {
+	var record Record
+	var elevation, luxMin, luxMax, luxStdDev, luxFiltered sql.NullFloat64
+	err := row.Scan(&record.ID, &record.JobID, &record.Lux, &record.FullSpectrum, &record.Visible, &record.Infrared, &record.CreatedAt,
+		&elevation, &record.Quality, &record.Samples, &luxMin, &luxMax, &luxStdDev, &luxFiltered)
+	record.SolarElevation = nullFloat(elevation)
+	record.LuxMin, record.LuxMax = nullFloat(luxMin), nullFloat(luxMax)
+	record.LuxStdDev, record.LuxFiltered = nullFloat(luxStdDev), nullFloat(luxFiltered)
+	return record, err
+}
+
+// Write readings in one transaction, with the prepared insert
+func (r *Repository) InsertReadings(records []Record) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insert := tx.Stmt(r.insert)
+	for _, record := range records {
+		_, err := insert.Exec(
+			record.JobID,
+			fmt.Sprintf("%.5f", record.Lux),
+			fmt.Sprintf("%.5e", record.FullSpectrum),
+			fmt.Sprintf("%.5e", record.Visible),
+			fmt.Sprintf("%.5e", record.Infrared),
+			record.CreatedAt,
+			record.SolarElevation,
+			record.Quality,
+			record.Samples,
+			record.LuxMin,
+			record.LuxMax,
+			record.LuxStdDev,
+			record.LuxFiltered,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// The newest reading, sql.ErrNoRows when there isn't one
+func (r *Repository) LatestReading() (Record, error) {
+	return scanRecord(r.db.QueryRow(`SELECT ` + recordColumns + ` FROM sunlight ORDER BY id DESC LIMIT 1`))
+}
+
+// The newest reading's id, 0 when there isn't one
+func (r *Repository) LatestID() (int64, error) {
+	var latest sql.NullInt64
+	err := r.db.QueryRow(`SELECT MAX(id) FROM sunlight`).Scan(&latest)
+	return latest.Int64, err
+}
+
+// Up to limit readings with an id after afterID, oldest first
+func (r *Repository) ReadingsAfter(afterID int64, limit int) ([]Record, error) {
+	return queryRecords(r.db, `SELECT `+recordColumns+` FROM sunlight WHERE id > ? ORDER BY id LIMIT ?`, afterID, limit)
+}
+
+// The readings from start to end, both included
+func (r *Repository) ReadingsBetween(start time.Time, end time.Time) ([]Record, error) {
+	return queryRecords(r.db, `SELECT `+recordColumns+` FROM sunlight WHERE created_at BETWEEN ? AND ? ORDER BY id`, start.UnixMilli(), end.UnixMilli())
+}
+
+// Call fn with every reading, oldest first, without holding them all in memory
+func (r *Repository) EachReading(fn func(Record) error) error {
+	return eachRecord(r.db, `SELECT `+recordColumns+` FROM sunlight ORDER BY id`, fn)
+}
+
+func eachRecord(db *sql.DB, query string, fn func(Record) error) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func queryRecords(db *sql.DB, query string, args ...interface{}) ([]Record, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []Record{}
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// When a job's first and last readings were taken, found is false when it has none
+func (r *Repository) JobSpan(jobID string) (first time.Time, last time.Time, found bool, err error) {
+	var firstMs, lastMs sql.NullInt64
+	err = r.db.QueryRow(`SELECT MIN(created_at), MAX(created_at) FROM sunlight WHERE job_id = ?`, jobID).Scan(&firstMs, &lastMs)
+	if err != nil || !firstMs.Valid {
+		return first, last, false, err
+	}
+	return time.UnixMilli(firstMs.Int64), time.UnixMilli(lastMs.Int64), true, nil
+}
+
+// The lux of readings from start up to end, leaving out ones with a wrong value, like a failed read.
+// Only the job's readings when jobID is set.
+func (r *Repository) ValidLux(start time.Time, end time.Time, jobID string) ([]LuxPoint, error) {
+	query := `SELECT CAST(lux AS REAL), created_at FROM sunlight WHERE created_at >= ? AND created_at < ? AND quality_flags & ? = 0`
+	args := []interface{}{start.UnixMilli(), end.UnixMilli(), quality.INVALID}
+	if jobID != "" {
+		query += ` AND job_id = ?`
+		args = append(args, jobID)
+	}
+	return queryLuxPoints(r.db, query, args...)
+}
+
+func queryLuxPoints(db *sql.DB, query string, args ...interface{}) ([]LuxPoint, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	points := []LuxPoint{}
+	for rows.Next() {
+		var point LuxPoint
+		if err := rows.Scan(&point.Lux, &point.CreatedAt); err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+	return points, rows.Err()
+}
+
+// The quality flags of every reading since then
+func (r *Repository) QualityFlagsSince(since time.Time) ([]quality.Flags, error) {
+	return queryFlags(r.db, `SELECT quality_flags FROM sunlight WHERE created_at >= ?`, since.UnixMilli())
+}
+
+func queryFlags(db *sql.DB, query string, args ...interface{}) ([]quality.Flags, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	flags := []quality.Flags{}
+	for rows.Next() {
+		var flag quality.Flags
+		if err := rows.Scan(&flag); err != nil {
+			return nil, err
+		}
+		flags = append(flags, flag)
+	}
+	return flags, rows.Err()
+}
+
+// Store readings pulled from a peer, ignoring ones that are already stored
+func (r *Repository) InsertPeerReadings(deviceID string, readings []PeerReading) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO hub_readings (device_id, remote_id, job_id, lux, full_spectrum, visible, infrared, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, reading := range readings {
+		_, err := stmt.Exec(deviceID, reading.RemoteID, reading.JobID, reading.Lux, reading.FullSpectrum, reading.Visible, reading.Infrared, reading.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// A peer's readings from start to end, both included, oldest first. Every peer's when deviceID is empty.
+func (r *Repository) PeerReadingsBetween(deviceID string, start time.Time, end time.Time) ([]PeerReading, error) {
+	return queryPeerReadings(r.db, `SELECT device_id, remote_id, job_id, lux, full_spectrum, visible, infrared, created_at FROM hub_readings
+		WHERE created_at BETWEEN ? AND ? AND (? = '' OR device_id = ?) ORDER BY created_at`,
+		start.UnixMilli(), end.UnixMilli(), deviceID, deviceID)
+}
+
+func queryPeerReadings(db *sql.DB, query string, args ...interface{}) ([]PeerReading, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	readings := []PeerReading{}
+	for rows.Next() {
+		var reading PeerReading
+		err := rows.Scan(&reading.DeviceID, &reading.RemoteID, &reading.JobID, &reading.Lux, &reading.FullSpectrum,
+			&reading.Visible, &reading.Infrared, &reading.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		readings = append(readings, reading)
+	}
+	return readings, rows.Err()
+}
+
+// The value, or nil when it's NULL
+func nullFloat(value sql.NullFloat64) *float64 {
+	if !value.Valid {
+		return nil
+	}
+	return &value.Float64
+}
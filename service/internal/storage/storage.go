@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+// Connections in the pool. WAL lets the readers work alongside the one writer, sqlite serializes the writes.
+const MAX_OPEN_CONNS = 8
+
+// Repository is the one connection pool to the database, and the SQLite ReadingStore.
+// Features with their own tables, like auth and the hub's peers, share the pool through DB.
+type Repository struct {
+	db   *sql.DB
+	path string
+	// The hot path, every reading goes through it
+	insert *sql.Stmt
+}
+
+// Open the database and bring its schema up to date
+func Open(path string) (*Repository, error) {
+	db, err := tools.ConnectSqlite(path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(MAX_OPEN_CONNS)
+	db.SetMaxIdleConns(MAX_OPEN_CONNS)
+
+	insert, err := db.Prepare(`INSERT INTO sunlight (job_id, lux, full_spectrum, visible, infrared, created_at, solar_elevation, quality_flags,
+		samples, lux_min, lux_max, lux_stddev, lux_filtered) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (job_id, created_at) DO NOTHING`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to prepare the reading insert: %w", err)
+	}
+	return &Repository{db: db, path: path, insert: insert}, nil
+}
+
+// The shared pool, for queries on tables other than the readings
+func (r *Repository) DB() *sql.DB {
+	return r.db
+}
+
+func (r *Repository) Close() error {
+	r.insert.Close()
+	return r.db.Close()
+}
+
+// Write a consistent copy of the database to a temporary file next to it, and return its path.
+// With WAL the database file alone can be behind, so it can't be served as it is.
+// The copy is for downloading, so it doesn't have the credentials.
+func (r *Repository) Snapshot() (string, error) {
+	file, err := os.CreateTemp(filepath.Dir(r.path), "gnome-snapshot-*.db")
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+	if _, err := r.db.Exec(`VACUUM INTO ?`, file.Name()); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := clearCredentials(file.Name()); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+func clearCredentials(path string) error {
+	snapshot, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+	return tools.ClearCredentials(context.Background(), snapshot)
+}
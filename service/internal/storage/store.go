@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ztkent/gnome/internal/quality"
+)
+
+// Where readings can be kept
+const (
+	BACKEND_SQLITE   = "sqlite"
+	BACKEND_MEMORY   = "memory"
+	BACKEND_POSTGRES = "postgres"
+)
+
+// ReadingStore keeps the device's readings, and the readings a hub pulls from its peers.
+// SQLite is the default, memory is for tests and trying Gnome out without a database,
+// and Postgres, or TimescaleDB, is for hubs collecting from a lot of devices.
+type ReadingStore interface {
+	// Write readings in one transaction, skipping any the job already has at the same time
+	InsertReadings(records []Record) error
+	// The newest reading, sql.ErrNoRows when there isn't one
+	LatestReading() (Record, error)
+	// The newest reading's id, 0 when there isn't one
+	LatestID() (int64, error)
+	// Up to limit readings with an id after afterID, oldest first
+	ReadingsAfter(afterID int64, limit int) ([]Record, error)
+	// The readings from start to end, both included, oldest first
+	ReadingsBetween(start time.Time, end time.Time) ([]Record, error)
+	// Call fn with every reading, oldest first, without holding them all in memory
+	EachReading(fn func(Record) error) error
+	// When a job's first and last readings were taken, found is false when it has none
+	JobSpan(jobID string) (first time.Time, last time.Time, found bool, err error)
+	// The lux of readings from start up to end, leaving out ones with a wrong value. Only the job's when jobID is set.
+	ValidLux(start time.Time, end time.Time, jobID string) ([]LuxPoint, error)
+	// The quality flags of every reading since then
+	QualityFlagsSince(since time.Time) ([]quality.Flags, error)
+
+	// Store readings pulled from a peer, ignoring ones that are already stored
+	InsertPeerReadings(deviceID string, readings []PeerReading) error
+	// A peer's readings from start to end, both included, oldest first. Every peer's when deviceID is empty.
+	PeerReadingsBetween(deviceID string, start time.Time, end time.Time) ([]PeerReading, error)
+}
+
+// A store that can write a copy of itself as a SQLite database, for the export
+type Snapshotter interface {
+	Snapshot() (string, error)
+}
+
+// A reading pulled from another device
+type PeerReading struct {
+	DeviceID string
+	// The reading's id on the device it came from
+	RemoteID     int64
+	JobID        string
+	Lux          float64
+	FullSpectrum float64
+	Visible      float64
+	Infrared     float64
+	// UTC epoch milliseconds
+	CreatedAt int64
+}
+
+// Open the backend readings are kept in. SQLite readings share the database with everything else.
+func OpenReadingStore(backend string, sqlite *Repository, postgresURL string) (ReadingStore, error) {
+	switch backend {
+	case "", BACKEND_SQLITE:
+		return sqlite, nil
+	case BACKEND_MEMORY:
+		return NewMemory(), nil
+	case BACKEND_POSTGRES:
+		postgres, err := OpenPostgres(postgresURL)
+		if err != nil {
+			return nil, err
+		}
+		return postgres, nil
+	}
+	return nil, fmt.Errorf("invalid storage backend %q, expected %s, %s or %s", backend, BACKEND_SQLITE, BACKEND_MEMORY, BACKEND_POSTGRES)
+}
+
+// The record at the precision SQLite keeps it, so every backend serves the same values
+func (record Record) rounded() Record {
+	record.Lux = round(record.Lux, "%.5f")
+	record.FullSpectrum = round(record.FullSpectrum, "%.5e")
+	record.Visible = round(record.Visible, "%.5e")
+	record.Infrared = round(record.Infrared, "%.5e")
+	return record
+}
+
+func round(value float64, format string) float64 {
+	rounded, err := strconv.ParseFloat(fmt.Sprintf(format, value), 64)
+	if err != nil {
+		return value
+	}
+	return rounded
+}
@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ztkent/gnome/internal/quality"
+)
+
+// Set to a database the tests can empty, to run them against Postgres too
+const TEST_POSTGRES_URL_ENV = "GNOME_TEST_POSTGRES_URL"
+
+var start = time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+// Every backend that can run here, freshly created
+func testStores(t *testing.T) map[string]ReadingStore {
+	t.Helper()
+	repository, err := Open(filepath.Join(t.TempDir(), "gnome.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { repository.Close() })
+	stores := map[string]ReadingStore{
+		BACKEND_MEMORY: NewMemory(),
+		BACKEND_SQLITE: repository,
+	}
+
+	if url := os.Getenv(TEST_POSTGRES_URL_ENV); url != "" {
+		postgres, err := OpenPostgres(url)
+		if err != nil {
+			t.Fatalf("OpenPostgres: %v", err)
+		}
+		t.Cleanup(func() { postgres.Close() })
+		if _, err := postgres.db.Exec(`TRUNCATE sunlight, hub_readings RESTART IDENTITY`); err != nil {
+			t.Fatalf("truncate: %v", err)
+		}
+		stores[BACKEND_POSTGRES] = postgres
+	}
+	return stores
+}
+
+// Run the test against every backend
+func forEachStore(t *testing.T, test func(t *testing.T, store ReadingStore)) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			test(t, store)
+		})
+	}
+}
+
+// Readings for the job, a minute apart from start
+func testRecords(jobID string, start time.Time, count int) []Record {
+	records := make([]Record, 0, count)
+	for i := 0; i < count; i++ {
+		records = append(records, Record{
+			JobID:        jobID,
+			Lux:          1000 + float64(i),
+			FullSpectrum: 2000,
+			Visible:      1500,
+			Infrared:     500,
+			CreatedAt:    start.Add(time.Duration(i) * time.Minute).UnixMilli(),
+			Samples:      1,
+		})
+	}
+	return records
+}
+
+func insert(t *testing.T, store ReadingStore, records []Record) {
+	t.Helper()
+	if err := store.InsertReadings(records); err != nil {
+		t.Fatalf("InsertReadings: %v", err)
+	}
+}
+
+func TestReadingsAfterPages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ReadingStore) {
+		insert(t, store, testRecords("job-1", start, 5))
+
+		pages := [][]Record{}
+		afterID := int64(0)
+		for {
+			page, err := store.ReadingsAfter(afterID, 2)
+			if err != nil {
+				t.Fatalf("ReadingsAfter: %v", err)
+			}
+			if len(page) == 0 {
+				break
+			}
+			pages = append(pages, page)
+			afterID = page[len(page)-1].ID
+		}
+		if len(pages) != 3 || len(pages[0]) != 2 || len(pages[1]) != 2 || len(pages[2]) != 1 {
+			t.Fatalf("expected pages of 2, 2 and 1, got %v", pages)
+		}
+		previous := int64(0)
+		for i, record := range append(append(pages[0], pages[1]...), pages[2]...) {
+			if record.ID <= previous || record.Lux != 1000+float64(i) {
+				t.Errorf("reading %d out of order: %+v", i, record)
+			}
+			previous = record.ID
+		}
+		if latest, err := store.LatestID(); err != nil || latest != previous {
+			t.Errorf("expected the latest id %d, got %d, %v", previous, latest, err)
+		}
+		if page, _ := store.ReadingsAfter(previous, 2); len(page) != 0 {
+			t.Errorf("expected nothing after the latest reading, got %v", page)
+		}
+	})
+}
+
+func TestRangeBounds(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ReadingStore) {
+		records := testRecords("job-1", start, 3)
+		// A wrong value is kept, but left out of the lux
+		records[1].Lux = -5
+		records[1].Quality = quality.FLAG_NEGATIVE
+		insert(t, store, records)
+		insert(t, store, testRecords("job-2", start.Add(30*time.Second), 1))
+		end := start.Add(2 * time.Minute)
+
+		between, err := store.ReadingsBetween(start, end)
+		if err != nil {
+			t.Fatalf("ReadingsBetween: %v", err)
+		}
+		if len(between) != 4 {
+			t.Errorf("expected ReadingsBetween to include both ends, got %d readings", len(between))
+		}
+		if after, _ := store.ReadingsBetween(start.Add(time.Millisecond), end.Add(-time.Millisecond)); len(after) != 2 {
+			t.Errorf("expected the readings strictly inside, got %d", len(after))
+		}
+
+		points, err := store.ValidLux(start, end, "")
+		if err != nil {
+			t.Fatalf("ValidLux: %v", err)
+		}
+		if len(points) != 2 || points[0].CreatedAt != start.UnixMilli() {
+			t.Errorf("expected ValidLux to include the start, leave out the end and the wrong value, got %+v", points)
+		}
+		if points, _ := store.ValidLux(start, end.Add(time.Millisecond), "job-1"); len(points) != 2 || points[1].Lux != 1002 {
+			t.Errorf("expected only job-1's valid lux, got %+v", points)
+		}
+
+		first, last, found, err := store.JobSpan("job-1")
+		if err != nil || !found || !first.Equal(start) || !last.Equal(end) {
+			t.Errorf("unexpected span %s to %s, %t, %v", first, last, found, err)
+		}
+		if _, _, found, _ := store.JobSpan("job-3"); found {
+			t.Error("found a span for a job without readings")
+		}
+	})
+}
+
+func TestReplayedReadingsAreSkipped(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ReadingStore) {
+		batch := testRecords("job-1", start, 3)
+		insert(t, store, batch)
+		// The queue delivers the batch again after a crash, with one new reading
+		insert(t, store, append(batch, testRecords("job-1", start.Add(3*time.Minute), 1)...))
+		// Another job can have a reading at the same time
+		insert(t, store, testRecords("job-2", start, 1))
+
+		records, err := store.ReadingsAfter(0, 100)
+		if err != nil {
+			t.Fatalf("ReadingsAfter: %v", err)
+		}
+		if len(records) != 5 {
+			t.Fatalf("expected 5 readings, got %d", len(records))
+		}
+		if records[3].Lux != 1000 || records[3].CreatedAt != start.Add(3*time.Minute).UnixMilli() {
+			t.Errorf("expected the new reading after the first batch, got %+v", records[3])
+		}
+	})
+}
+
+func TestPeerReadingsDedupe(t *testing.T) {
+	peerReadings := func(remoteIDs ...int64) []PeerReading {
+		readings := []PeerReading{}
+		for _, id := range remoteIDs {
+			readings = append(readings, PeerReading{RemoteID: id, JobID: "job-1", Lux: float64(id), CreatedAt: start.Add(time.Duration(id) * time.Minute).UnixMilli()})
+		}
+		return readings
+	}
+	forEachStore(t, func(t *testing.T, store ReadingStore) {
+		for _, sync := range []struct {
+			deviceID string
+			readings []PeerReading
+		}{
+			{"bed-1", peerReadings(1, 2)},
+			// The next sync overlaps the last one
+			{"bed-1", peerReadings(2, 3)},
+			// Ids are only unique per device
+			{"bed-2", peerReadings(1)},
+		} {
+			if err := store.InsertPeerReadings(sync.deviceID, sync.readings); err != nil {
+				t.Fatalf("InsertPeerReadings: %v", err)
+			}
+		}
+
+		readings, err := store.PeerReadingsBetween("bed-1", start, start.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("PeerReadingsBetween: %v", err)
+		}
+		if len(readings) != 3 {
+			t.Fatalf("expected 3 of bed-1's readings, got %+v", readings)
+		}
+		for i, reading := range readings {
+			if reading.DeviceID != "bed-1" || reading.RemoteID != int64(i+1) {
+				t.Errorf("unexpected reading %d %+v", i, reading)
+			}
+		}
+		if every, _ := store.PeerReadingsBetween("", start, start.Add(time.Hour)); len(every) != 4 {
+			t.Errorf("expected every peer's 4 readings, got %d", len(every))
+		}
+		if bounded, _ := store.PeerReadingsBetween("bed-1", start.Add(time.Minute), start.Add(2*time.Minute)); len(bounded) != 2 {
+			t.Errorf("expected both ends included, got %d", len(bounded))
+		}
+	})
+}
@@ -1,99 +1,11 @@
 package tools
 
 import (
-	"bytes"
 	"crypto/rand"
 	"fmt"
-	"log"
 	"net"
-	"net/http"
-	"os/exec"
-	"strings"
-	"time"
 )
 
-type Credentials struct {
-	SSID     string `json:"ssid"`
-	Password string `json:"password"`
-}
-
-// Use nmcli to connect to the provided Wi-Fi network credentials
-func attemptWifiConnection(creds Credentials) error {
-	log.Printf("Attempting to connect to Wi-Fi network: %s\n", creds.SSID)
-
-	// Recan for available networks
-	_, err := runCommand("nmcli", "device", "wifi", "rescan")
-	if err != nil {
-		return fmt.Errorf("Failed to rescan Wi-Fi networks: %v", err)
-	}
-
-	// Add new Wi-Fi connection
-	_, err = runCommand("nmcli", "dev", "wifi", "connect", creds.SSID, "password", creds.Password)
-	if err != nil {
-		return fmt.Errorf("failed to connect to Wi-Fi network %s: %v", creds.SSID, err)
-	}
-
-	// Ensure our network matches the SSID we requested
-	currentSSID, err := GetCurrentSSID()
-	if err != nil {
-		return fmt.Errorf("Failed to get current SSID: %v", err)
-	}
-	if currentSSID != creds.SSID {
-		return fmt.Errorf("Connected to %s, not %s", currentSSID, creds.SSID)
-	}
-	log.Printf("Connected to Wi-Fi network: %s\n", currentSSID)
-	return nil
-}
-
-func checkInternetConnection(testSite string) bool {
-	client := http.Client{
-		Timeout: 10 * time.Second,
-	}
-	if testSite == "" {
-		testSite = "http://www.ztkent.com"
-	}
-	log.Println("Checking internet connection: ", testSite)
-	response, err := client.Get(testSite)
-	if err != nil {
-		return false
-	}
-	defer response.Body.Close()
-	connected := response.StatusCode == 200
-	if connected {
-		_, err := GetCurrentSSID()
-		if err != nil {
-			log.Println("Failed to get current SSID:", err)
-		}
-	} else {
-		log.Println("Not connected to the internet")
-	}
-	return connected
-}
-
-func GetCurrentSSID() (string, error) {
-	output, err := runCommand("iwgetid", "-r")
-	if err != nil {
-		return "", err
-	}
-	ssid := strings.TrimSpace(string(output))
-	// Log SSID and our IP address
-	if ssid != "" {
-		log.Println("Connected to ", ssid, " : ", GetOutboundIP())
-	}
-
-	return ssid, nil
-}
-
-func GetOutboundIP() net.IP {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		return net.IPv4(127, 0, 0, 1)
-	}
-	defer conn.Close()
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP
-}
-
 // GenerateRandomMAC generates a random MAC address.
 func GenerateRandomMAC() string {
 	mac := make([]byte, 6)
@@ -124,15 +36,3 @@ func GetAllActiveMACAddresses() ([]string, error) {
 
 	return macAddresses, nil
 }
-
-func runCommand(name string, args ...string) (string, error) {
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	cmd := exec.Command(name, args...)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("%v: %s", err, stderr.String())
-	}
-	return stdout.String(), nil
-}
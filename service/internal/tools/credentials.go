@@ -0,0 +1,112 @@
+package tools
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Tables with password and token hashes. They stay on the device, exports and backups don't include them.
+var CREDENTIAL_TABLES = []string{"api_tokens", "users"}
+
+// The rows of the credential tables, so a restore can keep the logins the device has now
+type Credentials map[string]tableRows
+
+type tableRows struct {
+	columns []string
+	rows    [][]interface{}
+}
+
+// Empty the credential tables in a copy of the database, then vacuum it so the hashes aren't left in free pages.
+// The tables are kept, so the copy's schema still matches its migrations.
+func ClearCredentials(ctx context.Context, db *sql.DB) error {
+	for _, table := range CREDENTIAL_TABLES {
+		if exists, err := tableExists(ctx, db, table); err != nil {
+			return err
+		} else if !exists {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%s"`, table)); err != nil {
+			return fmt.Errorf("failed to clear %s: %w", table, err)
+		}
+	}
+	if _, err := db.ExecContext(ctx, `VACUUM`); err != nil {
+		return fmt.Errorf("failed to vacuum the copy: %w", err)
+	}
+	return nil
+}
+
+// Read the credential tables, before the database is replaced
+func SaveCredentials(ctx context.Context, db *sql.DB) (Credentials, error) {
+	credentials := Credentials{}
+	for _, table := range CREDENTIAL_TABLES {
+		if exists, err := tableExists(ctx, db, table); err != nil {
+			return nil, err
+		} else if !exists {
+			continue
+		}
+		saved, err := readTable(ctx, db, table)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", table, err)
+		}
+		credentials[table] = saved
+	}
+	return credentials, nil
+}
+
+// Replace the credential tables with the saved rows, in one transaction
+func (c Credentials) Restore(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for table, saved := range c {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%s"`, table)); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", table, err)
+		}
+		if len(saved.rows) == 0 {
+			continue
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(saved.columns)), ", ")
+		insert := fmt.Sprintf(`INSERT INTO "%s" ("%s") VALUES (%s)`, table, strings.Join(saved.columns, `", "`), placeholders)
+		for _, row := range saved.rows {
+			if _, err := tx.ExecContext(ctx, insert, row...); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", table, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func tableExists(ctx context.Context, db *sql.DB, table string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&count)
+	return count > 0, err
+}
+
+func readTable(ctx context.Context, db *sql.DB, table string) (tableRows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT * FROM "%s"`, table))
+	if err != nil {
+		return tableRows{}, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return tableRows{}, err
+	}
+	saved := tableRows{columns: columns}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return tableRows{}, err
+		}
+		saved.rows = append(saved.rows, values)
+	}
+	return saved, rows.Err()
+}
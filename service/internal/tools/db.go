@@ -1,12 +1,15 @@
 package tools
 
 import (
+	"context"
 	"database/sql"
 	"embed"
+	"fmt"
 	"io/fs"
 	"log"
+	"path/filepath"
+	"slices"
 	"time"
-    "path/filepath"
 
 	_ "github.com/mattn/go-sqlite3" // SQLite driver
 )
@@ -14,9 +17,13 @@ import (
 //go:embed migration/*
 var migrationFiles embed.FS
 
+// Set on every connection: WAL so readers don't block the writer, waiting out locks rather than failing with
+// "database is locked", and syncing at checkpoints only, which WAL keeps safe from corruption on power loss
+const SQLITE_OPTIONS = "_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL"
+
 func ConnectSqlite(filePath string) (*sql.DB, error) {
 	// connect to the sqlite database
-	db, err := connectWithBackoff("sqlite3", filePath, 3)
+	db, err := connectWithBackoff("sqlite3", filePath+"?"+SQLITE_OPTIONS, 3)
 	if err != nil {
 		return nil, err
 	}
@@ -30,23 +37,101 @@ func ConnectSqlite(filePath string) (*sql.DB, error) {
 	return db, nil
 }
 
+// Run each embedded migration once, in name order, recording it in schema_migrations.
+// Migrations from before the table existed were idempotent, so it's safe for them to run once more.
 func RunMigrations(db *sql.DB) error {
-    dirEntries, err := fs.ReadDir(migrationFiles, "migration")
-    if err != nil {
-        return err
-    }
-    for _, entry := range dirEntries {
-        fileName := filepath.Join("migration", entry.Name())
-        fileData, err := fs.ReadFile(migrationFiles, fileName)
-        if err != nil {
-            return err
-        }
-        if _, err := db.Exec(string(fileData)); err != nil {
-            return err
-        }
-    }
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS "schema_migrations" (
+		"name" varchar(255) PRIMARY KEY,
+		"applied_at" timestamp DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return err
+	}
+
+	dirEntries, err := fs.ReadDir(migrationFiles, "migration")
+	if err != nil {
+		return err
+	}
+	for _, entry := range dirEntries {
+		var applied int
+		err := db.QueryRow(`SELECT COUNT(*) FROM schema_migrations WHERE name = ?`, entry.Name()).Scan(&applied)
+		if err != nil {
+			return err
+		}
+		if applied > 0 {
+			continue
+		}
+
+		fileName := filepath.Join("migration", entry.Name())
+		fileData, err := fs.ReadFile(migrationFiles, fileName)
+		if err != nil {
+			return err
+		}
+		if err := applyMigration(db, entry.Name(), string(fileData)); err != nil {
+			return fmt.Errorf("migration %s failed: %w", entry.Name(), err)
+		}
+		log.Printf("Applied migration %s", entry.Name())
+	}
+
+	return nil
+}
+
+// The name of every embedded migration, in the order they run
+func Migrations() ([]string, error) {
+	dirEntries, err := fs.ReadDir(migrationFiles, "migration")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(dirEntries))
+	for _, entry := range dirEntries {
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// Migrations recorded in db that aren't embedded here, so it's from a newer version of Gnome
+func UnknownMigrations(ctx context.Context, db *sql.DB) ([]string, error) {
+	// Databases from before schema_migrations have nothing newer
+	var tables int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`).Scan(&tables)
+	if err != nil || tables == 0 {
+		return nil, err
+	}
+	known, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `SELECT name FROM schema_migrations ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	unknown := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(known, name) {
+			unknown = append(unknown, name)
+		}
+	}
+	return unknown, rows.Err()
+}
 
-    return nil
+func applyMigration(db *sql.DB, name string, migration string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migration); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (name) VALUES (?)`, name); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func connectWithBackoff(driver string, connStr string, maxRetries int) (*sql.DB, error) {
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS "api_tokens" (
+    "id" INTEGER PRIMARY KEY,
+    "name" varchar(255) NOT NULL,
+    "token_hash" varchar(64) NOT NULL UNIQUE,
+    "role" varchar(32) NOT NULL,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP,
+    "last_used_at" timestamp
+);
+
+CREATE TABLE IF NOT EXISTS "users" (
+    "id" INTEGER PRIMARY KEY,
+    "username" varchar(255) NOT NULL UNIQUE,
+    "password_hash" varchar(255) NOT NULL,
+    "role" varchar(32) NOT NULL,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS "device" (
+    "id" INTEGER PRIMARY KEY CHECK ("id" = 1),
+    "uuid" varchar(36) NOT NULL,
+    "name" varchar(255) NOT NULL,
+    "location" varchar(255) NOT NULL DEFAULT '',
+    "notes" text NOT NULL DEFAULT '',
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP,
+    "updated_at" timestamp DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS "hub_peers" (
+    "device_id" varchar(36) PRIMARY KEY,
+    "url" varchar(255) NOT NULL,
+    "name" varchar(255) NOT NULL DEFAULT '',
+    "location" varchar(255) NOT NULL DEFAULT '',
+    "tls_sha256" varchar(95) NOT NULL DEFAULT '',
+    "last_id" INTEGER NOT NULL DEFAULT 0,
+    "last_sync_at" timestamp,
+    "last_error" text NOT NULL DEFAULT '',
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS "hub_readings" (
+    "id" INTEGER PRIMARY KEY,
+    "device_id" varchar(36) NOT NULL,
+    "remote_id" INTEGER NOT NULL,
+    "job_id" varchar(255) NOT NULL,
+    "lux" REAL NOT NULL,
+    "full_spectrum" REAL NOT NULL,
+    "visible" REAL NOT NULL,
+    "infrared" REAL NOT NULL,
+    "created_at" varchar(32) NOT NULL,
+    UNIQUE ("device_id", "remote_id")
+);
+
+CREATE INDEX IF NOT EXISTS "hub_readings_device_created_at" ON "hub_readings" ("device_id", "created_at");
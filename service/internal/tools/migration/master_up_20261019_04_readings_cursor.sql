@@ -0,0 +1,17 @@
+-- AUTOINCREMENT keeps ids from being reused, so they're a stable cursor for syncing
+CREATE TABLE "sunlight_autoincrement" (
+    "id" INTEGER PRIMARY KEY AUTOINCREMENT,
+    "job_id" varchar(255) NOT NULL,
+    "lux" varchar(255) NOT NULL,
+    "full_spectrum" varchar(255) NOT NULL,
+    "visible" varchar(255) NOT NULL,
+    "infrared" varchar(255) NOT NULL,
+    "created_at" timestamp DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO "sunlight_autoincrement" ("id", "job_id", "lux", "full_spectrum", "visible", "infrared", "created_at")
+    SELECT "id", "job_id", "lux", "full_spectrum", "visible", "infrared", "created_at" FROM "sunlight";
+
+DROP TABLE "sunlight";
+
+ALTER TABLE "sunlight_autoincrement" RENAME TO "sunlight";
@@ -0,0 +1,4 @@
+-- Set once a reading has been accepted by the collector
+ALTER TABLE "sunlight" ADD COLUMN "uploaded_at" timestamp;
+
+CREATE INDEX IF NOT EXISTS "sunlight_pending_upload" ON "sunlight" ("id") WHERE "uploaded_at" IS NULL;
@@ -0,0 +1,52 @@
+-- Reading times become UTC epoch milliseconds, so they compare as numbers and can't be mistaken for local time
+CREATE TABLE "sunlight_epoch_ms" (
+    "id" INTEGER PRIMARY KEY AUTOINCREMENT,
+    "job_id" varchar(255) NOT NULL,
+    "lux" varchar(255) NOT NULL,
+    "full_spectrum" varchar(255) NOT NULL,
+    "visible" varchar(255) NOT NULL,
+    "infrared" varchar(255) NOT NULL,
+    "created_at" INTEGER NOT NULL DEFAULT (CAST(ROUND((julianday('now') - 2440587.5) * 86400000) AS INTEGER)),
+    "uploaded_at" INTEGER
+);
+
+INSERT INTO "sunlight_epoch_ms" ("id", "job_id", "lux", "full_spectrum", "visible", "infrared", "created_at", "uploaded_at")
+    SELECT "id", "job_id", "lux", "full_spectrum", "visible", "infrared",
+        COALESCE(CAST(ROUND((julianday("created_at") - 2440587.5) * 86400000) AS INTEGER), 0),
+        CAST(ROUND((julianday("uploaded_at") - 2440587.5) * 86400000) AS INTEGER)
+    FROM "sunlight";
+
+-- Keep the id sequence, so deleted ids aren't reused
+UPDATE "sqlite_sequence" SET "seq" = MAX("seq", (SELECT "seq" FROM "sqlite_sequence" WHERE "name" = 'sunlight'))
+    WHERE "name" = 'sunlight_epoch_ms' AND EXISTS (SELECT 1 FROM "sqlite_sequence" WHERE "name" = 'sunlight');
+
+DROP TABLE "sunlight";
+
+ALTER TABLE "sunlight_epoch_ms" RENAME TO "sunlight";
+
+CREATE INDEX IF NOT EXISTS "sunlight_pending_upload" ON "sunlight" ("id") WHERE "uploaded_at" IS NULL;
+CREATE INDEX IF NOT EXISTS "sunlight_created_at" ON "sunlight" ("created_at");
+
+CREATE TABLE "hub_readings_epoch_ms" (
+    "id" INTEGER PRIMARY KEY,
+    "device_id" varchar(36) NOT NULL,
+    "remote_id" INTEGER NOT NULL,
+    "job_id" varchar(255) NOT NULL,
+    "lux" REAL NOT NULL,
+    "full_spectrum" REAL NOT NULL,
+    "visible" REAL NOT NULL,
+    "infrared" REAL NOT NULL,
+    "created_at" INTEGER NOT NULL,
+    UNIQUE ("device_id", "remote_id")
+);
+
+INSERT INTO "hub_readings_epoch_ms" ("id", "device_id", "remote_id", "job_id", "lux", "full_spectrum", "visible", "infrared", "created_at")
+    SELECT "id", "device_id", "remote_id", "job_id", "lux", "full_spectrum", "visible", "infrared",
+        COALESCE(CAST(ROUND((julianday("created_at") - 2440587.5) * 86400000) AS INTEGER), 0)
+    FROM "hub_readings";
+
+DROP TABLE "hub_readings";
+
+ALTER TABLE "hub_readings_epoch_ms" RENAME TO "hub_readings";
+
+CREATE INDEX IF NOT EXISTS "hub_readings_device_created_at" ON "hub_readings" ("device_id", "created_at");
@@ -0,0 +1,2 @@
+-- The sun's elevation in degrees when the reading was taken, when the device knows where it is
+ALTER TABLE "sunlight" ADD COLUMN "solar_elevation" REAL;
@@ -0,0 +1,2 @@
+-- Sun-exposure reports read one job's readings at a time
+CREATE INDEX IF NOT EXISTS "sunlight_job_id_created_at" ON "sunlight" ("job_id", "created_at");
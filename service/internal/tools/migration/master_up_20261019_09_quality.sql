@@ -0,0 +1,2 @@
+-- What looked wrong with a reading, a bitmask of quality.Flags, 0 when nothing did
+ALTER TABLE "sunlight" ADD COLUMN "quality_flags" INTEGER NOT NULL DEFAULT 0;
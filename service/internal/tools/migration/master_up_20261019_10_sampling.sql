@@ -0,0 +1,7 @@
+-- Sub-samples averaged into a reading, and their spread when there was more than one
+ALTER TABLE "sunlight" ADD COLUMN "samples" INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE "sunlight" ADD COLUMN "lux_min" REAL;
+ALTER TABLE "sunlight" ADD COLUMN "lux_max" REAL;
+ALTER TABLE "sunlight" ADD COLUMN "lux_stddev" REAL;
+-- The live lux after the job's EMA or median filter, when it had one
+ALTER TABLE "sunlight" ADD COLUMN "lux_filtered" REAL;
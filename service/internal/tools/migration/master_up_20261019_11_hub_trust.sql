@@ -0,0 +1,5 @@
+-- The SHA-256 of a peer's public key, pinned instead of its certificate so a renewal doesn't break syncing.
+-- Peers pinned by certificate before this move to their public key the next time the certificate matches.
+ALTER TABLE "hub_peers" ADD COLUMN "tls_spki_sha256" varchar(44) NOT NULL DEFAULT '';
+-- Only approved peers are sent the hub token. Configured peers are approved again on startup, the rest need approving.
+ALTER TABLE "hub_peers" ADD COLUMN "approved" INTEGER NOT NULL DEFAULT 0;
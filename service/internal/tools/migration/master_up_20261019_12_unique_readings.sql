@@ -0,0 +1,5 @@
+-- A job takes one reading at a time, so a batch replayed from the results queue after a crash is ignored instead of stored twice.
+-- Readings already stored twice keep their first copy.
+DELETE FROM "sunlight" WHERE "id" NOT IN (SELECT MIN("id") FROM "sunlight" GROUP BY "job_id", "created_at");
+DROP INDEX IF EXISTS "sunlight_job_id_created_at";
+CREATE UNIQUE INDEX IF NOT EXISTS "sunlight_job_id_created_at" ON "sunlight" ("job_id", "created_at");
@@ -1,24 +1,48 @@
 package tools
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
 	"math/big"
+	"net"
+	"net/http"
 	"os"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	CERTIFICATE_LIFETIME = 365 * 24 * time.Hour
+	// Renew self-signed certificates a month before they expire
+	CERTIFICATE_RENEW_BEFORE = 30 * 24 * time.Hour
+	CERTIFICATE_CHECK_PERIOD = 12 * time.Hour
+)
+
 // Generate a self-signed certificate if one doesn't already exist.
 // HTTPS is required for communicating with the client app.
+// The certificate is reissued when it's close to expiring, or doesn't cover our current hostname and addresses.
+// An existing ECDSA key is kept, so clients pinning the public key don't need to pair again.
 func EnsureCertificate(certPath, keyPath string) error {
 	// Check if the certificate and key files exist
 	_, certErr := os.Stat(certPath)
 	_, keyErr := os.Stat(keyPath)
 
+	var existingKey *ecdsa.PrivateKey
 	// If both files exist, check the certificate's validity
 	if certErr == nil && keyErr == nil {
 		certData, err := os.ReadFile(certPath)
@@ -34,6 +58,9 @@ func EnsureCertificate(certPath, keyPath string) error {
 		if err != nil {
 			return err
 		}
+		if key, ok := cert.PrivateKey.(*ecdsa.PrivateKey); ok {
+			existingKey = key
+		}
 
 		x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
 		if err != nil {
@@ -42,21 +69,73 @@ func EnsureCertificate(certPath, keyPath string) error {
 
 		// Check if the certificate is still valid
 		now := time.Now()
-		if now.After(x509Cert.NotBefore) && now.Before(x509Cert.NotAfter) {
+		if now.After(x509Cert.NotBefore) && now.Before(x509Cert.NotAfter.Add(-CERTIFICATE_RENEW_BEFORE)) && coversSANs(x509Cert) {
 			// Certificate is valid, no need to regenerate
 			return nil
 		}
+		log.Printf("Renewing self-signed certificate, it expires %s", x509Cert.NotAfter.Format(time.RFC3339))
 	}
 
 	// Either the certificate/key files don't exist, or the certificate is invalid; generate a new one
-	return generateSelfSignedCertificate(certPath, keyPath)
+	return generateSelfSignedCertificate(certPath, keyPath, existingKey)
 }
 
-func generateSelfSignedCertificate(certPath, keyPath string) error {
-	// Generate a private key
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// Check the certificate names this device, as it's currently addressed
+func coversSANs(cert *x509.Certificate) bool {
+	dnsNames, ips := localSANs()
+	for _, name := range dnsNames {
+		if !slices.Contains(cert.DNSNames, name) {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		if !slices.ContainsFunc(cert.IPAddresses, ip.Equal) {
+			return false
+		}
+	}
+	return true
+}
+
+// The hostname, its mDNS name, and the addresses of our interfaces
+func localSANs() ([]string, []net.IP) {
+	dnsNames := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		dnsNames = append(dnsNames, hostname)
+		if !strings.HasSuffix(hostname, ".local") {
+			dnsNames = append(dnsNames, hostname+".local")
+		}
+	}
+
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	ifaces, err := net.Interfaces()
 	if err != nil {
-		return err
+		return dnsNames, ips
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+	return dnsNames, ips
+}
+
+func generateSelfSignedCertificate(certPath, keyPath string, privateKey *ecdsa.PrivateKey) error {
+	// Generate a private key, unless we're renewing with an existing one
+	if privateKey == nil {
+		var err error
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Create a certificate template
@@ -65,14 +144,18 @@ func generateSelfSignedCertificate(certPath, keyPath string) error {
 		return err
 	}
 
+	dnsNames, ips := localSANs()
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			Organization: []string{"Ztkent"},
+			CommonName:   dnsNames[len(dnsNames)-1],
 		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(CERTIFICATE_LIFETIME),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 	}
@@ -84,15 +167,19 @@ func generateSelfSignedCertificate(certPath, keyPath string) error {
 	}
 
 	// Encode and save the private key
-	keyFile, err := os.Create(keyPath)
+	keyBytes, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+	keyFile, err := os.OpenFile(keyPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
 	defer keyFile.Close()
 
 	privateKeyPEM := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+		Type:  "EC PRIVATE KEY",
+		Bytes: keyBytes,
 	}
 	if err := pem.Encode(keyFile, privateKeyPEM); err != nil {
 		return err
@@ -115,3 +202,175 @@ func generateSelfSignedCertificate(certPath, keyPath string) error {
 
 	return nil
 }
+
+// CertManager serves the current certificate to the TLS listener, and reloads it when it changes.
+// Self-signed certificates are renewed by the manager, user supplied ones are reloaded when the files change.
+type CertManager struct {
+	certPath   string
+	keyPath    string
+	selfSigned bool
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	leaf     *x509.Certificate
+	modified time.Time
+	onReload func(CertificateFingerprint)
+}
+
+type CertificateFingerprint struct {
+	SHA256          string    `json:"sha256"`
+	SPKISHA256      string    `json:"spki_sha256"`
+	NotAfter        time.Time `json:"not_after"`
+	DNSNames        []string  `json:"dns_names"`
+	IPAddresses     []string  `json:"ip_addresses"`
+	SelfSigned      bool      `json:"self_signed"`
+	PublicKeyPinned bool      `json:"public_key_pinned"`
+}
+
+func NewCertManager(certPath string, keyPath string, selfSigned bool) (*CertManager, error) {
+	c := &CertManager{
+		certPath:   certPath,
+		keyPath:    keyPath,
+		selfSigned: selfSigned,
+	}
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Check the certificate periodically, until the context is cancelled
+func (c *CertManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(CERTIFICATE_CHECK_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.refresh(); err != nil {
+				log.Printf("Failed to refresh certificate: %v", err)
+			}
+		}
+	}
+}
+
+func (c *CertManager) refresh() error {
+	if c.selfSigned {
+		if err := EnsureCertificate(c.certPath, c.keyPath); err != nil {
+			return err
+		}
+	}
+
+	info, err := os.Stat(c.certPath)
+	if err != nil {
+		return err
+	}
+	c.mu.RLock()
+	unchanged := c.cert != nil && info.ModTime().Equal(c.modified)
+	c.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	if len(cert.Certificate) == 0 {
+		return errors.New("no certificate found")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.leaf = leaf
+	c.modified = info.ModTime()
+	onReload := c.onReload
+	c.mu.Unlock()
+	log.Printf("Loaded certificate %s, expires %s", c.certPath, leaf.NotAfter.Format(time.RFC3339))
+	if onReload != nil {
+		onReload(c.Fingerprint())
+	}
+	return nil
+}
+
+// Call fn whenever a new certificate is loaded, e.g. to advertise its fingerprint
+func (c *CertManager) OnReload(fn func(CertificateFingerprint)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onReload = fn
+}
+
+func (c *CertManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+func (c *CertManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+	}
+}
+
+// Fingerprint of the certificate and its public key, for clients to pin on first pairing.
+// The public key survives renewal of a self-signed certificate, the certificate hash doesn't.
+func (c *CertManager) Fingerprint() CertificateFingerprint {
+	c.mu.RLock()
+	leaf := c.leaf
+	c.mu.RUnlock()
+
+	certSum := sha256.Sum256(leaf.Raw)
+	spkiSum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	hexPairs := make([]string, len(certSum))
+	for i, b := range certSum {
+		hexPairs[i] = fmt.Sprintf("%02X", b)
+	}
+	ips := make([]string, len(leaf.IPAddresses))
+	for i, ip := range leaf.IPAddresses {
+		ips[i] = ip.String()
+	}
+	_, isECDSA := leaf.PublicKey.(crypto.PublicKey).(*ecdsa.PublicKey)
+
+	return CertificateFingerprint{
+		SHA256:          strings.Join(hexPairs, ":"),
+		SPKISHA256:      base64.StdEncoding.EncodeToString(spkiSum[:]),
+		NotAfter:        leaf.NotAfter,
+		DNSNames:        leaf.DNSNames,
+		IPAddresses:     ips,
+		SelfSigned:      c.selfSigned,
+		PublicKeyPinned: c.selfSigned && isECDSA,
+	}
+}
+
+// Serve the certificate fingerprint as JSON
+func (c *CertManager) ServeFingerprint() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(c.Fingerprint()); err != nil {
+			log.Printf("Error encoding response: %v", err)
+		}
+	}
+}
+
+// Redirect HTTP requests to the HTTPS listener, except for the paths a client needs before it trusts our certificate
+func RedirectToHTTPS(httpsPort string, exempt http.Handler, exemptPaths ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(exemptPaths, r.URL.Path) {
+			exempt.ServeHTTP(w, r)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		target := "https://" + net.JoinHostPort(host, httpsPort) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,73 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Readings are stored as UTC epoch milliseconds, and served as RFC 3339 with the offset of the timezone they're shown in
+const TIME_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+
+// Times without an offset are read in the requested timezone, like a datetime-local input sends
+var localTimeLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+func FormatTime(ms int64, loc *time.Location) string {
+	return time.UnixMilli(ms).In(loc).Format(TIME_FORMAT)
+}
+
+// The timezone from ?tz=, an IANA name like America/Denver, or fallback when it isn't set
+func RequestLocation(r *http.Request, fallback *time.Location) (*time.Location, error) {
+	name := r.URL.Query().Get("tz")
+	if name == "" {
+		return fallback, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return fallback, fmt.Errorf("unknown timezone %q", name)
+	}
+	return loc, nil
+}
+
+// Parse an RFC 3339 time, or a local time without an offset in loc
+func ParseTime(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range localTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+// Get ?start=&end= from the request, in RFC 3339 or local to loc. Either defaults to the period before the other.
+func ParseStartAndEndDate(r *http.Request, loc *time.Location, period time.Duration) (time.Time, time.Time, error) {
+	r.ParseForm()
+	end := time.Now().In(loc)
+	start := end.Add(-period)
+	var err error
+	if value := r.FormValue("end"); value != "" {
+		if end, err = ParseTime(value, loc); err != nil {
+			return start, end, errors.New("end must be an RFC 3339 time, or a local time like 2006-01-02T15:04")
+		}
+		start = end.Add(-period)
+	}
+	if value := r.FormValue("start"); value != "" {
+		if start, err = ParseTime(value, loc); err != nil {
+			return start, end, errors.New("start must be an RFC 3339 time, or a local time like 2006-01-02T15:04")
+		}
+	}
+	if end.Before(start) {
+		return start, end, errors.New("end must be after start")
+	}
+	return start, end, nil
+}
+
+// Midnight at the start of t's day in loc
+func StartOfDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
@@ -1,14 +1,16 @@
 package tools
 
 import (
-	"database/sql"
-	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"net/http"
-	"os"
+	"strings"
 	"time"
+
+	"github.com/ztkent/gnome/internal/api"
 )
 
 // Prevent out-of-network requests to dashboard endpoints
@@ -25,6 +27,10 @@ func CheckInNetwork(next http.Handler) http.Handler {
 			return
 		}
 		if !isLocalAddress(parsedIP) {
+			if api.IsV2(r) {
+				api.ServeError(w, http.StatusForbidden, api.CODE_FORBIDDEN, "Access denied", nil)
+				return
+			}
 			http.Error(w, "Access denied", http.StatusForbidden)
 			return
 		}
@@ -33,165 +39,38 @@ func CheckInNetwork(next http.Handler) http.Handler {
 	})
 }
 func isLocalAddress(ip net.IP) bool {
-	privateBlocks := []string{
-		"10.0.0.0/8",
-		"172.16.0.0/12",
-		"192.168.0.0/16",
-	}
-	for _, block := range privateBlocks {
-		_, cidr, _ := net.ParseCIDR(block)
-		if cidr.Contains(ip) {
-			return true
-		}
-	}
-	return ip.String() == "127.0.0.1"
-}
-
-// Get the start and end dates from the request, format them for comparison with the DB
-func ParseStartAndEndDate(r *http.Request) (string, string) {
-	r.ParseForm()
-	startDate := r.FormValue("start")
-	endDate := r.FormValue("end")
-	layoutInput := "2006-01-02T15:04"
-	layoutDB := "2006-01-02 15:04:05"
-	if startDate == "" || endDate == "" {
-		startDate = time.Now().UTC().Add(-8 * time.Hour).Format(layoutDB)
-		endDate = time.Now().UTC().Format(layoutDB)
-	} else {
-		var err error
-		var t time.Time
-
-		// Assume they are in EST, who has users? Not me.
-		loc, _ := time.LoadLocation("America/Indiana/Indianapolis")
-
-		t, err = time.Parse(layoutInput, startDate)
-		if err != nil {
-			log.Println("Error parsing start date:", err)
-		} else {
-			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
-			startDate = t.UTC().Format(layoutDB)
-		}
-
-		t, err = time.Parse(layoutInput, endDate)
-		if err != nil {
-			log.Println("Error parsing end date:", err)
-		} else {
-			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
-			endDate = t.UTC().Format(layoutDB)
-		}
-	}
-	return startDate, endDate
-}
-func StartAndEndDateToTime(startDate string, endDate string) (time.Time, time.Time, error) {
-	layoutDB := "2006-01-02 15:04:05"
-	start, err := time.Parse(layoutDB, startDate)
-	if err != nil {
-		return time.Time{}, time.Time{}, err
-	}
-	end, err := time.Parse(layoutDB, endDate)
-	if err != nil {
-		return time.Time{}, time.Time{}, err
-	}
-	return start, end, nil
+	// Private ranges include 10/8, 172.16/12, 192.168/16 and IPv6 unique local addresses
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
 }
 
-func ExportToCSV(dbFile, csvFile string) error {
-	db, err := sql.Open("sqlite3", dbFile)
-	if err != nil {
-		return fmt.Errorf("failed to open database: %w", err)
-	}
-	defer db.Close()
-
-	rows, err := db.Query(`SELECT id, job_id, lux, full_spectrum, visible, infrared, created_at FROM sunlight`)
-	if err != nil {
-		return fmt.Errorf("failed to query database: %w", err)
-	}
-	defer rows.Close()
-
-	file, err := os.Create(csvFile)
-	if err != nil {
-		return fmt.Errorf("failed to create CSV file: %w", err)
-	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	// Write CSV header
-	header := []string{"id", "job_id", "lux", "full_spectrum", "visible", "infrared", "created_at"}
-	if err := writer.Write(header); err != nil {
-		return fmt.Errorf("failed to write CSV header: %w", err)
-	}
-
-	// Write CSV rows
-	for rows.Next() {
-		var id int
-		var jobID, lux, fullSpectrum, visible, infrared, createdAt string
-
-		if err := rows.Scan(&id, &jobID, &lux, &fullSpectrum, &visible, &infrared, &createdAt); err != nil {
-			return fmt.Errorf("failed to scan row: %w", err)
-		}
-
-		record := []string{
-			fmt.Sprintf("%d", id),
-			jobID,
-			lux,
-			fullSpectrum,
-			visible,
-			infrared,
-			createdAt,
-		}
-
-		if err := writer.Write(record); err != nil {
-			return fmt.Errorf("failed to write CSV record: %w", err)
-		}
-	}
-
-	if err := rows.Err(); err != nil {
-		return fmt.Errorf("row iteration error: %w", err)
+// Mark a route as deprecated, pointing clients at its successor
+func Deprecated(successor string, sunset time.Time) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+			w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+			next.ServeHTTP(w, r)
+		})
 	}
-	return nil
 }
 
-func ExportToJSON(dbFile string, start time.Time, end time.Time) ([]map[string]interface{}, error) {
-	db, err := sql.Open("sqlite3", dbFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
-	}
-	defer db.Close()
+const MAX_JSON_BODY = 1 << 20
 
-	rows, err := db.Query(`SELECT id, job_id, lux, full_spectrum, visible, infrared, created_at FROM sunlight WHERE created_at BETWEEN ? AND ?`, start.UTC(), end.UTC())
-	if err != nil {
-		return nil, fmt.Errorf("failed to query database: %w", err)
+// Decode a JSON request body into v, an empty body leaves v as it is.
+// Only JSON is accepted, a cross-origin form can't send it without a CORS preflight.
+func DecodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) (int, error) {
+	if r.Body == nil || r.ContentLength == 0 {
+		return http.StatusOK, nil
 	}
-	defer rows.Close()
-
-	var results []map[string]interface{}
-
-	for rows.Next() {
-		var id int
-		var jobID, lux, fullSpectrum, visible, infrared, createdAt string
-
-		if err := rows.Scan(&id, &jobID, &lux, &fullSpectrum, &visible, &infrared, &createdAt); err != nil {
-			return nil, fmt.Errorf("failed to scan row: %w", err)
-		}
-
-		record := map[string]interface{}{
-			"id":            id,
-			"job_id":        jobID,
-			"lux":           lux,
-			"full_spectrum": fullSpectrum,
-			"visible":       visible,
-			"infrared":      infrared,
-			"created_at":    createdAt,
-		}
-
-		results = append(results, record)
+	mediaType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	if mediaType != "application/json" {
+		return http.StatusUnsupportedMediaType, errors.New("content type must be application/json")
 	}
-
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("row iteration error: %w", err)
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_JSON_BODY))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return http.StatusBadRequest, fmt.Errorf("invalid JSON body: %w", err)
 	}
-
-	return results, nil
+	return http.StatusOK, nil
 }
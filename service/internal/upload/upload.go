@@ -0,0 +1,368 @@
+package upload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ztkent/gnome/internal/device"
+)
+
+const (
+	UPLOAD_INTERVAL   = time.Minute
+	UPLOAD_BATCH_SIZE = 500
+	// Batches per flush, so a long backlog doesn't hold the upload lock for too long
+	MAX_BATCHES_PER_FLUSH = 20
+	REQUEST_TIMEOUT       = 30 * time.Second
+	// Failed uploads are retried after RETRY_MIN, doubling up to RETRY_MAX
+	RETRY_MIN = 30 * time.Second
+	RETRY_MAX = 30 * time.Minute
+)
+
+// How batches are encoded, both are gzipped
+const (
+	FORMAT_JSON   = "json"
+	FORMAT_NDJSON = "ndjson"
+)
+
+// A reading as it's sent to the collector
+type Reading struct {
+	// Only set in NDJSON, a JSON batch has the device once
+	DeviceID     string    `json:"device_id,omitempty"`
+	ID           int64     `json:"id"`
+	JobID        string    `json:"job_id"`
+	Lux          float64   `json:"lux"`
+	FullSpectrum float64   `json:"full_spectrum"`
+	Visible      float64   `json:"visible"`
+	Infrared     float64   `json:"infrared"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// A JSON batch
+type Batch struct {
+	DeviceID   string    `json:"device_id"`
+	DeviceName string    `json:"device_name"`
+	Location   string    `json:"location"`
+	Readings   []Reading `json:"readings"`
+}
+
+type Status struct {
+	URL    string `json:"url"`
+	Format string `json:"format"`
+	// Readings the collector hasn't accepted yet
+	Pending int64 `json:"pending"`
+	// How long the oldest pending reading has been waiting, 0 when everything is uploaded
+	LagSeconds     float64    `json:"lag_seconds"`
+	LastUploadedID int64      `json:"last_uploaded_id"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at"`
+	LastSuccessAt  *time.Time `json:"last_success_at"`
+	LastError      string     `json:"last_error,omitempty"`
+	// Failed attempts in a row
+	Failures      int        `json:"failures"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+}
+
+// The lag for the dashboard
+func (s Status) Lag() string {
+	if s.Pending == 0 {
+		return "Up to date"
+	}
+	return (time.Duration(s.LagSeconds) * time.Second).String()
+}
+
+// The collector refused a batch, with how long it asked us to wait
+type responseError struct {
+	status     string
+	retryAfter time.Duration
+}
+
+func (e *responseError) Error() string {
+	return "collector returned " + e.status
+}
+
+// Uploader pushes readings to a collector, for devices that can't be reached inbound.
+// Each reading is marked once the collector accepts it, so nothing is lost while the collector is down.
+type Uploader struct {
+	db       *sql.DB
+	self     *device.Registry
+	endpoint string
+	token    string
+	format   string
+	client   *http.Client
+
+	// Only one upload runs at a time
+	uploading sync.Mutex
+	// mu guards the attempt history
+	mu             sync.Mutex
+	lastUploadedID int64
+	lastAttemptAt  *time.Time
+	lastSuccessAt  *time.Time
+	lastError      string
+	failures       int
+	nextAttemptAt  *time.Time
+}
+
+func New(db *sql.DB, self *device.Registry, endpoint string, token string, format string) (*Uploader, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid collector URL %q", endpoint)
+	}
+	if format == "" {
+		format = FORMAT_JSON
+	} else if format != FORMAT_JSON && format != FORMAT_NDJSON {
+		return nil, fmt.Errorf("invalid upload format %q, expected %s or %s", format, FORMAT_JSON, FORMAT_NDJSON)
+	}
+	return &Uploader{
+		db:       db,
+		self:     self,
+		endpoint: parsed.String(),
+		token:    token,
+		format:   format,
+		client:   &http.Client{Timeout: REQUEST_TIMEOUT},
+	}, nil
+}
+
+// Upload pending readings every interval until the context is cancelled, backing off while the collector fails
+func (u *Uploader) Run(ctx context.Context) {
+	for {
+		wait := UPLOAD_INTERVAL
+		if err := u.Flush(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			wait = u.retryDelay(err)
+			log.Printf("Upload to %s failed, retrying in %s: %v", u.redactedURL(), wait, err)
+		}
+		next := time.Now().Add(wait)
+		u.mu.Lock()
+		u.nextAttemptAt = &next
+		u.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Upload pending readings now, oldest first, until none are left or MAX_BATCHES_PER_FLUSH is reached
+func (u *Uploader) Flush(ctx context.Context) error {
+	u.uploading.Lock()
+	defer u.uploading.Unlock()
+
+	for batch := 0; batch < MAX_BATCHES_PER_FLUSH; batch++ {
+		readings, err := u.pending(ctx)
+		if err != nil {
+			return err
+		}
+		if len(readings) == 0 {
+			return nil
+		}
+		err = u.send(ctx, readings)
+		u.record(readings, err)
+		if err != nil {
+			return err
+		}
+		if len(readings) < UPLOAD_BATCH_SIZE {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (u *Uploader) Status(ctx context.Context) (Status, error) {
+	u.mu.Lock()
+	status := Status{
+		URL:            u.redactedURL(),
+		Format:         u.format,
+		LastUploadedID: u.lastUploadedID,
+		LastAttemptAt:  u.lastAttemptAt,
+		LastSuccessAt:  u.lastSuccessAt,
+		LastError:      u.lastError,
+		Failures:       u.failures,
+		NextAttemptAt:  u.nextAttemptAt,
+	}
+	u.mu.Unlock()
+
+	err := u.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sunlight WHERE uploaded_at IS NULL`).Scan(&status.Pending)
+	if err != nil {
+		return status, err
+	}
+	if status.Pending == 0 {
+		return status, nil
+	}
+	var oldest int64
+	err = u.db.QueryRowContext(ctx, `SELECT created_at FROM sunlight WHERE uploaded_at IS NULL ORDER BY id LIMIT 1`).Scan(&oldest)
+	if err != nil {
+		return status, err
+	}
+	status.LagSeconds = max(time.Since(time.UnixMilli(oldest)).Seconds(), 0)
+	return status, nil
+}
+
+func (u *Uploader) pending(ctx context.Context) ([]Reading, error) {
+	rows, err := u.db.QueryContext(ctx, `SELECT id, job_id, lux, full_spectrum, visible, infrared, created_at FROM sunlight
+		WHERE uploaded_at IS NULL ORDER BY id LIMIT ?`, UPLOAD_BATCH_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	readings := []Reading{}
+	for rows.Next() {
+		var reading Reading
+		var createdAt int64
+		if err := rows.Scan(&reading.ID, &reading.JobID, &reading.Lux, &reading.FullSpectrum, &reading.Visible, &reading.Infrared, &createdAt); err != nil {
+			return nil, err
+		}
+		reading.CreatedAt = time.UnixMilli(createdAt).UTC()
+		readings = append(readings, reading)
+	}
+	return readings, rows.Err()
+}
+
+// POST a gzipped batch, then mark it uploaded
+func (u *Uploader) send(ctx context.Context, readings []Reading) error {
+	info := u.self.Info()
+	body, contentType, err := u.encode(info, readings)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, REQUEST_TIMEOUT)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, u.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	first, last := readings[0].ID, readings[len(readings)-1].ID
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set("Content-Encoding", "gzip")
+	request.Header.Set("X-Gnome-Device-ID", info.ID)
+	// The same batch is sent again after a failure, so the collector can ignore a repeat
+	request.Header.Set("Idempotency-Key", fmt.Sprintf("%s-%d-%d", info.ID, first, last))
+	if u.token != "" {
+		request.Header.Set("Authorization", "Bearer "+u.token)
+	}
+
+	response, err := u.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return &responseError{status: response.Status, retryAfter: parseRetryAfter(response.Header.Get("Retry-After"))}
+	}
+
+	// Ids only increase, so the batch is every pending reading in this range
+	_, err = u.db.ExecContext(ctx, `UPDATE sunlight SET uploaded_at = ? WHERE id BETWEEN ? AND ? AND uploaded_at IS NULL`,
+		time.Now().UnixMilli(), first, last)
+	if err != nil {
+		return fmt.Errorf("failed to mark readings uploaded: %w", err)
+	}
+	return nil
+}
+
+func (u *Uploader) encode(info device.Info, readings []Reading) ([]byte, string, error) {
+	var buffer bytes.Buffer
+	compressed := gzip.NewWriter(&buffer)
+	contentType := "application/json"
+	if u.format == FORMAT_NDJSON {
+		contentType = "application/x-ndjson"
+		encoder := json.NewEncoder(compressed)
+		for _, reading := range readings {
+			reading.DeviceID = info.ID
+			if err := encoder.Encode(reading); err != nil {
+				return nil, "", err
+			}
+		}
+	} else {
+		batch := Batch{
+			DeviceID:   info.ID,
+			DeviceName: info.Name,
+			Location:   info.Location,
+			Readings:   readings,
+		}
+		if err := json.NewEncoder(compressed).Encode(batch); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := compressed.Close(); err != nil {
+		return nil, "", err
+	}
+	return buffer.Bytes(), contentType, nil
+}
+
+func (u *Uploader) record(readings []Reading, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now().UTC()
+	u.lastAttemptAt = &now
+	if err != nil {
+		u.lastError = err.Error()
+		u.failures++
+		return
+	}
+	u.lastUploadedID = readings[len(readings)-1].ID
+	u.lastSuccessAt = &now
+	u.lastError = ""
+	u.failures = 0
+}
+
+// Double the delay for each failure in a row, with some jitter so a fleet doesn't retry in step.
+// A collector's Retry-After is honoured, up to RETRY_MAX.
+func (u *Uploader) retryDelay(err error) time.Duration {
+	var refused *responseError
+	if errors.As(err, &refused) && refused.retryAfter > 0 {
+		return min(refused.retryAfter, RETRY_MAX)
+	}
+	u.mu.Lock()
+	failures := u.failures
+	u.mu.Unlock()
+
+	delay := RETRY_MIN
+	for i := 1; i < failures && delay < RETRY_MAX; i++ {
+		delay *= 2
+	}
+	delay = min(delay, RETRY_MAX)
+	return delay/2 + rand.N(delay/2)
+}
+
+// Don't show credentials in the URL
+func (u *Uploader) redactedURL() string {
+	parsed, err := url.Parse(u.endpoint)
+	if err != nil {
+		return ""
+	}
+	return parsed.Redacted()
+}
+
+// Retry-After is either seconds or an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+package upload
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+func (u *Uploader) StatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := u.Status(r.Context())
+		if err != nil {
+			log.Println(err)
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveJSON(w, status, http.StatusOK)
+	}
+}
+
+// Upload pending readings now, rather than waiting for the next interval
+func (u *Uploader) FlushHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flushErr := u.Flush(r.Context())
+		status, err := u.Status(r.Context())
+		if err != nil {
+			log.Println(err)
+			serveMessage(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if flushErr != nil {
+			serveJSON(w, status, http.StatusBadGateway)
+			return
+		}
+		serveJSON(w, status, http.StatusOK)
+	}
+}
+
+func serveJSON(w http.ResponseWriter, body interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+func serveMessage(w http.ResponseWriter, message string, status int) {
+	serveJSON(w, map[string]string{"message": message}, status)
+}
@@ -0,0 +1,259 @@
+package upload
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ztkent/gnome/internal/device"
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+// A request the collector received, with its body decompressed
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+// A collector that answers with the next status in line, then 200
+type collector struct {
+	mu       sync.Mutex
+	statuses []int
+	header   http.Header
+	requests []received
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body := []byte{}
+	if reader, err := gzip.NewReader(r.Body); err == nil {
+		body, _ = io.ReadAll(reader)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, received{header: r.Header.Clone(), body: body})
+	for name, values := range c.header {
+		w.Header()[name] = values
+	}
+	status := http.StatusOK
+	if len(c.statuses) > 0 {
+		status, c.statuses = c.statuses[0], c.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (c *collector) received() []received {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]received{}, c.requests...)
+}
+
+func newTestUploader(t *testing.T, format string, handler http.Handler) (*Uploader, *sql.DB) {
+	t.Helper()
+	db, err := tools.ConnectSqlite(filepath.Join(t.TempDir(), "gnome.db"))
+	if err != nil {
+		t.Fatalf("ConnectSqlite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	self, err := device.Load(db)
+	if err != nil {
+		t.Fatalf("device.Load: %v", err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	u, err := New(db, self, server.URL+"/ingest", "collector-token", format)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return u, db
+}
+
+func insertReadings(t *testing.T, db *sql.DB, count int) {
+	t.Helper()
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < count; i++ {
+		_, err := db.Exec(`INSERT INTO sunlight (job_id, lux, full_spectrum, visible, infrared, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			"job-1", 1000+i, 2000, 1500, 500, start.Add(time.Duration(i)*time.Minute).UnixMilli())
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+}
+
+func pendingCount(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var pending int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sunlight WHERE uploaded_at IS NULL`).Scan(&pending); err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	return pending
+}
+
+func TestUploadJSONBatch(t *testing.T) {
+	c := &collector{}
+	u, db := newTestUploader(t, FORMAT_JSON, c)
+	insertReadings(t, db, 3)
+
+	if err := u.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	requests := c.received()
+	if len(requests) != 1 {
+		t.Fatalf("expected one request, got %d", len(requests))
+	}
+	header := requests[0].header
+	deviceID := u.self.Info().ID
+	if header.Get("Content-Type") != "application/json" || header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("unexpected content headers %v", header)
+	}
+	if header.Get("Authorization") != "Bearer collector-token" || header.Get("X-Gnome-Device-ID") != deviceID {
+		t.Errorf("unexpected auth headers %v", header)
+	}
+	if key := header.Get("Idempotency-Key"); key != deviceID+"-1-3" {
+		t.Errorf("unexpected Idempotency-Key %q", key)
+	}
+
+	var batch Batch
+	if err := json.Unmarshal(requests[0].body, &batch); err != nil {
+		t.Fatalf("the body isn't a gzipped JSON batch: %v", err)
+	}
+	if batch.DeviceID != deviceID || len(batch.Readings) != 3 || batch.Readings[2].Lux != 1002 || batch.Readings[0].DeviceID != "" {
+		t.Errorf("unexpected batch %+v", batch)
+	}
+	if pending := pendingCount(t, db); pending != 0 {
+		t.Errorf("expected every reading to be marked uploaded, %d pending", pending)
+	}
+}
+
+func TestUploadNDJSON(t *testing.T) {
+	c := &collector{}
+	u, db := newTestUploader(t, FORMAT_NDJSON, c)
+	insertReadings(t, db, 3)
+
+	if err := u.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	requests := c.received()
+	if len(requests) != 1 || requests[0].header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("expected one NDJSON request, got %d", len(requests))
+	}
+	lines := 0
+	scanner := bufio.NewScanner(strings.NewReader(string(requests[0].body)))
+	for scanner.Scan() {
+		var reading Reading
+		if err := json.Unmarshal(scanner.Bytes(), &reading); err != nil {
+			t.Fatalf("line %d isn't JSON: %v", lines+1, err)
+		}
+		lines++
+		if reading.DeviceID != u.self.Info().ID || reading.ID != int64(lines) {
+			t.Errorf("unexpected reading %+v", reading)
+		}
+	}
+	if lines != 3 {
+		t.Errorf("expected 3 lines, got %d", lines)
+	}
+}
+
+func TestWatermarkOnlyAdvancesOn2xx(t *testing.T) {
+	c := &collector{statuses: []int{http.StatusInternalServerError, http.StatusBadRequest, http.StatusAccepted}}
+	u, db := newTestUploader(t, FORMAT_JSON, c)
+	insertReadings(t, db, 3)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if err := u.Flush(context.Background()); err == nil {
+			t.Fatal("expected the refused batch to fail")
+		}
+		if pending := pendingCount(t, db); pending != 3 {
+			t.Fatalf("readings were marked uploaded after a refusal, %d pending", pending)
+		}
+	}
+	status, _ := u.Status(context.Background())
+	if status.Failures != 2 || status.LastUploadedID != 0 || status.LastError == "" {
+		t.Errorf("unexpected status after failures %+v", status)
+	}
+
+	if err := u.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if pending := pendingCount(t, db); pending != 0 {
+		t.Errorf("expected a 202 to mark the readings uploaded, %d pending", pending)
+	}
+	requests := c.received()
+	for _, request := range requests[1:] {
+		if request.header.Get("Idempotency-Key") != requests[0].header.Get("Idempotency-Key") {
+			t.Error("a retried batch changed its Idempotency-Key")
+		}
+	}
+	status, _ = u.Status(context.Background())
+	if status.Failures != 0 || status.LastUploadedID != 3 {
+		t.Errorf("unexpected status after success %+v", status)
+	}
+}
+
+func TestUploadsInBatches(t *testing.T) {
+	c := &collector{}
+	u, db := newTestUploader(t, FORMAT_JSON, c)
+	insertReadings(t, db, UPLOAD_BATCH_SIZE+1)
+
+	if err := u.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	requests := c.received()
+	if len(requests) != 2 {
+		t.Fatalf("expected two batches, got %d", len(requests))
+	}
+	if requests[0].header.Get("Idempotency-Key") == requests[1].header.Get("Idempotency-Key") {
+		t.Error("two batches shared an Idempotency-Key")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	c := &collector{statuses: []int{http.StatusServiceUnavailable}, header: http.Header{"Retry-After": {"120"}}}
+	u, db := newTestUploader(t, FORMAT_JSON, c)
+	insertReadings(t, db, 1)
+
+	err := u.Flush(context.Background())
+	if err == nil {
+		t.Fatal("expected the 503 to fail")
+	}
+	if delay := u.retryDelay(err); delay != 2*time.Minute {
+		t.Errorf("expected to wait the 2 minutes the collector asked for, got %s", delay)
+	}
+
+	date := &responseError{retryAfter: parseRetryAfter(time.Now().Add(10 * time.Minute).UTC().Format(http.TimeFormat))}
+	if delay := u.retryDelay(date); delay < 9*time.Minute || delay > 10*time.Minute {
+		t.Errorf("expected about 10 minutes from an HTTP date, got %s", delay)
+	}
+	long := &responseError{retryAfter: parseRetryAfter("86400")}
+	if delay := u.retryDelay(long); delay != RETRY_MAX {
+		t.Errorf("expected a long Retry-After to be capped at %s, got %s", RETRY_MAX, delay)
+	}
+}
+
+func TestBackoffDoubles(t *testing.T) {
+	c := &collector{statuses: []int{500, 500, 500, 500, 500, 500, 500, 500, 500, 500, 500, 500}}
+	u, db := newTestUploader(t, FORMAT_JSON, c)
+	insertReadings(t, db, 1)
+
+	expected := RETRY_MIN
+	for failures := 1; failures <= 10; failures++ {
+		err := u.Flush(context.Background())
+		if err == nil {
+			t.Fatal("expected the 500 to fail")
+		}
+		delay := u.retryDelay(err)
+		if delay < expected/2 || delay >= expected {
+			t.Errorf("after %d failures expected between %s and %s, got %s", failures, expected/2, expected, delay)
+		}
+		expected = min(expected*2, RETRY_MAX)
+	}
+}
@@ -0,0 +1,234 @@
+package wifi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// How long we wait for NetworkManager to join a known network, before starting the access point
+	FALLBACK_DELAY = 2 * time.Minute
+	// Give up on provisioning after a while, so NetworkManager can retry known networks
+	ACCESS_POINT_TIMEOUT = 10 * time.Minute
+	MONITOR_INTERVAL     = 30 * time.Second
+	CONNECT_TIMEOUT      = 45 * time.Second
+	STATUS_TIMEOUT       = 10 * time.Second
+)
+
+var ErrBusy = errors.New("a Wi-Fi change is already in progress")
+
+// The result of the last connection attempt, so a client that lost the access point can check it later
+type Attempt struct {
+	SSID     string    `json:"ssid"`
+	Time     time.Time `json:"time"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+	Internet bool      `json:"internet"`
+}
+
+type Status struct {
+	Connection
+	AccessPoint     bool     `json:"access_point"`
+	AccessPointSSID string   `json:"access_point_ssid,omitempty"`
+	LastAttempt     *Attempt `json:"last_attempt,omitempty"`
+}
+
+// Provisioner watches the Wi-Fi connection, and starts a setup access point when no known network can be joined.
+// A client on the access point can then scan for networks and send credentials.
+type Provisioner struct {
+	controller Controller
+	apSSID     string
+	apPassword string
+	fallbackAP bool
+
+	// Serializes changes to the network, so the monitor doesn't fight a connection attempt
+	op sync.Mutex
+
+	mu                sync.Mutex
+	accessPoint       bool
+	apStarted         time.Time
+	disconnectedSince time.Time
+	lastAttempt       *Attempt
+
+	// Replaced in tests
+	now      func() time.Time
+	internet func(ctx context.Context) bool
+}
+
+func NewProvisioner(controller Controller, apSSID string, apPassword string, fallbackAP bool) *Provisioner {
+	return &Provisioner{
+		controller: controller,
+		apSSID:     apSSID,
+		apPassword: apPassword,
+		fallbackAP: fallbackAP,
+		now:        time.Now,
+		internet: func(ctx context.Context) bool {
+			return checkInternetConnection(ctx, "")
+		},
+	}
+}
+
+// Monitor the connection until the context is cancelled
+func (p *Provisioner) Run(ctx context.Context) {
+	ticker := time.NewTicker(MONITOR_INTERVAL)
+	defer ticker.Stop()
+	for {
+		p.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Provisioner) check(ctx context.Context) {
+	// Skip this round if a connection attempt is running
+	if !p.op.TryLock() {
+		return
+	}
+	defer p.op.Unlock()
+
+	p.mu.Lock()
+	accessPoint, apStarted := p.accessPoint, p.apStarted
+	p.mu.Unlock()
+
+	now := p.now()
+	if accessPoint {
+		if now.Sub(apStarted) < ACCESS_POINT_TIMEOUT {
+			return
+		}
+		log.Println("Nobody provisioned Wi-Fi, stopping the access point")
+		if err := p.controller.StopAccessPoint(ctx); err != nil {
+			log.Println(err)
+			return
+		}
+		p.mu.Lock()
+		p.accessPoint = false
+		p.disconnectedSince = now
+		p.mu.Unlock()
+		return
+	}
+
+	statusCtx, cancel := context.WithTimeout(ctx, STATUS_TIMEOUT)
+	defer cancel()
+	status, err := p.controller.Status(statusCtx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if status.Connected {
+		p.disconnectedSince = time.Time{}
+		return
+	}
+	if p.disconnectedSince.IsZero() {
+		p.disconnectedSince = now
+		return
+	}
+	if !p.fallbackAP || now.Sub(p.disconnectedSince) < FALLBACK_DELAY {
+		return
+	}
+
+	log.Printf("No Wi-Fi connection since %s, starting access point %s", p.disconnectedSince.Format(time.RFC3339), p.apSSID)
+	if err := p.controller.StartAccessPoint(ctx, p.apSSID, p.apPassword); err != nil {
+		log.Println(err)
+		return
+	}
+	p.accessPoint = true
+	p.apStarted = now
+}
+
+func (p *Provisioner) Scan(ctx context.Context) ([]Network, error) {
+	return p.controller.Scan(ctx)
+}
+
+func (p *Provisioner) Status(ctx context.Context) (Status, error) {
+	connection, err := p.controller.Status(ctx)
+	if err != nil {
+		return Status{}, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := Status{
+		Connection:  connection,
+		AccessPoint: p.accessPoint,
+		LastAttempt: p.lastAttempt,
+	}
+	if p.accessPoint {
+		status.AccessPointSSID = p.apSSID
+	}
+	return status, nil
+}
+
+// Connect to a network. On the access point the client loses its connection as soon as we switch,
+// so the attempt runs in the background and true is returned; the result is reported in Status.
+func (p *Provisioner) Connect(creds Credentials) (bool, error) {
+	if !p.op.TryLock() {
+		return false, ErrBusy
+	}
+
+	p.mu.Lock()
+	accessPoint := p.accessPoint
+	p.mu.Unlock()
+	if !accessPoint {
+		defer p.op.Unlock()
+		return false, p.connect(creds, false)
+	}
+
+	go func() {
+		defer p.op.Unlock()
+		// Give the response a moment to reach the client before the access point goes away
+		time.Sleep(time.Second)
+		if err := p.connect(creds, true); err != nil {
+			log.Println(err)
+		}
+	}()
+	return true, nil
+}
+
+// Caller holds op
+func (p *Provisioner) connect(creds Credentials, fromAccessPoint bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), CONNECT_TIMEOUT)
+	defer cancel()
+
+	if fromAccessPoint {
+		if err := p.controller.StopAccessPoint(ctx); err != nil {
+			return err
+		}
+	}
+
+	attempt := &Attempt{SSID: creds.SSID, Time: p.now()}
+	err := p.controller.Connect(ctx, creds)
+	if err != nil {
+		attempt.Error = err.Error()
+	} else {
+		attempt.Success = true
+		attempt.Internet = p.internet(ctx)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastAttempt = attempt
+	if err == nil {
+		p.accessPoint = false
+		p.disconnectedSince = time.Time{}
+		return nil
+	}
+
+	// Bring the access point back, so the client can try again
+	if fromAccessPoint {
+		if apErr := p.controller.StartAccessPoint(context.Background(), p.apSSID, p.apPassword); apErr != nil {
+			log.Println(apErr)
+			p.accessPoint = false
+		} else {
+			p.apStarted = p.now()
+		}
+	}
+	return err
+}
@@ -0,0 +1,293 @@
+package wifi
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A Controller that keeps the network's state in memory
+type fakeController struct {
+	mu          sync.Mutex
+	connected   bool
+	ssid        string
+	accessPoint bool
+	apPassword  string
+	apStarts    int
+	apStops     int
+	connectErr  error
+}
+
+func (f *fakeController) Scan(ctx context.Context) ([]Network, error) {
+	return []Network{{SSID: "garden", Signal: 70, Security: "WPA2"}}, nil
+}
+
+func (f *fakeController) Connect(ctx context.Context, creds Credentials) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.connectErr != nil {
+		return f.connectErr
+	}
+	f.connected = true
+	f.ssid = creds.SSID
+	return nil
+}
+
+func (f *fakeController) Status(ctx context.Context) (Connection, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.accessPoint {
+		return Connection{Interface: "wlan0", State: "access point"}, nil
+	}
+	if !f.connected {
+		return Connection{Interface: "wlan0", State: "disconnected"}, nil
+	}
+	return Connection{Interface: "wlan0", State: "connected", Connected: true, SSID: f.ssid}, nil
+}
+
+func (f *fakeController) StartAccessPoint(ctx context.Context, ssid string, password string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.accessPoint = true
+	f.connected = false
+	f.apPassword = password
+	f.apStarts++
+	return nil
+}
+
+func (f *fakeController) StopAccessPoint(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.accessPoint = false
+	f.apStops++
+	return nil
+}
+
+func (f *fakeController) counts() (starts int, stops int, accessPoint bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.apStarts, f.apStops, f.accessPoint
+}
+
+func (f *fakeController) disconnect() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connected = false
+}
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestProvisioner(controller Controller, fallbackAP bool) (*Provisioner, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC)}
+	p := NewProvisioner(controller, "Gnome-Setup", "owner-secret", fallbackAP)
+	p.now = clock.Now
+	p.internet = func(context.Context) bool { return true }
+	return p, clock
+}
+
+// Wait for a connection attempt running in the background
+func waitForAttempt(t *testing.T, p *Provisioner) *Attempt {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if p.op.TryLock() {
+			p.op.Unlock()
+			p.mu.Lock()
+			attempt := p.lastAttempt
+			p.mu.Unlock()
+			if attempt != nil {
+				return attempt
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the connection attempt didn't finish")
+	return nil
+}
+
+func TestNoAccessPointWhileConnected(t *testing.T) {
+	controller := &fakeController{connected: true, ssid: "garden"}
+	p, clock := newTestProvisioner(controller, true)
+	for i := 0; i < 10; i++ {
+		p.check(context.Background())
+		clock.Advance(MONITOR_INTERVAL)
+	}
+	if starts, _, _ := controller.counts(); starts != 0 {
+		t.Fatalf("started the access point %d times while connected", starts)
+	}
+}
+
+func TestAccessPointAfterFallbackDelay(t *testing.T) {
+	controller := &fakeController{}
+	p, clock := newTestProvisioner(controller, true)
+
+	p.check(context.Background())
+	clock.Advance(FALLBACK_DELAY - time.Second)
+	p.check(context.Background())
+	if starts, _, _ := controller.counts(); starts != 0 {
+		t.Fatal("started the access point before the fallback delay")
+	}
+
+	clock.Advance(time.Second)
+	p.check(context.Background())
+	if starts, _, accessPoint := controller.counts(); starts != 1 || !accessPoint {
+		t.Fatalf("expected the access point to start, %d starts", starts)
+	}
+	if controller.apPassword != "owner-secret" {
+		t.Errorf("access point started with password %q", controller.apPassword)
+	}
+	status, err := p.Status(context.Background())
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if !status.AccessPoint || status.AccessPointSSID != "Gnome-Setup" {
+		t.Errorf("status doesn't show the access point: %+v", status)
+	}
+}
+
+func TestReconnectingResetsFallbackDelay(t *testing.T) {
+	controller := &fakeController{}
+	p, clock := newTestProvisioner(controller, true)
+
+	p.check(context.Background())
+	clock.Advance(FALLBACK_DELAY / 2)
+	controller.Connect(context.Background(), Credentials{SSID: "garden"})
+	p.check(context.Background())
+	controller.disconnect()
+	clock.Advance(FALLBACK_DELAY / 2)
+	p.check(context.Background())
+	clock.Advance(FALLBACK_DELAY / 2)
+	p.check(context.Background())
+	if starts, _, _ := controller.counts(); starts != 0 {
+		t.Fatal("the fallback delay carried over a reconnection")
+	}
+}
+
+func TestNoAccessPointWhenFallbackDisabled(t *testing.T) {
+	controller := &fakeController{}
+	p, clock := newTestProvisioner(controller, false)
+	for i := 0; i < 10; i++ {
+		p.check(context.Background())
+		clock.Advance(FALLBACK_DELAY)
+	}
+	if starts, _, _ := controller.counts(); starts != 0 {
+		t.Fatalf("started the access point %d times with the fallback disabled", starts)
+	}
+}
+
+func TestAccessPointTimesOut(t *testing.T) {
+	controller := &fakeController{}
+	p, clock := newTestProvisioner(controller, true)
+	p.check(context.Background())
+	clock.Advance(FALLBACK_DELAY)
+	p.check(context.Background())
+
+	clock.Advance(ACCESS_POINT_TIMEOUT - time.Second)
+	p.check(context.Background())
+	if _, stops, _ := controller.counts(); stops != 0 {
+		t.Fatal("stopped the access point before the timeout")
+	}
+	clock.Advance(time.Second)
+	p.check(context.Background())
+	if _, stops, accessPoint := controller.counts(); stops != 1 || accessPoint {
+		t.Fatal("expected the access point to stop, so known networks can be retried")
+	}
+
+	// Still no known network, so it comes back after the delay
+	clock.Advance(FALLBACK_DELAY)
+	p.check(context.Background())
+	if starts, _, _ := controller.counts(); starts != 2 {
+		t.Fatalf("expected the access point to start again, %d starts", starts)
+	}
+}
+
+func TestConnectFromAccessPoint(t *testing.T) {
+	controller := &fakeController{}
+	p, clock := newTestProvisioner(controller, true)
+	p.check(context.Background())
+	clock.Advance(FALLBACK_DELAY)
+	p.check(context.Background())
+
+	background, err := p.Connect(Credentials{SSID: "garden", Password: "tomatoes"})
+	if err != nil || !background {
+		t.Fatalf("expected the connection to run in the background, got %v, %v", background, err)
+	}
+	if _, err := p.Connect(Credentials{SSID: "garden"}); !errors.Is(err, ErrBusy) {
+		t.Errorf("expected a second attempt to be refused, got %v", err)
+	}
+
+	attempt := waitForAttempt(t, p)
+	if !attempt.Success || !attempt.Internet || attempt.SSID != "garden" {
+		t.Fatalf("unexpected attempt %+v", attempt)
+	}
+	status, _ := p.Status(context.Background())
+	if status.AccessPoint || !status.Connected || status.SSID != "garden" {
+		t.Errorf("expected to be on garden without the access point, got %+v", status)
+	}
+
+	// Connected now, so the monitor leaves it alone
+	clock.Advance(ACCESS_POINT_TIMEOUT)
+	p.check(context.Background())
+	if starts, _, _ := controller.counts(); starts != 1 {
+		t.Errorf("the access point started again after connecting")
+	}
+}
+
+func TestFailedConnectRestartsAccessPoint(t *testing.T) {
+	controller := &fakeController{connectErr: errors.New("Secrets were required, but not provided")}
+	p, clock := newTestProvisioner(controller, true)
+	p.check(context.Background())
+	clock.Advance(FALLBACK_DELAY)
+	p.check(context.Background())
+
+	if _, err := p.Connect(Credentials{SSID: "garden", Password: "wrong-password"}); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	attempt := waitForAttempt(t, p)
+	if attempt.Success || attempt.Error == "" {
+		t.Fatalf("expected the attempt to fail, got %+v", attempt)
+	}
+	starts, stops, accessPoint := controller.counts()
+	if starts != 2 || stops != 1 || !accessPoint {
+		t.Fatalf("expected the access point back for another try, %d starts, %d stops", starts, stops)
+	}
+	status, _ := p.Status(context.Background())
+	if !status.AccessPoint || status.LastAttempt == nil {
+		t.Errorf("status should show the access point and the failed attempt, got %+v", status)
+	}
+}
+
+func TestConnectWithoutAccessPoint(t *testing.T) {
+	controller := &fakeController{connected: true, ssid: "shed"}
+	p, _ := newTestProvisioner(controller, true)
+
+	background, err := p.Connect(Credentials{SSID: "garden", Password: "tomatoes"})
+	if err != nil || background {
+		t.Fatalf("expected to connect right away, got %v, %v", background, err)
+	}
+	if starts, stops, _ := controller.counts(); starts != 0 || stops != 0 {
+		t.Errorf("touched the access point while connected")
+	}
+
+	controller.connectErr = errors.New("no network with SSID garden")
+	if _, err := p.Connect(Credentials{SSID: "garden"}); err == nil {
+		t.Error("expected the error from the controller")
+	}
+}
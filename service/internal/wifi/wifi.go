@@ -0,0 +1,309 @@
+package wifi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ztkent/gnome/internal/network"
+)
+
+type Credentials struct {
+	SSID     string `json:"ssid"`
+	Password string `json:"password"`
+}
+
+type Network struct {
+	SSID      string `json:"ssid"`
+	Signal    int    `json:"signal"`
+	Security  string `json:"security"`
+	Frequency string `json:"frequency"`
+	InUse     bool   `json:"in_use"`
+	Known     bool   `json:"known"`
+}
+
+type Connection struct {
+	Interface string `json:"interface"`
+	State     string `json:"state"`
+	Connected bool   `json:"connected"`
+	SSID      string `json:"ssid,omitempty"`
+	IPAddress string `json:"ip_address,omitempty"`
+}
+
+// Controller is everything provisioning needs from the network stack.
+// NMCLI is the real one, provisioning can be tested with a fake.
+type Controller interface {
+	Scan(ctx context.Context) ([]Network, error)
+	Connect(ctx context.Context, creds Credentials) error
+	Status(ctx context.Context) (Connection, error)
+	StartAccessPoint(ctx context.Context, ssid string, password string) error
+	StopAccessPoint(ctx context.Context) error
+}
+
+// The NetworkManager connection used for the setup access point
+const ACCESS_POINT_CONNECTION = "gnome-setup"
+
+// NMCLI controls a Wi-Fi interface through NetworkManager
+type NMCLI struct {
+	Interface string
+}
+
+func NewNMCLI(iface string) *NMCLI {
+	return &NMCLI{Interface: iface}
+}
+
+// Check nmcli is installed, so we don't try to provision without it
+func (n *NMCLI) Available() bool {
+	_, err := exec.LookPath("nmcli")
+	return err == nil
+}
+
+// Check the interface exists and is wireless, so a wired-only device doesn't start an access point
+func (n *NMCLI) HasInterface() bool {
+	for _, name := range []string{"wireless", "phy80211"} {
+		if _, err := os.Stat(filepath.Join(network.SYS_CLASS_NET, n.Interface, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *NMCLI) Scan(ctx context.Context) ([]Network, error) {
+	known, err := n.knownNetworks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	output, err := runCommand(ctx, "nmcli", "--terse", "--escape", "yes", "--fields", "IN-USE,SSID,SIGNAL,SECURITY,FREQ",
+		"device", "wifi", "list", "ifname", n.Interface, "--rescan", "yes")
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan Wi-Fi networks: %w", err)
+	}
+
+	// The same SSID is listed once per access point, keep the strongest
+	networks := []Network{}
+	seen := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := splitTerse(line)
+		if len(fields) < 5 || fields[1] == "" {
+			continue
+		}
+		signal, _ := strconv.Atoi(fields[2])
+		network := Network{
+			SSID:      fields[1],
+			Signal:    signal,
+			Security:  fields[3],
+			Frequency: fields[4],
+			InUse:     fields[0] == "*",
+			Known:     known[fields[1]],
+		}
+		if i, ok := seen[network.SSID]; ok {
+			if network.Signal > networks[i].Signal {
+				network.InUse = network.InUse || networks[i].InUse
+				networks[i] = network
+			}
+			continue
+		}
+		seen[network.SSID] = len(networks)
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Use nmcli to connect to the provided Wi-Fi network credentials.
+// The password goes to nmcli on stdin, arguments can be read by anyone with ps.
+func (n *NMCLI) Connect(ctx context.Context, creds Credentials) error {
+	log.Printf("Attempting to connect to Wi-Fi network: %s\n", creds.SSID)
+
+	// Rescan for available networks
+	_, err := runCommand(ctx, "nmcli", "device", "wifi", "rescan", "ifname", n.Interface)
+	if err != nil {
+		return fmt.Errorf("failed to rescan Wi-Fi networks: %w", err)
+	}
+
+	// Replace any saved connection for the network, the password may have changed
+	runCommand(ctx, "nmcli", "connection", "delete", "id", creds.SSID)
+	args := []string{"connection", "add", "type", "wifi", "ifname", n.Interface, "con-name", creds.SSID, "ssid", creds.SSID}
+	if creds.Password != "" {
+		args = append(args, "wifi-sec.key-mgmt", "wpa-psk")
+	}
+	if _, err := runCommand(ctx, "nmcli", args...); err != nil {
+		return fmt.Errorf("failed to add Wi-Fi network %s: %w", creds.SSID, err)
+	}
+	if err := n.up(ctx, creds.SSID, creds.Password); err != nil {
+		runCommand(context.Background(), "nmcli", "connection", "delete", "id", creds.SSID)
+		return fmt.Errorf("failed to connect to Wi-Fi network %s: %w", creds.SSID, err)
+	}
+
+	// Ensure our network matches the SSID we requested
+	status, err := n.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get current SSID: %w", err)
+	}
+	if status.SSID != creds.SSID {
+		return fmt.Errorf("connected to %s, not %s", status.SSID, creds.SSID)
+	}
+	log.Printf("Connected to Wi-Fi network: %s\n", status.SSID)
+	return nil
+}
+
+func (n *NMCLI) Status(ctx context.Context) (Connection, error) {
+	output, err := runCommand(ctx, "nmcli", "--terse", "--escape", "yes", "--get-values", "GENERAL.STATE,GENERAL.CONNECTION,IP4.ADDRESS",
+		"device", "show", n.Interface)
+	if err != nil {
+		return Connection{}, fmt.Errorf("failed to get Wi-Fi status: %w", err)
+	}
+	connection := Connection{Interface: n.Interface}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) > 0 {
+		// e.g. "100 (connected)"
+		state := lines[0]
+		if open, close := strings.Index(state, "("), strings.Index(state, ")"); open >= 0 && close > open {
+			state = state[open+1 : close]
+		}
+		connection.State = state
+	}
+	if len(lines) > 2 {
+		connection.IPAddress, _, _ = strings.Cut(lines[2], "/")
+	}
+	if connection.State != "connected" {
+		return connection, nil
+	}
+
+	// The connection is named for the SSID by default, but ask for the SSID in case it was renamed
+	if len(lines) > 1 && lines[1] == ACCESS_POINT_CONNECTION {
+		connection.State = "access point"
+		return connection, nil
+	}
+	ssid, err := runCommand(ctx, "iwgetid", "--raw", n.Interface)
+	if err != nil {
+		return Connection{}, fmt.Errorf("failed to get current SSID: %w", err)
+	}
+	connection.SSID = strings.TrimSpace(ssid)
+	connection.Connected = true
+	return connection, nil
+}
+
+// Start a WPA2 access point, sharing the device's addresses on 10.42.0.1/24 like nmcli's hotspot
+func (n *NMCLI) StartAccessPoint(ctx context.Context, ssid string, password string) error {
+	runCommand(ctx, "nmcli", "connection", "delete", "id", ACCESS_POINT_CONNECTION)
+	_, err := runCommand(ctx, "nmcli", "connection", "add", "type", "wifi", "ifname", n.Interface, "con-name", ACCESS_POINT_CONNECTION,
+		"autoconnect", "no", "ssid", ssid, "802-11-wireless.mode", "ap", "802-11-wireless.band", "bg", "ipv4.method", "shared",
+		"wifi-sec.key-mgmt", "wpa-psk", "wifi-sec.proto", "rsn", "wifi-sec.pairwise", "ccmp", "wifi-sec.group", "ccmp")
+	if err != nil {
+		return fmt.Errorf("failed to add access point: %w", err)
+	}
+	if err := n.up(ctx, ACCESS_POINT_CONNECTION, password); err != nil {
+		return fmt.Errorf("failed to start access point: %w", err)
+	}
+	return nil
+}
+
+// Activate a connection, passing the password as a secrets file on stdin
+func (n *NMCLI) up(ctx context.Context, connection string, password string) error {
+	if password == "" {
+		_, err := runCommand(ctx, "nmcli", "connection", "up", "id", connection)
+		return err
+	}
+	secrets := "802-11-wireless-security.psk:" + password + "\n"
+	_, err := runCommandWithInput(ctx, secrets, "nmcli", "connection", "up", "id", connection, "passwd-file", "/dev/stdin")
+	return err
+}
+
+func (n *NMCLI) StopAccessPoint(ctx context.Context) error {
+	_, err := runCommand(ctx, "nmcli", "connection", "down", ACCESS_POINT_CONNECTION)
+	if err != nil {
+		return fmt.Errorf("failed to stop access point: %w", err)
+	}
+	return nil
+}
+
+// The SSIDs NetworkManager has saved connections for
+func (n *NMCLI) knownNetworks(ctx context.Context) (map[string]bool, error) {
+	output, err := runCommand(ctx, "nmcli", "--terse", "--escape", "yes", "--fields", "NAME,TYPE", "connection", "show")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list saved connections: %w", err)
+	}
+	known := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := splitTerse(line)
+		if len(fields) == 2 && fields[1] == "802-11-wireless" && fields[0] != ACCESS_POINT_CONNECTION {
+			known[fields[0]] = true
+		}
+	}
+	return known, nil
+}
+
+// Split a line of nmcli --terse output, colons in values are escaped with a backslash
+func splitTerse(line string) []string {
+	var fields []string
+	var field strings.Builder
+	escaped := false
+	for _, c := range line {
+		switch {
+		case escaped:
+			field.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == ':':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(c)
+		}
+	}
+	return append(fields, field.String())
+}
+
+func checkInternetConnection(ctx context.Context, testSite string) bool {
+	client := http.Client{
+		Timeout: 10 * time.Second,
+	}
+	if testSite == "" {
+		testSite = "http://www.ztkent.com"
+	}
+	log.Println("Checking internet connection: ", testSite)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, testSite, nil)
+	if err != nil {
+		return false
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return false
+	}
+	defer response.Body.Close()
+	connected := response.StatusCode == 200
+	if !connected {
+		log.Println("Not connected to the internet")
+	}
+	return connected
+}
+
+func runCommand(ctx context.Context, name string, args ...string) (string, error) {
+	return runCommandWithInput(ctx, "", name, args...)
+}
+
+func runCommandWithInput(ctx context.Context, input string, name string, args ...string) (string, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("%s timed out", name)
+		}
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,82 @@
+package wifi
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ztkent/gnome/internal/tools"
+)
+
+// List the networks in range, marking the ones we already have credentials for
+func (p *Provisioner) ScanHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		networks, err := p.Scan(r.Context())
+		if err != nil {
+			log.Println(err)
+			serveMessage(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		serveJSON(w, networks, http.StatusOK)
+	}
+}
+
+func (p *Provisioner) StatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := p.Status(r.Context())
+		if err != nil {
+			log.Println(err)
+			serveMessage(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		serveJSON(w, status, http.StatusOK)
+	}
+}
+
+// Connect to a network from a JSON body of {"ssid": ..., "password": ...}
+func (p *Provisioner) ConnectHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var creds Credentials
+		if status, err := tools.DecodeJSONBody(w, r, &creds); err != nil {
+			serveMessage(w, err.Error(), status)
+			return
+		}
+		creds.SSID = strings.TrimSpace(creds.SSID)
+		if creds.SSID == "" {
+			serveMessage(w, "ssid is required", http.StatusBadRequest)
+			return
+		}
+		if creds.Password != "" && (len(creds.Password) < 8 || len(creds.Password) > 63) {
+			serveMessage(w, "password must be 8 to 63 characters", http.StatusBadRequest)
+			return
+		}
+
+		background, err := p.Connect(creds)
+		if errors.Is(err, ErrBusy) {
+			serveMessage(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Println(err)
+			serveMessage(w, err.Error(), http.StatusBadGateway)
+			return
+		} else if background {
+			serveMessage(w, "Connecting to "+creds.SSID+", the access point will stop. Check /api/v1/wifi/status on the new network", http.StatusAccepted)
+			return
+		}
+		serveMessage(w, "Connected to "+creds.SSID, http.StatusOK)
+	}
+}
+
+func serveJSON(w http.ResponseWriter, body interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+func serveMessage(w http.ResponseWriter, message string, status int) {
+	serveJSON(w, map[string]string{"message": message}, status)
+}
@@ -1,97 +1,405 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	// Timezones are loaded without relying on the system's tzdata
+	_ "time/tzdata"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/ztkent/gnome/internal/api"
+	"github.com/ztkent/gnome/internal/auth"
+	"github.com/ztkent/gnome/internal/backup"
+	"github.com/ztkent/gnome/internal/config"
+	"github.com/ztkent/gnome/internal/device"
+	"github.com/ztkent/gnome/internal/discovery"
 	"github.com/ztkent/gnome/internal/gnome"
 	"github.com/ztkent/gnome/internal/gnome/tsl2591"
+	"github.com/ztkent/gnome/internal/hub"
+	"github.com/ztkent/gnome/internal/importer"
+	"github.com/ztkent/gnome/internal/queue"
+	"github.com/ztkent/gnome/internal/solar"
+	"github.com/ztkent/gnome/internal/storage"
 	"github.com/ztkent/gnome/internal/tools"
+	"github.com/ztkent/gnome/internal/upload"
+	"github.com/ztkent/gnome/internal/wifi"
 )
 
 func main() {
 	// Log the process ID, in case we need it.
 	pid := os.Getpid()
 	log.Println("Gnome PID: ", pid)
+	cfg := config.Load()
 
-	// connect to the sqlite database
-	gnomeDB, err := tools.ConnectSqlite(gnome.GNOME_DB_PATH)
+	// connect to the sqlite database, every feature shares its connection pool
+	store, err := storage.Open(gnome.GNOME_DB_PATH)
 	if err != nil {
 		log.Fatalf("Failed to connect to the sqlite database: %v", err)
 	}
+	// Readings are in sqlite too, unless GNOME_STORAGE picks another backend
+	readings, err := storage.OpenReadingStore(cfg.Storage, store, cfg.PostgresURL)
+	if err != nil {
+		log.Fatalf("Failed to open the reading store: %v", err)
+	}
+
+	// Stop cleanly when systemd, or a user, asks us to
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Connect and start the Sunlight Meter
-	startSunLightMeter(gnomeDB, pid)
+	startSunLightMeter(ctx, cfg, store, readings, pid)
 }
 
-func startSunLightMeter(gnomeDB *sql.DB, pid int) {
-	// Connect the TSL2591 sensor
-	device, err := tsl2591.NewTSL2591(
-		tsl2591.TSL2591_GAIN_LOW,
-		tsl2591.TSL2591_INTEGRATIONTIME_300MS,
-		"/dev/i2c-1",
-	)
+func startSunLightMeter(ctx context.Context, cfg config.Config, store *storage.Repository, readings storage.ReadingStore, pid int) {
+	// Features with their own tables share the repository's pool
+	gnomeDB := store.DB()
+	// Everything running in the background until ctx is done, the store is closed once they've stopped
+	var background sync.WaitGroup
+
+	// Connect the TSL2591 sensor, the supervisor will keep trying if it isn't there yet
+	sensor, err := connectSensor()
 	if err != nil {
 		log.Printf("Failed to connect to the TSL2591 sensor: %v", err)
 	}
 
-	slMeter := gnome.SLMeter{
-		TSL2591:        device,
-		ResultsDB:      gnomeDB,
-		LuxResultsChan: make(chan gnome.LuxResults),
-		Pid:            pid,
+	// Results are queued on disk until they're in sqlite
+	results, err := queue.Open[gnome.LuxResults](gnome.GNOME_QUEUE_PATH, gnome.QUEUE_CAPACITY)
+	if err != nil {
+		log.Fatalf("Failed to open the results queue: %v", err)
+	}
+
+	// The device keeps its identity across reboots and network changes
+	identity, err := device.Load(gnomeDB)
+	if err != nil {
+		log.Fatalf("Failed to load the device identity: %v", err)
+	}
+
+	slMeter := gnome.NewSLMeter(sensor, readings, results, identity, pid)
+	slMeter.Timezone = cfg.Location()
+	slMeter.AuthEnabled = cfg.AuthEnabled
+	if !math.IsNaN(cfg.Latitude) || !math.IsNaN(cfg.Longitude) {
+		site, err := solar.NewSite(cfg.Latitude, cfg.Longitude)
+		if err != nil {
+			log.Printf("Ignoring GNOME_LATITUDE and GNOME_LONGITUDE: %v", err)
+		} else {
+			slMeter.Site = site
+		}
+	}
+	slMeter.DaylightOnly = cfg.DaylightOnly && slMeter.Site != nil
+	if cfg.DaylightOnly && slMeter.Site == nil {
+		log.Printf("GNOME_DAYLIGHT_ONLY needs GNOME_LATITUDE and GNOME_LONGITUDE, recording around the clock")
+	}
+
+	authenticator, err := auth.NewAuthenticator(gnomeDB, cfg.AuthEnabled, cfg.APIToken)
+	if err != nil {
+		log.Fatalf("Failed to set up authentication: %v", err)
 	}
 
 	// Start a new chi router
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	r.Use(handleServerPanic)
-	defineRoutes(r, &slMeter)
+	if cfg.LocalOnly {
+		r.Use(tools.CheckInNetwork)
+	}
+	r.Use(authenticator.CSRF)
 
-	// Lets start the sensor off the jump, if we can.
-	go slMeter.StartSensor()
+	// Load the certificate before defining routes, so we can serve its fingerprint
+	var certs *tools.CertManager
+	if cfg.TLSEnabled {
+		certs, err = newCertManager(cfg)
+		if err != nil {
+			log.Fatalf("Failed to load the TLS certificate: %v", err)
+		}
+		background.Go(func() { certs.Run(ctx) })
+	}
+	// Wi-Fi provisioning needs NetworkManager, and a Wi-Fi interface
+	var provisioner *wifi.Provisioner
+	if cfg.WifiEnabled {
+		nm := wifi.NewNMCLI(cfg.WifiInterface)
+		if !nm.Available() {
+			log.Println("nmcli isn't installed, Wi-Fi provisioning is disabled")
+		} else if !nm.HasInterface() {
+			log.Printf("%s isn't a Wi-Fi interface, Wi-Fi provisioning is disabled", cfg.WifiInterface)
+		} else {
+			provisioner = wifi.NewProvisioner(nm, cfg.APSSID, cfg.APPassword, fallbackAP(cfg))
+			background.Go(func() { provisioner.Run(ctx) })
+			if !cfg.AuthEnabled {
+				log.Println("Joining a network from the API needs GNOME_AUTH=true, only the Wi-Fi scan and status are served")
+			}
+		}
+	}
+	// Listen for any result messages from our jobs, record them in sqlite
+	go slMeter.MonitorAndRecordResults()
 
-	// Default to an HTTP server
-	app_port := "8080"
-	log.Printf("Starting HTTP server on port %s", app_port)
-	err = http.ListenAndServe(":"+app_port, r)
-	if err != nil {
-		log.Fatalf("Failed to start HTTP server: %v", err)
+	defineRoutes(r, cfg, slMeter, authenticator, certs, provisioner)
+	defineV2Routes(r, slMeter, authenticator)
+
+	// A hub pulls readings from the other devices, and compares them on its dashboard
+	if cfg.HubEnabled {
+		slMeter.HubDashboard = true
+		fleet := hub.New(gnomeDB, readings, identity, cfg.HubToken, cfg.HubPeers, cfg.DiscoveryPort, slMeter.Timezone, slMeter.Site)
+		defineHubRoutes(r, fleet, authenticator)
+		background.Go(func() { fleet.Run(ctx) })
+	}
+
+	// Merge backups and other devices' exports back into the database
+	sqliteReadings := readings == storage.ReadingStore(store)
+	if sqliteReadings {
+		imports := importer.New(gnomeDB, identity, filepath.Dir(gnome.GNOME_DB_PATH))
+		defineImportRoutes(r, imports, authenticator)
+	}
+
+	// Push readings to a collector, for devices that can't be reached inbound
+	if cfg.UploadURL != "" && !sqliteReadings {
+		log.Printf("Uploads need GNOME_STORAGE=sqlite, ignoring GNOME_UPLOAD_URL")
+	} else if cfg.UploadURL != "" {
+		uploader, err := upload.New(gnomeDB, identity, cfg.UploadURL, cfg.UploadToken, cfg.UploadFormat)
+		if err != nil {
+			log.Printf("Failed to start the uploader: %v", err)
+		} else {
+			slMeter.Uploads = uploader
+			defineUploadRoutes(r, uploader, authenticator)
+			background.Go(func() { uploader.Run(ctx) })
+		}
+	}
+
+	// Snapshot the database every day, to a directory that can be on another drive
+	if cfg.BackupDir != "" {
+		backups, err := backup.New(gnomeDB, identity, cfg.BackupDir, cfg.BackupDaily, cfg.BackupWeekly, slMeter.Timezone)
+		if err != nil {
+			log.Printf("Failed to start backups: %v", err)
+		} else {
+			backups.PauseWrites = slMeter.PauseWrites
+			defineBackupRoutes(r, backups, authenticator)
+			background.Go(func() { backups.Run(ctx) })
+		}
 	}
+
+	// Let clients find us without sweeping the subnet
+	if cfg.MDNSEnabled || cfg.DiscoveryPort != 0 {
+		advertiser := discovery.NewAdvertiser(discoveryService(cfg, identity.Info(), certs), cfg.MDNSEnabled, cfg.DiscoveryPort)
+		identity.OnChange(func(info device.Info) {
+			advertiser.Update(func(service *discovery.Service) {
+				service.Name = info.Name
+			})
+		})
+		if certs != nil {
+			certs.OnReload(func(fingerprint tools.CertificateFingerprint) {
+				advertiser.Update(func(service *discovery.Service) {
+					service.TLSSHA256 = fingerprint.SHA256
+				})
+			})
+		}
+		background.Go(func() { advertiser.Run(ctx) })
+	}
+
+	// Lets start the sensor off the jump, or as soon as it's connected.
+	background.Go(func() { slMeter.Supervise(ctx, connectSensor, true) })
+	background.Go(func() { slMeter.Network.Run(ctx) })
+
+	// Serve HTTP, and HTTPS when it's enabled
+	var httpHandler http.Handler = r
+	if certs != nil && cfg.HTTPRedirect {
+		// Clients still need to find us and pin the certificate before they can use HTTPS
+		httpHandler = tools.RedirectToHTTPS(cfg.HTTPSPort, r, "/id", "/api/v1/tls/fingerprint")
+	}
+	servers := []*http.Server{{Addr: ":" + cfg.HTTPPort, Handler: httpHandler}}
+	go func() {
+		log.Printf("Starting HTTP server on port %s", cfg.HTTPPort)
+		if err := servers[0].ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start HTTP server: %v", err)
+		}
+	}()
+	if certs != nil {
+		tlsServer := &http.Server{Addr: ":" + cfg.HTTPSPort, Handler: r, TLSConfig: certs.TLSConfig()}
+		servers = append(servers, tlsServer)
+		go func() {
+			log.Printf("Starting HTTPS server on port %s", cfg.HTTPSPort)
+			if err := tlsServer.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("Failed to start HTTPS server: %v", err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	log.Println("Shutting down Gnome")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gnome.SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	// Stop accepting requests first, so nothing can start a new job while we're stopping
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to shut down server on %s: %v", server.Addr, err)
+		}
+	}
+	// Backups, uploads and hub syncs stop with ctx, wait for them so none is mid-query when the store closes
+	stopped := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		log.Println("Timed out waiting for background tasks to stop")
+	}
+	if err := slMeter.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down the Sunlight Meter: %v", err)
+	}
+	if postgres, ok := readings.(*storage.Postgres); ok {
+		if err := postgres.Close(); err != nil {
+			log.Printf("Failed to close the postgres database: %v", err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		log.Printf("Failed to close the sqlite database: %v", err)
+	}
+	log.Println("Gnome stopped")
 }
 
-func defineRoutes(r *chi.Mux, meter *gnome.SLMeter) {
-	// Listen for any result messages from our jobs, record them in sqlite
-	go meter.MonitorAndRecordResults()
+// What we advertise to clients looking for devices
+func discoveryService(cfg config.Config, info device.Info, certs *tools.CertManager) discovery.Service {
+	service := discovery.Service{
+		Name:    info.Name,
+		ID:      info.ID,
+		Sensors: []string{"tsl2591"},
+	}
+	service.Port, _ = strconv.Atoi(cfg.HTTPPort)
+	if certs != nil {
+		service.TLSPort, _ = strconv.Atoi(cfg.HTTPSPort)
+		service.TLSSHA256 = certs.Fingerprint().SHA256
+	}
+	return service
+}
 
-	// Sunlight API, these serve a JSON response
+// Use the supplied certificate if there is one, otherwise generate our own
+func newCertManager(cfg config.Config) (*tools.CertManager, error) {
+	if cfg.UserCertificate() {
+		return tools.NewCertManager(cfg.TLSCertPath, cfg.TLSKeyPath, false)
+	}
+	return tools.NewCertManager(config.SELF_SIGNED_CERT_PATH, config.SELF_SIGNED_KEY_PATH, true)
+}
+
+func connectSensor() (*tsl2591.TSL2591, error) {
+	return tsl2591.NewTSL2591(
+		tsl2591.TSL2591_GAIN_LOW,
+		tsl2591.TSL2591_INTEGRATIONTIME_300MS,
+		"/dev/i2c-1",
+	)
+}
+
+// Start and stop were GET routes, apps get until the sunset to move to POST
+var legacyGetSunset = time.Date(2027, time.April, 1, 0, 0, 0, 0, time.UTC)
+
+// Anyone in range can join the access point, so it needs a password of the owner's and an operator to change the network
+func fallbackAP(cfg config.Config) bool {
+	if !cfg.WifiFallbackAP {
+		return false
+	} else if !cfg.AuthEnabled {
+		log.Println("GNOME_WIFI_FALLBACK_AP needs GNOME_AUTH=true, the setup access point is disabled")
+		return false
+	} else if len(cfg.APPassword) < 8 || len(cfg.APPassword) > 63 {
+		log.Println("GNOME_WIFI_FALLBACK_AP needs a GNOME_AP_PASSWORD of 8 to 63 characters, the setup access point is disabled")
+		return false
+	}
+	return true
+}
+
+func defineRoutes(r *chi.Mux, cfg config.Config, meter *gnome.SLMeter, authenticator *auth.Authenticator, certs *tools.CertManager, provisioner *wifi.Provisioner) {
+	viewer := authenticator.Require(auth.RoleViewer)
+	operator := authenticator.Require(auth.RoleOperator)
+
+	// Device discovery stays open, so clients can find us before they have credentials
 	r.Get("/id", meter.ID())
+	r.With(viewer).Get("/metrics", meter.Metrics())
+
+	// Sunlight API, these serve a JSON response
 	r.Route("/api/v1", func(r chi.Router) {
-		r.Get("/start", meter.Start())
-		r.Get("/stop", meter.Stop())
-		r.Get("/signal-strength", meter.SignalStrength())
-		r.Get("/current-conditions", meter.CurrentConditions())
-		r.Get("/export", meter.ServeResultsDB())
-		r.Get("/csv", meter.ServeResultsCSV())
-		r.Get("/graph", meter.ServeResultsJSON())
+		// The certificate fingerprint is open too, the app pins it when pairing
+		if certs != nil {
+			r.Get("/tls/fingerprint", certs.ServeFingerprint())
+		}
+		r.Get("/csrf", authenticator.ServeCSRFToken())
+		r.With(operator).Post("/start", meter.Start())
+		r.With(operator).Post("/stop", meter.Stop())
+		if cfg.LegacyGetRoutes {
+			r.With(operator, tools.Deprecated("/api/v1/start", legacyGetSunset)).Get("/start", meter.Start())
+			r.With(operator, tools.Deprecated("/api/v1/stop", legacyGetSunset)).Get("/stop", meter.Stop())
+		}
+		r.Group(func(r chi.Router) {
+			r.Use(viewer)
+			r.Get("/signal-strength", meter.SignalStrength())
+			r.Get("/network", meter.NetworkInfo())
+			r.Get("/readings", meter.Readings())
+			r.Get("/current-conditions", meter.CurrentConditions())
+			r.Get("/export", meter.ServeResultsDB())
+			r.Get("/csv", meter.ServeResultsCSV())
+			r.Get("/graph", meter.ServeResultsJSON())
+			r.Get("/daily", meter.DailySummaries())
+			r.Get("/report", meter.SunReport())
+			r.Get("/report/markdown", meter.SunReportMarkdown())
+		})
+		if meter.Site != nil {
+			r.With(viewer).Get("/solar", meter.Solar())
+		}
+
+		// Device identity
+		r.With(viewer).Get("/device", meter.Device.GetHandler())
+		r.With(operator).Patch("/device", meter.Device.PatchHandler())
+
+		// Wi-Fi provisioning
+		if provisioner != nil {
+			r.Route("/wifi", func(r chi.Router) {
+				r.With(viewer).Get("/scan", provisioner.ScanHandler())
+				r.With(viewer).Get("/status", provisioner.StatusHandler())
+				// Anyone on the network could otherwise move the device onto theirs
+				if authenticator.Enabled() {
+					r.With(operator).Post("/connect", provisioner.ConnectHandler())
+				}
+			})
+		}
+
+		// Credential management
+		r.Route("/auth", func(r chi.Router) {
+			r.With(viewer).Get("/whoami", authenticator.WhoAmI())
+			r.Group(func(r chi.Router) {
+				r.Use(operator)
+				r.Get("/tokens", authenticator.ListTokens())
+				r.Post("/tokens", authenticator.CreateTokenHandler())
+				r.Delete("/tokens/{id}", authenticator.DeleteToken())
+				r.Get("/users", authenticator.ListUsers())
+				r.Post("/users", authenticator.SetUserHandler())
+				r.Delete("/users/{username}", authenticator.DeleteUser())
+			})
+		})
 	})
 
 	// Dashboard routes
-	r.Get("/", meter.Dashboard())
+	r.With(viewer).Get("/", meter.Dashboard())
 	r.Route("/dashboard", func(r chi.Router) {
+		r.Use(viewer)
 		r.Get("/device-status", meter.DashboardDeviceStatus())
 		r.Get("/current-conditions", meter.DashboardCurrentConditions())
 		r.Get("/signal-strength", meter.DashboardSignalStrength())
 		r.Get("/controls", meter.DashboardControls())
 		r.Get("/system-info", meter.DashboardSystemInfo())
 		r.Get("/historical-graph", meter.DashboardHistoricalGraph())
+		r.Get("/report", meter.DashboardSunReport())
 	})
 
 	// Static files handler for JS, CSS and other assets
@@ -116,10 +424,95 @@ func defineRoutes(r *chi.Mux, meter *gnome.SLMeter) {
 	})
 }
 
+// The versioned API, with typed bodies and the error envelope. New clients should use it.
+func defineV2Routes(r *chi.Mux, meter *gnome.SLMeter, authenticator *auth.Authenticator) {
+	viewer := authenticator.Require(auth.RoleViewer)
+	operator := authenticator.Require(auth.RoleOperator)
+	v2 := meter.V2()
+
+	// The document describes the API, so clients can be generated from it before they have credentials
+	r.Get("/api/openapi.json", api.ServeOpenAPI())
+	r.Route(api.V2_PREFIX, func(r chi.Router) {
+		r.NotFound(api.NotFound())
+		r.MethodNotAllowed(api.MethodNotAllowed())
+
+		r.Group(func(r chi.Router) {
+			r.Use(viewer)
+			r.Get("/status", v2.Status())
+			r.Get("/current-conditions", v2.CurrentConditions())
+			r.Get("/signal-strength", v2.SignalStrength())
+			r.Get("/network", v2.Network())
+			r.Get("/readings", v2.Readings())
+			r.Get("/readings/range", v2.ReadingsRange())
+			r.Get("/daily", v2.DailySummaries())
+			r.Get("/report", v2.SunReport())
+			r.Get("/solar", v2.Solar())
+			r.Get("/device", v2.Device())
+			r.Get("/export/csv", v2.ExportCSV())
+			r.Get("/export/db", v2.ExportDB())
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(operator)
+			r.Post("/start", v2.Start())
+			r.Post("/stop", v2.Stop())
+			r.Patch("/device", v2.PatchDevice())
+		})
+	})
+}
+
+func defineHubRoutes(r *chi.Mux, fleet *hub.Hub, authenticator *auth.Authenticator) {
+	viewer := authenticator.Require(auth.RoleViewer)
+	operator := authenticator.Require(auth.RoleOperator)
+
+	r.Route("/api/v1/hub", func(r chi.Router) {
+		r.With(viewer).Get("/devices", fleet.DevicesHandler())
+		r.With(viewer).Get("/compare", fleet.CompareHandler())
+		r.With(viewer).Get("/readings", fleet.ReadingsHandler())
+		r.With(operator).Post("/peers", fleet.AddPeerHandler())
+		r.With(operator).Delete("/peers/{deviceID}", fleet.RemovePeerHandler())
+		r.With(operator).Post("/peers/{deviceID}/approve", fleet.ApprovePeerHandler())
+		r.With(operator).Post("/peers/{deviceID}/repin", fleet.RepinPeerHandler())
+		r.With(operator).Post("/sync", fleet.SyncHandler())
+	})
+	r.With(viewer).Get("/dashboard/hub", fleet.DashboardHandler())
+}
+
+func defineUploadRoutes(r *chi.Mux, uploader *upload.Uploader, authenticator *auth.Authenticator) {
+	r.Route("/api/v1/upload", func(r chi.Router) {
+		r.With(authenticator.Require(auth.RoleViewer)).Get("/", uploader.StatusHandler())
+		r.With(authenticator.Require(auth.RoleOperator)).Post("/flush", uploader.FlushHandler())
+	})
+}
+
+func defineBackupRoutes(r *chi.Mux, backups *backup.Manager, authenticator *auth.Authenticator) {
+	r.Route("/api/v1/backups", func(r chi.Router) {
+		r.With(authenticator.Require(auth.RoleViewer)).Get("/", backups.StatusHandler())
+		r.Group(func(r chi.Router) {
+			r.Use(authenticator.Require(auth.RoleOperator))
+			r.Post("/", backups.CreateHandler())
+			r.Delete("/{name}", backups.DeleteHandler())
+			// Anyone on the network could otherwise roll the database back
+			if authenticator.Enabled() {
+				r.Post("/{name}/restore", backups.RestoreHandler())
+			} else {
+				log.Println("Restoring backups from the API needs GNOME_AUTH=true, the restore route is disabled")
+			}
+		})
+	})
+}
+
+func defineImportRoutes(r *chi.Mux, imports *importer.Importer, authenticator *auth.Authenticator) {
+	r.With(authenticator.Require(auth.RoleOperator)).Post("/api/v1/import", imports.ImportHandler())
+}
+
 func handleServerPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
+				if api.IsV2(r) {
+					api.ServeError(w, http.StatusInternalServerError, api.CODE_INTERNAL, fmt.Sprintf("%v", err), nil)
+					return
+				}
 				gnome.ServeResponse(w, r, (fmt.Sprintf("%v", err)), http.StatusInternalServerError)
 			}
 		}()
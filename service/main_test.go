@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ztkent/gnome/internal/api"
+	"github.com/ztkent/gnome/internal/auth"
+	"github.com/ztkent/gnome/internal/backup"
+	"github.com/ztkent/gnome/internal/config"
+	"github.com/ztkent/gnome/internal/device"
+	"github.com/ztkent/gnome/internal/gnome"
+	"github.com/ztkent/gnome/internal/hub"
+	"github.com/ztkent/gnome/internal/importer"
+	"github.com/ztkent/gnome/internal/storage"
+	"github.com/ztkent/gnome/internal/tools"
+	"github.com/ztkent/gnome/internal/upload"
+	"github.com/ztkent/gnome/internal/wifi"
+)
+
+// A router with every optional feature set up, so each documented route is registered
+func newTestRouter(t *testing.T) *chi.Mux {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := tools.ConnectSqlite(filepath.Join(dir, "gnome.db"))
+	if err != nil {
+		t.Fatalf("ConnectSqlite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	identity, err := device.Load(db)
+	if err != nil {
+		t.Fatalf("device.Load: %v", err)
+	}
+	authenticator, err := auth.NewAuthenticator(db, true, "test-token")
+	if err != nil {
+		t.Fatalf("NewAuthenticator: %v", err)
+	}
+	certs, err := tools.NewCertManager(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), true)
+	if err != nil {
+		t.Fatalf("NewCertManager: %v", err)
+	}
+	uploader, err := upload.New(db, identity, "http://localhost/readings", "", "")
+	if err != nil {
+		t.Fatalf("upload.New: %v", err)
+	}
+	backups, err := backup.New(db, identity, dir, 7, 4, time.UTC)
+	if err != nil {
+		t.Fatalf("backup.New: %v", err)
+	}
+	readings := storage.NewMemory()
+	meter := gnome.NewSLMeter(nil, readings, nil, identity, 0)
+	meter.Timezone = time.UTC
+	provisioner := wifi.NewProvisioner(wifi.NewNMCLI("wlan0"), "gnome-setup", "", false)
+
+	r := chi.NewRouter()
+	defineRoutes(r, config.Config{}, meter, authenticator, certs, provisioner)
+	defineV2Routes(r, meter, authenticator)
+	defineHubRoutes(r, hub.New(db, readings, identity, "", nil, 0, time.UTC, nil), authenticator)
+	defineImportRoutes(r, importer.New(db, identity, dir), authenticator)
+	defineUploadRoutes(r, uploader, authenticator)
+	defineBackupRoutes(r, backups, authenticator)
+	return r
+}
+
+// The operations openapi.json documents, as "METHOD /path", read from the route that serves it
+func documentedOperations(t *testing.T, r http.Handler) map[string]bool {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/openapi.json = %d", w.Code)
+	}
+	var document struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &document); err != nil {
+		t.Fatalf("openapi.json isn't valid JSON: %v", err)
+	}
+
+	operations := map[string]bool{}
+	for path, item := range document.Paths {
+		for method := range item {
+			switch method {
+			case "get", "put", "post", "delete", "patch":
+				operations[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+	return operations
+}
+
+// The routes the router serves, as "METHOD /path"
+func registeredRoutes(t *testing.T, r chi.Routes) map[string]bool {
+	t.Helper()
+	routes := map[string]bool{}
+	err := chi.Walk(r, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		// A subrouter's index is served without the trailing slash
+		if len(route) > 1 {
+			route = strings.TrimSuffix(route, "/")
+		}
+		routes[method+" "+route] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("chi.Walk: %v", err)
+	}
+	return routes
+}
+
+func TestV2RoutesAreDocumented(t *testing.T) {
+	r := newTestRouter(t)
+	documented := documentedOperations(t, r)
+	for route := range registeredRoutes(t, r) {
+		_, path, _ := strings.Cut(route, " ")
+		if (path == api.V2_PREFIX || strings.HasPrefix(path, api.V2_PREFIX+"/")) && !documented[route] {
+			t.Errorf("%s isn't in openapi.json", route)
+		}
+	}
+}
+
+func TestDocumentedRoutesAreServed(t *testing.T) {
+	r := newTestRouter(t)
+	registered := registeredRoutes(t, r)
+	for operation := range documentedOperations(t, r) {
+		if !registered[operation] {
+			t.Errorf("openapi.json documents %s, but it isn't routed", operation)
+		}
+	}
+}